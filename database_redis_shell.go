@@ -97,8 +97,14 @@ func (z *zephyrix) getPoolID(args []string) (int, error) {
 }
 
 func (z *zephyrix) createRedisClient(config RedisConfig) *redis.Client {
+	return newRedisClient(config)
+}
+
+// newRedisClient connects to the redis server of a pool, for the features beeorm does not expose like pub/sub.
+func newRedisClient(config RedisConfig) *redis.Client {
 	return redis.NewClient(&redis.Options{
 		Addr:     config.Address,
+		Username: config.Username,
 		Password: config.Password,
 		DB:       config.DB,
 	})
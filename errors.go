@@ -9,4 +9,28 @@ var (
 	ErrMFARequired      = errors.New("MFA required")
 	ErrInvalidMFAToken  = errors.New("invalid MFA token")
 	ErrUnsupportedOAuth = errors.New("unsupported OAuth2 operation")
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrInvalidToken     = errors.New("invalid token")
+	ErrInvalidSession   = errors.New("invalid session")
+	ErrForbidden        = errors.New("forbidden")
+
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+	ErrUserExists          = errors.New("user already exists")
+	ErrAccountDisabled     = errors.New("account disabled")
+	ErrAccountLocked       = errors.New("account locked")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+	ErrInvalidAPIKey       = errors.New("invalid API key")
+	ErrInvalidMFAChallenge = errors.New("invalid or expired MFA challenge")
+	ErrInvalidWebAuthn     = errors.New("invalid WebAuthn response")
+	ErrAccountLinked       = errors.New("account is linked to another user")
+	ErrNoOAuth2Token       = errors.New("no OAuth2 token stored")
+	ErrWeakPassword        = errors.New("password does not satisfy the password policy")
+	ErrPasswordExpired     = errors.New("password expired")
+	ErrEmailNotVerified    = errors.New("email address not verified")
+	ErrInvalidInvitation   = errors.New("invalid or expired invitation")
+	ErrDomainNotAllowed    = errors.New("email domain not allowed")
+	ErrRecoveryUnavailable = errors.New("account recovery not available")
+	ErrInvalidCSRFToken    = errors.New("invalid CSRF token")
+
+	ErrMFAEnrollmentRequired = errors.New("MFA required but no method is enrolled")
 )
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+type APIKeyEntity struct {
+	ID     uint64 `orm:"table=zephyrix_api_keys"`
+	Prefix string `orm:"unique=prefix;required"` // public part of the key, used to look it up
+	Hash   string `orm:"required"`               // SHA-256 of the whole key, the key itself is never stored
+	Name   string
+
+	UserID     uint64 `orm:"index=user_id"`
+	Scopes     string `orm:"length=max"` // JSON encoded list of scopes
+	AllowedIPs string `orm:"length=max"` // JSON encoded list of IPs and CIDRs, empty allows any address
+
+	Revoked    bool
+	RotatedTo  uint64     // ID of the key that replaced this one
+	ExpiresAt  *time.Time `orm:"time"`
+	LastUsedAt *time.Time `orm:"time"`
+	LastUsedIP string
+
+	CreatedAt time.Time `orm:"time"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type InvitationEntity struct {
+	ID       uint64 `orm:"table=zephyrix_invitations"`
+	CodeHash string `orm:"unique=code_hash;required"` // SHA-256 of the code, the code itself is never stored
+	Email    string // only this address may use the invitation, empty allows any address
+	Roles    string `orm:"length=max"` // JSON encoded list of the roles granted to the new user
+
+	CreatedBy uint64
+	UsedBy    uint64
+	UsedAt    *time.Time `orm:"time"`
+	Revoked   bool
+
+	CreatedAt time.Time `orm:"time"`
+	ExpiresAt time.Time `orm:"time"`
+}
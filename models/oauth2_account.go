@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// OAuth2AccountEntity links the account of an OAuth2 or OIDC provider to a user,
+// a user can have accounts of several providers.
+type OAuth2AccountEntity struct {
+	ID       uint64 `orm:"table=zephyrix_oauth2_accounts"`
+	Provider string `orm:"unique=provider_subject;required"`
+	Subject  string `orm:"unique=provider_subject:2;required"` // stable ID of the account at the provider, the "sub" claim
+	UserID   uint64 `orm:"index=user_id"`
+	Email    string
+
+	// tokens of the provider, encrypted with authentication.oauth2.encryption_keys, empty without keys
+	AccessToken  string `orm:"length=max"`
+	RefreshToken string `orm:"length=max"`
+	TokenType    string
+	TokenExpiry  *time.Time `orm:"time"`
+
+	LastLoginAt *time.Time `orm:"time"`
+	CreatedAt   time.Time  `orm:"time"`
+}
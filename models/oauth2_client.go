@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// OAuth2ClientEntity is an application signing its users in with Zephyrix as authorization server.
+type OAuth2ClientEntity struct {
+	ID         uint64 `orm:"table=zephyrix_oauth2_clients"`
+	ClientID   string `orm:"unique=client_id;required"`
+	SecretHash string // SHA-256 of the client secret, empty for public clients
+	Name       string
+
+	RedirectURIs string `orm:"length=max"` // JSON encoded list of exact redirect URIs
+	GrantTypes   string `orm:"length=max"` // JSON encoded list of allowed grant types
+	Scopes       string `orm:"length=max"` // JSON encoded list of the scopes the client may request
+
+	Public      bool // clients that can not keep a secret, e.g. SPAs and mobile apps, must use PKCE
+	SkipConsent bool // first-party clients are not asked for consent
+	Revoked     bool
+
+	CreatedAt time.Time `orm:"time"`
+	UpdatedAt time.Time `orm:"time"`
+}
+
+// OAuth2ConsentEntity is the consent of a user to the scopes of a client.
+type OAuth2ConsentEntity struct {
+	ID        uint64     `orm:"table=zephyrix_oauth2_consents"`
+	UserID    uint64     `orm:"unique=user_client"`
+	ClientID  string     `orm:"unique=user_client:2"`
+	Scopes    string     `orm:"length=max"` // JSON encoded list of the granted scopes
+	ExpiresAt *time.Time `orm:"time"`
+	CreatedAt time.Time  `orm:"time"`
+	UpdatedAt time.Time  `orm:"time"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// OAuth2ProviderEntity defines an OAuth2 or OIDC provider when authentication.oauth2.providers_source is "database".
+type OAuth2ProviderEntity struct {
+	ID           uint64 `orm:"table=zephyrix_oauth2_providers"`
+	Name         string `orm:"unique=name;required"`
+	ClientID     string `orm:"required"`
+	ClientSecret string `orm:"length=max"` // encrypted with authentication.oauth2.encryption_keys
+	RedirectURL  string `orm:"length=max"`
+	Scopes       string `orm:"length=max"` // JSON encoded list of scopes
+
+	Issuer      string `orm:"length=max"`
+	AuthURL     string `orm:"length=max"`
+	TokenURL    string `orm:"length=max"`
+	UserInfoURL string `orm:"length=max"`
+	JWKSURL     string `orm:"length=max"`
+	EmailsURL   string `orm:"length=max"`
+
+	DisablePKCE bool
+	TrustEmail  bool
+	Claims      string `orm:"length=max"` // JSON encoded claim mapping
+
+	CreatedAt time.Time `orm:"time"`
+	UpdatedAt time.Time `orm:"time"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// PasswordHistoryEntity keeps the hashes of the previous passwords of a user, see PasswordPolicy.HistoryCount.
+type PasswordHistoryEntity struct {
+	ID     uint64 `orm:"table=zephyrix_password_history"`
+	UserID uint64 `orm:"index=user_id"`
+	Hash   string `orm:"required"`
+
+	CreatedAt time.Time `orm:"time"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+type RoleEntity struct {
+	ID          uint64 `orm:"table=zephyrix_roles"`
+	Name        string `orm:"unique=name;required"`
+	Parent      string `orm:"index=parent"` // name of the role whose permissions are inherited
+	Description string
+
+	CreatedAt time.Time `orm:"time"`
+}
+
+type PermissionEntity struct {
+	ID          uint64 `orm:"table=zephyrix_permissions"`
+	Name        string `orm:"unique=name;required"` // <resource>.<action>, e.g. orders.write
+	Description string
+
+	CreatedAt time.Time `orm:"time"`
+}
+
+type RolePermissionEntity struct {
+	ID         uint64 `orm:"table=zephyrix_role_permissions"`
+	Role       string `orm:"unique=role_permission;required"`
+	Permission string `orm:"unique=role_permission:2;required"`
+
+	CreatedAt time.Time `orm:"time"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+type RefreshTokenEntity struct {
+	ID        uint64 `orm:"table=zephyrix_refresh_tokens"`
+	TokenHash string `orm:"unique=token_hash;required"`
+	FamilyID  string `orm:"index=family_id;required"`
+
+	UserID   uint64 `orm:"index=user_id"`
+	DeviceID string
+
+	// tokens issued to a client of the authorization server
+	ClientID string
+	Scopes   string `orm:"length=max"` // JSON encoded list of the granted scopes
+
+	Revoked bool
+	UsedAt  *time.Time `orm:"time"`
+
+	CreatedAt time.Time `orm:"time"`
+	ExpiresAt time.Time `orm:"time"`
+}
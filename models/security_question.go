@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// SecurityQuestionEntity is a recovery question chosen by a user, see AccountRecovery.SecurityQuestions.
+type SecurityQuestionEntity struct {
+	ID         uint64 `orm:"table=zephyrix_security_questions"`
+	UserID     uint64 `orm:"index=user_id"`
+	Question   string `orm:"required"`
+	AnswerHash string `orm:"required"` // the normalized answer, hashed like a password
+
+	CreatedAt time.Time `orm:"time"`
+}
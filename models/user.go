@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+type UserEntity struct {
+	ID       uint64 `orm:"table=zephyrix_users"`
+	Username string `orm:"unique=username;required"`
+	Email    string `orm:"unique=email"`
+
+	PasswordHash      string
+	PasswordChangedAt time.Time `orm:"time"`
+
+	Roles      string `orm:"length=max"` // JSON encoded list of roles
+	MFAMethods string `orm:"length=max"` // JSON encoded map of MFA method to secret
+	Metadata   string `orm:"length=max"` // JSON encoded custom data
+
+	Active bool
+	Locked bool
+
+	CreatedAt   time.Time  `orm:"time"`
+	UpdatedAt   time.Time  `orm:"time"`
+	LastLoginAt *time.Time `orm:"time"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type WebAuthnCredentialEntity struct {
+	ID           uint64 `orm:"table=zephyrix_webauthn_credentials"`
+	CredentialID string `orm:"unique=credential_id;required"` // base64url encoded credential ID chosen by the authenticator
+	UserID       uint64 `orm:"index=user_id"`
+	Name         string
+	PublicKey    string `orm:"length=max;required"` // base64url encoded COSE key
+	SignCount    uint32
+	AAGUID       string // authenticator model, hex encoded
+	Attestation  string // attestation format verified at registration, "none" or "packed"
+	Transports   string `orm:"length=max"` // JSON encoded transports reported by the browser
+
+	LastUsedAt *time.Time `orm:"time"`
+	CreatedAt  time.Time  `orm:"time"`
+}
@@ -0,0 +1,163 @@
+package zephyrix
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Path matching modes of a reverse proxy.
+const (
+	ProxyMatchPrefix = "prefix"
+	ProxyMatchExact  = "exact"
+	ProxyMatchGlob   = "glob"
+	ProxyMatchRegex  = "regex"
+)
+
+// proxyMatcher decides whether a request path belongs to a proxy.
+//
+// Paths listed in ignore_path are always matched as prefixes, whatever the proxy mode.
+type proxyMatcher struct {
+	mode     string
+	patterns []proxyPattern
+	ignore   []string
+}
+
+type proxyPattern struct {
+	raw    string
+	prefix string         // literal part, used by the prefix and exact modes and for stripping
+	re     *regexp.Regexp // compiled pattern of the glob and regex modes
+}
+
+// newProxyMatcher compiles the path patterns of a proxy configuration.
+func newProxyMatcher(config ProxyConfig) (*proxyMatcher, error) {
+	mode := strings.ToLower(config.Match)
+	if mode == "" {
+		mode = ProxyMatchPrefix
+	}
+
+	m := &proxyMatcher{mode: mode, ignore: config.IgnorePath}
+	for _, raw := range config.Path {
+		pattern := proxyPattern{raw: raw}
+		switch mode {
+		case ProxyMatchPrefix:
+			pattern.prefix = strings.TrimSuffix(strings.TrimSuffix(raw, "*"), "/")
+		case ProxyMatchExact:
+			pattern.prefix = raw
+		case ProxyMatchGlob:
+			pattern.re = globToRegexp(raw)
+			pattern.prefix = globLiteralPrefix(raw)
+		case ProxyMatchRegex:
+			re, err := regexp.Compile(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", raw, err)
+			}
+			pattern.re = re
+		default:
+			return nil, fmt.Errorf("unknown match mode: %s", config.Match)
+		}
+		m.patterns = append(m.patterns, pattern)
+	}
+
+	return m, nil
+}
+
+// match reports whether the request path must be handled by the proxy.
+func (m *proxyMatcher) match(path string) bool {
+	for _, ignore := range m.ignore {
+		if hasPathPrefix(path, strings.TrimSuffix(ignore, "/*")) {
+			return false
+		}
+	}
+
+	for _, pattern := range m.patterns {
+		if m.matchPattern(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *proxyMatcher) matchPattern(pattern proxyPattern, path string) bool {
+	switch m.mode {
+	case ProxyMatchPrefix:
+		return hasPathPrefix(path, pattern.prefix)
+	case ProxyMatchExact:
+		return path == pattern.prefix
+	default:
+		return pattern.re.MatchString(path)
+	}
+}
+
+// strip removes the part of the path matched by the proxy, the result always starts with a slash.
+func (m *proxyMatcher) strip(path string) string {
+	for _, pattern := range m.patterns {
+		if !m.matchPattern(pattern, path) {
+			continue
+		}
+
+		var rest string
+		switch m.mode {
+		case ProxyMatchRegex:
+			loc := pattern.re.FindStringIndex(path)
+			if loc == nil || loc[0] != 0 {
+				return path
+			}
+			rest = path[loc[1]:]
+		default:
+			rest = strings.TrimPrefix(path, pattern.prefix)
+		}
+		return "/" + strings.TrimPrefix(rest, "/")
+	}
+	return path
+}
+
+// hasPathPrefix reports whether path is prefix itself or lies below it,
+// "/api" matches "/api" and "/api/users" but not "/apis".
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression.
+// "*" matches within a single path segment, "**" matches across segments and "?" matches one character.
+func globToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// globLiteralPrefix returns the directory part of a glob pattern that precedes its first wildcard.
+func globLiteralPrefix(glob string) string {
+	idx := strings.IndexAny(glob, "*?")
+	if idx < 0 {
+		return glob
+	}
+	literal := glob[:idx]
+	if slash := strings.LastIndex(literal, "/"); slash >= 0 {
+		return literal[:slash]
+	}
+	return ""
+}
@@ -2,12 +2,16 @@ package zephyrix
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,6 +24,39 @@ type ProxyConfig struct {
 	IgnorePath  []string `mapstructure:"ignore_path"`
 	Headers     []string `mapstructure:"headers"`
 	StripPrefix bool     `mapstructure:"strip_prefix"`
+	Match       string   `mapstructure:"match"`    // "prefix" (default), "exact", "glob" or "regex"
+	Priority    int      `mapstructure:"priority"` // proxies with a higher priority are matched first
+
+	Auth  ProxyAuthConfig  `mapstructure:"auth"`
+	Cache ProxyCacheConfig `mapstructure:"cache"`
+}
+
+// ProxyAuthConfig turns a proxy into an authenticating gateway.
+// When enabled, requests must carry a valid JWT or session before they are forwarded,
+// and the resolved identity is passed on to the upstream service.
+type ProxyAuthConfig struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Roles   []string `mapstructure:"roles"` // the identity must have at least one of these roles, directly or inherited
+
+	// IdentityHeaders forwards the user ID, roles and session ID as plain headers.
+	IdentityHeaders bool   `mapstructure:"identity_headers"`
+	UserIDHeader    string `mapstructure:"user_id_header"`
+	RolesHeader     string `mapstructure:"roles_header"`
+	SessionHeader   string `mapstructure:"session_header"`
+
+	// StripCredentials removes the client's Authorization header, API key header and session
+	// cookie so the upstream never sees the original credentials.
+	StripCredentials bool `mapstructure:"strip_credentials"`
+
+	InternalJWT InternalJWTConfig `mapstructure:"internal_jwt"`
+}
+
+// InternalJWTConfig configures the short-lived token minted for the upstream service.
+type InternalJWTConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	Header     string        `mapstructure:"header"`   // defaults to Authorization, sent as a bearer token
+	Audience   string        `mapstructure:"audience"` // required, distinct from authentication.jwt.audience
+	Expiration time.Duration `mapstructure:"expiration"`
 }
 
 // CustomBadGatewayError represents a custom error for bad gateway responses.
@@ -28,64 +65,119 @@ type CustomBadGatewayError struct {
 	Message string `json:"message"`
 }
 
-// setupProxies initializes and sets up the reverse proxies based on the configuration.
+// setupProxies initializes the reverse proxies and registers them as the fallback stage of the engine.
+//
+// Proxies only see requests that gin's route tree could not match, so every registered route,
+// including routes with parameters or wildcards, always takes precedence over a proxy.
+// Static files mounted at the root are served last, once no proxy matched.
 func (z *zephyrix) setupProxies(handler *gin.Engine) {
-	proxyMiddleware := z.createProxyMiddleware()
-	handler.Use(proxyMiddleware)
+	handler.NoRoute(z.createProxyHandler(), z.staticFallbackHandler())
+}
+
+// staticFallbackHandler serves the static mounts registered at the root of the engine.
+// The mounts are read at request time, as Router.Static mounts are registered after the engine setup.
+func (z *zephyrix) staticFallbackHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if z.r == nil {
+			return
+		}
+		for _, fallback := range z.r.fallbacks {
+			if fallback(c); c.IsAborted() {
+				return
+			}
+		}
+	}
+}
+
+// proxyRoute is a reverse proxy ready to be matched against incoming requests.
+type proxyRoute struct {
+	config  ProxyConfig
+	proxy   *httputil.ReverseProxy
+	matcher *proxyMatcher
 }
 
-// createProxyMiddleware creates a gin middleware for handling reverse proxies.
-func (z *zephyrix) createProxyMiddleware() gin.HandlerFunc {
-	proxies := make([]*httputil.ReverseProxy, len(z.config.Server.Proxies))
+// createProxyHandler creates the gin handler dispatching unmatched requests to the reverse proxies.
+//
+// Proxies are tried by descending priority, proxies with the same priority keep their configuration order.
+func (z *zephyrix) createProxyHandler() gin.HandlerFunc {
+	routes := make([]*proxyRoute, len(z.config.Server.Proxies))
 	var wg sync.WaitGroup
 	wg.Add(len(z.config.Server.Proxies))
 
 	for i, proxyConfig := range z.config.Server.Proxies {
 		go func(i int, proxyConfig ProxyConfig) {
 			defer wg.Done()
+			matcher, err := newProxyMatcher(proxyConfig)
+			if err != nil {
+				Logger.Error("Invalid path configuration for proxy %s: %s", proxyConfig.Name, err)
+				return
+			}
 			proxy, err := z.createReverseProxy(proxyConfig)
 			if err != nil {
 				Logger.Error("Failed to create reverse proxy: %s", err)
-				return
 			}
-			proxies[i] = proxy
+			routes[i] = &proxyRoute{config: proxyConfig, proxy: proxy, matcher: matcher}
 		}(i, proxyConfig)
 	}
 
 	wg.Wait()
 
+	routes = sortProxyRoutes(routes)
+
 	return func(c *gin.Context) {
-		// Check if the route already exists in the Gin router
-		if z.routeExists(c.Request.Method, c.Request.URL.Path) {
-			c.Next()
+		for _, route := range routes {
+			if !route.matcher.match(c.Request.URL.Path) {
+				continue
+			}
+			z.serveProxy(c, route)
+			c.Abort()
 			return
 		}
+		// no proxy matches, the request goes on to the root static mounts or gin's default 404
+	}
+}
 
-		for i, proxyConfig := range z.config.Server.Proxies {
-			if z.shouldProxy(c.Request.URL.Path, proxyConfig) {
-				if proxyConfig.StripPrefix {
-					c.Request.URL.Path = z.stripPrefix(c.Request.URL.Path, proxyConfig.Path)
-				}
-				proxies[i].ServeHTTP(c.Writer, c.Request)
-				return
-			}
+// sortProxyRoutes drops the proxies that failed to initialize and orders the rest by priority.
+func sortProxyRoutes(routes []*proxyRoute) []*proxyRoute {
+	sorted := make([]*proxyRoute, 0, len(routes))
+	for _, route := range routes {
+		if route != nil {
+			sorted = append(sorted, route)
 		}
-
-		// If no proxy matches, proceed with the next handler
-		c.Next()
 	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].config.Priority > sorted[j].config.Priority
+	})
+	return sorted
 }
 
-// routeExists checks if a route already exists in the Gin router.
-func (z *zephyrix) routeExists(method, path string) bool {
-	// This is a simplified check. You may need to implement a more
-	// comprehensive check based on your router's structure.
-	for _, route := range z.r.handler.Routes() {
-		if route.Method == method && route.Path == path {
-			return true
+// serveProxy forwards the request to the upstream of the given proxy.
+func (z *zephyrix) serveProxy(c *gin.Context, route *proxyRoute) {
+	proxyConfig := route.config
+	if proxyConfig.Auth.Enabled && !z.authenticateProxyRequest(c, proxyConfig.Auth) {
+		return
+	}
+	if route.proxy == nil {
+		z.customErrorHandler(c.Writer, c.Request, fmt.Errorf("proxy %s is not available", proxyConfig.Name))
+		c.Abort()
+		return
+	}
+	forward := func() {
+		if proxyConfig.StripPrefix {
+			// only the upstream sees the stripped path, the cache keys the response by the
+			// requested one, so proxies stripping different prefixes never share an entry
+			path, rawPath := c.Request.URL.Path, c.Request.URL.RawPath
+			c.Request.URL.Path = route.matcher.strip(path)
+			c.Request.URL.RawPath = ""
+			defer func() { c.Request.URL.Path, c.Request.URL.RawPath = path, rawPath }()
 		}
+		route.proxy.ServeHTTP(c.Writer, c.Request)
 	}
-	return false
+	if proxyConfig.Cache.Enabled && z.cache != nil {
+		z.cache.serve(c, proxyConfig.Cache.TTL, proxyConfig.Cache.Tags, forward)
+		return
+	}
+	forward()
 }
 
 // createReverseProxy creates a new reverse proxy for the given configuration.
@@ -102,49 +194,142 @@ func (z *zephyrix) createReverseProxy(proxyConfig ProxyConfig) (*httputil.Revers
 		originalDirector(req)
 		z.modifyRequest(req, proxyConfig)
 	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		stripGatewaySecurityHeaders(res)
+		return nil
+	}
 	proxy.ErrorHandler = z.customErrorHandler
 	Logger.Debug("Created reverse proxy for %s at %s", proxyConfig.Name, proxyConfig.Address)
 	return proxy, nil
 }
 
-// shouldProxy determines if a request should be proxied based on its path and the proxy configuration.
-func (z *zephyrix) shouldProxy(path string, config ProxyConfig) bool {
-	// First, check if the path is in the ignore list
-	for _, ignorePath := range config.IgnorePath {
-		if strings.HasPrefix(path, ignorePath) {
-			return false
+// modifyRequest modifies the incoming request based on the proxy configuration.
+func (z *zephyrix) modifyRequest(req *http.Request, proxyConfig ProxyConfig) {
+	for _, header := range proxyConfig.Headers {
+		if val := req.Header.Get(header); val != "" {
+			req.Header.Set(header, val)
 		}
 	}
+	// Additional custom logic for request modification can be added here
+}
+
+// authenticateProxyRequest resolves the identity of a proxied request and prepares the
+// identity headers for the upstream. It writes the error response and aborts the request
+// when the request must not be forwarded.
+func (z *zephyrix) authenticateProxyRequest(c *gin.Context, config ProxyAuthConfig) bool {
+	if z.auth == nil {
+		Logger.Error("Proxy authentication is enabled, but the auth provider is not available")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "authentication unavailable"})
+		return false
+	}
+
+	// never trust identity headers sent by the client
+	userIDHeader, rolesHeader, sessionHeader := proxyIdentityHeaderNames(config)
+	c.Request.Header.Del(userIDHeader)
+	c.Request.Header.Del(rolesHeader)
+	c.Request.Header.Del(sessionHeader)
 
-	// Then check if the path should be proxied
-	for _, proxyPath := range config.Path {
-		if strings.HasPrefix(path, strings.TrimSuffix(proxyPath, "/*")) {
-			return true
+	// the user is loaded like the "auth" middleware does, disabled or locked accounts and
+	// roles changed since the token was signed are enforced before anything is forwarded
+	identity, user, err := z.auth.authenticateRequest(c)
+	if err != nil {
+		switch {
+		case isAuthError(err):
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		case errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrAccountLocked), errors.Is(err, ErrForbidden):
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		default:
+			Logger.Error("Failed to authenticate proxied request: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
 		}
+		return false
 	}
 
-	return false
-}
+	allowed, err := z.auth.hasAnyRole(c.Request.Context(), identity, config.Roles...)
+	if err != nil {
+		Logger.Error("Failed to resolve the roles of user %d: %s", identity.UserID, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return false
+	}
+
+	c.Set(identityContextKey, identity)
+	c.Set(userContextKey, user)
+
+	if config.StripCredentials {
+		c.Request.Header.Del("Authorization")
+		if apiKeys := z.auth.components.apiKeys; apiKeys != nil {
+			c.Request.Header.Del(apiKeys.Header())
+		}
+		z.stripSessionCookie(c.Request)
+	}
+
+	if config.IdentityHeaders {
+		c.Request.Header.Set(userIDHeader, strconv.FormatUint(identity.UserID, 10))
+		if len(identity.Roles) > 0 {
+			c.Request.Header.Set(rolesHeader, strings.Join(identity.Roles, ","))
+		}
+		if identity.SessionID != "" {
+			c.Request.Header.Set(sessionHeader, identity.SessionID)
+		}
+	}
 
-// stripPrefix removes the proxy path prefix from the request path.
-func (z *zephyrix) stripPrefix(path string, prefixes []string) string {
-	for _, prefix := range prefixes {
-		trimmedPrefix := strings.TrimSuffix(prefix, "/*")
-		if strings.HasPrefix(path, trimmedPrefix) {
-			return "/" + strings.TrimPrefix(path, trimmedPrefix)
+	if config.InternalJWT.Enabled {
+		expiration := config.InternalJWT.Expiration
+		if expiration <= 0 {
+			expiration = time.Minute
+		}
+		token, err := z.auth.GenerateInternalToken(identity, config.InternalJWT.Audience, expiration)
+		if err != nil {
+			Logger.Error("Failed to mint internal JWT for proxied request: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return false
+		}
+		header := config.InternalJWT.Header
+		if header == "" {
+			header = "Authorization"
+		}
+		if strings.EqualFold(header, "Authorization") {
+			token = "Bearer " + token
 		}
+		c.Request.Header.Set(header, token)
 	}
-	return path
+
+	return true
 }
 
-// modifyRequest modifies the incoming request based on the proxy configuration.
-func (z *zephyrix) modifyRequest(req *http.Request, proxyConfig ProxyConfig) {
-	for _, header := range proxyConfig.Headers {
-		if val := req.Header.Get(header); val != "" {
-			req.Header.Set(header, val)
+// proxyIdentityHeaderNames returns the configured identity header names, or their defaults.
+func proxyIdentityHeaderNames(config ProxyAuthConfig) (userID, roles, session string) {
+	userID, roles, session = config.UserIDHeader, config.RolesHeader, config.SessionHeader
+	if userID == "" {
+		userID = "X-Auth-User-Id"
+	}
+	if roles == "" {
+		roles = "X-Auth-Roles"
+	}
+	if session == "" {
+		session = "X-Auth-Session-Id"
+	}
+	return userID, roles, session
+}
+
+// stripSessionCookie removes the Zephyrix session cookie from the request, keeping any other cookie.
+func (z *zephyrix) stripSessionCookie(req *http.Request) {
+	if z.auth.components.sessionManager == nil {
+		return
+	}
+	name := z.auth.components.sessionManager.CookieName()
+
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			req.AddCookie(cookie)
 		}
 	}
-	// Additional custom logic for request modification can be added here
 }
 
 // customErrorHandler handles errors that occur during proxying.
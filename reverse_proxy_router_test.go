@@ -0,0 +1,276 @@
+package zephyrix
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+func TestProxyMatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ProxyConfig
+		path    string
+		match   bool
+		stripTo string
+	}{
+		{"prefix catch-all", ProxyConfig{Path: []string{"/*"}}, "/anything/here", true, "/anything/here"},
+		{"prefix segment", ProxyConfig{Path: []string{"/api/*"}}, "/api/users", true, "/users"},
+		{"prefix exact segment", ProxyConfig{Path: []string{"/api"}}, "/api", true, "/"},
+		{"prefix is segment aware", ProxyConfig{Path: []string{"/api"}}, "/apis", false, ""},
+		{"prefix ignored", ProxyConfig{Path: []string{"/*"}, IgnorePath: []string{"/health"}}, "/health/live", false, ""},
+		{"exact", ProxyConfig{Match: "exact", Path: []string{"/login"}}, "/login", true, "/"},
+		{"exact mismatch", ProxyConfig{Match: "exact", Path: []string{"/login"}}, "/login/sso", false, ""},
+		{"glob single segment", ProxyConfig{Match: "glob", Path: []string{"/assets/*.js"}}, "/assets/app.js", true, "/app.js"},
+		{"glob does not cross segments", ProxyConfig{Match: "glob", Path: []string{"/assets/*.js"}}, "/assets/v1/app.js", false, ""},
+		{"glob double star", ProxyConfig{Match: "glob", Path: []string{"/assets/**"}}, "/assets/v1/app.js", true, "/v1/app.js"},
+		{"regex", ProxyConfig{Match: "regex", Path: []string{`^/v[0-9]+/`}}, "/v2/orders", true, "/orders"},
+		{"regex mismatch", ProxyConfig{Match: "regex", Path: []string{`^/v[0-9]+/`}}, "/vx/orders", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newProxyMatcher(tt.config)
+			require.NoError(t, err)
+			require.Equal(t, tt.match, m.match(tt.path))
+			if tt.match {
+				require.Equal(t, tt.stripTo, m.strip(tt.path))
+			}
+		})
+	}
+}
+
+func TestProxyMatcherInvalidConfig(t *testing.T) {
+	_, err := newProxyMatcher(ProxyConfig{Match: "regex", Path: []string{"("}})
+	require.Error(t, err)
+
+	_, err = newProxyMatcher(ProxyConfig{Match: "fuzzy", Path: []string{"/"}})
+	require.Error(t, err)
+}
+
+func TestRouteTakesPrecedenceOverProxy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name+":"+r.URL.Path)
+		}))
+	}
+	frontend := upstream("frontend")
+	defer frontend.Close()
+	api := upstream("api")
+	defer api.Close()
+
+	z := &zephyrix{config: &Config{Server: ServerConfig{Proxies: []ProxyConfig{
+		{Name: "frontend", Address: frontend.URL, Path: []string{"/*"}},
+		{Name: "api", Address: api.URL, Path: []string{"/api/*"}, StripPrefix: true, Priority: 10},
+	}}}}
+
+	handler := gin.New()
+	handler.HandleMethodNotAllowed = true
+	handler.GET("/users/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, "route:"+c.Param("id"))
+	})
+	handler.GET("/files/*path", func(c *gin.Context) {
+		c.String(http.StatusOK, "files:"+c.Param("path"))
+	})
+	z.setupProxies(handler)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{http.MethodGet, "/users/42", http.StatusOK, "route:42"},
+		{http.MethodGet, "/files/a/b.txt", http.StatusOK, "files:/a/b.txt"},
+		{http.MethodPost, "/users/42", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/api/orders", http.StatusOK, "api:/orders"},
+		{http.MethodGet, "/dashboard", http.StatusOK, "frontend:/dashboard"},
+	}
+
+	// the reverse proxy needs a real connection, a response recorder is not enough
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+			require.NoError(t, err)
+			resp, err := server.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.status, resp.StatusCode)
+			if tt.body != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, tt.body, string(body))
+			}
+		})
+	}
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// the upstream answers with the headers it received
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(r.Header)
+	}))
+	defer upstream.Close()
+
+	ap := newTestAuthProvider(t,
+		&models.UserEntity{ID: 1, Username: "alice", Active: true, Roles: `["admin"]`},
+		&models.UserEntity{ID: 2, Username: "bob", Active: true},
+		&models.UserEntity{ID: 3, Username: "carol", Active: false, Roles: `["admin"]`},
+		&models.UserEntity{ID: 4, Username: "dave", Active: true, Locked: true, Roles: `["admin"]`},
+	)
+	ap.components.apiKeys = &APIKeyManager{config: APIKeyConfig{Header: defaultAPIKeyHeader}}
+	ap.components.sessionManager = &SessionManager{storage: NewMemorySessionStorage()}
+
+	z := &zephyrix{auth: ap, config: &Config{Server: ServerConfig{Proxies: []ProxyConfig{
+		{Name: "admin", Address: upstream.URL, Path: []string{"/admin/*"}, Auth: ProxyAuthConfig{
+			Enabled:          true,
+			Roles:            []string{"admin"},
+			IdentityHeaders:  true,
+			StripCredentials: true,
+			InternalJWT:      InternalJWTConfig{Enabled: true, Audience: "billing"},
+		}},
+		{Name: "open", Address: upstream.URL, Path: []string{"/open/*"}, Auth: ProxyAuthConfig{Enabled: true}},
+	}}}}
+	handler := gin.New()
+	z.setupProxies(handler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	token := func(id uint64, claims ...jwt.MapClaims) string {
+		user, err := ap.components.userStore.GetByID(context.Background(), id)
+		require.NoError(t, err)
+		signed, err := ap.generateJWT(user, claims...)
+		require.NoError(t, err)
+		return "Bearer " + signed
+	}
+	spoofed := http.Header{"X-Auth-User-Id": {"1"}, "X-Auth-Roles": {"admin"}, "X-Auth-Session-Id": {"forged"}}
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		status        int
+		forwarded     http.Header // headers the upstream must receive
+		removed       []string    // headers the upstream must not receive
+	}{
+		{name: "anonymous", path: "/admin/users", status: http.StatusUnauthorized},
+		{name: "garbage token", path: "/admin/users", authorization: "Bearer nope", status: http.StatusUnauthorized},
+		{name: "disabled user", path: "/admin/users", authorization: token(3), status: http.StatusForbidden},
+		{name: "locked user", path: "/admin/users", authorization: token(4), status: http.StatusForbidden},
+		{name: "missing role", path: "/admin/users", authorization: token(2), status: http.StatusForbidden},
+		{name: "stale role of the token", path: "/admin/users", authorization: token(2, jwt.MapClaims{"roles": []string{"admin"}}), status: http.StatusForbidden},
+		{
+			name: "identity forwarded", path: "/admin/users", authorization: token(1), status: http.StatusOK,
+			forwarded: http.Header{"X-Auth-User-Id": {"1"}, "X-Auth-Roles": {"admin"}, "Cookie": {"theme=dark"}},
+			removed:   []string{"X-Auth-Session-Id", defaultAPIKeyHeader},
+		},
+		{
+			name: "spoofed identity removed", path: "/open/users", authorization: token(2), status: http.StatusOK,
+			forwarded: http.Header{"Authorization": {token(2)}},
+			removed:   []string{"X-Auth-User-Id", "X-Auth-Roles", "X-Auth-Session-Id"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+tt.path, nil)
+			require.NoError(t, err)
+			for name, values := range spoofed {
+				req.Header[name] = values
+			}
+			req.Header.Set(defaultAPIKeyHeader, "zx_leaked")
+			req.Header.Set("Cookie", "zephyrix_session=stolen; theme=dark")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			resp, err := server.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.status, resp.StatusCode)
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var received http.Header
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&received))
+			for name, values := range tt.forwarded {
+				require.Equal(t, values, received[name], name)
+			}
+			for _, name := range tt.removed {
+				require.Empty(t, received.Get(name), name)
+			}
+		})
+	}
+}
+
+func TestProxyInternalJWT(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var internal string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal = bearerToken(r)
+	}))
+	defer upstream.Close()
+
+	ap := newTestAuthProvider(t, &models.UserEntity{ID: 1, Username: "alice", Active: true, Roles: `["admin"]`})
+	z := &zephyrix{auth: ap, config: &Config{Server: ServerConfig{Proxies: []ProxyConfig{
+		{Name: "billing", Address: upstream.URL, Path: []string{"/*"}, Auth: ProxyAuthConfig{
+			Enabled:          true,
+			StripCredentials: true,
+			InternalJWT:      InternalJWTConfig{Enabled: true, Audience: "billing", Expiration: time.Minute},
+		}},
+	}}}}
+	handler := gin.New()
+	handler.GET("/me", ap.Middleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	z.setupProxies(handler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	user, _ := ap.components.userStore.GetByID(context.Background(), 1)
+	access, err := ap.generateJWT(user)
+	require.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/invoices", nil)
+	req.Header.Set("Authorization", "Bearer "+access)
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NotEmpty(t, internal)
+	require.NotEqual(t, access, internal, "the client token is replaced")
+	parsed, err := ap.VerifyToken(internal)
+	require.NoError(t, err)
+	claims := parsed.Claims.(jwt.MapClaims)
+	require.Equal(t, internalTokenType, claims["typ"])
+	require.True(t, claims.VerifyAudience("billing", true))
+	require.Equal(t, "1", claims["sub"])
+
+	// an upstream, or whoever reads its logs, can not replay the token against Zephyrix
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/me", nil)
+	req.Header.Set("Authorization", "Bearer "+internal)
+	resp, err = server.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	identity := &Identity{UserID: 1, Method: IdentityMethodJWT}
+	_, err = ap.GenerateInternalToken(identity, "", time.Minute)
+	require.Error(t, err, "an audience is required")
+	_, err = ap.GenerateInternalToken(identity, ap.config.JWT.Audience, time.Minute)
+	require.Error(t, err, "the audience of the access tokens is refused")
+}
@@ -26,6 +26,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/latolukasz/beeorm/v3"
 )
 
@@ -63,6 +64,8 @@ type Zephyrix interface {
 	// RegisterRouteHandler will register a route handler, the handler must implement RouteHandler interface
 	RegisterRouteHandler(handlers ...any)
 	RegisterMiddleware(middlewares ...any)
+	// RegisterUserStore replaces the default user store, the constructor must return a UserStore
+	RegisterUserStore(constructor any)
 
 	RegisterJob(job ...JobInterface)
 	RegisterSchedule(schedule ...ScheduleInterface)
@@ -91,9 +94,26 @@ type Router interface {
 	TRACE(relativePath string, handlerFunction any, middlewareFunctions ...any)
 	Any(relativePath string, handlerFunction any, middlewareFunctions ...any)
 	Match(httpMethods []HTTPVerb, relativePath string, handlerFunction any, middlewareFunctions ...any)
+	Static(relativePath string, root any, config ...StaticConfig)
 }
 
 // Context is the interface that will be used to interact with the request and response
 type Context interface {
 	JSON(code int, obj interface{})
+	// CSPNonce returns the Content-Security-Policy nonce of the request,
+	// empty unless authentication.security_headers.csp_nonce is enabled.
+	// A response that read the nonce is never stored in the response cache.
+	CSPNonce() string
+	// User returns the user authenticated by the "auth" middleware, nil for anonymous requests.
+	User() User
+	// Claims returns the JWT claims of the request, nil unless it was authenticated with a bearer token.
+	Claims() jwt.MapClaims
+	// Identity returns the authenticated principal of the request, nil for anonymous requests.
+	Identity() *Identity
+	// Session returns the cookie session of the request, nil unless the "session" middleware or the
+	// "auth" middleware with a session cookie ran. Changes to Session.Data are saved after the handlers.
+	Session() *Session
+	// CSRFToken returns the token unsafe requests of the session must send in the CSRF header or form field,
+	// empty unless authentication.session.csrf is enabled.
+	CSRFToken() string
 }
@@ -0,0 +1,357 @@
+package zephyrix
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+)
+
+const (
+	defaultLockoutResetAfter = 24 * time.Hour
+	defaultLockoutMaxDelay   = 10 * time.Second
+
+	lockoutUserPrefix = "zephyrix:lockout:user:"
+	lockoutIPPrefix   = "zephyrix:lockout:ip:"
+
+	// lockedUntilMetadata holds the end of a timed lock in RFC 3339, locks without it last until
+	// an administrator unlocks the account.
+	lockedUntilMetadata = "locked_until"
+)
+
+// normalize applies the defaults of the configuration.
+func (c AccountLockout) normalize() AccountLockout {
+	if c.ResetAfter <= 0 {
+		c.ResetAfter = defaultLockoutResetAfter
+	}
+	if c.IPBlockDuration <= 0 {
+		c.IPBlockDuration = c.LockoutDuration
+	}
+	if c.IPBlockDuration <= 0 {
+		c.IPBlockDuration = c.ResetAfter
+	}
+	if c.ProgressiveDelay > 0 && c.MaxDelay <= 0 {
+		c.MaxDelay = defaultLockoutMaxDelay
+	}
+	return c
+}
+
+// delay returns how long the answer to the nth consecutive failure is held back,
+// the delay doubles with every failure up to MaxDelay.
+func (c AccountLockout) delay(failures int64) time.Duration {
+	if c.ProgressiveDelay <= 0 || failures < 1 {
+		return 0
+	}
+	delay := c.ProgressiveDelay
+	for i := int64(1); i < failures && delay < c.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, c.MaxDelay)
+}
+
+// LockoutEvent describes an account locked after too many failed logins, or by an administrator.
+type LockoutEvent struct {
+	UserID   uint64    `json:"user_id"`
+	Username string    `json:"username"`
+	IP       string    `json:"ip,omitempty"`
+	Reason   string    `json:"reason"`             // "too_many_attempts" or "admin"
+	Attempts int64     `json:"attempts,omitempty"` // failed attempts that triggered the lock
+	Until    time.Time `json:"until,omitempty"`    // zero until an administrator unlocks the account
+}
+
+// LockoutHook is called after an account was locked, e.g. to notify the user or the security team.
+type LockoutHook func(ctx context.Context, event LockoutEvent)
+
+// LockoutStatus is the lockout state of an account.
+type LockoutStatus struct {
+	Locked         bool      `json:"locked"`
+	LockedUntil    time.Time `json:"locked_until,omitempty"`
+	FailedAttempts int64     `json:"failed_attempts"`
+}
+
+// LockoutManager counts failed logins per account and per IP address in redis. Accounts are locked
+// with User.Lock after max_attempts failures and unlocked again once lockout_duration passed, addresses
+// are blocked after ip_max_attempts failures. Counters reset reset_after the last failure.
+type LockoutManager struct {
+	config      AccountLockout
+	orm         beeorm.Engine
+	redisClient beeorm.RedisCache
+	users       UserStore
+	audit       *AuditLogger
+	webhook     *WebhookCodeSender
+
+	mu    sync.RWMutex
+	hooks []LockoutHook
+}
+
+func NewLockoutManager(conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, users UserStore, audit *AuditLogger) (*LockoutManager, error) {
+	lm := &LockoutManager{
+		config:      conf.Authentication.AccountLockout.normalize(),
+		orm:         orm,
+		redisClient: redisClient,
+		users:       users,
+		audit:       audit,
+	}
+	if url := conf.Authentication.Webhooks.AccountLocked; url != "" {
+		webhook, err := NewWebhookCodeSender(WebhookSenderConfig{URL: url, Timeout: 10 * time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("account lockout: %w", err)
+		}
+		lm.webhook = webhook
+	}
+	return lm, nil
+}
+
+// Enabled reports whether accounts are locked after failed logins.
+func (lm *LockoutManager) Enabled() bool {
+	return lm.config.MaxAttempts > 0
+}
+
+// OnLock registers a hook called whenever an account gets locked.
+func (lm *LockoutManager) OnLock(hook LockoutHook) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.hooks = append(lm.hooks, hook)
+}
+
+// CheckIP returns ErrRateLimited while the address is blocked after too many failures.
+func (lm *LockoutManager) CheckIP(ctx context.Context, ip string) error {
+	if lm.config.IPMaxAttempts <= 0 || ip == "" {
+		return nil
+	}
+	if lm.count(ctx, lockoutIPPrefix+ip) >= int64(lm.config.IPMaxAttempts) {
+		return fmt.Errorf("%w: too many failed logins from %s", ErrRateLimited, ip)
+	}
+	return nil
+}
+
+// FailedFromIP counts a failed login from the address and holds the answer back by the progressive delay.
+func (lm *LockoutManager) FailedFromIP(ctx context.Context, ip string) {
+	if ip == "" || (lm.config.IPMaxAttempts <= 0 && lm.config.ProgressiveDelay <= 0) {
+		return
+	}
+	key := lockoutIPPrefix + ip
+	failures := lm.increment(ctx, key, lm.config.ResetAfter)
+	if lm.config.IPMaxAttempts > 0 && failures == int64(lm.config.IPMaxAttempts) {
+		// the block outlasts reset_after when ip_block_duration is longer
+		lm.redisClient.Expire(lm.orm.NewORM(ctx), key, max(lm.config.IPBlockDuration, lm.config.ResetAfter))
+		lm.log(ctx, "ip_blocked", 0, fmt.Sprintf("ip=%s attempts=%d", ip, failures))
+	}
+	lm.wait(ctx, failures)
+}
+
+// Failed counts a failed login of the user and locks the account once max_attempts is reached.
+func (lm *LockoutManager) Failed(ctx context.Context, user User, ip string) {
+	if !lm.Enabled() {
+		return
+	}
+	failures := lm.increment(ctx, lockoutUserPrefix+strconv.FormatUint(user.ID(), 10), lm.config.ResetAfter)
+	if failures >= int64(lm.config.MaxAttempts) && !user.IsLocked() {
+		var until time.Time
+		if lm.config.LockoutDuration > 0 {
+			until = time.Now().Add(lm.config.LockoutDuration)
+		}
+		if err := lm.lock(ctx, user, until, LockoutEvent{IP: ip, Reason: "too_many_attempts", Attempts: failures}); err != nil {
+			Logger.Error("Failed to lock user %d: %s", user.ID(), err)
+		}
+	}
+}
+
+// Succeeded resets the failure counter of the user after a successful login.
+func (lm *LockoutManager) Succeeded(ctx context.Context, user User) {
+	if !lm.Enabled() {
+		return
+	}
+	lm.redisClient.Del(lm.orm.NewORM(ctx), lockoutUserPrefix+strconv.FormatUint(user.ID(), 10))
+}
+
+// IsLocked reports whether the user is locked, timed locks that ran out are lifted on the way.
+func (lm *LockoutManager) IsLocked(ctx context.Context, user User) bool {
+	if !user.IsLocked() {
+		return false
+	}
+	until := lockedUntil(user)
+	if until.IsZero() || time.Now().Before(until) {
+		return true
+	}
+
+	if err := lm.unlock(ctx, user); err != nil {
+		Logger.Error("Failed to unlock user %d after the lockout: %s", user.ID(), err)
+		return true
+	}
+	lm.log(ctx, "account_unlocked", user.ID(), "lockout expired")
+	return false
+}
+
+// Lock locks the account of the user, a zero duration locks it until Unlock is called.
+func (lm *LockoutManager) Lock(ctx context.Context, userID uint64, duration time.Duration) error {
+	user, err := lm.users.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	return lm.lock(ctx, user, until, LockoutEvent{Reason: "admin"})
+}
+
+// Unlock lifts the lock of the account and resets its failure counter.
+func (lm *LockoutManager) Unlock(ctx context.Context, userID uint64) error {
+	user, err := lm.users.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := lm.unlock(ctx, user); err != nil {
+		return err
+	}
+	lm.log(ctx, "account_unlocked", user.ID(), "unlocked by an administrator")
+	return nil
+}
+
+// UnblockIP resets the failure counter of an address.
+func (lm *LockoutManager) UnblockIP(ctx context.Context, ip string) {
+	lm.redisClient.Del(lm.orm.NewORM(ctx), lockoutIPPrefix+ip)
+	lm.log(ctx, "ip_unblocked", 0, fmt.Sprintf("ip=%s", ip))
+}
+
+// Status returns the lockout state of the account.
+func (lm *LockoutManager) Status(ctx context.Context, userID uint64) (*LockoutStatus, error) {
+	user, err := lm.users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	status := &LockoutStatus{
+		Locked:         user.IsLocked(),
+		FailedAttempts: lm.count(ctx, lockoutUserPrefix+strconv.FormatUint(userID, 10)),
+	}
+	if status.Locked {
+		status.LockedUntil = lockedUntil(user)
+		status.Locked = status.LockedUntil.IsZero() || time.Now().Before(status.LockedUntil)
+	}
+	return status, nil
+}
+
+func (lm *LockoutManager) lock(ctx context.Context, user User, until time.Time, event LockoutEvent) error {
+	if err := user.Lock(); err != nil {
+		return err
+	}
+	value := ""
+	if !until.IsZero() {
+		value = until.UTC().Format(time.RFC3339)
+	}
+	if err := user.SetMetadata(lockedUntilMetadata, value); err != nil {
+		return err
+	}
+	if err := lm.users.Update(ctx, user); err != nil {
+		return err
+	}
+
+	event.UserID, event.Username, event.Until = user.ID(), user.Username(), until
+	lm.log(ctx, "account_locked", user.ID(), fmt.Sprintf("reason=%s attempts=%d ip=%s until=%s", event.Reason, event.Attempts, event.IP, value))
+	lm.notify(ctx, event)
+	return nil
+}
+
+func (lm *LockoutManager) unlock(ctx context.Context, user User) error {
+	if err := user.Unlock(); err != nil {
+		return err
+	}
+	if err := user.SetMetadata(lockedUntilMetadata, ""); err != nil {
+		return err
+	}
+	if err := lm.users.Update(ctx, user); err != nil {
+		return err
+	}
+	lm.redisClient.Del(lm.orm.NewORM(ctx), lockoutUserPrefix+strconv.FormatUint(user.ID(), 10))
+	return nil
+}
+
+// notify runs the hooks and calls the account_locked webhook in the background,
+// a slow receiver must not hold back the answer to the login.
+func (lm *LockoutManager) notify(ctx context.Context, event LockoutEvent) {
+	lm.mu.RLock()
+	hooks := append([]LockoutHook(nil), lm.hooks...)
+	lm.mu.RUnlock()
+	if len(hooks) == 0 && lm.webhook == nil {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		for _, hook := range hooks {
+			hook(ctx, event)
+		}
+		if lm.webhook == nil {
+			return
+		}
+		err := lm.webhook.post(ctx, map[string]interface{}{
+			"event":    "account_locked",
+			"user_id":  event.UserID,
+			"username": event.Username,
+			"ip":       event.IP,
+			"reason":   event.Reason,
+			"attempts": event.Attempts,
+			"until":    event.Until,
+		})
+		if err != nil {
+			Logger.Error("Failed to notify the lockout of user %d: %s", event.UserID, err)
+		}
+	}()
+}
+
+// increment counts a failure under the key, which expires ttl after the last failure.
+func (lm *LockoutManager) increment(ctx context.Context, key string, ttl time.Duration) int64 {
+	orm := lm.orm.NewORM(ctx)
+	failures := lm.redisClient.Incr(orm, key)
+	lm.redisClient.Expire(orm, key, ttl)
+	return failures
+}
+
+func (lm *LockoutManager) count(ctx context.Context, key string) int64 {
+	value, found := lm.redisClient.Get(lm.orm.NewORM(ctx), key)
+	if !found {
+		return 0
+	}
+	count, _ := strconv.ParseInt(value, 10, 64)
+	return count
+}
+
+func (lm *LockoutManager) wait(ctx context.Context, failures int64) {
+	delay := lm.config.delay(failures)
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+func (lm *LockoutManager) log(ctx context.Context, action string, userID uint64, details string) {
+	if lm.audit == nil {
+		return
+	}
+	if err := lm.audit.Log(ctx, action, strconv.FormatUint(userID, 10), details); err != nil {
+		Logger.Error("Failed to write %s to the audit log: %s", action, err)
+	}
+}
+
+// lockedUntil returns the end of the timed lock of the user, zero when the lock is not timed.
+func lockedUntil(user User) time.Time {
+	value, err := user.GetMetadata(lockedUntilMetadata)
+	if err != nil {
+		return time.Time{}
+	}
+	s, _ := value.(string)
+	until, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return until
+}
@@ -0,0 +1,106 @@
+package zephyrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+// lockoutCommand builds the `lockout` command locking and unlocking accounts.
+func (z *zephyrix) lockoutCommand(cancel context.CancelFunc) *cobra.Command {
+	var duration time.Duration
+
+	lockoutCommand := &cobra.Command{
+		GroupID: authGroup.ID,
+		Use:     "lockout",
+		Short:   "Manage account lockouts",
+		Long:    "Show, lock and unlock accounts locked after failed logins, and unblock IP addresses (authentication.account_lockout)",
+		PersistentPreRun: func(_ *cobra.Command, _ []string) {
+			z.options = append(z.options, fx.Invoke(beeormInvoke))
+		},
+		PersistentPostRun: func(_ *cobra.Command, _ []string) {
+			defer cancel()
+		},
+	}
+
+	statusCommand := &cobra.Command{
+		Use:   "status <username>",
+		Short: "Show whether an account is locked and its failed logins",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				user, err := ap.Users().GetByUsername(ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to find user %s: %w", args[0], err)
+				}
+				status, err := ap.Lockout().Status(ctx, user.ID())
+				if err != nil {
+					return err
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(status)
+			})
+		},
+	}
+
+	lockCommand := &cobra.Command{
+		Use:   "lock <username>",
+		Short: "Lock an account",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				user, err := ap.Users().GetByUsername(ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to find user %s: %w", args[0], err)
+				}
+				if err := ap.Lockout().Lock(ctx, user.ID(), duration); err != nil {
+					return err
+				}
+				Logger.Info("Locked user %s", args[0])
+				return nil
+			})
+		},
+	}
+	lockCommand.Flags().DurationVarP(&duration, "duration", "d", 0, "how long the account stays locked, 0 until it is unlocked")
+
+	unlockCommand := &cobra.Command{
+		Use:   "unlock <username>",
+		Short: "Unlock an account and reset its failed logins",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				user, err := ap.Users().GetByUsername(ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to find user %s: %w", args[0], err)
+				}
+				if err := ap.Lockout().Unlock(ctx, user.ID()); err != nil {
+					return err
+				}
+				Logger.Info("Unlocked user %s", args[0])
+				return nil
+			})
+		},
+	}
+
+	unblockCommand := &cobra.Command{
+		Use:   "unblock-ip <ip>",
+		Short: "Reset the failed logins of an IP address",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				ap.Lockout().UnblockIP(ctx, args[0])
+				Logger.Info("Unblocked %s", args[0])
+				return nil
+			})
+		},
+	}
+
+	lockoutCommand.AddCommand(statusCommand, lockCommand, unlockCommand, unblockCommand)
+	return lockoutCommand
+}
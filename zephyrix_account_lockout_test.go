@@ -0,0 +1,160 @@
+package zephyrix
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/latolukasz/beeorm/v3"
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+func TestAccountLockoutConfig(t *testing.T) {
+	config := AccountLockout{MaxAttempts: 5, LockoutDuration: 30 * time.Minute}.normalize()
+	require.Equal(t, defaultLockoutResetAfter, config.ResetAfter)
+	require.Equal(t, 30*time.Minute, config.IPBlockDuration)
+	require.Zero(t, config.delay(3), "progressive delays are off by default")
+
+	config = AccountLockout{ProgressiveDelay: 250 * time.Millisecond, MaxDelay: time.Second}.normalize()
+	require.Equal(t, defaultLockoutResetAfter, config.IPBlockDuration)
+	require.Zero(t, config.delay(0))
+	require.Equal(t, 250*time.Millisecond, config.delay(1))
+	require.Equal(t, 500*time.Millisecond, config.delay(2))
+	require.Equal(t, time.Second, config.delay(3))
+	require.Equal(t, time.Second, config.delay(100))
+}
+
+func TestLoginRateLimitKey(t *testing.T) {
+	require.Equal(t, "password:10.0.0.1:jane@example.com",
+		loginRateLimitKey(Authenticate{GrantType: GrantTypePassword, Auth: " Jane@Example.com", Password: "secret", IP: "10.0.0.1"}))
+	require.Equal(t, "refresh_token:10.0.0.1",
+		loginRateLimitKey(Authenticate{GrantType: GrantTypeRefreshToken, RefreshToken: "token", IP: "10.0.0.1"}),
+		"tokens are not part of the key")
+	require.Equal(t, "magic_token:10.0.0.1",
+		loginRateLimitKey(Authenticate{GrantType: GrantTypeMagicToken, MagicToken: "token", IP: "10.0.0.1"}))
+	require.Equal(t, "authorization_code:10.0.0.1:github",
+		loginRateLimitKey(Authenticate{GrantType: GrantTypeAuthorization, Provider: "github", Code: "code", IP: "10.0.0.1"}))
+}
+
+func TestLockedUntil(t *testing.T) {
+	ap := newTestAuthProvider(t)
+	store := ap.components.userStore.(*testUserStore)
+	lm := &LockoutManager{users: store}
+
+	user := store.wrap(&models.UserEntity{ID: 1, Active: true})
+	require.False(t, lm.IsLocked(context.Background(), user))
+
+	require.NoError(t, user.Lock())
+	require.True(t, lockedUntil(user).IsZero())
+	require.True(t, lm.IsLocked(context.Background(), user), "locks without end last until an unlock")
+
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	require.NoError(t, user.SetMetadata(lockedUntilMetadata, until.Format(time.RFC3339)))
+	require.Equal(t, until, lockedUntil(user))
+	require.True(t, lm.IsLocked(context.Background(), user))
+
+	// the metadata survives the round trip through the entity
+	entity := &models.UserEntity{ID: 1}
+	require.NoError(t, user.encode(entity))
+	require.Equal(t, until, lockedUntil(store.wrap(entity)))
+}
+
+// testRedisCache keeps in memory the values and counters used by the login checks, other commands panic.
+type testRedisCache struct {
+	beeorm.RedisCache
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newTestRedisCache() *testRedisCache {
+	return &testRedisCache{values: make(map[string]string)}
+}
+
+func (r *testRedisCache) Get(_ beeorm.ORM, key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.values[key]
+	return value, ok
+}
+
+func (r *testRedisCache) Incr(_ beeorm.ORM, key string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count, _ := strconv.ParseInt(r.values[key], 10, 64)
+	count++
+	r.values[key] = strconv.FormatInt(count, 10)
+	return count
+}
+
+func (r *testRedisCache) Del(_ beeorm.ORM, keys ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		delete(r.values, key)
+	}
+}
+
+func (r *testRedisCache) Expire(beeorm.ORM, string, time.Duration) bool { return true }
+
+// testEngine hands out the nil ORM the in-memory redis ignores.
+type testEngine struct{ beeorm.Engine }
+
+func (testEngine) NewORM(context.Context) beeorm.ORM { return nil }
+
+func TestOAuth2CallbackIPBlock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ap := newTestAuthProvider(t)
+	ap.config.FeatureToggles.SocialLogin = true
+	redis := newTestRedisCache()
+	ap.components.rateLimiter = &RateLimiter{client: redis}
+	ap.components.lockout = &LockoutManager{config: AccountLockout{IPMaxAttempts: 3}.normalize(), orm: testEngine{}, redisClient: redis}
+	ap.components.oauth2Manager = &OAuth2Manager{orm: testEngine{}, redisClient: redis}
+
+	route := newOAuth2CallbackRoute(ap)
+	handlers := make([]gin.HandlerFunc, 0, len(route.Handlers()))
+	for _, handler := range route.Handlers() {
+		handlers = append(handlers, handler.(func(*gin.Context)))
+	}
+	r := gin.New()
+	r.GET(route.Path(), handlers...)
+
+	callback := func(ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "/auth/oauth2/github/callback?code=code&state=forged", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusBadRequest, callback("203.0.113.7"))
+	}
+	require.Equal(t, http.StatusTooManyRequests, callback("203.0.113.7"), "the address is blocked after ip_max_attempts failures")
+	require.Equal(t, http.StatusBadRequest, callback("203.0.113.8"), "other addresses are not")
+}
+
+func TestExpiredLockAuthenticatesRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	until := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	ap := newTestAuthProvider(t, &models.UserEntity{ID: 1, Username: "alice", Active: true, Locked: true, Metadata: `{"locked_until": "` + until + `"}`})
+	ap.components.lockout = &LockoutManager{orm: testEngine{}, redisClient: newTestRedisCache(), users: ap.components.userStore}
+
+	r := gin.New()
+	r.GET("/me", ap.Middleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	user, err := ap.components.userStore.GetByID(context.Background(), 1)
+	require.NoError(t, err)
+	token, err := ap.generateJWT(user)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code, "the lock ran out")
+	require.False(t, ap.components.userStore.(*testUserStore).users[1].Locked, "and was lifted")
+}
@@ -0,0 +1,430 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+const (
+	// RecoveryMethodEmail resets passwords with a token emailed to the user.
+	RecoveryMethodEmail = "email"
+	// RecoveryMethodSecurityQuestions resets passwords once enough security questions are answered.
+	RecoveryMethodSecurityQuestions = "security_questions"
+
+	defaultPasswordResetTTL      = 15 * time.Minute
+	defaultRecoveryRatePool      = "password_reset"
+	defaultSecurityQuestions     = 3
+	defaultRequiredCorrectAnswer = 2
+
+	passwordResetPrefix     = "zephyrix:password_reset:"
+	passwordResetUserPrefix = "zephyrix:password_reset:user:"
+)
+
+// normalize applies the defaults of the configuration.
+func (c AccountRecovery) normalize() AccountRecovery {
+	if c.TokenExpiration <= 0 {
+		c.TokenExpiration = defaultPasswordResetTTL
+	}
+	if c.RateLimitPool == "" {
+		c.RateLimitPool = defaultRecoveryRatePool
+	}
+	if c.SecurityQuestions <= 0 {
+		c.SecurityQuestions = defaultSecurityQuestions
+	}
+	if c.RequiredCorrect <= 0 {
+		c.RequiredCorrect = defaultRequiredCorrectAnswer
+	}
+	c.RequiredCorrect = min(c.RequiredCorrect, c.SecurityQuestions)
+	return c
+}
+
+// passwordResetState is stored in redis under the hash of a reset token.
+type passwordResetState struct {
+	UserID uint64 `json:"user_id"`
+	Method string `json:"method"`
+}
+
+// SecurityQuestion is a recovery question of a user, as shown to whoever tries to answer it.
+type SecurityQuestion struct {
+	ID       uint64 `json:"id"`
+	Question string `json:"question"`
+}
+
+// SecurityAnswer is a recovery question chosen by a user, with its answer.
+type SecurityAnswer struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+// PasswordReset completes a password reset with a token from RequestPasswordReset or AnswerSecurityQuestions.
+type PasswordReset struct {
+	Token       string
+	NewPassword string
+	IP          string
+}
+
+// RecoveryManager issues the password reset tokens of the AccountRecovery methods.
+//
+// A token is single use and only the SHA-256 of it is stored, a new token replaces the previous one
+// of the user. Answers to the security questions are normalized and hashed like passwords.
+type RecoveryManager struct {
+	config      AccountRecovery
+	orm         beeorm.Engine
+	redisClient beeorm.RedisCache
+	users       UserStore
+	hasher      *PasswordHasher
+	limiter     *RateLimiter
+	audit       *AuditLogger
+	mailer      MailSender
+	lockout     *LockoutManager
+}
+
+func NewRecoveryManager(conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, users UserStore, hasher *PasswordHasher, rl *RateLimiter, audit *AuditLogger) (*RecoveryManager, error) {
+	auth := conf.Authentication
+	rm := &RecoveryManager{
+		config:      auth.AccountRecovery.normalize(),
+		orm:         orm,
+		redisClient: redisClient,
+		users:       users,
+		hasher:      hasher,
+		limiter:     rl,
+		audit:       audit,
+	}
+
+	mail := rm.config.Mail
+	if mail.Driver == "" {
+		mail = auth.MFA.Email
+	}
+	var err error
+	if rm.mailer, err = newMailSender(mail); err != nil {
+		return nil, fmt.Errorf("account recovery: %w", err)
+	}
+	return rm, nil
+}
+
+// Enabled reports whether passwords can be reset with the method, RecoveryMethodEmail or RecoveryMethodSecurityQuestions.
+func (rm *RecoveryManager) Enabled(method string) bool {
+	return slices.Contains(rm.config.Methods, method)
+}
+
+// SetMailSender replaces the sender of the reset emails, e.g. with a provider specific client.
+func (rm *RecoveryManager) SetMailSender(sender MailSender) {
+	rm.mailer = sender
+}
+
+// Request emails a reset link to the user with the address. Unknown, disabled and locked accounts
+// get no email but no error either, so the answer does not reveal which accounts exist.
+func (rm *RecoveryManager) Request(ctx context.Context, email, ip string) error {
+	if !rm.Enabled(RecoveryMethodEmail) {
+		return errors.New("password reset by email is not enabled")
+	}
+	if rm.mailer == nil || rm.config.ResetURL == "" {
+		return errors.New("no mail sender or reset_url configured for password resets")
+	}
+
+	email = normalizeUsername(email)
+	if email == "" {
+		return fmt.Errorf("%w: email is required", ErrInvalidCredentials)
+	}
+	if rm.limiter != nil && !rm.limiter.Limiter(ctx, rm.config.RateLimitPool).Allow(ctx, "password_reset", email) {
+		return ErrRateLimited
+	}
+
+	user, err := rm.users.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			rm.log(ctx, "password_reset_unknown_address", 0, fmt.Sprintf("to=%s ip=%s", maskDestination(email), ip))
+			return nil
+		}
+		return err
+	}
+	if !user.IsActive() || rm.lockout.IsLocked(ctx, user) {
+		rm.log(ctx, "password_reset_refused", user.ID(), "account disabled or locked")
+		return nil
+	}
+
+	token, err := rm.issue(ctx, user, RecoveryMethodEmail)
+	if err != nil {
+		return err
+	}
+	err = rm.mailer.SendMail(ctx, Mail{
+		To:      user.Email(),
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Open the link below to choose a new password, it expires in %s and works once:\n\n%s\n\n"+
+			"If you did not request it, you can ignore this email, your password is unchanged.", rm.config.TokenExpiration, tokenLink(rm.config.ResetURL, token)),
+	})
+	if err != nil {
+		rm.discard(ctx, hashResetToken(token), user.ID())
+		return fmt.Errorf("failed to send the password reset: %w", err)
+	}
+
+	rm.log(ctx, "password_reset_requested", user.ID(), fmt.Sprintf("to=%s ip=%s", maskDestination(user.Email()), ip))
+	return nil
+}
+
+// Verify returns the user of a reset token without consuming it, e.g. before showing the new password form.
+func (rm *RecoveryManager) Verify(ctx context.Context, token string) (User, error) {
+	user, _, err := rm.lookup(ctx, token)
+	return user, err
+}
+
+// SetSecurityQuestions replaces the security questions of the user, at least security_questions
+// distinct questions with an answer are required.
+func (rm *RecoveryManager) SetSecurityQuestions(ctx context.Context, userID uint64, answers []SecurityAnswer) error {
+	if len(answers) < rm.config.SecurityQuestions {
+		return fmt.Errorf("%w: %d security questions are required", ErrInvalidCredentials, rm.config.SecurityQuestions)
+	}
+	seen := make(map[string]bool, len(answers))
+	for _, answer := range answers {
+		question := strings.ToLower(strings.TrimSpace(answer.Question))
+		if question == "" || normalizeSecurityAnswer(answer.Answer) == "" {
+			return fmt.Errorf("%w: every security question needs an answer", ErrInvalidCredentials)
+		}
+		if seen[question] {
+			return fmt.Errorf("%w: security questions must be distinct", ErrInvalidCredentials)
+		}
+		seen[question] = true
+	}
+
+	orm := rm.orm.NewORM(ctx)
+	for _, question := range rm.questions(ctx, userID) {
+		beeorm.DeleteEntity(orm, question)
+	}
+	now := time.Now().UTC()
+	for _, answer := range answers {
+		hash, err := rm.hasher.Hash(normalizeSecurityAnswer(answer.Answer))
+		if err != nil {
+			return fmt.Errorf("failed to hash the security answer: %w", err)
+		}
+		entity := beeorm.NewEntity[models.SecurityQuestionEntity](orm)
+		entity.UserID = userID
+		entity.Question = strings.TrimSpace(answer.Question)
+		entity.AnswerHash = hash
+		entity.CreatedAt = now
+	}
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to store the security questions: %w", err)
+	}
+
+	rm.log(ctx, "security_questions_set", userID, fmt.Sprintf("questions=%d", len(answers)))
+	return nil
+}
+
+// SecurityQuestions returns the questions of the user with the address. ErrRecoveryUnavailable is returned
+// alike for unknown, disabled and locked accounts and for accounts with too few questions.
+func (rm *RecoveryManager) SecurityQuestions(ctx context.Context, email, ip string) ([]SecurityQuestion, error) {
+	if !rm.Enabled(RecoveryMethodSecurityQuestions) {
+		return nil, errors.New("password reset with security questions is not enabled")
+	}
+	email = normalizeUsername(email)
+	if rm.limiter != nil && !rm.limiter.Limiter(ctx, rm.config.RateLimitPool).Allow(ctx, "security_questions", email) {
+		return nil, ErrRateLimited
+	}
+
+	user, entities, err := rm.questionsOf(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	questions := make([]SecurityQuestion, len(entities))
+	for i, entity := range entities {
+		questions[i] = SecurityQuestion{ID: entity.ID, Question: entity.Question}
+	}
+	rm.log(ctx, "security_questions_requested", user.ID(), fmt.Sprintf("ip=%s", ip))
+	return questions, nil
+}
+
+// AnswerSecurityQuestions checks the answers, keyed by SecurityQuestion.ID, and returns a reset token once
+// required_correct of them match. Wrong answers count as failed logins of the account lockout.
+func (rm *RecoveryManager) AnswerSecurityQuestions(ctx context.Context, email string, answers map[uint64]string, ip string) (string, error) {
+	if !rm.Enabled(RecoveryMethodSecurityQuestions) {
+		return "", errors.New("password reset with security questions is not enabled")
+	}
+	email = normalizeUsername(email)
+	if rm.limiter != nil && !rm.limiter.Limiter(ctx, rm.config.RateLimitPool).Allow(ctx, "security_answers", email) {
+		return "", ErrRateLimited
+	}
+
+	user, questions, err := rm.questionsOf(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	correct := 0
+	for _, question := range questions {
+		if answer, ok := answers[question.ID]; ok && rm.hasher.Verify(question.AnswerHash, normalizeSecurityAnswer(answer)) {
+			correct++
+		}
+	}
+	if correct < rm.config.RequiredCorrect {
+		rm.lockout.Failed(ctx, user, ip)
+		rm.log(ctx, "security_questions_failed", user.ID(), fmt.Sprintf("correct=%d ip=%s", correct, ip))
+		return "", fmt.Errorf("%w: wrong answers to the security questions", ErrInvalidCredentials)
+	}
+
+	token, err := rm.issue(ctx, user, RecoveryMethodSecurityQuestions)
+	if err != nil {
+		return "", err
+	}
+	rm.log(ctx, "security_questions_answered", user.ID(), fmt.Sprintf("correct=%d ip=%s", correct, ip))
+	return token, nil
+}
+
+// questionsOf returns the user with the address and its questions, when it may answer them.
+func (rm *RecoveryManager) questionsOf(ctx context.Context, email string) (User, []*models.SecurityQuestionEntity, error) {
+	user, err := rm.users.GetByEmail(ctx, email)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, nil, ErrRecoveryUnavailable
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.IsActive() || rm.lockout.IsLocked(ctx, user) {
+		return nil, nil, ErrRecoveryUnavailable
+	}
+	questions := rm.questions(ctx, user.ID())
+	if len(questions) < rm.config.RequiredCorrect {
+		return nil, nil, ErrRecoveryUnavailable
+	}
+	return user, questions, nil
+}
+
+func (rm *RecoveryManager) questions(ctx context.Context, userID uint64) []*models.SecurityQuestionEntity {
+	iterator := beeorm.Search[models.SecurityQuestionEntity](rm.orm.NewORM(ctx), beeorm.NewWhere("`UserID` = ? ORDER BY `ID`", userID), nil)
+	questions := make([]*models.SecurityQuestionEntity, 0, iterator.Len())
+	for iterator.Next() {
+		questions = append(questions, iterator.Entity())
+	}
+	return questions
+}
+
+// issue stores a new reset token of the user, replacing the previous one.
+func (rm *RecoveryManager) issue(ctx context.Context, user User, method string) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate the password reset token: %w", err)
+	}
+	hash := hashResetToken(token)
+	state, _ := json.Marshal(passwordResetState{UserID: user.ID(), Method: method})
+
+	orm := rm.orm.NewORM(ctx)
+	rm.redisClient.Set(orm, passwordResetPrefix+hash, string(state), rm.config.TokenExpiration)
+	rm.redisClient.Set(orm, passwordResetUserPrefix+strconv.FormatUint(user.ID(), 10), hash, rm.config.TokenExpiration)
+	return token, nil
+}
+
+// lookup returns the user and state of a reset token that is neither used, expired nor replaced.
+func (rm *RecoveryManager) lookup(ctx context.Context, token string) (User, *passwordResetState, error) {
+	if token == "" {
+		return nil, nil, fmt.Errorf("%w: missing password reset token", ErrInvalidToken)
+	}
+	orm := rm.orm.NewORM(ctx)
+	hash := hashResetToken(token)
+	encoded, found := rm.redisClient.Get(orm, passwordResetPrefix+hash)
+	if !found {
+		return nil, nil, fmt.Errorf("%w: unknown, used or expired password reset token", ErrInvalidToken)
+	}
+	var state passwordResetState
+	if err := json.Unmarshal([]byte(encoded), &state); err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed password reset state", ErrInvalidToken)
+	}
+	if latest, _ := rm.redisClient.Get(orm, passwordResetUserPrefix+strconv.FormatUint(state.UserID, 10)); latest != hash {
+		return nil, nil, fmt.Errorf("%w: a newer password reset was requested", ErrInvalidToken)
+	}
+
+	user, err := rm.users.GetByID(ctx, state.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, nil, fmt.Errorf("%w: unknown user", ErrInvalidToken)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.IsActive() {
+		return nil, nil, ErrAccountDisabled
+	}
+	if rm.lockout.IsLocked(ctx, user) {
+		return nil, nil, ErrAccountLocked
+	}
+	return user, &state, nil
+}
+
+// discard forgets a reset token, the pending one of the user included.
+func (rm *RecoveryManager) discard(ctx context.Context, hash string, userID uint64) {
+	orm := rm.orm.NewORM(ctx)
+	rm.redisClient.Del(orm, passwordResetPrefix+hash)
+	rm.redisClient.Del(orm, passwordResetUserPrefix+strconv.FormatUint(userID, 10))
+}
+
+func (rm *RecoveryManager) log(ctx context.Context, action string, userID uint64, details string) {
+	if rm.audit == nil {
+		return
+	}
+	if err := rm.audit.Log(ctx, action, strconv.FormatUint(userID, 10), details); err != nil {
+		Logger.Error("Failed to write %s to the audit log: %s", action, err)
+	}
+}
+
+// normalizeSecurityAnswer makes answers case and whitespace insensitive, " New  York" matches "new york".
+func normalizeSecurityAnswer(answer string) string {
+	return strings.Join(strings.Fields(strings.ToLower(answer)), " ")
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Recovery returns the manager of the password resets, e.g. to set the security questions of a user.
+func (ap *AuthProvider) Recovery() *RecoveryManager {
+	return ap.components.recovery
+}
+
+// RequestPasswordReset emails a reset link to the address, completed with ResetPassword.
+func (ap *AuthProvider) RequestPasswordReset(ctx context.Context, email, ip string) error {
+	return ap.components.recovery.Request(ctx, email, ip)
+}
+
+// ResetPassword sets the new password of the user of a reset token and signs the user out everywhere:
+// every session, access token and refresh token issued before the reset stops working.
+func (ap *AuthProvider) ResetPassword(ctx context.Context, input PasswordReset) (User, error) {
+	rm := ap.components.recovery
+	user, state, err := rm.lookup(ctx, input.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	// concurrent resets race on this marker, a rejected password releases it to try another one
+	orm := ap.orm.NewORM(ctx)
+	hash := hashResetToken(input.Token)
+	if !ap.redisClient.SetNX(orm, passwordResetPrefix+hash+":used", "1", rm.config.TokenExpiration) {
+		return nil, fmt.Errorf("%w: password reset token was already used", ErrInvalidToken)
+	}
+	if err := ap.SetPassword(ctx, user, input.NewPassword); err != nil {
+		ap.redisClient.Del(orm, passwordResetPrefix+hash+":used")
+		return nil, err
+	}
+	rm.discard(ctx, hash, user.ID())
+	rm.log(ctx, "password_reset_completed", user.ID(), fmt.Sprintf("method=%s ip=%s", state.Method, input.IP))
+
+	if err := ap.RevokeSessions(ctx, user.ID()); err != nil {
+		return nil, fmt.Errorf("password was reset but the sessions were not revoked: %w", err)
+	}
+	rm.log(ctx, "sessions_revoked", user.ID(), "password reset")
+
+	// the emailed link proves the address belongs to the user
+	if state.Method == RecoveryMethodEmail && !isEmailVerified(user) {
+		if err := ap.markEmailVerified(ctx, user); err != nil {
+			Logger.Error("Failed to verify the email address of user %d: %s", user.ID(), err)
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,191 @@
+package zephyrix
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recoveryRouteHandler is one of the JSON endpoints of the password reset:
+//
+//	POST /auth/password-reset              {"email"} -> 202, whether or not the address has an account
+//	POST /auth/password-reset/questions    {"email"} -> {"questions": [{"id", "question"}]}
+//	POST /auth/password-reset/answers      {"email", "answers": {"<id>": "answer"}} -> {"reset_token"}
+//	POST /auth/password-reset/confirm      {"token", "password"} -> 204
+//	POST /auth/security-questions          {"password", "questions": [{"question", "answer"}]} -> 204, authenticated
+//
+// The endpoints of a method answer 404 while it is missing from account_recovery.methods.
+type recoveryRouteHandler struct {
+	name    string
+	path    string
+	handler []any
+}
+
+func (h *recoveryRouteHandler) Name() string     { return h.name }
+func (h *recoveryRouteHandler) Method() []string { return []string{http.MethodPost} }
+func (h *recoveryRouteHandler) Path() string     { return h.path }
+func (h *recoveryRouteHandler) Handlers() []any  { return h.handler }
+
+func newPasswordResetRequestRoute(ap *AuthProvider) *recoveryRouteHandler {
+	return &recoveryRouteHandler{
+		name: "password_reset_request",
+		path: "/auth/password-reset",
+		handler: []any{ap.requireRecovery(RecoveryMethodEmail), func(c *gin.Context) {
+			var body struct {
+				Email string `json:"email"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Email == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			if err := ap.RequestPasswordReset(c.Request.Context(), body.Email, c.ClientIP()); err != nil {
+				writeRecoveryError(c, err)
+				return
+			}
+			c.Status(http.StatusAccepted)
+		}},
+	}
+}
+
+func newSecurityQuestionsRoute(ap *AuthProvider) *recoveryRouteHandler {
+	return &recoveryRouteHandler{
+		name: "password_reset_questions",
+		path: "/auth/password-reset/questions",
+		handler: []any{ap.requireRecovery(RecoveryMethodSecurityQuestions), func(c *gin.Context) {
+			var body struct {
+				Email string `json:"email"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Email == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			questions, err := ap.components.recovery.SecurityQuestions(c.Request.Context(), body.Email, c.ClientIP())
+			if err != nil {
+				writeRecoveryError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"questions": questions})
+		}},
+	}
+}
+
+func newSecurityAnswersRoute(ap *AuthProvider) *recoveryRouteHandler {
+	return &recoveryRouteHandler{
+		name: "password_reset_answers",
+		path: "/auth/password-reset/answers",
+		handler: []any{ap.requireRecovery(RecoveryMethodSecurityQuestions), func(c *gin.Context) {
+			var body struct {
+				Email   string            `json:"email"`
+				Answers map[uint64]string `json:"answers"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Email == "" || len(body.Answers) == 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			token, err := ap.components.recovery.AnswerSecurityQuestions(c.Request.Context(), body.Email, body.Answers, c.ClientIP())
+			if err != nil {
+				writeRecoveryError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"reset_token": token, "expires_in": int64(ap.components.recovery.config.TokenExpiration.Seconds())})
+		}},
+	}
+}
+
+func newPasswordResetRoute(ap *AuthProvider) *recoveryRouteHandler {
+	return &recoveryRouteHandler{
+		name: "password_reset_confirm",
+		path: "/auth/password-reset/confirm",
+		handler: []any{ap.requireRecovery(), func(c *gin.Context) {
+			var body struct {
+				Token    string `json:"token"`
+				Password string `json:"password"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Token == "" || body.Password == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			_, err := ap.ResetPassword(c.Request.Context(), PasswordReset{Token: body.Token, NewPassword: body.Password, IP: c.ClientIP()})
+			if err != nil {
+				writeRecoveryError(c, err)
+				return
+			}
+			c.Status(http.StatusNoContent)
+		}},
+	}
+}
+
+func newSetSecurityQuestionsRoute(ap *AuthProvider) *recoveryRouteHandler {
+	return &recoveryRouteHandler{
+		name: "security_questions_set",
+		path: "/auth/security-questions",
+		handler: []any{ap.requireRecovery(RecoveryMethodSecurityQuestions), ap.Middleware(), func(c *gin.Context) {
+			var body struct {
+				Password  string           `json:"password"`
+				Questions []SecurityAnswer `json:"questions"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || len(body.Questions) == 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			// a stolen session must not be enough to plant answers and take the account over
+			user := c.Value(userContextKey).(User)
+			if !user.CheckPassword(body.Password) {
+				writeRecoveryError(c, ErrInvalidPassword)
+				return
+			}
+			if err := ap.components.recovery.SetSecurityQuestions(c.Request.Context(), user.ID(), body.Questions); err != nil {
+				writeRecoveryError(c, err)
+				return
+			}
+			c.Status(http.StatusNoContent)
+		}},
+	}
+}
+
+// requireRecovery hides the endpoints while none of the methods is enabled, any method when none is given.
+func (ap *AuthProvider) requireRecovery(methods ...string) gin.HandlerFunc {
+	if len(methods) == 0 {
+		methods = []string{RecoveryMethodEmail, RecoveryMethodSecurityQuestions}
+	}
+	return func(c *gin.Context) {
+		if ap.components.recovery != nil {
+			for _, method := range methods {
+				if ap.components.recovery.Enabled(method) {
+					return
+				}
+			}
+		}
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// writeRecoveryError maps the errors of the password reset to JSON responses.
+func writeRecoveryError(c *gin.Context, err error) {
+	var policy *PasswordPolicyError
+	switch {
+	case errors.As(err, &policy):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "weak_password", "violations": policy.Violations})
+	case errors.Is(err, ErrInvalidToken):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_token", "message": err.Error()})
+	case errors.Is(err, ErrInvalidPassword):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_password"})
+	case errors.Is(err, ErrInvalidCredentials):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "message": err.Error()})
+	case errors.Is(err, ErrRecoveryUnavailable):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "recovery_unavailable"})
+	case errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrAccountLocked):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account_unavailable"})
+	case errors.Is(err, ErrRateLimited):
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate_limited"})
+	default:
+		Logger.Error("Password reset failed: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+	}
+}
@@ -0,0 +1,56 @@
+package zephyrix
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountRecoveryConfig(t *testing.T) {
+	config := AccountRecovery{}.normalize()
+	require.Equal(t, defaultPasswordResetTTL, config.TokenExpiration)
+	require.Equal(t, defaultRecoveryRatePool, config.RateLimitPool)
+	require.Equal(t, defaultSecurityQuestions, config.SecurityQuestions)
+	require.Equal(t, defaultRequiredCorrectAnswer, config.RequiredCorrect)
+
+	config = AccountRecovery{SecurityQuestions: 2, RequiredCorrect: 5}.normalize()
+	require.Equal(t, 2, config.RequiredCorrect, "more correct answers than questions can not be required")
+}
+
+func TestNormalizeSecurityAnswer(t *testing.T) {
+	require.Equal(t, "new york", normalizeSecurityAnswer("  New \t York "))
+	require.Equal(t, "", normalizeSecurityAnswer(" \n "))
+}
+
+func TestSetSecurityQuestionsValidation(t *testing.T) {
+	rm := &RecoveryManager{config: AccountRecovery{SecurityQuestions: 2}.normalize()}
+	ctx := context.Background()
+
+	err := rm.SetSecurityQuestions(ctx, 1, []SecurityAnswer{{"First pet?", "Rex"}})
+	require.ErrorIs(t, err, ErrInvalidCredentials, "too few questions")
+	err = rm.SetSecurityQuestions(ctx, 1, []SecurityAnswer{{"First pet?", "Rex"}, {"first pet? ", "Max"}})
+	require.ErrorIs(t, err, ErrInvalidCredentials, "the same question twice")
+	err = rm.SetSecurityQuestions(ctx, 1, []SecurityAnswer{{"First pet?", "Rex"}, {"Birth city?", "  "}})
+	require.ErrorIs(t, err, ErrInvalidCredentials, "blank answer")
+}
+
+func TestRequireRecovery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ap := newTestAuthProvider(t)
+	ap.components.recovery = &RecoveryManager{config: AccountRecovery{Methods: []string{RecoveryMethodEmail}}}
+
+	status := func(handler gin.HandlerFunc) int {
+		r := gin.New()
+		r.POST("/", handler, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		return w.Code
+	}
+	require.Equal(t, http.StatusNoContent, status(ap.requireRecovery(RecoveryMethodEmail)))
+	require.Equal(t, http.StatusNotFound, status(ap.requireRecovery(RecoveryMethodSecurityQuestions)))
+	require.Equal(t, http.StatusNoContent, status(ap.requireRecovery()), "any enabled method")
+}
@@ -0,0 +1,343 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+const (
+	// apiKeyPrefix starts every key, so leaked keys are easy to recognize and scan for.
+	apiKeyPrefix         = "zx_"
+	defaultAPIKeyHeader  = "X-API-Key"
+	apiKeyLastUsedPeriod = time.Minute // last usage is written at most once per period
+)
+
+// APIKey is the public description of an API key, the key itself is only known when it is created.
+type APIKey struct {
+	ID         uint64     `json:"id"`
+	Prefix     string     `json:"prefix"`
+	Name       string     `json:"name"`
+	UserID     uint64     `json:"user_id"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips,omitempty"`
+	Revoked    bool       `json:"revoked"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// NewAPIKey holds the attributes of an API key to create.
+type NewAPIKey struct {
+	UserID     uint64
+	Name       string
+	Scopes     []string
+	AllowedIPs []string
+	ExpiresIn  time.Duration // defaults to authentication.api_key.expiration, negative never expires
+}
+
+// APIKeyManager issues and verifies the API keys used as machine credentials.
+//
+// Keys look like `zx_<prefix>_<secret>`, the prefix identifies the key and only a SHA-256 hash
+// of the whole key is stored, which is enough for 256 bits of random secret.
+type APIKeyManager struct {
+	config      APIKeyConfig
+	enabled     bool
+	orm         beeorm.Engine
+	redisClient beeorm.RedisCache
+	audit       *AuditLogger
+}
+
+func NewAPIKeyManager(conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, audit *AuditLogger) *APIKeyManager {
+	config := conf.Authentication.APIKey
+	if config.Header == "" {
+		config.Header = defaultAPIKeyHeader
+	}
+	return &APIKeyManager{
+		config:      config,
+		enabled:     config.Enabled && conf.Authentication.FeatureToggles.APIKeyAuth,
+		orm:         orm,
+		redisClient: redisClient,
+		audit:       audit,
+	}
+}
+
+// Enabled reports whether requests may authenticate with API keys.
+func (m *APIKeyManager) Enabled() bool {
+	return m.enabled
+}
+
+// Header returns the name of the header carrying the API key.
+func (m *APIKeyManager) Header() string {
+	return m.config.Header
+}
+
+// Create issues a new key, the returned key is shown once and can not be recovered later.
+func (m *APIKeyManager) Create(ctx context.Context, input NewAPIKey) (*APIKey, string, error) {
+	if input.UserID == 0 {
+		return nil, "", errors.New("API keys must belong to a user")
+	}
+	for _, ip := range input.AllowedIPs {
+		if _, err := parseIPRange(ip); err != nil {
+			return nil, "", err
+		}
+	}
+
+	key, prefix, err := newAPIKeySecret()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+
+	scopes, _ := json.Marshal(input.Scopes)
+	allowedIPs, _ := json.Marshal(input.AllowedIPs)
+
+	expiresIn := input.ExpiresIn
+	if expiresIn == 0 {
+		expiresIn = m.config.Expiration
+	}
+
+	orm := m.orm.NewORM(ctx)
+	now := time.Now().UTC()
+	entity := beeorm.NewEntity[models.APIKeyEntity](orm)
+	entity.Prefix = prefix
+	entity.Hash = hashAPIKey(key)
+	entity.Name = input.Name
+	entity.UserID = input.UserID
+	entity.Scopes = string(scopes)
+	entity.AllowedIPs = string(allowedIPs)
+	entity.CreatedAt = now
+	if expiresIn > 0 {
+		expiresAt := now.Add(expiresIn)
+		entity.ExpiresAt = &expiresAt
+	}
+
+	if err := orm.Flush(); err != nil {
+		return nil, "", fmt.Errorf("failed to save API key: %w", err)
+	}
+
+	m.log(ctx, "api_key_created", entity.UserID, "prefix="+prefix)
+	return apiKeyFromEntity(entity), key, nil
+}
+
+// Verify returns the key matching the presented secret when it is valid and used from an allowed address.
+func (m *APIKeyManager) Verify(ctx context.Context, key, ip string) (*APIKey, error) {
+	prefix, ok := apiKeyPrefixOf(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed key", ErrInvalidAPIKey)
+	}
+
+	orm := m.orm.NewORM(ctx)
+	entity, found := beeorm.GetByUniqueIndex[models.APIKeyEntity](orm, "prefix", prefix)
+	if !found || subtle.ConstantTimeCompare([]byte(entity.Hash), []byte(hashAPIKey(key))) != 1 {
+		return nil, fmt.Errorf("%w: unknown key", ErrInvalidAPIKey)
+	}
+	if entity.Revoked {
+		return nil, fmt.Errorf("%w: revoked key", ErrInvalidAPIKey)
+	}
+	if entity.ExpiresAt != nil && time.Now().After(*entity.ExpiresAt) {
+		return nil, fmt.Errorf("%w: expired key", ErrInvalidAPIKey)
+	}
+
+	apiKey := apiKeyFromEntity(entity)
+	if !ipAllowed(apiKey.AllowedIPs, ip) {
+		m.log(ctx, "api_key_ip_rejected", entity.UserID, fmt.Sprintf("prefix=%s ip=%s", prefix, ip))
+		return nil, fmt.Errorf("%w: API key not allowed from %s", ErrForbidden, ip)
+	}
+
+	m.touch(orm, entity, ip)
+	return apiKey, nil
+}
+
+// touch records the last usage of a key, throttled so busy keys do not write on every request.
+func (m *APIKeyManager) touch(orm beeorm.ORM, entity *models.APIKeyEntity, ip string) {
+	if !m.redisClient.SetNX(orm, "zephyrix:apikey:used:"+strconv.FormatUint(entity.ID, 10), ip, apiKeyLastUsedPeriod) {
+		return
+	}
+
+	now := time.Now().UTC()
+	edited := beeorm.EditEntity(orm, entity)
+	edited.LastUsedAt = &now
+	edited.LastUsedIP = ip
+	if err := orm.FlushAsync(); err != nil {
+		Logger.Error("Failed to record API key usage: %s", err)
+	}
+}
+
+// Get returns a key by ID.
+func (m *APIKeyManager) Get(ctx context.Context, id uint64) (*APIKey, error) {
+	entity, found := beeorm.GetByID[models.APIKeyEntity](m.orm.NewORM(ctx), id)
+	if !found {
+		return nil, fmt.Errorf("API key %d not found", id)
+	}
+	return apiKeyFromEntity(entity), nil
+}
+
+// List returns the keys of a user, including the revoked and expired ones.
+func (m *APIKeyManager) List(ctx context.Context, userID uint64) ([]*APIKey, error) {
+	var keys []*APIKey
+	iterator := beeorm.Search[models.APIKeyEntity](m.orm.NewORM(ctx), beeorm.NewWhere("`UserID` = ?", userID), nil)
+	for iterator.Next() {
+		keys = append(keys, apiKeyFromEntity(iterator.Entity()))
+	}
+	return keys, nil
+}
+
+// Revoke disables a key immediately.
+func (m *APIKeyManager) Revoke(ctx context.Context, id uint64) error {
+	orm := m.orm.NewORM(ctx)
+	entity, found := beeorm.GetByID[models.APIKeyEntity](orm, id)
+	if !found {
+		return fmt.Errorf("API key %d not found", id)
+	}
+	edited := beeorm.EditEntity(orm, entity)
+	edited.Revoked = true
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+
+	m.log(ctx, "api_key_revoked", entity.UserID, "prefix="+entity.Prefix)
+	return nil
+}
+
+// Rotate issues a replacement with the same owner, scopes and allowed IPs.
+// The old key keeps working for the grace period, so clients can be updated without downtime.
+func (m *APIKeyManager) Rotate(ctx context.Context, id uint64, grace time.Duration) (*APIKey, string, error) {
+	orm := m.orm.NewORM(ctx)
+	entity, found := beeorm.GetByID[models.APIKeyEntity](orm, id)
+	if !found {
+		return nil, "", fmt.Errorf("API key %d not found", id)
+	}
+	if entity.Revoked {
+		return nil, "", fmt.Errorf("API key %d is revoked", id)
+	}
+
+	old := apiKeyFromEntity(entity)
+	input := NewAPIKey{UserID: old.UserID, Name: old.Name, Scopes: old.Scopes, AllowedIPs: old.AllowedIPs, ExpiresIn: -1}
+	if old.ExpiresAt != nil {
+		// the replacement lives as long as the original was granted to
+		input.ExpiresIn = old.ExpiresAt.Sub(old.CreatedAt)
+	}
+	replacement, key, err := m.Create(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	edited := beeorm.EditEntity(orm, entity)
+	edited.RotatedTo = replacement.ID
+	if grace <= 0 {
+		edited.Revoked = true
+	} else if expiresAt := time.Now().UTC().Add(grace); entity.ExpiresAt == nil || expiresAt.Before(*entity.ExpiresAt) {
+		edited.ExpiresAt = &expiresAt
+	}
+	if err := orm.Flush(); err != nil {
+		return nil, "", fmt.Errorf("failed to retire rotated API key: %w", err)
+	}
+
+	m.log(ctx, "api_key_rotated", entity.UserID, fmt.Sprintf("prefix=%s replacement=%s", entity.Prefix, replacement.Prefix))
+	return replacement, key, nil
+}
+
+func (m *APIKeyManager) log(ctx context.Context, action string, userID uint64, details string) {
+	if m.audit == nil {
+		return
+	}
+	if err := m.audit.Log(ctx, action, strconv.FormatUint(userID, 10), details); err != nil {
+		Logger.Error("Failed to write %s to the audit log: %s", action, err)
+	}
+}
+
+func apiKeyFromEntity(entity *models.APIKeyEntity) *APIKey {
+	key := &APIKey{
+		ID:         entity.ID,
+		Prefix:     entity.Prefix,
+		Name:       entity.Name,
+		UserID:     entity.UserID,
+		Revoked:    entity.Revoked,
+		ExpiresAt:  entity.ExpiresAt,
+		LastUsedAt: entity.LastUsedAt,
+		LastUsedIP: entity.LastUsedIP,
+		CreatedAt:  entity.CreatedAt,
+	}
+	_ = json.Unmarshal([]byte(entity.Scopes), &key.Scopes)
+	_ = json.Unmarshal([]byte(entity.AllowedIPs), &key.AllowedIPs)
+	return key
+}
+
+// newAPIKeySecret generates a key and its public prefix.
+func newAPIKeySecret() (key, prefix string, err error) {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	prefix = hex.EncodeToString(id)
+	return apiKeyPrefix + prefix + "_" + secret, prefix, nil
+}
+
+// apiKeyPrefixOf extracts the public prefix of a key.
+func apiKeyPrefixOf(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	return prefix, ok && prefix != "" && secret != ""
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseIPRange parses an IP or a CIDR of an allow-list.
+func parseIPRange(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", value)
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q: %w", value, err)
+	}
+	return network, nil
+}
+
+// ipAllowed reports whether ip matches the allow-list, an empty list allows any address.
+func ipAllowed(allowed []string, ip string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, value := range allowed {
+		if network, err := parseIPRange(value); err == nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package zephyrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+// apiKeyCommand builds the `apikey` command managing the API keys of the users.
+func (z *zephyrix) apiKeyCommand(cancel context.CancelFunc) *cobra.Command {
+	var (
+		scopes     []string
+		allowedIPs []string
+		expiresIn  time.Duration
+		grace      time.Duration
+	)
+
+	apiKeyCommand := &cobra.Command{
+		GroupID: authGroup.ID,
+		Use:     "apikey",
+		Short:   "Manage API keys",
+		Long:    "Create, list, rotate and revoke the API keys used as machine credentials",
+		PersistentPreRun: func(_ *cobra.Command, _ []string) {
+			z.options = append(z.options, fx.Invoke(beeormInvoke))
+		},
+		PersistentPostRun: func(_ *cobra.Command, _ []string) {
+			defer cancel()
+		},
+	}
+
+	createCommand := &cobra.Command{
+		Use:   "create <username> <name>",
+		Short: "Create an API key owned by a user",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				user, err := ap.Users().GetByUsername(ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to find user %s: %w", args[0], err)
+				}
+				apiKey, key, err := ap.APIKeys().Create(ctx, NewAPIKey{
+					UserID:     user.ID(),
+					Name:       args[1],
+					Scopes:     scopes,
+					AllowedIPs: allowedIPs,
+					ExpiresIn:  expiresIn,
+				})
+				if err != nil {
+					return err
+				}
+				Logger.Info("Created API key %d (%s), it will not be shown again:", apiKey.ID, apiKey.Prefix)
+				fmt.Println(key)
+				return nil
+			})
+		},
+	}
+	createCommand.Flags().StringSliceVarP(&scopes, "scopes", "s", nil, "permissions the key may use, e.g. orders.read,orders.*, and role:<name> for the roles of the owner it acts with")
+	createCommand.Flags().StringSliceVar(&allowedIPs, "allow-ip", nil, "IPs or CIDRs the key may be used from")
+	createCommand.Flags().DurationVarP(&expiresIn, "expires-in", "e", 0, "lifetime of the key, defaults to authentication.api_key.expiration")
+
+	listCommand := &cobra.Command{
+		Use:   "list <username>",
+		Short: "List the API keys of a user",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				user, err := ap.Users().GetByUsername(ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to find user %s: %w", args[0], err)
+				}
+				keys, err := ap.APIKeys().List(ctx, user.ID())
+				if err != nil {
+					return err
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(keys)
+			})
+		},
+	}
+
+	rotateCommand := &cobra.Command{
+		Use:   "rotate <id>",
+		Short: "Replace an API key, the old key keeps working during the grace period",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			id, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid API key id %q", args[0])
+			}
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				apiKey, key, err := ap.APIKeys().Rotate(ctx, id, grace)
+				if err != nil {
+					return err
+				}
+				Logger.Info("Rotated API key %d to %d (%s), it will not be shown again:", id, apiKey.ID, apiKey.Prefix)
+				fmt.Println(key)
+				return nil
+			})
+		},
+	}
+	rotateCommand.Flags().DurationVarP(&grace, "grace", "g", 24*time.Hour, "how long the old key keeps working, 0 revokes it immediately")
+
+	revokeCommand := &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an API key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			id, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid API key id %q", args[0])
+			}
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				if err := ap.APIKeys().Revoke(ctx, id); err != nil {
+					return err
+				}
+				Logger.Info("Revoked API key %d", id)
+				return nil
+			})
+		},
+	}
+
+	apiKeyCommand.AddCommand(createCommand, listCommand, rotateCommand, revokeCommand)
+	return apiKeyCommand
+}
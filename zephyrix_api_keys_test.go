@@ -0,0 +1,47 @@
+package zephyrix
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyFormat(t *testing.T) {
+	key, prefix, err := newAPIKeySecret()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(key, apiKeyPrefix+prefix+"_"))
+
+	parsed, ok := apiKeyPrefixOf(key)
+	require.True(t, ok)
+	require.Equal(t, prefix, parsed)
+	require.Len(t, hashAPIKey(key), 64)
+
+	for _, malformed := range []string{"", "zx_", "zx_abc", "zx__secret", "sk_abc_secret"} {
+		_, ok := apiKeyPrefixOf(malformed)
+		require.False(t, ok, malformed)
+	}
+}
+
+func TestAPIKeyIPAllowList(t *testing.T) {
+	require.True(t, ipAllowed(nil, "203.0.113.7"))
+
+	allowed := []string{"10.0.0.0/8", "203.0.113.7", "2001:db8::/32"}
+	require.True(t, ipAllowed(allowed, "10.1.2.3"))
+	require.True(t, ipAllowed(allowed, "203.0.113.7"))
+	require.True(t, ipAllowed(allowed, "2001:db8::1"))
+	require.False(t, ipAllowed(allowed, "203.0.113.8"))
+	require.False(t, ipAllowed(allowed, "not an ip"))
+
+	_, err := parseIPRange("10.0.0.0/33")
+	require.Error(t, err)
+}
+
+func TestIdentityScopes(t *testing.T) {
+	key := &Identity{Method: IdentityMethodAPIKey, Scopes: []string{"orders.*"}}
+	require.True(t, key.HasScope("orders.write"))
+	require.False(t, key.HasScope("users.read"))
+
+	jwt := &Identity{Method: IdentityMethodJWT}
+	require.True(t, jwt.HasScope("users.read"), "scopes only restrict API keys")
+}
@@ -26,8 +26,14 @@ type zephyrix struct {
 	c  context.Context
 	db *beeormEngine
 
-	r  *zephyrixRouter
-	mw *ZephyrixMiddlewares
+	r     *zephyrixRouter
+	mw    *ZephyrixMiddlewares
+	auth  *AuthProvider
+	cache *ResponseCache
+	audit *AuditLogger
+	rl    *RateLimiter
+
+	userStore any // constructor of the UserStore, see RegisterUserStore
 
 	crond *cron.Cron
 }
@@ -42,8 +48,23 @@ var dbGroup = &cobra.Group{
 	Title: "Database Commands",
 }
 
+var authGroup = &cobra.Group{
+	ID:    "auth",
+	Title: "Authentication Commands",
+}
+
 func (z *zephyrix) preInit() {
-	z.fx = fx.New(z.options...)
+	userStore := fx.Provide(fx.Annotate(NewBeeORMUserStore, fx.As(new(UserStore))))
+	if z.userStore != nil {
+		userStore = fx.Provide(z.userStore)
+	}
+	z.fx = fx.New(append(z.options, userStore)...)
+}
+
+// RegisterUserStore replaces the default BeeORM user store,
+// the constructor must return a UserStore and can depend on anything provided by the application.
+func (z *zephyrix) RegisterUserStore(constructor any) {
+	z.userStore = constructor
 }
 
 func NewApplication() Zephyrix {
@@ -62,7 +83,7 @@ func NewApplication() Zephyrix {
 	}
 
 	cobraInstance.PersistentFlags().StringVarP(&configFilePath, "config", "c", "zephyrix.yaml", "config file path")
-	cobraInstance.AddGroup(serverGroup, dbGroup)
+	cobraInstance.AddGroup(serverGroup, dbGroup, authGroup)
 
 	z := &zephyrix{
 		cobraInstance: cobraInstance,
@@ -100,6 +121,16 @@ func NewApplication() Zephyrix {
 	z.db = beeormProvider()
 	z.db.RegisterEntity(&models.AuditLogEntity{})
 	z.db.RegisterEntity(&models.SessionEntity{})
+	z.db.RegisterEntity(&models.UserEntity{})
+	z.db.RegisterEntity(&models.RefreshTokenEntity{})
+	z.db.RegisterEntity(&models.RoleEntity{}, &models.PermissionEntity{}, &models.RolePermissionEntity{})
+	z.db.RegisterEntity(&models.APIKeyEntity{})
+	z.db.RegisterEntity(&models.WebAuthnCredentialEntity{})
+	z.db.RegisterEntity(&models.OAuth2AccountEntity{}, &models.OAuth2ProviderEntity{})
+	z.db.RegisterEntity(&models.OAuth2ClientEntity{}, &models.OAuth2ConsentEntity{})
+	z.db.RegisterEntity(&models.PasswordHistoryEntity{})
+	z.db.RegisterEntity(&models.InvitationEntity{})
+	z.db.RegisterEntity(&models.SecurityQuestionEntity{})
 
 	z.options = append(z.options, fx.Provide(func() *beeormEngine {
 		return z.db
@@ -115,9 +146,21 @@ func NewApplication() Zephyrix {
 		}
 		return l
 	}))
+	z.options = append(z.options, fx.Invoke(func(l *AuditLogger) {
+		z.audit = l
+	}))
+
+	z.options = append(z.options, fx.Provide(NewResponseCache))
+	z.options = append(z.options, fx.Invoke(func(rc *ResponseCache) {
+		z.cache = rc
+	}))
+	z.RegisterMiddleware(newResponseCacheMiddleware)
 
 	z.options = append(z.options, fx.Provide(NewRateLimiter))
 	z.options = append(z.options, fx.Invoke(invokeRateLimiter))
+	z.options = append(z.options, fx.Invoke(func(rl *RateLimiter) {
+		z.rl = rl
+	}))
 
 	z.crond = cron.New(cron.WithSeconds())
 	z.options = append(z.options, fx.Invoke(z.scheduleInvoke))
@@ -184,5 +227,14 @@ func NewApplication() Zephyrix {
 	dbCommand.AddCommand(mysqlShellCommand)
 	dbCommand.AddCommand(redisShellCommand)
 	z.cobraInstance.AddCommand(dbCommand)
+
+	// AUTH COMMANDS
+
+	z.cobraInstance.AddCommand(z.rbacCommand(cancel))
+	z.cobraInstance.AddCommand(z.apiKeyCommand(cancel))
+	z.cobraInstance.AddCommand(z.oauth2Command(cancel))
+	z.cobraInstance.AddCommand(z.oauth2ClientCommand(cancel))
+	z.cobraInstance.AddCommand(z.lockoutCommand(cancel))
+	z.cobraInstance.AddCommand(z.invitationCommand(cancel))
 	return z
 }
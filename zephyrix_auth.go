@@ -2,126 +2,163 @@ package zephyrix
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/latolukasz/beeorm/v3"
 	"go.uber.org/fx"
-	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/oauth2"
 )
 
 type AuthProvider struct {
 	config      *AuthConfig
 	orm         beeorm.Engine
 	redisClient beeorm.RedisCache
-	jwtSecret   []byte
+	keyRing     *KeyRing
 	components  struct {
-		passwordHasher int
-		passwordSalt   string
+		passwordHasher *PasswordHasher
+		userStore      UserStore
 		auditLogger    *AuditLogger
 		rateLimiter    *RateLimiter
 		mfaManager     *MFAManager
 		oauth2Manager  *OAuth2Manager
 		sessionManager *SessionManager
+		refreshTokens  RefreshTokenStore
+		apiKeys        *APIKeyManager
+		webauthn       *WebAuthnManager
+		magicLinks     *MagicLinkManager
+		authServer     *AuthorizationServer
+		lockout        *LockoutManager
+		passwords      *PasswordValidator
+		registration   *RegistrationManager
+		recovery       *RecoveryManager
+		authorizer     *Authorizer // resolves inherited roles for "auth:<role>" and proxy roles
 	}
 	providerCache sync.Map
+	pubsub        *redis.Client
+	stop          context.CancelFunc
 }
 
-func NewAuthProvider(lc fx.Lifecycle, conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, a *AuditLogger, rl *RateLimiter) (*AuthProvider, error) {
+func NewAuthProvider(lc fx.Lifecycle, conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, a *AuditLogger, rl *RateLimiter, sm *SessionManager, users UserStore) (*AuthProvider, error) {
 	ap := &AuthProvider{
 		config:      &conf.Authentication,
 		orm:         orm,
 		redisClient: redisClient,
-		jwtSecret:   []byte(conf.Authentication.JWT.Secret),
 	}
 
-	ap.components.passwordHasher = bcrypt.DefaultCost
-	ap.components.passwordSalt = conf.Authentication.PasswordHashingSalt
+	keyRing, err := newKeyRing(conf.Authentication.JWT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWT keys: %w", err)
+	}
+	ap.keyRing = keyRing
+
+	ap.components.passwordHasher = NewPasswordHasher(conf.Authentication.PasswordHashingCost, conf.Authentication.PasswordHashingSalt)
+	ap.components.userStore = users
 	ap.components.auditLogger = a
 	ap.components.rateLimiter = rl
+	ap.components.sessionManager = sm
+	ap.components.apiKeys = NewAPIKeyManager(conf, orm, redisClient, a)
+	ap.components.webauthn = NewWebAuthnManager(conf, orm, redisClient, users, a)
 
-	lc.Append(fx.Hook{
-		OnStart: ap.initialize,
-		OnStop:  ap.cleanup,
-	})
+	ap.components.oauth2Manager, err = NewOAuth2Manager(conf.Authentication.OAuth2, orm, redisClient)
+	if err != nil {
+		return nil, err
+	}
+	// providers stored in the database are reloaded on every instance through redis pub/sub
+	if conf.Authentication.OAuth2.ProvidersSource == "database" && len(conf.Database.Pools) > 0 && conf.Database.Pools[0].Redis.Enabled {
+		ap.pubsub = newRedisClient(conf.Database.Pools[0].Redis)
+		ap.components.oauth2Manager.pubsub = ap.pubsub
+	}
 
-	return ap, nil
-}
+	ap.components.refreshTokens, err = newRefreshTokenStore(conf, orm, redisClient)
+	if err != nil {
+		return nil, err
+	}
 
-func (ap *AuthProvider) initialize(ctx context.Context) error {
-	if ap.config.OAuth2.ProvidersSource == "database" {
-		if err := ap.components.oauth2Manager.SyncProviders(ctx); err != nil {
-			return fmt.Errorf("failed to sync OAuth2 providers: %w", err)
-		}
+	ap.components.passwords, err = NewPasswordValidator(conf, orm, ap.components.passwordHasher)
+	if err != nil {
+		return nil, err
 	}
 
-	return ap.warmCaches(ctx)
-}
+	ap.components.registration, err = NewRegistrationManager(conf, orm, redisClient, rl, a)
+	if err != nil {
+		return nil, err
+	}
 
-func (ap *AuthProvider) cleanup(ctx context.Context) error {
-	return ap.cleanupTemporaryData(ctx)
-}
+	ap.components.lockout, err = NewLockoutManager(conf, orm, redisClient, users, a)
+	if err != nil {
+		return nil, err
+	}
 
-func (ap *AuthProvider) VerifyMFA(ctx context.Context, username, method, token string) (string, error) {
-	user, err := ap.getUserByUsername(ctx, username)
+	ap.components.mfaManager, err = NewMFAManager(conf.Authentication.MFA, redisClient, orm, users, rl, a)
 	if err != nil {
-		ap.components.auditLogger.logFailedLogin(ctx, username, "user_not_found")
-		return "", ErrUserNotFound
+		return nil, err
 	}
+	ap.components.mfaManager.webauthn = ap.components.webauthn
 
-	valid, err := ap.components.mfaManager.VerifyMFA(ctx, user, MFAMethod(method), token)
+	ap.components.magicLinks, err = NewMagicLinkManager(conf, orm, redisClient, users, rl, a)
 	if err != nil {
-		return "", fmt.Errorf("MFA verification failed: %w", err)
+		return nil, err
 	}
+	ap.components.magicLinks.lockout = ap.components.lockout
 
-	if !valid {
-		ap.components.auditLogger.logFailedMFA(ctx, username, method)
-		return "", ErrInvalidMFAToken
+	ap.components.recovery, err = NewRecoveryManager(conf, orm, redisClient, users, ap.components.passwordHasher, rl, a)
+	if err != nil {
+		return nil, err
 	}
+	ap.components.recovery.lockout = ap.components.lockout
 
-	jwtToken, err := ap.generateJWT(user)
+	ap.components.authServer, err = NewAuthorizationServer(conf, orm, redisClient, a)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate JWT after MFA: %w", err)
+		return nil, err
+	}
+	// clients verify the ID tokens with the published keys, they can not know the HMAC secret
+	if ap.components.authServer.Enabled() && keyRing.isHMAC() {
+		return nil, errors.New("authorization_server requires an asymmetric jwt.signing_method")
 	}
 
-	ap.components.auditLogger.logSuccessfulMFA(ctx, username, method)
-	return jwtToken, nil
-}
+	lc.Append(fx.Hook{
+		OnStart: ap.initialize,
+		OnStop:  ap.cleanup,
+	})
 
-func (ap *AuthProvider) InitializeOAuth2(ctx context.Context) error {
-	return ap.components.oauth2Manager.Initialize(ctx)
+	return ap, nil
 }
 
-func (ap *AuthProvider) GetOAuth2AuthURL(providerName, state string) (string, error) {
-	return ap.components.oauth2Manager.GetAuthURL(providerName, state)
-}
+func (ap *AuthProvider) initialize(ctx context.Context) error {
+	background, cancel := context.WithCancel(context.Background())
+	ap.stop = cancel
+	ap.startRefreshTokenCleanup(background)
+	ap.keyRing.startRotation(background.Done())
 
-func (ap *AuthProvider) HandleOAuth2Callback(ctx context.Context, providerName, code string) (User, error) {
-	token, err := ap.components.oauth2Manager.Exchange(ctx, providerName, code)
-	if err != nil {
-		return nil, fmt.Errorf("OAuth2 code exchange failed: %w", err)
+	if err := ap.components.oauth2Manager.Initialize(ctx); err != nil {
+		return fmt.Errorf("failed to load OAuth2 providers: %w", err)
 	}
+	ap.components.oauth2Manager.startProviderSync(background)
 
-	userInfo, err := ap.components.oauth2Manager.GetUserInfo(ctx, providerName, token)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get OAuth2 user info: %w", err)
-	}
+	return ap.warmCaches(ctx)
+}
 
-	user, err := ap.findOrCreateOAuth2User(ctx, providerName, userInfo)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find or create OAuth2 user: %w", err)
+func (ap *AuthProvider) cleanup(ctx context.Context) error {
+	if ap.stop != nil {
+		ap.stop()
 	}
-
-	if err := ap.storeOAuth2Token(ctx, user, providerName, token); err != nil {
-		return nil, fmt.Errorf("failed to store OAuth2 token: %w", err)
+	if ap.pubsub != nil {
+		ap.pubsub.Close()
 	}
-
-	return user, nil
+	ap.components.passwords.Close()
+	return ap.cleanupTemporaryData(ctx)
 }
 
+// accessTokenType is the typ claim of the access tokens, the only tokens accepted as credentials.
+// Every other token signed by the key ring (MFA challenges, ID tokens, ...) carries a type of its own.
+const accessTokenType = "access"
+
 func (ap *AuthProvider) generateJWT(user User, opts ...jwt.MapClaims) (string, error) {
 	now := time.Now()
 	claims := jwt.MapClaims{
@@ -130,6 +167,10 @@ func (ap *AuthProvider) generateJWT(user User, opts ...jwt.MapClaims) (string, e
 		"iat": now.Unix(),
 		"iss": ap.config.JWT.Issuer,
 		"aud": ap.config.JWT.Audience,
+		"typ": accessTokenType,
+	}
+	if roles := user.Roles(); len(roles) > 0 {
+		claims["roles"] = roles
 	}
 
 	for _, opt := range opts {
@@ -138,35 +179,91 @@ func (ap *AuthProvider) generateJWT(user User, opts ...jwt.MapClaims) (string, e
 		}
 	}
 
-	token := jwt.NewWithClaims(ap.getSigningMethod(), claims)
-	return token.SignedString(ap.jwtSecret)
+	return ap.signClaims(claims)
+}
+
+// internalTokenType is the typ claim of the tokens minted for upstream services, they are refused as access tokens.
+const internalTokenType = "internal"
+
+// GenerateInternalToken mints a short-lived JWT describing an already authenticated identity.
+// It is meant for upstream services sitting behind Zephyrix, which trust the token instead of
+// re-authenticating the user themselves. The audience names the upstream and must differ from
+// the audience of the access tokens, so a token leaked by one upstream is worthless elsewhere.
+func (ap *AuthProvider) GenerateInternalToken(identity *Identity, audience string, ttl time.Duration) (string, error) {
+	if audience == "" || audience == ap.config.JWT.Audience {
+		return "", errors.New("internal tokens need an audience distinct from the access tokens")
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub": strconv.FormatUint(identity.UserID, 10),
+		"exp": now.Add(ttl).Unix(),
+		"iat": now.Unix(),
+		"iss": ap.config.JWT.Issuer,
+		"aud": audience,
+		"typ": internalTokenType,
+		"amr": []string{identity.Method},
+	}
+	if len(identity.Roles) > 0 {
+		claims["roles"] = identity.Roles
+	}
+	if identity.SessionID != "" {
+		claims["sid"] = identity.SessionID
+	}
+
+	return ap.signClaims(claims)
+}
+
+func (ap *AuthProvider) signClaims(claims jwt.MapClaims) (string, error) {
+	return ap.keyRing.Sign(claims)
 }
 
 func (ap *AuthProvider) VerifyToken(tokenString string) (*jwt.Token, error) {
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return ap.jwtSecret, nil
-	})
+	return jwt.Parse(tokenString, ap.keyRing.Keyfunc)
 }
 
-func (ap *AuthProvider) getSigningMethod() jwt.SigningMethod {
-	switch ap.config.JWT.SigningMethod {
-	case "HS384":
-		return jwt.SigningMethodHS384
-	case "HS512":
-		return jwt.SigningMethodHS512
-	default:
-		return jwt.SigningMethodHS256
-	}
+// KeyRing returns the keys signing the JWTs issued by the provider.
+func (ap *AuthProvider) KeyRing() *KeyRing {
+	return ap.keyRing
 }
 
-func (ap *AuthProvider) getUserByUsername(ctx context.Context, username string) (User, error) {
-	// Implementation depends on your User model and ORM usage
-	fmt.Println("getUserByUsername not implemented")
+// MFA returns the manager of the multi-factor authentication methods, e.g. to enroll TOTP.
+func (ap *AuthProvider) MFA() *MFAManager {
+	return ap.components.mfaManager
+}
+
+// APIKeys returns the manager of the API keys.
+func (ap *AuthProvider) APIKeys() *APIKeyManager {
+	return ap.components.apiKeys
+}
+
+// WebAuthn returns the manager of the WebAuthn credentials (passkeys).
+func (ap *AuthProvider) WebAuthn() *WebAuthnManager {
+	return ap.components.webauthn
+}
 
-	return nil, nil
+// MagicLinks returns the manager of the magic links, e.g. to plug a mail sender.
+func (ap *AuthProvider) MagicLinks() *MagicLinkManager {
+	return ap.components.magicLinks
+}
+
+// Lockout returns the manager of the account lockouts, e.g. to unlock an account or register a LockoutHook.
+func (ap *AuthProvider) Lockout() *LockoutManager {
+	return ap.components.lockout
+}
+
+// Users returns the user store of the provider.
+func (ap *AuthProvider) Users() UserStore {
+	return ap.components.userStore
+}
+
+// getUserByUsername looks a user up by username, or by email when the login looks like an address.
+func (ap *AuthProvider) getUserByUsername(ctx context.Context, username string) (User, error) {
+	user, err := ap.components.userStore.GetByUsername(ctx, username)
+	if errors.Is(err, ErrUserNotFound) && strings.Contains(username, "@") {
+		return ap.components.userStore.GetByEmail(ctx, username)
+	}
+	return user, err
 }
 
 func (ap *AuthProvider) warmCaches(ctx context.Context) error {
@@ -183,25 +280,48 @@ func (ap *AuthProvider) cleanupTemporaryData(ctx context.Context) error {
 	return nil
 }
 
-func (ap *AuthProvider) findOrCreateOAuth2User(ctx context.Context, providerName string, userInfo map[string]interface{}) (User, error) {
-	// Implementation for finding or creating a user based on OAuth2 user info
-	fmt.Println("findOrCreateOAuth2User not implemented")
-
-	return nil, nil
-}
-
-func (ap *AuthProvider) storeOAuth2Token(ctx context.Context, user User, providerName string, token *oauth2.Token) error {
-	// Implementation for storing the OAuth2 token for the user
-	fmt.Println("storeOAuth2Token not implemented")
-
-	return nil
-}
-
 // AuthProviderModule provides an fx.Option to register the AuthProvider with the application
 func AuthProviderModule() fx.Option {
 	return fx.Module(
 		"auth_provider",
+		fx.Provide(NewSessionManager),
 		fx.Provide(NewAuthProvider),
-		fx.Invoke(func(*AuthProvider) {}),
+		fx.Provide(asRoute(newJWKSRouteHandler)),
+		fx.Provide(asRoute(newWebAuthnRegisterBeginRoute)),
+		fx.Provide(asRoute(newWebAuthnRegisterFinishRoute)),
+		fx.Provide(asRoute(newWebAuthnLoginBeginRoute)),
+		fx.Provide(asRoute(newWebAuthnLoginFinishRoute)),
+		fx.Provide(asRoute(newMagicLinkRequestRoute)),
+		fx.Provide(asRoute(newMagicLinkVerifyRoute)),
+		fx.Provide(asRoute(newOAuth2LoginRoute)),
+		fx.Provide(asRoute(newOAuth2LinkRoute)),
+		fx.Provide(asRoute(newOAuth2CallbackRoute)),
+		fx.Provide(asRoute(newOpenIDConfigurationRoute)),
+		fx.Provide(asRoute(newAuthorizeRoute)),
+		fx.Provide(asRoute(newConsentRoute)),
+		fx.Provide(asRoute(newConsentAnswerRoute)),
+		fx.Provide(asRoute(newTokenRoute)),
+		fx.Provide(asRoute(newIntrospectRoute)),
+		fx.Provide(asRoute(newRevokeRoute)),
+		fx.Provide(asRoute(newUserInfoRoute)),
+		fx.Provide(asRoute(newRegisterRoute)),
+		fx.Provide(asRoute(newVerifyEmailRoute)),
+		fx.Provide(asRoute(newResendEmailVerificationRoute)),
+		fx.Provide(asRoute(newPasswordResetRequestRoute)),
+		fx.Provide(asRoute(newPasswordResetRoute)),
+		fx.Provide(asRoute(newSecurityQuestionsRoute)),
+		fx.Provide(asRoute(newSecurityAnswersRoute)),
+		fx.Provide(asRoute(newSetSecurityQuestionsRoute)),
+		fx.Provide(asRoute(newSessionInfoRoute)),
+		fx.Provide(asRoute(newSessionLoginRoute)),
+		fx.Provide(asRoute(newSessionLogoutRoute)),
+		fx.Provide(asMiddleware(newAuthMiddleware)),
+		fx.Provide(asMiddleware(newSessionMiddleware)),
+		fx.Provide(NewAuthorizer),
+		fx.Provide(asMiddleware(newPermissionMiddleware)),
+		fx.Invoke(func(z *zephyrix, ap *AuthProvider, authorizer *Authorizer) {
+			z.auth = ap
+			ap.components.authorizer = authorizer
+		}),
 	)
 }
@@ -5,45 +5,53 @@ import (
 )
 
 type AuthConfig struct {
-	RedisPool           string             `mapstructure:"redis_pool"`
-	GrantTypes          []string           `mapstructure:"grant_types"`
-	APIKey              APIKeyConfig       `mapstructure:"api_key"`
-	JWT                 JWTConfig          `mapstructure:"jwt"`
-	Session             SessionConfig      `mapstructure:"session"`
-	OAuth2              OAuth2Config       `mapstructure:"oauth2"`
-	MFA                 MFAConfig          `mapstructure:"multi_factor_authentication"`
-	PasswordPolicy      PasswordPolicy     `mapstructure:"password_policy"`
-	AccountLockout      AccountLockout     `mapstructure:"account_lockout"`
-	RateLimiting        RateLimitingConfig `mapstructure:"rate_limiting"`
-	SecurityHeaders     SecurityHeaders    `mapstructure:"security_headers"`
-	UserRegistration    UserRegistration   `mapstructure:"user_registration"`
-	AccountRecovery     AccountRecovery    `mapstructure:"account_recovery"`
-	SessionManagement   SessionManagement  `mapstructure:"session_management"`
-	ConsentManagement   ConsentManagement  `mapstructure:"consent_management"`
-	Passwordless        Passwordless       `mapstructure:"passwordless"`
-	Geofencing          Geofencing         `mapstructure:"geofencing"`
-	Webhooks            WebhooksConfig     `mapstructure:"webhooks"`
-	FeatureToggles      FeatureToggles     `mapstructure:"feature_toggles"`
-	PasswordHashingCost int                `mapstructure:"hashing_cost"`
-	PasswordHashingSalt string             `mapstructure:"hashing_salt"`
-	Audit               bool               `mapstructure:"audit"`
+	RedisPool           string                    `mapstructure:"redis_pool"`
+	GrantTypes          []string                  `mapstructure:"grant_types"`
+	APIKey              APIKeyConfig              `mapstructure:"api_key"`
+	JWT                 JWTConfig                 `mapstructure:"jwt"`
+	Session             SessionConfig             `mapstructure:"session"`
+	Authorization       AuthorizationConfig       `mapstructure:"authorization"`
+	OAuth2              OAuth2Config              `mapstructure:"oauth2"`
+	MFA                 MFAConfig                 `mapstructure:"multi_factor_authentication"`
+	PasswordPolicy      PasswordPolicy            `mapstructure:"password_policy"`
+	AccountLockout      AccountLockout            `mapstructure:"account_lockout"`
+	RateLimiting        RateLimitingConfig        `mapstructure:"rate_limiting"`
+	SecurityHeaders     SecurityHeaders           `mapstructure:"security_headers"`
+	UserRegistration    UserRegistration          `mapstructure:"user_registration"`
+	AccountRecovery     AccountRecovery           `mapstructure:"account_recovery"`
+	SessionManagement   SessionManagement         `mapstructure:"session_management"`
+	ConsentManagement   ConsentManagement         `mapstructure:"consent_management"`
+	AuthorizationServer AuthorizationServerConfig `mapstructure:"authorization_server"`
+	Passwordless        Passwordless              `mapstructure:"passwordless"`
+	Geofencing          Geofencing                `mapstructure:"geofencing"`
+	Webhooks            WebhooksConfig            `mapstructure:"webhooks"`
+	FeatureToggles      FeatureToggles            `mapstructure:"feature_toggles"`
+	PasswordHashingCost int                       `mapstructure:"hashing_cost"`
+	PasswordHashingSalt string                    `mapstructure:"hashing_salt"`
+	Audit               bool                      `mapstructure:"audit"`
 }
 
 type APIKeyConfig struct {
 	Enabled    bool          `mapstructure:"enabled"`
-	Expiration time.Duration `mapstructure:"expiration"`
+	Expiration time.Duration `mapstructure:"expiration"` // default lifetime of new keys, 0 never expires
+	Header     string        `mapstructure:"header"`     // defaults to X-API-Key, keys are also accepted as bearer tokens
 }
 
 type JWTConfig struct {
-	Secret            string        `mapstructure:"secret"`
-	Issuer            string        `mapstructure:"issuer"`
-	Audience          string        `mapstructure:"audience"`
-	Expiration        time.Duration `mapstructure:"expiration"`
-	RefreshExpiration time.Duration `mapstructure:"refresh_expiration"`
-	SigningMethod     string        `mapstructure:"signing_method"`
+	Secret            string         `mapstructure:"secret"`
+	Issuer            string         `mapstructure:"issuer"`
+	Audience          string         `mapstructure:"audience"`
+	Expiration        time.Duration  `mapstructure:"expiration"`
+	RefreshExpiration time.Duration  `mapstructure:"refresh_expiration"`
+	RefreshStorage    string         `mapstructure:"refresh_storage"` // "redis" or "mysql"
+	RefreshPool       string         `mapstructure:"refresh_pool"`
+	SigningMethod     string         `mapstructure:"signing_method"` // HS256/384/512, RS256/384/512, PS256/384/512, ES256/384/512 or EdDSA
+	Keys              []JWTKeyConfig `mapstructure:"keys"`
+	KeyDirectory      string         `mapstructure:"key_directory"`     // generated keys are shared between instances through this directory
+	RotationInterval  time.Duration  `mapstructure:"rotation_interval"` // 0 disables automatic rotation
+	KeyRetention      time.Duration  `mapstructure:"key_retention"`     // age at which a generated key leaves the ring
 }
 
-
 type OAuth2Provider struct {
 	ClientID     string `mapstructure:"client_id"`
 	ClientSecret string `mapstructure:"client_secret"`
@@ -56,14 +64,19 @@ type PasswordPolicy struct {
 	RequireLowercase    bool          `mapstructure:"require_lowercase"`
 	RequireNumbers      bool          `mapstructure:"require_numbers"`
 	RequireSpecialChars bool          `mapstructure:"require_special_chars"`
-	MaxAge              time.Duration `mapstructure:"max_age"`
-	HistoryCount        int           `mapstructure:"history_count"`
+	MaxAge              time.Duration `mapstructure:"max_age"`            // passwords older than this must be changed at the next login, 0 never expire
+	HistoryCount        int           `mapstructure:"history_count"`      // previous passwords that can not be used again
+	BreachedPasswords   string        `mapstructure:"breached_passwords"` // sorted SHA-1 hash list of breached passwords, lines HASH:COUNT
 }
 
 type AccountLockout struct {
-	MaxAttempts     int           `mapstructure:"max_attempts"`
-	LockoutDuration time.Duration `mapstructure:"lockout_duration"`
-	ResetAfter      time.Duration `mapstructure:"reset_after"`
+	MaxAttempts      int           `mapstructure:"max_attempts"`      // failed logins before the account is locked, 0 disables locking
+	LockoutDuration  time.Duration `mapstructure:"lockout_duration"`  // 0 locks until an administrator unlocks the account
+	ResetAfter       time.Duration `mapstructure:"reset_after"`       // failures are forgotten this long after the last one
+	IPMaxAttempts    int           `mapstructure:"ip_max_attempts"`   // failed logins before an address is blocked, 0 disables blocking
+	IPBlockDuration  time.Duration `mapstructure:"ip_block_duration"` // defaults to lockout_duration
+	ProgressiveDelay time.Duration `mapstructure:"progressive_delay"` // delay of failed logins, doubled with every failure
+	MaxDelay         time.Duration `mapstructure:"max_delay"`
 }
 
 type RateLimitingConfig struct {
@@ -78,20 +91,47 @@ type RateLimitSettings struct {
 }
 
 type SecurityHeaders struct {
-	HSTSEnabled   bool   `mapstructure:"hsts_enabled"`
-	CSPEnabled    bool   `mapstructure:"csp_enabled"`
-	XFrameOptions string `mapstructure:"xframe_options"`
+	HSTSEnabled           bool          `mapstructure:"hsts_enabled"`
+	HSTSMaxAge            time.Duration `mapstructure:"hsts_max_age"`
+	HSTSIncludeSubdomains bool          `mapstructure:"hsts_include_subdomains"`
+	HSTSPreload           bool          `mapstructure:"hsts_preload"`
+
+	CSPEnabled    bool                `mapstructure:"csp_enabled"`
+	CSPDirectives map[string][]string `mapstructure:"csp_directives"`
+	CSPNonce      bool                `mapstructure:"csp_nonce"`       // add a per-request nonce to script-src and style-src
+	CSPReportOnly bool                `mapstructure:"csp_report_only"` // send Content-Security-Policy-Report-Only instead
+	CSPReportPath string              `mapstructure:"csp_report_path"` // collection endpoint of the violation reports
+	CSPReportPool string              `mapstructure:"csp_report_pool"` // rate limiter pool of the reports per client IP
+
+	XFrameOptions             string `mapstructure:"xframe_options"`
+	ReferrerPolicy            string `mapstructure:"referrer_policy"`
+	PermissionsPolicy         string `mapstructure:"permissions_policy"`
+	CrossOriginOpenerPolicy   string `mapstructure:"cross_origin_opener_policy"`
+	CrossOriginEmbedderPolicy string `mapstructure:"cross_origin_embedder_policy"`
 }
 
 type UserRegistration struct {
-	EmailVerificationRequired bool     `mapstructure:"email_verification_required"`
-	InvitationOnly            bool     `mapstructure:"invitation_only"`
-	AllowedDomains            []string `mapstructure:"allowed_domains"`
+	Enabled                   bool             `mapstructure:"enabled"` // serves the registration endpoints
+	EmailVerificationRequired bool             `mapstructure:"email_verification_required"`
+	InvitationOnly            bool             `mapstructure:"invitation_only"`
+	AllowedDomains            []string         `mapstructure:"allowed_domains"`
+	DefaultRoles              []string         `mapstructure:"default_roles"`
+	VerificationURL           string           `mapstructure:"verification_url"` // page receiving the verification token, "{token}" is replaced with it
+	VerificationTTL           time.Duration    `mapstructure:"verification_ttl"`
+	InvitationURL             string           `mapstructure:"invitation_url"` // page receiving the invitation code, "{token}" is replaced with it
+	InvitationTTL             time.Duration    `mapstructure:"invitation_ttl"` // default lifetime of invitations
+	RateLimitPool             string           `mapstructure:"rate_limit_pool"`
+	Mail                      CodeSenderConfig `mapstructure:"mail"` // defaults to the email sender of MFA
 }
 
 type AccountRecovery struct {
-	Methods         []string      `mapstructure:"methods"`
-	TokenExpiration time.Duration `mapstructure:"token_expiration"`
+	Methods           []string         `mapstructure:"methods"`            // "email" and "security_questions", empty disables password resets
+	TokenExpiration   time.Duration    `mapstructure:"token_expiration"`   // lifetime of the reset tokens
+	ResetURL          string           `mapstructure:"reset_url"`          // page receiving the reset token, "{token}" is replaced with it
+	SecurityQuestions int              `mapstructure:"security_questions"` // questions a user must set up
+	RequiredCorrect   int              `mapstructure:"required_correct"`   // correct answers required to reset the password
+	RateLimitPool     string           `mapstructure:"rate_limit_pool"`
+	Mail              CodeSenderConfig `mapstructure:"mail"` // defaults to the email sender of MFA
 }
 
 type SessionManagement struct {
@@ -104,8 +144,10 @@ type ConsentManagement struct {
 }
 
 type Passwordless struct {
-	Enabled bool     `mapstructure:"enabled"`
-	Methods []string `mapstructure:"methods"`
+	Enabled   bool            `mapstructure:"enabled"`
+	Methods   []string        `mapstructure:"methods"`
+	WebAuthn  WebAuthnConfig  `mapstructure:"webauthn"`
+	MagicLink MagicLinkConfig `mapstructure:"magic_link"`
 }
 
 type Geofencing struct {
@@ -114,8 +156,10 @@ type Geofencing struct {
 }
 
 type WebhooksConfig struct {
-	LoginSuccess string `mapstructure:"login_success"`
-	LoginFailure string `mapstructure:"login_failure"`
+	LoginSuccess   string `mapstructure:"login_success"`
+	LoginFailure   string `mapstructure:"login_failure"`
+	AccountLocked  string `mapstructure:"account_locked"`  // receives a JSON LockoutEvent when an account gets locked
+	UserRegistered string `mapstructure:"user_registered"` // receives the user_registered and email_verified events
 }
 
 type FeatureToggles struct {
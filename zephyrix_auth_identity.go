@@ -0,0 +1,294 @@
+package zephyrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Identity describes the authenticated principal behind a request,
+// regardless of the credential (JWT, session, ...) that was used to prove it.
+type Identity struct {
+	UserID    uint64
+	Roles     []string
+	SessionID string
+	Method    string
+	Claims    jwt.MapClaims
+	APIKeyID  uint64
+	Scopes    []string // scopes of the API key, the key may only use the permissions and roles they cover
+
+	session *Session // the session of the cookie, for IdentityMethodSession
+}
+
+const (
+	IdentityMethodJWT     = "jwt"
+	IdentityMethodSession = "session"
+	IdentityMethodAPIKey  = "api_key"
+)
+
+// sessionsRevokedPrefix keys the time of the last RevokeSessions of a user.
+const sessionsRevokedPrefix = "zephyrix:sessions_revoked:"
+
+// identityContextKey is the gin context key holding the *Identity of an authenticated request.
+const identityContextKey = "zephyrix.identity"
+
+// HasRole reports whether the identity carries the given role.
+func (i *Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAnyRole reports whether the identity carries at least one of the given roles.
+// An empty list of roles is always satisfied.
+func (i *Identity) HasAnyRole(roles ...string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		if i.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the scopes of an API key identity cover the permission,
+// identities that are not API keys are not restricted by scopes.
+func (i *Identity) HasScope(permission string) bool {
+	if i.Method != IdentityMethodAPIKey {
+		return true
+	}
+	for _, scope := range i.Scopes {
+		if permissionMatches(scope, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// roleScope is the API key scope granting a role, e.g. "role:admin". The wildcard
+// scopes "role:*" and "*" grant every role of the owner.
+func roleScope(role string) string {
+	return "role:" + role
+}
+
+// IdentifyRequest resolves the identity of an incoming HTTP request.
+//
+// The API key header is checked first when API keys are enabled, then the bearer token
+// in the Authorization header, then the session cookie configured under authentication.session.cookie_name.
+// It returns ErrUnauthenticated when the request carries no usable credentials.
+func (ap *AuthProvider) IdentifyRequest(r *http.Request) (*Identity, error) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return ap.identifyRequest(r, ip)
+}
+
+// identifyRequest is IdentifyRequest with the client IP resolved by the caller, e.g. through the trusted proxies.
+func (ap *AuthProvider) identifyRequest(r *http.Request, clientIP string) (*Identity, error) {
+	if apiKeys := ap.components.apiKeys; apiKeys != nil && apiKeys.Enabled() {
+		if key := r.Header.Get(apiKeys.Header()); key != "" {
+			return ap.identityFromAPIKey(r, key, clientIP)
+		}
+		if token := bearerToken(r); strings.HasPrefix(token, apiKeyPrefix) {
+			return ap.identityFromAPIKey(r, token, clientIP)
+		}
+	}
+
+	if token := bearerToken(r); token != "" {
+		identity, err := ap.identityFromJWT(token)
+		if err != nil {
+			return nil, err
+		}
+		issuedAt, _ := claimUint64(identity.Claims, "iat")
+		if ap.sessionRevoked(r.Context(), identity.UserID, time.Unix(int64(issuedAt), 0)) {
+			return nil, fmt.Errorf("%w: revoked", ErrInvalidToken)
+		}
+		return identity, nil
+	}
+
+	if ap.components.sessionManager != nil {
+		if cookie, err := r.Cookie(ap.components.sessionManager.CookieName()); err == nil && cookie.Value != "" {
+			return ap.identityFromSession(r, cookie.Value)
+		}
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+func (ap *AuthProvider) identityFromJWT(tokenString string) (*Identity, error) {
+	token, err := ap.VerifyToken(tokenString)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	// exp, nbf and iat are checked by the parser, iss and aud are ours to check
+	if config := ap.config.JWT; config.Issuer != "" && !claims.VerifyIssuer(config.Issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	if config := ap.config.JWT; config.Audience != "" && !claims.VerifyAudience(config.Audience, true) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+	// the key ring signs other kinds of tokens too, only those typed as access tokens are credentials
+	if claims["typ"] != accessTokenType {
+		return nil, fmt.Errorf("%w: not an access token", ErrInvalidToken)
+	}
+
+	userID, err := claimUint64(claims, "sub")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	identity := &Identity{
+		UserID: userID,
+		Roles:  claimStrings(claims, "roles"),
+		Method: IdentityMethodJWT,
+		Claims: claims,
+	}
+	if sid, ok := claims["sid"].(string); ok {
+		identity.SessionID = sid
+	}
+	return identity, nil
+}
+
+func (ap *AuthProvider) identityFromAPIKey(r *http.Request, key, clientIP string) (*Identity, error) {
+	apiKey, err := ap.components.apiKeys.Verify(r.Context(), key, clientIP)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		UserID:   apiKey.UserID,
+		Method:   IdentityMethodAPIKey,
+		APIKeyID: apiKey.ID,
+		Scopes:   apiKey.Scopes,
+	}
+	if user, err := ap.components.userStore.GetByID(r.Context(), apiKey.UserID); err == nil {
+		identity.Roles = user.Roles()
+	}
+	return identity, nil
+}
+
+func (ap *AuthProvider) identityFromSession(r *http.Request, sessionID string) (*Identity, error) {
+	session, err := ap.components.sessionManager.GetSession(r.Context(), sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSession, err)
+	}
+
+	if session.UserID == 0 {
+		return nil, ErrUnauthenticated
+	}
+	if ap.sessionRevoked(r.Context(), session.UserID, session.CreatedAt) {
+		if err := ap.components.sessionManager.DestroySession(r.Context(), session.ID); err != nil {
+			Logger.Error("Failed to destroy revoked session %s: %s", session.ID, err)
+		}
+		return nil, fmt.Errorf("%w: revoked", ErrInvalidSession)
+	}
+
+	// cookies are sent along with cross-site requests, unsafe ones must prove they come from our pages
+	if err := ap.components.sessionManager.VerifyCSRF(r, session); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrForbidden, err)
+	}
+
+	return &Identity{
+		UserID:    session.UserID,
+		Roles:     sessionRoles(session),
+		SessionID: session.ID,
+		Method:    IdentityMethodSession,
+		session:   session,
+	}, nil
+}
+
+// RevokeSessions signs the user out everywhere, e.g. after a password reset: the refresh tokens are
+// revoked, and the access tokens and sessions issued before now are refused from then on.
+func (ap *AuthProvider) RevokeSessions(ctx context.Context, userID uint64) error {
+	if err := ap.RevokeRefreshTokens(ctx, userID, ""); err != nil {
+		return fmt.Errorf("failed to revoke the refresh tokens: %w", err)
+	}
+	if ap.redisClient != nil {
+		// no expiry, sessions are extended for as long as they are used
+		ap.redisClient.Set(ap.orm.NewORM(ctx), sessionsRevokedPrefix+strconv.FormatUint(userID, 10), time.Now().Unix(), 0)
+	}
+	return nil
+}
+
+// sessionRevoked reports whether credentials of the user issued at the given time were revoked by RevokeSessions.
+func (ap *AuthProvider) sessionRevoked(ctx context.Context, userID uint64, issuedAt time.Time) bool {
+	if ap.redisClient == nil {
+		return false
+	}
+	value, found := ap.redisClient.Get(ap.orm.NewORM(ctx), sessionsRevokedPrefix+strconv.FormatUint(userID, 10))
+	if !found {
+		return false
+	}
+	revokedAt, err := strconv.ParseInt(value, 10, 64)
+	return err == nil && issuedAt.Unix() < revokedAt
+}
+
+// bearerToken extracts the token of an `Authorization: Bearer <token>` header.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// claimUint64 reads a numeric claim, accepting both JSON numbers and numeric strings.
+func claimUint64(claims jwt.MapClaims, name string) (uint64, error) {
+	switch v := claims[name].(type) {
+	case float64:
+		return uint64(v), nil
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	case nil:
+		return 0, fmt.Errorf("missing %s claim", name)
+	default:
+		return 0, fmt.Errorf("invalid %s claim type %T", name, v)
+	}
+}
+
+// claimStrings reads a claim that is either a single string or a list of strings.
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// isAuthError reports whether err is one of the errors that should produce a 401 response.
+func isAuthError(err error) bool {
+	return errors.Is(err, ErrUnauthenticated) || errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrInvalidSession) || errors.Is(err, ErrInvalidAPIKey)
+}
@@ -0,0 +1,178 @@
+package zephyrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// userContextKey is the gin context key holding the User of an authenticated request.
+const userContextKey = "zephyrix.user"
+
+// authMiddleware exposes request authentication as the named middleware "auth".
+//
+// Usage: "auth" requires any authenticated user, "auth:admin,editor" additionally
+// requires one of the listed roles, held directly or inherited. The identity and the user are attached to the
+// request and available through Context.User() and Context.Claims(), the session of a
+// cookie through Context.Session().
+type authMiddleware struct {
+	ap *AuthProvider
+}
+
+func newAuthMiddleware(ap *AuthProvider) *authMiddleware {
+	return &authMiddleware{ap: ap}
+}
+
+func (m *authMiddleware) Name() string {
+	return "auth"
+}
+
+func (m *authMiddleware) Handler(args ...any) any {
+	roles := make([]string, 0, len(args))
+	for _, arg := range args {
+		if role := fmt.Sprint(arg); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return m.ap.Middleware(roles...)
+}
+
+// Middleware returns a gin middleware authenticating the request, the request is rejected
+// with 401 when it carries no valid credentials and with 403 when the user lacks the roles.
+func (ap *AuthProvider) Middleware(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ap.authenticate(c, roles...) {
+			c.Next()
+			ap.saveSession(c)
+		}
+	}
+}
+
+// authenticate attaches the identity and the user to the request,
+// it writes the error response and returns false when the request must not go further.
+func (ap *AuthProvider) authenticate(c *gin.Context, roles ...string) bool {
+	identity, user, err := ap.authenticateRequest(c)
+	if err != nil {
+		switch {
+		case isAuthError(err):
+			abortUnauthorized(c, err)
+		case errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrAccountLocked), errors.Is(err, ErrForbidden):
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "message": err.Error()})
+		default:
+			Logger.Error("Failed to authenticate request: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	allowed, err := ap.hasAnyRole(c.Request.Context(), identity, roles...)
+	if err != nil {
+		Logger.Error("Failed to resolve the roles of user %d: %s", identity.UserID, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return false
+	}
+
+	c.Set(identityContextKey, identity)
+	c.Set(userContextKey, user)
+	if session := identity.session; session != nil {
+		if err := ap.attachSession(c, session); err != nil {
+			Logger.Error("Failed to attach session %s: %s", session.ID, err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return false
+		}
+		ap.rotateOnPrivilegeChange(c, identity, user)
+	}
+	return true
+}
+
+// authenticateRequest resolves the identity of the request and loads its user.
+// An identity already resolved earlier in the chain, e.g. by the reverse proxy, is reused.
+func (ap *AuthProvider) authenticateRequest(c *gin.Context) (*Identity, User, error) {
+	identity, ok := c.Value(identityContextKey).(*Identity)
+	if !ok {
+		var err error
+		if identity, err = ap.identifyRequest(c.Request, c.ClientIP()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	user, err := ap.components.userStore.GetByID(c.Request.Context(), identity.UserID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			// the credentials outlived the account
+			return nil, nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+		}
+		return nil, nil, fmt.Errorf("failed to load user %d: %w", identity.UserID, err)
+	}
+	// timed locks that ran out are lifted here too, not only by the next password login
+	if err := ap.checkAccount(c.Request.Context(), user); err != nil {
+		return nil, nil, err
+	}
+	// the stored roles are authoritative, those of the token may predate a change
+	identity.Roles = user.Roles()
+	if identity.Method == IdentityMethodAPIKey {
+		// a key acts with the roles its scopes grant, not with every role of its owner
+		identity.Roles = slices.DeleteFunc(slices.Clone(identity.Roles), func(role string) bool {
+			return !identity.HasScope(roleScope(role))
+		})
+	}
+
+	return identity, user, nil
+}
+
+// hasAnyRole reports whether the identity holds one of the roles, directly or through the role hierarchy.
+// An empty list of roles is always satisfied.
+func (ap *AuthProvider) hasAnyRole(ctx context.Context, identity *Identity, roles ...string) (bool, error) {
+	if identity.HasAnyRole(roles...) {
+		return true, nil
+	}
+	if ap.components.authorizer == nil {
+		return false, nil
+	}
+	effective, err := ap.components.authorizer.EffectiveRoles(ctx, identity.Roles)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if slices.Contains(effective, role) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// abortUnauthorized writes a 401 response with the RFC 6750 challenge of the error.
+func abortUnauthorized(c *gin.Context, err error) {
+	challenge := `Bearer realm="zephyrix"`
+	if errors.Is(err, ErrInvalidToken) {
+		challenge += `, error="invalid_token"`
+	}
+	c.Header("WWW-Authenticate", challenge)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+}
+
+func (z *zephyrixContext) Identity() *Identity {
+	identity, _ := z.Context.Value(identityContextKey).(*Identity)
+	return identity
+}
+
+func (z *zephyrixContext) User() User {
+	user, _ := z.Context.Value(userContextKey).(User)
+	return user
+}
+
+func (z *zephyrixContext) Claims() jwt.MapClaims {
+	if identity := z.Identity(); identity != nil {
+		return identity.Claims
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package zephyrix
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+// testUserStore is an in-memory UserStore of entities wrapped like the BeeORM store does.
+type testUserStore struct {
+	BeeORMUserStore
+	users map[uint64]*models.UserEntity
+}
+
+func (s *testUserStore) GetByID(_ context.Context, id uint64) (User, error) {
+	entity, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return s.wrap(entity), nil
+}
+
+func (s *testUserStore) Update(_ context.Context, user User) error {
+	u := user.(*beeormUser)
+	entity := *u.entity
+	if err := u.encode(&entity); err != nil {
+		return err
+	}
+	s.users[entity.ID] = &entity
+	return nil
+}
+
+func newTestAuthProvider(t *testing.T, users ...*models.UserEntity) *AuthProvider {
+	config := &AuthConfig{JWT: JWTConfig{Secret: "secret", Issuer: "zephyrix", Audience: "zephyrix", Expiration: time.Hour}}
+	kr, err := newKeyRing(config.JWT)
+	require.NoError(t, err)
+
+	store := &testUserStore{users: make(map[uint64]*models.UserEntity)}
+	for _, user := range users {
+		store.users[user.ID] = user
+	}
+
+	ap := &AuthProvider{config: config, keyRing: kr}
+	ap.components.userStore = store
+	ap.components.auditLogger = &AuditLogger{}
+	return ap
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ap := newTestAuthProvider(t,
+		&models.UserEntity{ID: 1, Username: "alice", Active: true, Roles: `["admin"]`},
+		&models.UserEntity{ID: 2, Username: "bob", Active: true},
+		&models.UserEntity{ID: 3, Username: "carol", Active: false},
+	)
+	z := &zephyrix{}
+
+	r := gin.New()
+	// "key:<scopes>" stands for an API key of alice, resolved like the reverse proxy hands over identities
+	r.Use(func(c *gin.Context) {
+		if scopes, ok := strings.CutPrefix(c.GetHeader("Authorization"), "key:"); ok {
+			c.Set(identityContextKey, &Identity{UserID: 1, Method: IdentityMethodAPIKey, Scopes: strings.Split(scopes, ",")})
+		}
+	})
+	r.GET("/me", ap.Middleware(), func(c *gin.Context) {
+		ctx := z.newZephyrixContext(c)
+		c.String(http.StatusOK, "%s %v", ctx.User().Username(), ctx.Claims()["sub"])
+	})
+	admin := newAuthMiddleware(ap).Handler("admin").(gin.HandlerFunc)
+	r.GET("/admin", admin, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	token := func(user User, claims ...jwt.MapClaims) string {
+		signed, err := ap.generateJWT(user, claims...)
+		require.NoError(t, err)
+		return "Bearer " + signed
+	}
+	alice, _ := ap.components.userStore.GetByID(context.Background(), 1)
+	bob, _ := ap.components.userStore.GetByID(context.Background(), 2)
+	carol, _ := ap.components.userStore.GetByID(context.Background(), 3)
+
+	tests := []struct {
+		name, path, authorization string
+		status                    int
+		body                      string
+	}{
+		{"anonymous", "/me", "", http.StatusUnauthorized, ""},
+		{"garbage token", "/me", "Bearer nope", http.StatusUnauthorized, ""},
+		{"valid token", "/me", token(bob), http.StatusOK, "bob 2"},
+		{"expired token", "/me", token(bob, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}), http.StatusUnauthorized, ""},
+		{"foreign audience", "/me", token(bob, jwt.MapClaims{"aud": "billing"}), http.StatusUnauthorized, ""},
+		{"foreign issuer", "/me", token(bob, jwt.MapClaims{"iss": "someone"}), http.StatusUnauthorized, ""},
+		{"untyped token", "/me", token(bob, jwt.MapClaims{"typ": ""}), http.StatusUnauthorized, ""},
+		{"other token type", "/me", token(bob, jwt.MapClaims{"typ": mfaChallengeTokenType}), http.StatusUnauthorized, ""},
+		{"unknown user", "/me", token(bob, jwt.MapClaims{"sub": "42"}), http.StatusUnauthorized, ""},
+		{"disabled user", "/me", token(carol), http.StatusForbidden, ""},
+		{"missing role", "/admin", token(bob), http.StatusForbidden, ""},
+		{"role", "/admin", token(alice), http.StatusNoContent, ""},
+		{"narrow API key of an admin", "/admin", "key:orders.read", http.StatusForbidden, ""},
+		{"API key granted the role", "/admin", "key:orders.read,role:admin", http.StatusNoContent, ""},
+		{"unrestricted API key", "/admin", "key:*", http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, tt.status, w.Code)
+			if tt.body != "" {
+				require.Equal(t, tt.body, w.Body.String())
+			}
+			if tt.status == http.StatusUnauthorized {
+				require.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+}
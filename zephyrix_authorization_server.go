@@ -0,0 +1,605 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+const (
+	authzCodePrefix      = "zephyrix:authz:code:"
+	authzRequestPrefix   = "zephyrix:authz:request:"
+	authzRevokedPrefix   = "zephyrix:authz:revoked:"
+	authzAccessTokenType = "oauth2_access" // typ claim of the access tokens issued to clients
+	idTokenType          = "id_token"      // typ claim of the ID tokens, never accepted as a credential
+
+	defaultAuthorizationCodeTTL = time.Minute
+	authorizationRequestTTL     = 10 * time.Minute
+)
+
+// scopes of OpenID Connect, clients may always be granted them
+const (
+	ScopeOpenID        = "openid"
+	ScopeProfile       = "profile"
+	ScopeEmail         = "email"
+	ScopeOfflineAccess = "offline_access"
+)
+
+// AuthorizationServerConfig configures Zephyrix as OAuth2 authorization server and OpenID provider
+// of other applications, the clients are registered with `zephyrix oauth2-client`.
+type AuthorizationServerConfig struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	Issuer         string        `mapstructure:"issuer"`           // public URL of Zephyrix, e.g. https://id.example.com
+	LoginURL       string        `mapstructure:"login_url"`        // page signing users in, receives the authorization URL as return_to
+	ConsentURL     string        `mapstructure:"consent_url"`      // page asking for consent, receives the ID of the pending request as request
+	CodeTTL        time.Duration `mapstructure:"code_ttl"`         // lifetime of authorization codes, 1m by default
+	AccessTokenTTL time.Duration `mapstructure:"access_token_ttl"` // defaults to jwt.expiration
+	Scopes         []string      `mapstructure:"scopes"`           // scopes of the APIs clients may be granted, besides the OIDC ones
+}
+
+// OAuth2Error is an error of the authorization server, as defined by RFC 6749.
+type OAuth2Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuth2Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func oauth2Error(code, description string) *OAuth2Error {
+	return &OAuth2Error{Code: code, Description: description}
+}
+
+// OAuth2Client is an application using Zephyrix as authorization server, its secret is only known when it is created.
+type OAuth2Client struct {
+	ID           uint64    `json:"id"`
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	GrantTypes   []string  `json:"grant_types"`
+	Scopes       []string  `json:"scopes"`
+	Public       bool      `json:"public"`
+	SkipConsent  bool      `json:"skip_consent"`
+	Revoked      bool      `json:"revoked"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// NewOAuth2Client holds the attributes of a client to register.
+type NewOAuth2Client struct {
+	ClientID     string // generated when empty
+	Name         string
+	RedirectURIs []string
+	GrantTypes   []string // authorization_code and refresh_token by default
+	Scopes       []string // openid, profile and email by default
+	Public       bool
+	SkipConsent  bool
+}
+
+// OAuth2Consent is the consent of a user to the scopes of a client.
+type OAuth2Consent struct {
+	ClientID  string     `json:"client_id"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// AuthorizationRequest is the request of a client to the authorization endpoint.
+type AuthorizationRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	Prompt              string `form:"prompt" json:"prompt"`
+}
+
+// pendingAuthorization is an authorization request waiting for the consent of its user.
+type pendingAuthorization struct {
+	Request  AuthorizationRequest `json:"request"`
+	UserID   uint64               `json:"user_id"`
+	Scopes   []string             `json:"scopes"`
+	AuthTime int64                `json:"auth_time"`
+}
+
+// authorizationCode is the grant stored under an issued authorization code.
+type authorizationCode struct {
+	ClientID      string   `json:"client_id"`
+	RedirectURI   string   `json:"redirect_uri"`
+	UserID        uint64   `json:"user_id"`
+	Scopes        []string `json:"scopes"`
+	CodeChallenge string   `json:"code_challenge,omitempty"`
+	Nonce         string   `json:"nonce,omitempty"`
+	AuthTime      int64    `json:"auth_time"`
+}
+
+// AuthorizationServer keeps the clients, consents and authorization codes of the authorization server.
+//
+// Only SHA-256 hashes of client secrets and codes are stored. Codes live in redis and can be used once.
+type AuthorizationServer struct {
+	config      AuthorizationServerConfig
+	consent     ConsentManagement
+	orm         beeorm.Engine
+	redisClient beeorm.RedisCache
+	audit       *AuditLogger
+}
+
+func NewAuthorizationServer(conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, audit *AuditLogger) (*AuthorizationServer, error) {
+	config := conf.Authentication.AuthorizationServer
+	if config.Enabled && config.Issuer == "" {
+		return nil, errors.New("authorization_server.issuer is required")
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if config.CodeTTL <= 0 {
+		config.CodeTTL = defaultAuthorizationCodeTTL
+	}
+	if config.AccessTokenTTL <= 0 {
+		config.AccessTokenTTL = conf.Authentication.JWT.Expiration
+	}
+
+	return &AuthorizationServer{
+		config:      config,
+		consent:     conf.Authentication.ConsentManagement,
+		orm:         orm,
+		redisClient: redisClient,
+		audit:       audit,
+	}, nil
+}
+
+// Enabled reports whether Zephyrix acts as authorization server.
+func (as *AuthorizationServer) Enabled() bool {
+	return as.config.Enabled
+}
+
+// Issuer returns the issuer of the tokens, the base URL of the endpoints.
+func (as *AuthorizationServer) Issuer() string {
+	return as.config.Issuer
+}
+
+// SupportedScopes returns the scopes clients may be granted.
+func (as *AuthorizationServer) SupportedScopes() []string {
+	scopes := []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopeOfflineAccess}
+	for _, scope := range as.config.Scopes {
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// RegisterClient registers a client, the returned secret is shown once and empty for public clients.
+func (as *AuthorizationServer) RegisterClient(ctx context.Context, input NewOAuth2Client) (*OAuth2Client, string, error) {
+	if input.Name == "" {
+		return nil, "", errors.New("the name of the client is required")
+	}
+	if len(input.GrantTypes) == 0 {
+		input.GrantTypes = []string{string(GrantTypeAuthorization), string(GrantTypeRefreshToken)}
+	}
+	if len(input.Scopes) == 0 {
+		input.Scopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+	}
+	if err := as.validateClient(input); err != nil {
+		return nil, "", err
+	}
+
+	clientID := input.ClientID
+	if clientID == "" {
+		id, err := newOpaqueToken()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to generate client ID: %w", err)
+		}
+		clientID = id[:22]
+	}
+
+	var secret string
+	if !input.Public {
+		var err error
+		if secret, err = newOpaqueToken(); err != nil {
+			return nil, "", fmt.Errorf("failed to generate client secret: %w", err)
+		}
+	}
+
+	orm := as.orm.NewORM(ctx)
+	if _, found := beeorm.GetByUniqueIndex[models.OAuth2ClientEntity](orm, "client_id", clientID); found {
+		return nil, "", fmt.Errorf("client %s already exists", clientID)
+	}
+
+	redirectURIs, _ := json.Marshal(input.RedirectURIs)
+	grantTypes, _ := json.Marshal(input.GrantTypes)
+	scopes, _ := json.Marshal(input.Scopes)
+
+	now := time.Now().UTC()
+	entity := beeorm.NewEntity[models.OAuth2ClientEntity](orm)
+	entity.ClientID = clientID
+	entity.Name = input.Name
+	entity.RedirectURIs = string(redirectURIs)
+	entity.GrantTypes = string(grantTypes)
+	entity.Scopes = string(scopes)
+	entity.Public = input.Public
+	entity.SkipConsent = input.SkipConsent
+	entity.CreatedAt = now
+	entity.UpdatedAt = now
+	if secret != "" {
+		entity.SecretHash = hashClientSecret(secret)
+	}
+	if err := orm.Flush(); err != nil {
+		return nil, "", fmt.Errorf("failed to save OAuth2 client: %w", err)
+	}
+
+	as.log(ctx, "oauth2_client_registered", 0, "client_id="+clientID)
+	return oauth2ClientFromEntity(entity), secret, nil
+}
+
+func (as *AuthorizationServer) validateClient(input NewOAuth2Client) error {
+	for _, grantType := range input.GrantTypes {
+		switch GrantType(grantType) {
+		case GrantTypeAuthorization, GrantTypeRefreshToken:
+		case GrantTypeClientCredentials:
+			if input.Public {
+				return errors.New("public clients can not use the client_credentials grant")
+			}
+		default:
+			return fmt.Errorf("unsupported grant type %q", grantType)
+		}
+	}
+	if slices.Contains(input.GrantTypes, string(GrantTypeAuthorization)) && len(input.RedirectURIs) == 0 {
+		return errors.New("clients using the authorization_code grant need a redirect URI")
+	}
+	for _, redirectURI := range input.RedirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return fmt.Errorf("invalid redirect URI %q, it must be absolute and without fragment", redirectURI)
+		}
+	}
+	supported := as.SupportedScopes()
+	for _, scope := range input.Scopes {
+		if !slices.Contains(supported, scope) {
+			return fmt.Errorf("unsupported scope %q, add it to authorization_server.scopes", scope)
+		}
+	}
+	return nil
+}
+
+// Client returns a registered client, revoked clients included.
+func (as *AuthorizationServer) Client(ctx context.Context, clientID string) (*OAuth2Client, error) {
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2ClientEntity](as.orm.NewORM(ctx), "client_id", clientID)
+	if !found {
+		return nil, oauth2Error("invalid_client", "unknown client")
+	}
+	return oauth2ClientFromEntity(entity), nil
+}
+
+// Clients returns the registered clients.
+func (as *AuthorizationServer) Clients(ctx context.Context) ([]*OAuth2Client, error) {
+	var clients []*OAuth2Client
+	iterator := beeorm.Search[models.OAuth2ClientEntity](as.orm.NewORM(ctx), beeorm.NewWhere("1"), nil)
+	for iterator.Next() {
+		clients = append(clients, oauth2ClientFromEntity(iterator.Entity()))
+	}
+	return clients, nil
+}
+
+// RotateClientSecret replaces the secret of a confidential client, the old secret stops working immediately.
+func (as *AuthorizationServer) RotateClientSecret(ctx context.Context, clientID string) (string, error) {
+	orm := as.orm.NewORM(ctx)
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2ClientEntity](orm, "client_id", clientID)
+	if !found {
+		return "", fmt.Errorf("client %s not found", clientID)
+	}
+	if entity.Public {
+		return "", fmt.Errorf("client %s is public and has no secret", clientID)
+	}
+
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate client secret: %w", err)
+	}
+	edited := beeorm.EditEntity(orm, entity)
+	edited.SecretHash = hashClientSecret(secret)
+	edited.UpdatedAt = time.Now().UTC()
+	if err := orm.Flush(); err != nil {
+		return "", fmt.Errorf("failed to rotate client secret: %w", err)
+	}
+
+	as.log(ctx, "oauth2_client_secret_rotated", 0, "client_id="+clientID)
+	return secret, nil
+}
+
+// RevokeClient disables a client, its tokens are refused by introspection and userinfo.
+func (as *AuthorizationServer) RevokeClient(ctx context.Context, clientID string) error {
+	orm := as.orm.NewORM(ctx)
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2ClientEntity](orm, "client_id", clientID)
+	if !found {
+		return fmt.Errorf("client %s not found", clientID)
+	}
+	edited := beeorm.EditEntity(orm, entity)
+	edited.Revoked = true
+	edited.UpdatedAt = time.Now().UTC()
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to revoke client: %w", err)
+	}
+
+	as.log(ctx, "oauth2_client_revoked", 0, "client_id="+clientID)
+	return nil
+}
+
+// AuthenticateClient verifies the credentials of a client. Public clients only present their ID.
+func (as *AuthorizationServer) AuthenticateClient(ctx context.Context, clientID, secret string) (*OAuth2Client, error) {
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2ClientEntity](as.orm.NewORM(ctx), "client_id", clientID)
+	if !found || entity.Revoked {
+		return nil, oauth2Error("invalid_client", "unknown client")
+	}
+	if entity.Public {
+		if secret != "" {
+			return nil, oauth2Error("invalid_client", "public clients have no secret")
+		}
+		return oauth2ClientFromEntity(entity), nil
+	}
+	if secret == "" || subtle.ConstantTimeCompare([]byte(entity.SecretHash), []byte(hashClientSecret(secret))) != 1 {
+		as.log(ctx, "oauth2_client_authentication_failed", 0, "client_id="+clientID)
+		return nil, oauth2Error("invalid_client", "invalid client credentials")
+	}
+	return oauth2ClientFromEntity(entity), nil
+}
+
+// redirectURI returns the redirect URI of a request, which must be one of the client exactly.
+// It may be omitted when the client has a single one.
+func (c *OAuth2Client) redirectURI(requested string) (string, bool) {
+	if requested == "" {
+		if len(c.RedirectURIs) == 1 {
+			return c.RedirectURIs[0], true
+		}
+		return "", false
+	}
+	return requested, slices.Contains(c.RedirectURIs, requested)
+}
+
+// allows reports whether the client may use the grant type.
+func (c *OAuth2Client) allows(grantType GrantType) bool {
+	return slices.Contains(c.GrantTypes, string(grantType))
+}
+
+// grantedScopes returns the requested scopes, all the scopes of the client when none are requested.
+func (c *OAuth2Client) grantedScopes(requested string) ([]string, error) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return slices.Clone(c.Scopes), nil
+	}
+	if err := scopesWithin(scopes, c.Scopes); err != nil {
+		return nil, err
+	}
+	return slices.Compact(scopes), nil
+}
+
+// scopesWithin checks that every requested scope is one of the allowed ones.
+func scopesWithin(requested, allowed []string) error {
+	for _, scope := range requested {
+		if !slices.Contains(allowed, scope) {
+			return oauth2Error("invalid_scope", fmt.Sprintf("scope %q is not allowed", scope))
+		}
+	}
+	return nil
+}
+
+// hasConsent reports whether the user consented to the scopes of the client.
+func (as *AuthorizationServer) hasConsent(ctx context.Context, userID uint64, client *OAuth2Client, scopes []string) bool {
+	if !as.consent.RequireConsent || client.SkipConsent {
+		return true
+	}
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2ConsentEntity](as.orm.NewORM(ctx), "user_client", userID, client.ClientID)
+	if !found || (entity.ExpiresAt != nil && time.Now().After(*entity.ExpiresAt)) {
+		return false
+	}
+	var granted []string
+	_ = json.Unmarshal([]byte(entity.Scopes), &granted)
+	return scopesWithin(scopes, granted) == nil
+}
+
+// grantConsent records the consent of the user, it expires after consent_management.consent_validity.
+func (as *AuthorizationServer) grantConsent(ctx context.Context, userID uint64, clientID string, scopes []string) error {
+	orm := as.orm.NewORM(ctx)
+	now := time.Now().UTC()
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2ConsentEntity](orm, "user_client", userID, clientID)
+	if found {
+		entity = beeorm.EditEntity(orm, entity)
+		var granted []string
+		if entity.ExpiresAt == nil || now.Before(*entity.ExpiresAt) {
+			_ = json.Unmarshal([]byte(entity.Scopes), &granted)
+		}
+		for _, scope := range granted {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	} else {
+		entity = beeorm.NewEntity[models.OAuth2ConsentEntity](orm)
+		entity.UserID = userID
+		entity.ClientID = clientID
+		entity.CreatedAt = now
+	}
+
+	encoded, _ := json.Marshal(scopes)
+	entity.Scopes = string(encoded)
+	entity.UpdatedAt = now
+	entity.ExpiresAt = nil
+	if as.consent.ConsentValidity > 0 {
+		expiresAt := now.Add(as.consent.ConsentValidity)
+		entity.ExpiresAt = &expiresAt
+	}
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to save consent: %w", err)
+	}
+
+	as.log(ctx, "oauth2_consent_granted", userID, fmt.Sprintf("client_id=%s scopes=%s", clientID, strings.Join(scopes, " ")))
+	return nil
+}
+
+// Consents returns the clients the user consented to.
+func (as *AuthorizationServer) Consents(ctx context.Context, userID uint64) ([]*OAuth2Consent, error) {
+	var consents []*OAuth2Consent
+	iterator := beeorm.Search[models.OAuth2ConsentEntity](as.orm.NewORM(ctx), beeorm.NewWhere("`UserID` = ?", userID), nil)
+	for iterator.Next() {
+		entity := iterator.Entity()
+		consent := &OAuth2Consent{ClientID: entity.ClientID, ExpiresAt: entity.ExpiresAt, UpdatedAt: entity.UpdatedAt}
+		_ = json.Unmarshal([]byte(entity.Scopes), &consent.Scopes)
+		consents = append(consents, consent)
+	}
+	return consents, nil
+}
+
+// RevokeConsent withdraws the consent of the user, the refresh tokens of the client stop working.
+func (as *AuthorizationServer) RevokeConsent(ctx context.Context, userID uint64, clientID string) error {
+	orm := as.orm.NewORM(ctx)
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2ConsentEntity](orm, "user_client", userID, clientID)
+	if !found {
+		return nil
+	}
+	beeorm.DeleteEntity(orm, entity)
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to revoke consent: %w", err)
+	}
+
+	as.log(ctx, "oauth2_consent_revoked", userID, "client_id="+clientID)
+	return nil
+}
+
+// savePendingAuthorization keeps a request until the user answers the consent screen.
+func (as *AuthorizationServer) savePendingAuthorization(ctx context.Context, pending *pendingAuthorization) (string, error) {
+	id, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	data, _ := json.Marshal(pending)
+	as.redisClient.Set(as.orm.NewORM(ctx), authzRequestPrefix+id, string(data), authorizationRequestTTL)
+	return id, nil
+}
+
+// pendingAuthorization returns a request waiting for the consent of the user.
+func (as *AuthorizationServer) pendingAuthorization(ctx context.Context, id string, userID uint64) (*pendingAuthorization, error) {
+	data, found := as.redisClient.Get(as.orm.NewORM(ctx), authzRequestPrefix+id)
+	if !found {
+		return nil, fmt.Errorf("%w: unknown or expired authorization request", ErrInvalidToken)
+	}
+	var pending pendingAuthorization
+	if err := json.Unmarshal([]byte(data), &pending); err != nil || pending.UserID != userID {
+		return nil, fmt.Errorf("%w: unknown or expired authorization request", ErrInvalidToken)
+	}
+	return &pending, nil
+}
+
+// consumePendingAuthorization removes a request once the user answered, a request is answered once.
+func (as *AuthorizationServer) consumePendingAuthorization(ctx context.Context, id string, userID uint64) (*pendingAuthorization, error) {
+	pending, err := as.pendingAuthorization(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	orm := as.orm.NewORM(ctx)
+	if !as.redisClient.SetNX(orm, authzRequestPrefix+id+":used", "1", authorizationRequestTTL) {
+		return nil, fmt.Errorf("%w: authorization request already answered", ErrInvalidToken)
+	}
+	as.redisClient.Del(orm, authzRequestPrefix+id)
+	return pending, nil
+}
+
+// issueCode stores the grant and returns its authorization code.
+func (as *AuthorizationServer) issueCode(ctx context.Context, grant *authorizationCode) (string, error) {
+	code, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	data, _ := json.Marshal(grant)
+	as.redisClient.Set(as.orm.NewORM(ctx), authzCodePrefix+hashRefreshToken(code), string(data), as.config.CodeTTL)
+	return code, nil
+}
+
+// consumeCode returns the grant of an authorization code, a code can only be used once.
+func (as *AuthorizationServer) consumeCode(ctx context.Context, code string) (*authorizationCode, error) {
+	orm := as.orm.NewORM(ctx)
+	key := authzCodePrefix + hashRefreshToken(code)
+	data, found := as.redisClient.Get(orm, key)
+	if !found || !as.redisClient.SetNX(orm, key+":used", "1", as.config.CodeTTL) {
+		return nil, oauth2Error("invalid_grant", "unknown, expired or used authorization code")
+	}
+	as.redisClient.Del(orm, key)
+
+	var grant authorizationCode
+	if err := json.Unmarshal([]byte(data), &grant); err != nil {
+		return nil, oauth2Error("invalid_grant", "malformed authorization code")
+	}
+	return &grant, nil
+}
+
+// revokeAccessToken refuses the access token until it expires.
+func (as *AuthorizationServer) revokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) {
+	if ttl := time.Until(expiresAt); ttl > 0 {
+		as.redisClient.Set(as.orm.NewORM(ctx), authzRevokedPrefix+jti, "1", ttl)
+	}
+}
+
+func (as *AuthorizationServer) isAccessTokenRevoked(ctx context.Context, jti string) bool {
+	_, revoked := as.redisClient.Get(as.orm.NewORM(ctx), authzRevokedPrefix+jti)
+	return revoked
+}
+
+func (as *AuthorizationServer) log(ctx context.Context, action string, userID uint64, details string) {
+	if as.audit == nil {
+		return
+	}
+	if err := as.audit.Log(ctx, action, strconv.FormatUint(userID, 10), details); err != nil {
+		Logger.Error("Failed to write %s to the audit log: %s", action, err)
+	}
+}
+
+func oauth2ClientFromEntity(entity *models.OAuth2ClientEntity) *OAuth2Client {
+	client := &OAuth2Client{
+		ID:          entity.ID,
+		ClientID:    entity.ClientID,
+		Name:        entity.Name,
+		Public:      entity.Public,
+		SkipConsent: entity.SkipConsent,
+		Revoked:     entity.Revoked,
+		CreatedAt:   entity.CreatedAt,
+		UpdatedAt:   entity.UpdatedAt,
+	}
+	_ = json.Unmarshal([]byte(entity.RedirectURIs), &client.RedirectURIs)
+	_ = json.Unmarshal([]byte(entity.GrantTypes), &client.GrantTypes)
+	_ = json.Unmarshal([]byte(entity.Scopes), &client.Scopes)
+	return client
+}
+
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyPKCE checks the code verifier against the S256 challenge of the authorization request (RFC 7636).
+func verifyPKCE(challenge, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
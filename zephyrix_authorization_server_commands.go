@@ -0,0 +1,109 @@
+package zephyrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+// oauth2ClientCommand builds the `oauth2-client` command managing the clients of the authorization server.
+func (z *zephyrix) oauth2ClientCommand(cancel context.CancelFunc) *cobra.Command {
+	var input NewOAuth2Client
+
+	clientCommand := &cobra.Command{
+		GroupID: authGroup.ID,
+		Use:     "oauth2-client",
+		Short:   "Manage the clients of the authorization server",
+		Long:    "Register, list, rotate and revoke the applications signing their users in with Zephyrix (authentication.authorization_server)",
+		PersistentPreRun: func(_ *cobra.Command, _ []string) {
+			z.options = append(z.options, fx.Invoke(beeormInvoke))
+		},
+		PersistentPostRun: func(_ *cobra.Command, _ []string) {
+			defer cancel()
+		},
+	}
+
+	createCommand := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Register a client",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			input.Name = args[0]
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				client, secret, err := ap.AuthorizationServer().RegisterClient(ctx, input)
+				if err != nil {
+					return err
+				}
+				Logger.Info("Registered OAuth2 client %s (%s)", client.Name, client.ClientID)
+				fmt.Println("client_id:", client.ClientID)
+				if secret != "" {
+					Logger.Info("The client secret will not be shown again:")
+					fmt.Println("client_secret:", secret)
+				}
+				return nil
+			})
+		},
+	}
+	createCommand.Flags().StringVar(&input.ClientID, "client-id", "", "ID of the client, generated when empty")
+	createCommand.Flags().StringSliceVarP(&input.RedirectURIs, "redirect-uri", "r", nil, "exact redirect URIs of the client")
+	createCommand.Flags().StringSliceVarP(&input.GrantTypes, "grant-types", "g", nil, "authorization_code, refresh_token and/or client_credentials, the first two by default")
+	createCommand.Flags().StringSliceVarP(&input.Scopes, "scopes", "s", nil, "scopes the client may request, openid,profile,email by default")
+	createCommand.Flags().BoolVar(&input.Public, "public", false, "the client can not keep a secret (SPA, mobile app) and must use PKCE")
+	createCommand.Flags().BoolVar(&input.SkipConsent, "skip-consent", false, "first-party client, users are not asked for consent")
+
+	listCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List the registered clients",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				clients, err := ap.AuthorizationServer().Clients(ctx)
+				if err != nil {
+					return err
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(clients)
+			})
+		},
+	}
+
+	rotateCommand := &cobra.Command{
+		Use:   "rotate-secret <client_id>",
+		Short: "Replace the secret of a confidential client",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				secret, err := ap.AuthorizationServer().RotateClientSecret(ctx, args[0])
+				if err != nil {
+					return err
+				}
+				Logger.Info("Rotated the secret of OAuth2 client %s, it will not be shown again:", args[0])
+				fmt.Println(secret)
+				return nil
+			})
+		},
+	}
+
+	revokeCommand := &cobra.Command{
+		Use:   "revoke <client_id>",
+		Short: "Disable a client and refuse its tokens",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				if err := ap.AuthorizationServer().RevokeClient(ctx, args[0]); err != nil {
+					return err
+				}
+				Logger.Info("Revoked OAuth2 client %s", args[0])
+				return nil
+			})
+		},
+	}
+
+	clientCommand.AddCommand(createCommand, listCommand, rotateCommand, revokeCommand)
+	return clientCommand
+}
@@ -0,0 +1,304 @@
+package zephyrix
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authorizationServerRouteHandler is one of the endpoints of the authorization server:
+//
+//	GET  /.well-known/openid-configuration  discovery document, the keys are published at /.well-known/jwks.json
+//	GET  /oauth2/authorize                   authorization code flow, signs the user in through login_url first
+//	GET  /oauth2/consent?request             (authenticated) -> the client and scopes of a request awaiting consent
+//	POST /oauth2/consent                     (authenticated) {"request", "approve"} -> {"redirect_to"}
+//	POST /oauth2/token                       authorization_code, refresh_token and client_credentials grants
+//	POST /oauth2/introspect                  RFC 7662, for confidential clients
+//	POST /oauth2/revoke                      RFC 7009
+//	GET  /oauth2/userinfo                    claims of the user of an access token granted openid
+//
+// Clients authenticate with HTTP basic authentication or the client_id and client_secret form parameters.
+// A consent answered with the session cookie carries the CSRF token of the session, see CSRFConfig.
+// The endpoints answer 404 while the authorization server is disabled.
+type authorizationServerRouteHandler struct {
+	name    string
+	methods []string
+	path    string
+	handler []any
+}
+
+func (h *authorizationServerRouteHandler) Name() string     { return h.name }
+func (h *authorizationServerRouteHandler) Method() []string { return h.methods }
+func (h *authorizationServerRouteHandler) Path() string     { return h.path }
+func (h *authorizationServerRouteHandler) Handlers() []any  { return h.handler }
+
+func newOpenIDConfigurationRoute(ap *AuthProvider) *authorizationServerRouteHandler {
+	return &authorizationServerRouteHandler{
+		name:    "openid_configuration",
+		methods: []string{http.MethodGet},
+		path:    "/.well-known/openid-configuration",
+		handler: []any{ap.requireAuthorizationServer, func(c *gin.Context) {
+			issuer := ap.components.authServer.Issuer()
+			c.Header("Cache-Control", "public, max-age=300")
+			c.JSON(http.StatusOK, gin.H{
+				"issuer":                                         issuer,
+				"authorization_endpoint":                         issuer + "/oauth2/authorize",
+				"token_endpoint":                                 issuer + "/oauth2/token",
+				"introspection_endpoint":                         issuer + "/oauth2/introspect",
+				"revocation_endpoint":                            issuer + "/oauth2/revoke",
+				"userinfo_endpoint":                              issuer + "/oauth2/userinfo",
+				"jwks_uri":                                       issuer + "/.well-known/jwks.json",
+				"scopes_supported":                               ap.components.authServer.SupportedScopes(),
+				"response_types_supported":                       []string{"code"},
+				"response_modes_supported":                       []string{"query"},
+				"grant_types_supported":                          []GrantType{GrantTypeAuthorization, GrantTypeRefreshToken, GrantTypeClientCredentials},
+				"subject_types_supported":                        []string{"public"},
+				"id_token_signing_alg_values_supported":          []string{ap.keyRing.Method().Alg()},
+				"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+				"code_challenge_methods_supported":               []string{"S256"},
+				"claims_supported":                               []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "azp", "preferred_username", "updated_at", "email", "email_verified"},
+				"authorization_response_iss_parameter_supported": true,
+			})
+		}},
+	}
+}
+
+func newAuthorizeRoute(ap *AuthProvider) *authorizationServerRouteHandler {
+	return &authorizationServerRouteHandler{
+		name:    "oauth2_authorize",
+		methods: []string{http.MethodGet, http.MethodPost},
+		path:    "/oauth2/authorize",
+		handler: []any{ap.requireAuthorizationServer, func(c *gin.Context) {
+			var request AuthorizationRequest
+			if err := c.ShouldBind(&request); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, oauth2Error("invalid_request", ""))
+				return
+			}
+
+			ctx := c.Request.Context()
+			as := ap.components.authServer
+			client, redirectURI, err := ap.authorizationClient(ctx, request)
+			if err != nil {
+				// the redirect URI is not trusted, the error is shown to the user instead
+				writeAuthorizationServerError(c, err)
+				return
+			}
+			redirectError := func(err *OAuth2Error) {
+				c.Redirect(http.StatusFound, authorizationErrorRedirect(redirectURI, request.State, as.Issuer(), err))
+			}
+
+			_, user, err := ap.authenticateRequest(c)
+			switch {
+			case err == nil:
+			case isAuthError(err) && request.Prompt == "none":
+				redirectError(oauth2Error("login_required", ""))
+				return
+			case isAuthError(err) && as.config.LoginURL != "":
+				c.Redirect(http.StatusFound, appendQuery(as.config.LoginURL, url.Values{"return_to": {as.Issuer() + c.Request.URL.RequestURI()}}))
+				return
+			case isAuthError(err):
+				abortUnauthorized(c, err)
+				return
+			case errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrAccountLocked):
+				redirectError(oauth2Error("access_denied", err.Error()))
+				return
+			default:
+				Logger.Error("Failed to authenticate authorization request: %s", err)
+				redirectError(oauth2Error("server_error", ""))
+				return
+			}
+
+			response, err := ap.Authorize(ctx, user, client, request)
+			var oauthErr *OAuth2Error
+			switch {
+			case errors.As(err, &oauthErr):
+				redirectError(oauthErr)
+			case err != nil:
+				Logger.Error("Failed to authorize OAuth2 client %s: %s", client.ClientID, err)
+				redirectError(oauth2Error("server_error", ""))
+			case response.ConsentRequest != "" && as.config.ConsentURL != "":
+				c.Redirect(http.StatusFound, appendQuery(as.config.ConsentURL, url.Values{"request": {response.ConsentRequest}}))
+			case response.ConsentRequest != "":
+				c.JSON(http.StatusOK, gin.H{"consent_required": true, "request": response.ConsentRequest, "client": response.Client, "scopes": response.Scopes})
+			default:
+				c.Redirect(http.StatusFound, response.RedirectURI)
+			}
+		}},
+	}
+}
+
+func newConsentRoute(ap *AuthProvider) *authorizationServerRouteHandler {
+	return &authorizationServerRouteHandler{
+		name:    "oauth2_consent",
+		methods: []string{http.MethodGet},
+		path:    "/oauth2/consent",
+		handler: []any{ap.requireAuthorizationServer, ap.Middleware(), func(c *gin.Context) {
+			response, err := ap.PendingAuthorization(c.Request.Context(), c.Value(userContextKey).(User), c.Query("request"))
+			if err != nil {
+				writeAuthorizationServerError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, response)
+		}},
+	}
+}
+
+func newConsentAnswerRoute(ap *AuthProvider) *authorizationServerRouteHandler {
+	return &authorizationServerRouteHandler{
+		name:    "oauth2_consent_answer",
+		methods: []string{http.MethodPost},
+		path:    "/oauth2/consent",
+		handler: []any{ap.requireAuthorizationServer, ap.Middleware(), func(c *gin.Context) {
+			var body struct {
+				Request string `json:"request" form:"request"`
+				Approve bool   `json:"approve" form:"approve"`
+			}
+			if err := c.ShouldBind(&body); err != nil || body.Request == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, oauth2Error("invalid_request", ""))
+				return
+			}
+
+			response, err := ap.AnswerConsent(c.Request.Context(), c.Value(userContextKey).(User), body.Request, body.Approve)
+			if err != nil {
+				writeAuthorizationServerError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"redirect_to": response.RedirectURI})
+		}},
+	}
+}
+
+func newTokenRoute(ap *AuthProvider) *authorizationServerRouteHandler {
+	return &authorizationServerRouteHandler{
+		name:    "oauth2_token",
+		methods: []string{http.MethodPost},
+		path:    "/oauth2/token",
+		handler: []any{ap.requireAuthorizationServer, ap.requireOAuth2Client, func(c *gin.Context) {
+			c.Header("Cache-Control", "no-store")
+			c.Header("Pragma", "no-cache")
+
+			client := c.Value(oauth2ClientContextKey).(*OAuth2Client)
+			response, err := ap.ExchangeOAuth2Token(c.Request.Context(), client, OAuth2TokenRequest{
+				GrantType:    GrantType(c.PostForm("grant_type")),
+				Code:         c.PostForm("code"),
+				RedirectURI:  c.PostForm("redirect_uri"),
+				CodeVerifier: c.PostForm("code_verifier"),
+				RefreshToken: c.PostForm("refresh_token"),
+				Scope:        c.PostForm("scope"),
+			})
+			if err != nil {
+				writeAuthorizationServerError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, response)
+		}},
+	}
+}
+
+func newIntrospectRoute(ap *AuthProvider) *authorizationServerRouteHandler {
+	return &authorizationServerRouteHandler{
+		name:    "oauth2_introspect",
+		methods: []string{http.MethodPost},
+		path:    "/oauth2/introspect",
+		handler: []any{ap.requireAuthorizationServer, ap.requireOAuth2Client, func(c *gin.Context) {
+			client := c.Value(oauth2ClientContextKey).(*OAuth2Client)
+			if client.Public {
+				writeAuthorizationServerError(c, oauth2Error("unauthorized_client", "public clients can not introspect tokens"))
+				return
+			}
+			c.Header("Cache-Control", "no-store")
+			c.JSON(http.StatusOK, ap.IntrospectOAuth2Token(c.Request.Context(), client, c.PostForm("token")))
+		}},
+	}
+}
+
+func newRevokeRoute(ap *AuthProvider) *authorizationServerRouteHandler {
+	return &authorizationServerRouteHandler{
+		name:    "oauth2_revoke",
+		methods: []string{http.MethodPost},
+		path:    "/oauth2/revoke",
+		handler: []any{ap.requireAuthorizationServer, ap.requireOAuth2Client, func(c *gin.Context) {
+			ap.RevokeOAuth2Token(c.Request.Context(), c.Value(oauth2ClientContextKey).(*OAuth2Client), c.PostForm("token"))
+			c.Status(http.StatusOK)
+		}},
+	}
+}
+
+func newUserInfoRoute(ap *AuthProvider) *authorizationServerRouteHandler {
+	return &authorizationServerRouteHandler{
+		name:    "oauth2_userinfo",
+		methods: []string{http.MethodGet, http.MethodPost},
+		path:    "/oauth2/userinfo",
+		handler: []any{ap.requireAuthorizationServer, func(c *gin.Context) {
+			claims, err := ap.OAuth2UserInfo(c.Request.Context(), bearerToken(c.Request))
+			switch {
+			case errors.Is(err, ErrForbidden):
+				c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+				c.AbortWithStatusJSON(http.StatusForbidden, oauth2Error("insufficient_scope", ""))
+			case err != nil:
+				abortUnauthorized(c, ErrInvalidToken)
+			default:
+				c.Header("Cache-Control", "no-store")
+				c.JSON(http.StatusOK, claims)
+			}
+		}},
+	}
+}
+
+// oauth2ClientContextKey is the gin context key holding the authenticated *OAuth2Client.
+const oauth2ClientContextKey = "zephyrix.oauth2_client"
+
+// requireOAuth2Client authenticates the client calling the token, introspection and revocation endpoints.
+func (ap *AuthProvider) requireOAuth2Client(c *gin.Context) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1, the credentials are form encoded before basic authentication
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err == nil {
+			secret, err = url.QueryUnescape(secret)
+		}
+		if err != nil || c.PostForm("client_secret") != "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, oauth2Error("invalid_request", "malformed client credentials"))
+			return
+		}
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	if clientID == "" {
+		writeAuthorizationServerError(c, oauth2Error("invalid_client", "client authentication is required"))
+		return
+	}
+
+	client, err := ap.components.authServer.AuthenticateClient(c.Request.Context(), clientID, secret)
+	if err != nil {
+		writeAuthorizationServerError(c, err)
+		return
+	}
+	c.Set(oauth2ClientContextKey, client)
+}
+
+// requireAuthorizationServer hides the endpoints while the authorization server is disabled.
+func (ap *AuthProvider) requireAuthorizationServer(c *gin.Context) {
+	if !ap.components.authServer.Enabled() {
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// writeAuthorizationServerError maps the errors of the authorization server to RFC 6749 responses.
+func writeAuthorizationServerError(c *gin.Context, err error) {
+	var oauthErr *OAuth2Error
+	switch {
+	case errors.As(err, &oauthErr) && oauthErr.Code == "invalid_client":
+		c.Header("WWW-Authenticate", `Basic realm="zephyrix"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, oauthErr)
+	case errors.As(err, &oauthErr):
+		c.AbortWithStatusJSON(http.StatusBadRequest, oauthErr)
+	case errors.Is(err, ErrInvalidToken):
+		c.AbortWithStatusJSON(http.StatusBadRequest, oauth2Error("invalid_request", err.Error()))
+	default:
+		Logger.Error("OAuth2 authorization server request failed: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, oauth2Error("server_error", ""))
+	}
+}
@@ -0,0 +1,135 @@
+package zephyrix
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	require.True(t, verifyPKCE(challenge, verifier))
+	require.False(t, verifyPKCE(challenge, strings.Repeat("w", 43)))
+	require.False(t, verifyPKCE(challenge, ""))
+	require.False(t, verifyPKCE(challenge, "short"), "verifiers have at least 43 characters")
+	require.True(t, verifyPKCE("", ""))
+	require.False(t, verifyPKCE("", verifier), "a verifier without challenge is a downgrade")
+}
+
+func TestOAuth2Client(t *testing.T) {
+	client := &OAuth2Client{
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		GrantTypes:   []string{"authorization_code"},
+		Scopes:       []string{"openid", "email"},
+	}
+
+	redirectURI, ok := client.redirectURI("")
+	require.True(t, ok, "the only redirect URI is the default")
+	require.Equal(t, "https://app.example.com/callback", redirectURI)
+	_, ok = client.redirectURI("https://app.example.com/callback/../admin")
+	require.False(t, ok, "redirect URIs match exactly")
+
+	require.True(t, client.allows(GrantTypeAuthorization))
+	require.False(t, client.allows(GrantTypeClientCredentials))
+
+	scopes, err := client.grantedScopes("")
+	require.NoError(t, err)
+	require.Equal(t, []string{"openid", "email"}, scopes)
+	scopes, err = client.grantedScopes("openid")
+	require.NoError(t, err)
+	require.Equal(t, []string{"openid"}, scopes)
+	_, err = client.grantedScopes("openid admin")
+	var oauthErr *OAuth2Error
+	require.ErrorAs(t, err, &oauthErr)
+	require.Equal(t, "invalid_scope", oauthErr.Code)
+}
+
+func TestValidateOAuth2Client(t *testing.T) {
+	as := &AuthorizationServer{config: AuthorizationServerConfig{Scopes: []string{"orders.read"}}}
+	valid := NewOAuth2Client{
+		Name:         "shop",
+		RedirectURIs: []string{"https://shop.example.com/callback"},
+		GrantTypes:   []string{"authorization_code", "client_credentials"},
+		Scopes:       []string{"openid", "orders.read"},
+	}
+	require.NoError(t, as.validateClient(valid))
+
+	for name, change := range map[string]func(*NewOAuth2Client){
+		"public client credentials": func(c *NewOAuth2Client) { c.Public = true },
+		"unknown grant":             func(c *NewOAuth2Client) { c.GrantTypes = []string{"password"} },
+		"no redirect URI":           func(c *NewOAuth2Client) { c.RedirectURIs = nil },
+		"relative redirect URI":     func(c *NewOAuth2Client) { c.RedirectURIs = []string{"/callback"} },
+		"redirect URI fragment":     func(c *NewOAuth2Client) { c.RedirectURIs = []string{"https://shop.example.com/#token"} },
+		"unknown scope":             func(c *NewOAuth2Client) { c.Scopes = []string{"orders.write"} },
+	} {
+		client := valid
+		change(&client)
+		require.Error(t, as.validateClient(client), name)
+	}
+}
+
+func TestAuthorizationErrorRedirect(t *testing.T) {
+	redirect := authorizationErrorRedirect("https://app.example.com/callback?tenant=acme", "xyz", "https://id.example.com",
+		oauth2Error("access_denied", "the user denied the request"))
+	parsed, err := url.Parse(redirect)
+	require.NoError(t, err)
+	require.Equal(t, "acme", parsed.Query().Get("tenant"))
+	require.Equal(t, "access_denied", parsed.Query().Get("error"))
+	require.Equal(t, "xyz", parsed.Query().Get("state"))
+	require.Equal(t, "https://id.example.com", parsed.Query().Get("iss"))
+}
+
+func TestIDToken(t *testing.T) {
+	entity := &models.UserEntity{
+		ID: 7, Username: "jane", Email: "jane@example.com", Active: true, Metadata: `{"email_verified": true}`,
+	}
+	ap := newTestAuthProvider(t, entity)
+	kr, err := newKeyRing(JWTConfig{SigningMethod: "RS256"})
+	require.NoError(t, err)
+	ap.keyRing = kr
+	ap.components.authServer = &AuthorizationServer{config: AuthorizationServerConfig{Issuer: "https://id.example.com", AccessTokenTTL: time.Minute}}
+
+	user := ap.components.userStore.(*testUserStore).wrap(entity)
+	client := &OAuth2Client{ClientID: "shop"}
+
+	signed, err := ap.signIDToken(client, user, []string{"openid", "email"}, "n-0S6", 1700000000)
+	require.NoError(t, err)
+	token, err := ap.VerifyToken(signed)
+	require.NoError(t, err)
+	claims := token.Claims.(jwt.MapClaims)
+	require.Equal(t, "https://id.example.com", claims["iss"])
+	require.Equal(t, "7", claims["sub"])
+	require.Equal(t, "shop", claims["aud"])
+	require.Equal(t, "n-0S6", claims["nonce"])
+	require.Equal(t, idTokenType, claims["typ"])
+	require.Equal(t, "jane@example.com", claims["email"])
+	require.Equal(t, true, claims["email_verified"])
+	require.NotContains(t, claims, "preferred_username", "the profile scope was not granted")
+
+	access, err := ap.signOAuth2AccessToken(client, "7", []string{"openid"})
+	require.NoError(t, err)
+	_, err = ap.identityFromJWT(access)
+	require.ErrorIs(t, err, ErrInvalidToken, "access tokens of clients are not access tokens of Zephyrix")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/me", ap.Middleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Code, "ID tokens are not credentials")
+}
@@ -0,0 +1,507 @@
+package zephyrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+// AuthorizationResponse is the outcome of an authorization request, either the redirect to the client
+// carrying the code or the ID of a request awaiting the consent of the user.
+type AuthorizationResponse struct {
+	RedirectURI    string   `json:"redirect_to,omitempty"`
+	ConsentRequest string   `json:"request,omitempty"`
+	Client         string   `json:"client,omitempty"` // name of the client asking for consent
+	Scopes         []string `json:"scopes,omitempty"`
+}
+
+// OAuth2TokenRequest is a request to the token endpoint of the authorization server.
+type OAuth2TokenRequest struct {
+	GrantType    GrantType
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+}
+
+// OAuth2TokenResponse is the answer of the token endpoint (RFC 6749 section 5.1).
+type OAuth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// AuthorizationServer returns the authorization server, e.g. to register clients.
+func (ap *AuthProvider) AuthorizationServer() *AuthorizationServer {
+	return ap.components.authServer
+}
+
+// Authorize answers the authorization request of a client on behalf of the signed in user. The client
+// and the redirect URI must have been checked with authorizationClient, other errors go back to the client.
+func (ap *AuthProvider) Authorize(ctx context.Context, user User, client *OAuth2Client, request AuthorizationRequest) (*AuthorizationResponse, error) {
+	as := ap.components.authServer
+	if request.ResponseType != "code" {
+		return nil, oauth2Error("unsupported_response_type", "only the code response type is supported")
+	}
+	if !client.allows(GrantTypeAuthorization) {
+		return nil, oauth2Error("unauthorized_client", "the client may not use the authorization_code grant")
+	}
+	scopes, err := client.grantedScopes(request.Scope)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case request.CodeChallenge == "" && client.Public:
+		return nil, oauth2Error("invalid_request", "public clients must use PKCE")
+	case request.CodeChallenge != "" && request.CodeChallengeMethod != "S256":
+		return nil, oauth2Error("invalid_request", "code_challenge_method must be S256")
+	}
+
+	pending := &pendingAuthorization{Request: request, UserID: user.ID(), Scopes: scopes, AuthTime: time.Now().Unix()}
+	if request.Prompt == "consent" || !as.hasConsent(ctx, user.ID(), client, scopes) {
+		if request.Prompt == "none" {
+			return nil, oauth2Error("consent_required", "")
+		}
+		id, err := as.savePendingAuthorization(ctx, pending)
+		if err != nil {
+			return nil, err
+		}
+		return &AuthorizationResponse{ConsentRequest: id, Client: client.Name, Scopes: scopes}, nil
+	}
+	return ap.completeAuthorization(ctx, client, pending)
+}
+
+// PendingAuthorization describes a request awaiting the consent of the user, for the consent screen.
+func (ap *AuthProvider) PendingAuthorization(ctx context.Context, user User, id string) (*AuthorizationResponse, error) {
+	as := ap.components.authServer
+	pending, err := as.pendingAuthorization(ctx, id, user.ID())
+	if err != nil {
+		return nil, err
+	}
+	client, err := as.Client(ctx, pending.Request.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthorizationResponse{ConsentRequest: id, Client: client.Name, Scopes: pending.Scopes}, nil
+}
+
+// AnswerConsent completes a request awaiting consent, the returned redirect carries the code
+// or the access_denied error.
+func (ap *AuthProvider) AnswerConsent(ctx context.Context, user User, id string, approved bool) (*AuthorizationResponse, error) {
+	as := ap.components.authServer
+	pending, err := as.consumePendingAuthorization(ctx, id, user.ID())
+	if err != nil {
+		return nil, err
+	}
+	client, err := as.Client(ctx, pending.Request.ClientID)
+	if err != nil || client.Revoked {
+		return nil, oauth2Error("invalid_client", "unknown client")
+	}
+	redirectURI, _ := client.redirectURI(pending.Request.RedirectURI)
+
+	if !approved {
+		as.log(ctx, "oauth2_consent_denied", user.ID(), "client_id="+client.ClientID)
+		return &AuthorizationResponse{RedirectURI: authorizationErrorRedirect(redirectURI, pending.Request.State, as.Issuer(),
+			oauth2Error("access_denied", "the user denied the request"))}, nil
+	}
+	if err := as.grantConsent(ctx, user.ID(), client.ClientID, pending.Scopes); err != nil {
+		return nil, err
+	}
+	return ap.completeAuthorization(ctx, client, pending)
+}
+
+// completeAuthorization issues the authorization code of an approved request.
+func (ap *AuthProvider) completeAuthorization(ctx context.Context, client *OAuth2Client, pending *pendingAuthorization) (*AuthorizationResponse, error) {
+	as := ap.components.authServer
+	redirectURI, _ := client.redirectURI(pending.Request.RedirectURI)
+	code, err := as.issueCode(ctx, &authorizationCode{
+		ClientID:      client.ClientID,
+		RedirectURI:   pending.Request.RedirectURI, // the token request must repeat it when it was sent
+		UserID:        pending.UserID,
+		Scopes:        pending.Scopes,
+		CodeChallenge: pending.Request.CodeChallenge,
+		Nonce:         pending.Request.Nonce,
+		AuthTime:      pending.AuthTime,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue authorization code: %w", err)
+	}
+
+	query := url.Values{"code": {code}, "iss": {as.Issuer()}}
+	if pending.Request.State != "" {
+		query.Set("state", pending.Request.State)
+	}
+	return &AuthorizationResponse{RedirectURI: appendQuery(redirectURI, query)}, nil
+}
+
+// authorizationClient returns the client of an authorization request and its redirect URI. Its errors
+// must not be redirected, the redirect URI is not trusted yet.
+func (ap *AuthProvider) authorizationClient(ctx context.Context, request AuthorizationRequest) (*OAuth2Client, string, error) {
+	client, err := ap.components.authServer.Client(ctx, request.ClientID)
+	if err != nil || client.Revoked {
+		return nil, "", oauth2Error("invalid_client", "unknown client")
+	}
+	redirectURI, ok := client.redirectURI(request.RedirectURI)
+	if !ok {
+		return nil, "", oauth2Error("invalid_request", "redirect_uri is not registered for the client")
+	}
+	return client, redirectURI, nil
+}
+
+// ExchangeOAuth2Token issues tokens to an authenticated client.
+func (ap *AuthProvider) ExchangeOAuth2Token(ctx context.Context, client *OAuth2Client, request OAuth2TokenRequest) (*OAuth2TokenResponse, error) {
+	if !client.allows(request.GrantType) {
+		return nil, oauth2Error("unauthorized_client", fmt.Sprintf("the client may not use the %s grant", request.GrantType))
+	}
+
+	switch request.GrantType {
+	case GrantTypeAuthorization:
+		return ap.exchangeAuthorizationCode(ctx, client, request)
+	case GrantTypeRefreshToken:
+		return ap.exchangeOAuth2RefreshToken(ctx, client, request)
+	case GrantTypeClientCredentials:
+		scopes, err := client.grantedScopes(request.Scope)
+		if err != nil {
+			return nil, err
+		}
+		// OIDC scopes describe users, a client acting on its own behalf has none
+		scopes = slices.DeleteFunc(scopes, func(scope string) bool {
+			return slices.Contains([]string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopeOfflineAccess}, scope)
+		})
+		accessToken, err := ap.signOAuth2AccessToken(client, client.ClientID, scopes)
+		if err != nil {
+			return nil, err
+		}
+		ap.components.authServer.log(ctx, "oauth2_client_credentials", 0, "client_id="+client.ClientID)
+		return ap.oauth2TokenResponse(accessToken, scopes), nil
+	default:
+		return nil, oauth2Error("unsupported_grant_type", "")
+	}
+}
+
+func (ap *AuthProvider) exchangeAuthorizationCode(ctx context.Context, client *OAuth2Client, request OAuth2TokenRequest) (*OAuth2TokenResponse, error) {
+	grant, err := ap.components.authServer.consumeCode(ctx, request.Code)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case grant.ClientID != client.ClientID:
+		return nil, oauth2Error("invalid_grant", "the code was issued to another client")
+	case grant.RedirectURI != request.RedirectURI:
+		return nil, oauth2Error("invalid_grant", "redirect_uri does not match the authorization request")
+	case !verifyPKCE(grant.CodeChallenge, request.CodeVerifier):
+		return nil, oauth2Error("invalid_grant", "invalid code_verifier")
+	}
+
+	user, err := ap.oauth2User(ctx, grant.UserID)
+	if err != nil {
+		return nil, err
+	}
+	response, err := ap.issueOAuth2Tokens(ctx, client, user, grant.Scopes, grant.Scopes, "", grant.Nonce, grant.AuthTime)
+	if err != nil {
+		return nil, err
+	}
+	ap.components.authServer.log(ctx, "oauth2_authorization_code", user.ID(), "client_id="+client.ClientID)
+	return response, nil
+}
+
+func (ap *AuthProvider) exchangeOAuth2RefreshToken(ctx context.Context, client *OAuth2Client, request OAuth2TokenRequest) (*OAuth2TokenResponse, error) {
+	user, stored, err := ap.consumeRefreshToken(ctx, request.RefreshToken, "", client.ClientID)
+	if err != nil {
+		if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrRefreshTokenReused) || errors.Is(err, ErrAccountDisabled) || errors.Is(err, ErrAccountLocked) {
+			return nil, oauth2Error("invalid_grant", err.Error())
+		}
+		return nil, err
+	}
+
+	// the scopes of the access token may be narrowed, the refresh token keeps the original grant
+	scopes := stored.Scopes
+	if requested := strings.Fields(request.Scope); len(requested) > 0 {
+		if err := scopesWithin(requested, stored.Scopes); err != nil {
+			return nil, err
+		}
+		scopes = requested
+	}
+	if !ap.components.authServer.hasConsent(ctx, user.ID(), client, stored.Scopes) {
+		ap.revokeRefreshTokenFamily(ctx, stored.FamilyID)
+		return nil, oauth2Error("invalid_grant", "the consent was revoked")
+	}
+	return ap.issueOAuth2Tokens(ctx, client, user, scopes, stored.Scopes, stored.FamilyID, "", 0)
+}
+
+// revokeRefreshTokenFamily revokes a refresh token family, logging the failure.
+func (ap *AuthProvider) revokeRefreshTokenFamily(ctx context.Context, familyID string) {
+	if err := ap.components.refreshTokens.RevokeFamily(ctx, familyID); err != nil {
+		Logger.Error("Failed to revoke refresh token family %s: %s", familyID, err)
+	}
+}
+
+// oauth2User loads the user of a grant, which must still be allowed to sign in.
+func (ap *AuthProvider) oauth2User(ctx context.Context, userID uint64) (User, error) {
+	user, err := ap.components.userStore.GetByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, oauth2Error("invalid_grant", "unknown user")
+		}
+		return nil, err
+	}
+	if !user.IsActive() || ap.components.lockout.IsLocked(ctx, user) {
+		return nil, oauth2Error("invalid_grant", "the account is disabled or locked")
+	}
+	return user, nil
+}
+
+// issueOAuth2Tokens issues the access token, the ID token when openid was granted and a refresh
+// token of the family when the client may refresh, an empty familyID starts a new family.
+func (ap *AuthProvider) issueOAuth2Tokens(ctx context.Context, client *OAuth2Client, user User, scopes, granted []string, familyID, nonce string, authTime int64) (*OAuth2TokenResponse, error) {
+	accessToken, err := ap.signOAuth2AccessToken(client, strconv.FormatUint(user.ID(), 10), scopes)
+	if err != nil {
+		return nil, err
+	}
+	response := ap.oauth2TokenResponse(accessToken, scopes)
+
+	if slices.Contains(scopes, ScopeOpenID) {
+		if response.IDToken, err = ap.signIDToken(client, user, scopes, nonce, authTime); err != nil {
+			return nil, err
+		}
+	}
+
+	if client.allows(GrantTypeRefreshToken) && ap.components.refreshTokens != nil {
+		refreshToken, err := newOpaqueToken()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+		}
+		if familyID == "" {
+			familyID = uuid.NewString()
+		}
+		expiration := ap.config.JWT.RefreshExpiration
+		if expiration <= 0 {
+			expiration = defaultRefreshExpiration
+		}
+
+		now := time.Now().UTC()
+		if err := ap.components.refreshTokens.Save(ctx, &RefreshToken{
+			TokenHash: hashRefreshToken(refreshToken),
+			FamilyID:  familyID,
+			UserID:    user.ID(),
+			ClientID:  client.ClientID,
+			Scopes:    granted,
+			CreatedAt: now,
+			ExpiresAt: now.Add(expiration),
+		}); err != nil {
+			return nil, fmt.Errorf("failed to store refresh token: %w", err)
+		}
+		response.RefreshToken = refreshToken
+	}
+	return response, nil
+}
+
+func (ap *AuthProvider) oauth2TokenResponse(accessToken string, scopes []string) *OAuth2TokenResponse {
+	return &OAuth2TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(ap.components.authServer.config.AccessTokenTTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}
+}
+
+// signOAuth2AccessToken signs an access token of a client. Its typ keeps it from being accepted
+// as an access token of Zephyrix itself, the scopes it was granted would not be enforced.
+func (ap *AuthProvider) signOAuth2AccessToken(client *OAuth2Client, subject string, scopes []string) (string, error) {
+	as := ap.components.authServer
+	now := time.Now()
+	return ap.signClaims(jwt.MapClaims{
+		"typ":       authzAccessTokenType,
+		"jti":       uuid.NewString(),
+		"iss":       as.Issuer(),
+		"sub":       subject,
+		"aud":       client.ClientID,
+		"client_id": client.ClientID,
+		"scope":     strings.Join(scopes, " "),
+		"iat":       now.Unix(),
+		"exp":       now.Add(as.config.AccessTokenTTL).Unix(),
+	})
+}
+
+// signIDToken signs the OpenID Connect ID token of the user.
+func (ap *AuthProvider) signIDToken(client *OAuth2Client, user User, scopes []string, nonce string, authTime int64) (string, error) {
+	as := ap.components.authServer
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": as.Issuer(),
+		"sub": strconv.FormatUint(user.ID(), 10),
+		"aud": client.ClientID,
+		"azp": client.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(as.config.AccessTokenTTL).Unix(),
+		"typ": idTokenType,
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if authTime != 0 {
+		claims["auth_time"] = authTime
+	}
+	for name, value := range userClaims(user, scopes) {
+		claims[name] = value
+	}
+	return ap.signClaims(claims)
+}
+
+// userClaims returns the standard claims of the user covered by the scopes.
+func userClaims(user User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": strconv.FormatUint(user.ID(), 10)}
+	if slices.Contains(scopes, ScopeProfile) {
+		claims["preferred_username"] = user.Username()
+		if !user.UpdatedAt().IsZero() {
+			claims["updated_at"] = user.UpdatedAt().Unix()
+		}
+	}
+	if slices.Contains(scopes, ScopeEmail) && user.Email() != "" {
+		claims["email"] = user.Email()
+		if verified, err := user.GetMetadata("email_verified"); err == nil {
+			if verified, ok := verified.(bool); ok {
+				claims["email_verified"] = verified
+			}
+		}
+	}
+	return claims
+}
+
+// parseOAuth2AccessToken verifies an access token issued to a client.
+func (ap *AuthProvider) parseOAuth2AccessToken(ctx context.Context, token string) (jwt.MapClaims, error) {
+	as := ap.components.authServer
+	parsed, err := ap.VerifyToken(token)
+	if err != nil || !parsed.Valid {
+		return nil, ErrInvalidToken
+	}
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != authzAccessTokenType || !claims.VerifyIssuer(as.Issuer(), true) {
+		return nil, ErrInvalidToken
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, ErrInvalidToken
+	}
+	if jti, _ := claims["jti"].(string); jti == "" || as.isAccessTokenRevoked(ctx, jti) {
+		return nil, ErrInvalidToken
+	}
+	clientID, _ := claims["client_id"].(string)
+	if client, err := as.Client(ctx, clientID); err != nil || client.Revoked {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// IntrospectOAuth2Token describes a token to a confidential client (RFC 7662). Refresh tokens are only
+// described to the client they were issued to, inactive tokens only answer {"active": false}.
+func (ap *AuthProvider) IntrospectOAuth2Token(ctx context.Context, client *OAuth2Client, token string) map[string]interface{} {
+	if claims, err := ap.parseOAuth2AccessToken(ctx, token); err == nil {
+		response := map[string]interface{}{"active": true, "token_type": "Bearer"}
+		for _, name := range []string{"scope", "client_id", "sub", "aud", "iss", "exp", "iat", "jti"} {
+			if value, ok := claims[name]; ok {
+				response[name] = value
+			}
+		}
+		return response
+	}
+
+	if store := ap.components.refreshTokens; store != nil {
+		stored, err := store.Get(ctx, hashRefreshToken(token))
+		if err == nil && stored.ClientID == client.ClientID && !stored.Revoked && stored.UsedAt == nil && time.Now().Before(stored.ExpiresAt) {
+			return map[string]interface{}{
+				"active":     true,
+				"token_type": "refresh_token",
+				"scope":      strings.Join(stored.Scopes, " "),
+				"client_id":  stored.ClientID,
+				"sub":        strconv.FormatUint(stored.UserID, 10),
+				"iat":        stored.CreatedAt.Unix(),
+				"exp":        stored.ExpiresAt.Unix(),
+			}
+		}
+	}
+	return map[string]interface{}{"active": false}
+}
+
+// RevokeOAuth2Token revokes a token of the client (RFC 7009), a refresh token revokes its whole family.
+// Unknown tokens and tokens of other clients are ignored.
+func (ap *AuthProvider) RevokeOAuth2Token(ctx context.Context, client *OAuth2Client, token string) {
+	as := ap.components.authServer
+	if claims, err := ap.parseOAuth2AccessToken(ctx, token); err == nil {
+		if claims["client_id"] == client.ClientID {
+			jti, _ := claims["jti"].(string)
+			exp, _ := claims["exp"].(float64)
+			as.revokeAccessToken(ctx, jti, time.Unix(int64(exp), 0))
+			as.log(ctx, "oauth2_access_token_revoked", 0, "client_id="+client.ClientID)
+		}
+		return
+	}
+
+	if store := ap.components.refreshTokens; store != nil {
+		if stored, err := store.Get(ctx, hashRefreshToken(token)); err == nil && stored.ClientID == client.ClientID {
+			ap.revokeRefreshTokenFamily(ctx, stored.FamilyID)
+			as.log(ctx, "oauth2_refresh_token_revoked", stored.UserID, "client_id="+client.ClientID)
+		}
+	}
+}
+
+// OAuth2UserInfo returns the claims of the user of an access token granted the openid scope.
+func (ap *AuthProvider) OAuth2UserInfo(ctx context.Context, accessToken string) (map[string]interface{}, error) {
+	claims, err := ap.parseOAuth2AccessToken(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	scopes := strings.Fields(claimString(claims, "scope"))
+	if !slices.Contains(scopes, ScopeOpenID) {
+		return nil, fmt.Errorf("%w: the openid scope was not granted", ErrForbidden)
+	}
+	userID, err := claimUint64(claims, "sub")
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	user, err := ap.components.userStore.GetByID(ctx, userID)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !user.IsActive() || ap.components.lockout.IsLocked(ctx, user) {
+		return nil, ErrInvalidToken
+	}
+	return userClaims(user, scopes), nil
+}
+
+// authorizationErrorRedirect returns the redirect carrying an error of the authorization request.
+func authorizationErrorRedirect(redirectURI, state, issuer string, err *OAuth2Error) string {
+	query := url.Values{"error": {err.Code}, "iss": {issuer}}
+	if err.Description != "" {
+		query.Set("error_description", err.Description)
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	return appendQuery(redirectURI, query)
+}
+
+// appendQuery adds parameters to the query of a URL, keeping the ones it already has.
+func appendQuery(rawURL string, query url.Values) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	values := parsed.Query()
+	for name, value := range query {
+		values[name] = value
+	}
+	parsed.RawQuery = values.Encode()
+	return parsed.String()
+}
@@ -0,0 +1,392 @@
+package zephyrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+const (
+	defaultAuthorizationCacheTTL = 10 * time.Minute
+	rbacCachePrefix              = "zephyrix:rbac"
+	// maxRoleDepth bounds the role hierarchy walk, protecting against cycles created in the database.
+	maxRoleDepth = 32
+)
+
+// AuthorizationConfig configures the role and permission based access control.
+type AuthorizationConfig struct {
+	CacheTTL time.Duration `mapstructure:"cache_ttl"` // lifetime of the cached permission sets of the roles
+}
+
+// Authorizer answers permission checks from the roles of the users.
+//
+// Roles are stored in `zephyrix_roles` and may inherit the permissions of a parent role,
+// permissions are named `<resource>.<action>` and granted to roles through `zephyrix_role_permissions`.
+// A granted permission matches by name, `orders.*` grants every action on orders and `*` grants everything.
+//
+// The effective permission set of each role is cached in Redis, every change made through
+// the Authorizer bumps a version key, which invalidates the cached sets of all the instances.
+type Authorizer struct {
+	orm         beeorm.Engine
+	redisClient beeorm.RedisCache
+	users       UserStore
+	audit       *AuditLogger
+	ttl         time.Duration
+}
+
+func NewAuthorizer(conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, users UserStore, audit *AuditLogger) *Authorizer {
+	ttl := conf.Authentication.Authorization.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultAuthorizationCacheTTL
+	}
+	return &Authorizer{
+		orm:         orm,
+		redisClient: redisClient,
+		users:       users,
+		audit:       audit,
+		ttl:         ttl,
+	}
+}
+
+// Can reports whether the user may perform action on resource, i.e. holds the `<resource>.<action>` permission.
+func (a *Authorizer) Can(ctx context.Context, user User, action, resource string) (bool, error) {
+	return a.HasPermission(ctx, user.Roles(), resource+"."+action)
+}
+
+// HasPermission reports whether one of the roles, or a role they inherit from, grants the permission.
+func (a *Authorizer) HasPermission(ctx context.Context, roles []string, permission string) (bool, error) {
+	for _, role := range roles {
+		permissions, err := a.RolePermissions(ctx, role)
+		if err != nil {
+			return false, err
+		}
+		for _, granted := range permissions {
+			if permissionMatches(granted, permission) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// EffectiveRoles returns the roles together with every role they inherit from.
+func (a *Authorizer) EffectiveRoles(ctx context.Context, roles []string) ([]string, error) {
+	effective := make([]string, 0, len(roles))
+	for _, role := range roles {
+		resolved, err := a.resolveRole(ctx, role)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range resolved.Roles {
+			if !slices.Contains(effective, name) {
+				effective = append(effective, name)
+			}
+		}
+	}
+	return effective, nil
+}
+
+// RolePermissions returns the effective permissions of a role, including the inherited ones.
+func (a *Authorizer) RolePermissions(ctx context.Context, role string) ([]string, error) {
+	resolved, err := a.resolveRole(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	return resolved.Permissions, nil
+}
+
+// resolvedRole is the cached outcome of walking the hierarchy of a role.
+type resolvedRole struct {
+	Roles       []string `json:"roles"` // the role and its ancestors, nearest first
+	Permissions []string `json:"permissions"`
+}
+
+func (a *Authorizer) resolveRole(ctx context.Context, role string) (*resolvedRole, error) {
+	orm := a.orm.NewORM(ctx)
+	key := a.cacheKey(orm, role)
+	if cached, found := a.redisClient.Get(orm, key); found {
+		var resolved resolvedRole
+		if err := json.Unmarshal([]byte(cached), &resolved); err == nil {
+			return &resolved, nil
+		}
+	}
+
+	roles, permissions, err := resolveRoleHierarchy(role, func(name string) (string, []string, bool) {
+		entity, found := beeorm.GetByUniqueIndex[models.RoleEntity](orm, "name", name)
+		if !found {
+			return "", nil, false
+		}
+		var granted []string
+		iterator := beeorm.Search[models.RolePermissionEntity](orm, beeorm.NewWhere("`Role` = ?", name), nil)
+		for iterator.Next() {
+			granted = append(granted, iterator.Entity().Permission)
+		}
+		return entity.Parent, granted, true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := &resolvedRole{Roles: roles, Permissions: permissions}
+	encoded, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, err
+	}
+	a.redisClient.Set(orm, key, string(encoded), a.ttl)
+	return resolved, nil
+}
+
+// resolveRoleHierarchy walks the hierarchy of a role, lookup returns the parent
+// and the permissions granted directly to a role. It returns the role followed by
+// its ancestors, and the permissions granted along the way.
+func resolveRoleHierarchy(role string, lookup func(role string) (parent string, permissions []string, found bool)) ([]string, []string, error) {
+	seen := make(map[string]bool)
+	unique := make(map[string]bool)
+	roles := make([]string, 0)
+	permissions := make([]string, 0)
+
+	for name := role; name != ""; {
+		if seen[name] {
+			return nil, nil, fmt.Errorf("role %s inherits from itself", name)
+		}
+		if len(seen) >= maxRoleDepth {
+			return nil, nil, fmt.Errorf("role %s exceeds the maximum hierarchy depth of %d", role, maxRoleDepth)
+		}
+		seen[name] = true
+		roles = append(roles, name)
+
+		parent, granted, found := lookup(name)
+		if !found {
+			// roles without a definition simply grant nothing
+			break
+		}
+		for _, permission := range granted {
+			if !unique[permission] {
+				unique[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+		name = parent
+	}
+
+	return roles, permissions, nil
+}
+
+// permissionMatches reports whether a granted permission, possibly a wildcard, covers the required one.
+func permissionMatches(granted, required string) bool {
+	if granted == "*" || granted == required {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(granted, "*"); ok {
+		return strings.HasPrefix(required, prefix)
+	}
+	return false
+}
+
+func (a *Authorizer) cacheKey(orm beeorm.ORM, role string) string {
+	version, _ := a.redisClient.Get(orm, rbacCachePrefix+":version")
+	return rbacCachePrefix + ":" + version + ":role:" + role
+}
+
+// invalidate drops the cached permission sets of every role.
+func (a *Authorizer) invalidate(ctx context.Context) {
+	a.redisClient.Incr(a.orm.NewORM(ctx), rbacCachePrefix+":version")
+}
+
+// CreateRole creates a role, or updates the parent of an existing one.
+func (a *Authorizer) CreateRole(ctx context.Context, name, parent, description string) error {
+	name, parent = strings.TrimSpace(name), strings.TrimSpace(parent)
+	if name == "" {
+		return errors.New("role name is required")
+	}
+	if name == parent {
+		return fmt.Errorf("role %s can not inherit from itself", name)
+	}
+
+	orm := a.orm.NewORM(ctx)
+	if entity, found := beeorm.GetByUniqueIndex[models.RoleEntity](orm, "name", name); found {
+		entity = beeorm.EditEntity(orm, entity)
+		entity.Parent = parent
+		if description != "" {
+			entity.Description = description
+		}
+	} else {
+		entity = beeorm.NewEntity[models.RoleEntity](orm)
+		entity.Name = name
+		entity.Parent = parent
+		entity.Description = description
+		entity.CreatedAt = time.Now().UTC()
+	}
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to save role %s: %w", name, err)
+	}
+
+	a.invalidate(ctx)
+	a.log(ctx, "rbac_role_saved", fmt.Sprintf("role=%s parent=%s", name, parent))
+	return nil
+}
+
+// DeleteRole deletes a role and its grants, users keep the role name but it no longer grants anything.
+func (a *Authorizer) DeleteRole(ctx context.Context, name string) error {
+	orm := a.orm.NewORM(ctx)
+	entity, found := beeorm.GetByUniqueIndex[models.RoleEntity](orm, "name", name)
+	if !found {
+		return fmt.Errorf("role %s not found", name)
+	}
+	beeorm.DeleteEntity(orm, entity)
+	iterator := beeorm.Search[models.RolePermissionEntity](orm, beeorm.NewWhere("`Role` = ?", name), nil)
+	for iterator.Next() {
+		beeorm.DeleteEntity(orm, iterator.Entity())
+	}
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to delete role %s: %w", name, err)
+	}
+
+	a.invalidate(ctx)
+	a.log(ctx, "rbac_role_deleted", "role="+name)
+	return nil
+}
+
+// Grant grants a permission to a role, creating both when they do not exist yet.
+func (a *Authorizer) Grant(ctx context.Context, role, permission string) error {
+	if role == "" || permission == "" {
+		return errors.New("role and permission are required")
+	}
+
+	orm := a.orm.NewORM(ctx)
+	now := time.Now().UTC()
+	if _, found := beeorm.GetByUniqueIndex[models.RoleEntity](orm, "name", role); !found {
+		entity := beeorm.NewEntity[models.RoleEntity](orm)
+		entity.Name = role
+		entity.CreatedAt = now
+	}
+	if _, found := beeorm.GetByUniqueIndex[models.PermissionEntity](orm, "name", permission); !found {
+		entity := beeorm.NewEntity[models.PermissionEntity](orm)
+		entity.Name = permission
+		entity.CreatedAt = now
+	}
+	if _, found := beeorm.GetByUniqueIndex[models.RolePermissionEntity](orm, "role_permission", role, permission); !found {
+		entity := beeorm.NewEntity[models.RolePermissionEntity](orm)
+		entity.Role = role
+		entity.Permission = permission
+		entity.CreatedAt = now
+	}
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to grant %s to %s: %w", permission, role, err)
+	}
+
+	a.invalidate(ctx)
+	a.log(ctx, "rbac_grant", fmt.Sprintf("role=%s permission=%s", role, permission))
+	return nil
+}
+
+// Revoke removes a permission granted to a role.
+func (a *Authorizer) Revoke(ctx context.Context, role, permission string) error {
+	orm := a.orm.NewORM(ctx)
+	entity, found := beeorm.GetByUniqueIndex[models.RolePermissionEntity](orm, "role_permission", role, permission)
+	if !found {
+		return fmt.Errorf("permission %s is not granted to %s", permission, role)
+	}
+	beeorm.DeleteEntity(orm, entity)
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to revoke %s from %s: %w", permission, role, err)
+	}
+
+	a.invalidate(ctx)
+	a.log(ctx, "rbac_revoke", fmt.Sprintf("role=%s permission=%s", role, permission))
+	return nil
+}
+
+// Assign adds a role to a user.
+func (a *Authorizer) Assign(ctx context.Context, user User, role string) error {
+	if err := user.AddRole(role); err != nil {
+		return err
+	}
+	if err := a.users.Update(ctx, user); err != nil {
+		return fmt.Errorf("failed to assign %s to %s: %w", role, user.Username(), err)
+	}
+	a.log(ctx, "rbac_assign", fmt.Sprintf("user=%s role=%s", user.Username(), role))
+	return nil
+}
+
+// Unassign removes a role from a user.
+func (a *Authorizer) Unassign(ctx context.Context, user User, role string) error {
+	if err := user.RemoveRole(role); err != nil {
+		return err
+	}
+	if err := a.users.Update(ctx, user); err != nil {
+		return fmt.Errorf("failed to remove %s from %s: %w", role, user.Username(), err)
+	}
+	a.log(ctx, "rbac_unassign", fmt.Sprintf("user=%s role=%s", user.Username(), role))
+	return nil
+}
+
+func (a *Authorizer) log(ctx context.Context, action, details string) {
+	if a.audit == nil {
+		return
+	}
+	if err := a.audit.Log(ctx, action, "", details); err != nil {
+		Logger.Error("Failed to write %s to the audit log: %s", action, err)
+	}
+}
+
+// permissionMiddleware exposes permission checks as the named middleware "can".
+//
+// Usage: "can:orders.write" or "can:orders.read,invoices.read", every listed permission is required.
+// The request is authenticated first when no "auth" middleware ran before it.
+type permissionMiddleware struct {
+	ap         *AuthProvider
+	authorizer *Authorizer
+}
+
+func newPermissionMiddleware(ap *AuthProvider, authorizer *Authorizer) *permissionMiddleware {
+	return &permissionMiddleware{ap: ap, authorizer: authorizer}
+}
+
+func (m *permissionMiddleware) Name() string {
+	return "can"
+}
+
+func (m *permissionMiddleware) Handler(args ...any) any {
+	permissions := make([]string, 0, len(args))
+	for _, arg := range args {
+		if permission := fmt.Sprint(arg); permission != "" {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	return func(c *gin.Context) {
+		if _, authenticated := c.Get(userContextKey); !authenticated && !m.ap.authenticate(c) {
+			return
+		}
+
+		user := c.MustGet(userContextKey).(User)
+		identity, _ := c.Value(identityContextKey).(*Identity)
+		for _, permission := range permissions {
+			if identity != nil && !identity.HasScope(permission) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient_scope", "permission": permission})
+				return
+			}
+			allowed, err := m.authorizer.HasPermission(c.Request.Context(), user.Roles(), permission)
+			if err != nil {
+				Logger.Error("Failed to check permission %s: %s", permission, err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "permission": permission})
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,163 @@
+package zephyrix
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+// runCommand starts the application and runs f with a dependency resolved from it,
+// the command stops the application when it returns.
+func runCommand[T any](z *zephyrix, f func(ctx context.Context, dependency T) error) error {
+	var result error
+	z.options = append(z.options, fx.Invoke(func(dependency T) {
+		result = f(z.c, dependency)
+	}))
+	if err := z.fxStart(); err != nil {
+		return err
+	}
+	return result
+}
+
+// rbacCommand builds the `rbac` command managing roles, permissions and role assignments.
+func (z *zephyrix) rbacCommand(cancel context.CancelFunc) *cobra.Command {
+	var parent, description string
+
+	run := func(f func(ctx context.Context, a *Authorizer) error) func(*cobra.Command, []string) error {
+		return func(_ *cobra.Command, _ []string) error {
+			return runCommand(z, f)
+		}
+	}
+
+	userCommand := func(f func(ctx context.Context, a *Authorizer, user User, role string) error) func(*cobra.Command, []string) error {
+		return func(cmd *cobra.Command, args []string) error {
+			return run(func(ctx context.Context, a *Authorizer) error {
+				user, err := a.users.GetByUsername(ctx, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to find user %s: %w", args[0], err)
+				}
+				return f(ctx, a, user, args[1])
+			})(cmd, args)
+		}
+	}
+
+	rbacCommand := &cobra.Command{
+		GroupID: authGroup.ID,
+		Use:     "rbac",
+		Short:   "Manage roles and permissions",
+		Long:    "Manage roles, the permissions granted to them and the roles assigned to users",
+		PersistentPreRun: func(_ *cobra.Command, _ []string) {
+			z.options = append(z.options, fx.Invoke(beeormInvoke))
+		},
+		PersistentPostRun: func(_ *cobra.Command, _ []string) {
+			defer cancel()
+		},
+	}
+
+	roleCommand := &cobra.Command{
+		Use:   "role <name>",
+		Short: "Create or update a role",
+		Args:  cobra.ExactArgs(1),
+	}
+	roleCommand.RunE = func(cmd *cobra.Command, args []string) error {
+		return run(func(ctx context.Context, a *Authorizer) error {
+			if err := a.CreateRole(ctx, args[0], parent, description); err != nil {
+				return err
+			}
+			Logger.Info("Role %s saved", args[0])
+			return nil
+		})(cmd, args)
+	}
+	roleCommand.Flags().StringVarP(&parent, "parent", "p", "", "role whose permissions are inherited")
+	roleCommand.Flags().StringVarP(&description, "description", "d", "", "description of the role")
+
+	deleteRoleCommand := &cobra.Command{
+		Use:   "delete-role <name>",
+		Short: "Delete a role and its grants",
+		Args:  cobra.ExactArgs(1),
+	}
+	deleteRoleCommand.RunE = func(cmd *cobra.Command, args []string) error {
+		return run(func(ctx context.Context, a *Authorizer) error {
+			if err := a.DeleteRole(ctx, args[0]); err != nil {
+				return err
+			}
+			Logger.Info("Role %s deleted", args[0])
+			return nil
+		})(cmd, args)
+	}
+
+	grantCommand := &cobra.Command{
+		Use:   "grant <role> <permission>",
+		Short: "Grant a permission to a role",
+		Args:  cobra.ExactArgs(2),
+	}
+	grantCommand.RunE = func(cmd *cobra.Command, args []string) error {
+		return run(func(ctx context.Context, a *Authorizer) error {
+			if err := a.Grant(ctx, args[0], args[1]); err != nil {
+				return err
+			}
+			Logger.Info("Granted %s to %s", args[1], args[0])
+			return nil
+		})(cmd, args)
+	}
+
+	revokeCommand := &cobra.Command{
+		Use:   "revoke <role> <permission>",
+		Short: "Revoke a permission from a role",
+		Args:  cobra.ExactArgs(2),
+	}
+	revokeCommand.RunE = func(cmd *cobra.Command, args []string) error {
+		return run(func(ctx context.Context, a *Authorizer) error {
+			if err := a.Revoke(ctx, args[0], args[1]); err != nil {
+				return err
+			}
+			Logger.Info("Revoked %s from %s", args[1], args[0])
+			return nil
+		})(cmd, args)
+	}
+
+	assignCommand := &cobra.Command{
+		Use:   "assign <username> <role>",
+		Short: "Assign a role to a user",
+		Args:  cobra.ExactArgs(2),
+		RunE: userCommand(func(ctx context.Context, a *Authorizer, user User, role string) error {
+			if err := a.Assign(ctx, user, role); err != nil {
+				return err
+			}
+			Logger.Info("Assigned %s to %s", role, user.Username())
+			return nil
+		}),
+	}
+
+	unassignCommand := &cobra.Command{
+		Use:   "unassign <username> <role>",
+		Short: "Remove a role from a user",
+		Args:  cobra.ExactArgs(2),
+		RunE: userCommand(func(ctx context.Context, a *Authorizer, user User, role string) error {
+			if err := a.Unassign(ctx, user, role); err != nil {
+				return err
+			}
+			Logger.Info("Removed %s from %s", role, user.Username())
+			return nil
+		}),
+	}
+
+	checkCommand := &cobra.Command{
+		Use:   "check <username> <permission>",
+		Short: "Check whether a user holds a permission",
+		Args:  cobra.ExactArgs(2),
+		RunE: userCommand(func(ctx context.Context, a *Authorizer, user User, permission string) error {
+			allowed, err := a.HasPermission(ctx, user.Roles(), permission)
+			if err != nil {
+				return err
+			}
+			Logger.Info("%s %s: %t (roles: %v)", user.Username(), permission, allowed, user.Roles())
+			return nil
+		}),
+	}
+
+	rbacCommand.AddCommand(roleCommand, deleteRoleCommand, grantCommand, revokeCommand, assignCommand, unassignCommand, checkCommand)
+	return rbacCommand
+}
@@ -0,0 +1,46 @@
+package zephyrix
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionMatches(t *testing.T) {
+	require.True(t, permissionMatches("orders.write", "orders.write"))
+	require.True(t, permissionMatches("orders.*", "orders.write"))
+	require.True(t, permissionMatches("*", "invoices.read"))
+	require.False(t, permissionMatches("orders.read", "orders.write"))
+	require.False(t, permissionMatches("orders.*", "invoices.read"))
+}
+
+func TestResolveRoleHierarchy(t *testing.T) {
+	type role struct {
+		parent      string
+		permissions []string
+	}
+	roles := map[string]role{
+		"viewer": {permissions: []string{"orders.read"}},
+		"editor": {parent: "viewer", permissions: []string{"orders.write", "orders.read"}},
+		"admin":  {parent: "editor", permissions: []string{"users.*"}},
+		"loop-a": {parent: "loop-b"},
+		"loop-b": {parent: "loop-a"},
+	}
+	lookup := func(name string) (string, []string, bool) {
+		r, ok := roles[name]
+		return r.parent, r.permissions, ok
+	}
+
+	chain, permissions, err := resolveRoleHierarchy("admin", lookup)
+	require.NoError(t, err)
+	require.Equal(t, []string{"admin", "editor", "viewer"}, chain)
+	require.ElementsMatch(t, []string{"users.*", "orders.write", "orders.read"}, permissions)
+
+	chain, permissions, err = resolveRoleHierarchy("unknown", lookup)
+	require.NoError(t, err)
+	require.Equal(t, []string{"unknown"}, chain, "a role without a definition is still held")
+	require.Empty(t, permissions)
+
+	_, _, err = resolveRoleHierarchy("loop-a", lookup)
+	require.Error(t, err, "cycles are reported instead of looping forever")
+}
@@ -0,0 +1,174 @@
+package zephyrix
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// cborMaxDepth bounds the nesting of decoded items, WebAuthn structures are at most a few levels deep.
+const cborMaxDepth = 16
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// cborDecode decodes the first CBOR (RFC 8949) item of data and returns it with the remaining bytes.
+//
+// It covers what WebAuthn attestation objects and COSE keys use: integers are returned as int64,
+// byte strings as []byte, text as string, arrays as []interface{} and maps as map[interface{}]interface{}.
+// Tags are skipped, indefinite lengths are refused as authenticators must use the canonical encoding.
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeItem(data, 0)
+}
+
+func cborDecodeItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nesting too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	if major == 7 {
+		return cborDecodeSimple(data)
+	}
+
+	arg, data, err := cborArgument(info, data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if uint64(len(data)) < arg {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 2 {
+			return append([]byte(nil), data[:arg]...), data[arg:], nil
+		}
+		return string(data[:arg]), data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			if item, data, err = cborDecodeItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, errCBORTruncated
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			if key, data, err = cborDecodeItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+			if value, data, err = cborDecodeItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			if _, duplicate := items[key]; duplicate {
+				return nil, nil, fmt.Errorf("cbor: duplicate map key %v", key)
+			}
+			items[key] = value
+		}
+		return items, data, nil
+	default: // 6, tags
+		return cborDecodeItem(data, depth+1)
+	}
+}
+
+// cborArgument reads the argument of an item header, the length or the value of the item.
+func cborArgument(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	case info == 31:
+		return 0, nil, errors.New("cbor: indefinite length items are not supported")
+	case info > 27:
+		return 0, nil, fmt.Errorf("cbor: invalid additional information %d", info)
+	default:
+		return 0, nil, errCBORTruncated
+	}
+}
+
+func cborDecodeSimple(data []byte) (interface{}, []byte, error) {
+	info := data[0] & 0x1f
+	data = data[1:]
+	switch info {
+	case 20:
+		return false, data, nil
+	case 21:
+		return true, data, nil
+	case 22, 23:
+		return nil, data, nil
+	case 25:
+		if len(data) < 2 {
+			return nil, nil, errCBORTruncated
+		}
+		return float64(halfToFloat32(binary.BigEndian.Uint16(data))), data[2:], nil
+	case 26:
+		if len(data) < 4 {
+			return nil, nil, errCBORTruncated
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+	case 27:
+		if len(data) < 8 {
+			return nil, nil, errCBORTruncated
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+}
+
+// halfToFloat32 converts an IEEE 754 half precision float.
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exponent := uint32(h>>10) & 0x1f
+	mantissa := uint32(h) & 0x3ff
+
+	switch exponent {
+	case 0:
+		// subnormal numbers and zeros
+		value := float32(mantissa) / 1024 / 16384
+		if sign != 0 {
+			return -value
+		}
+		return value
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	default:
+		return math.Float32frombits(sign | (exponent+112)<<23 | mantissa<<13)
+	}
+}
@@ -0,0 +1,279 @@
+package zephyrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CodeMessage is a one-time code to deliver to a user.
+type CodeMessage struct {
+	Method  MFAMethod     // MFAMethodEmail or MFAMethodSMS
+	To      string        // email address or phone number
+	Code    string        // the code in clear text
+	Purpose string        // what the code is for, e.g. "login"
+	TTL     time.Duration // how long the code stays valid
+}
+
+// Text renders the default body of the message.
+func (m CodeMessage) Text() string {
+	return fmt.Sprintf("Your %s verification code is %s. It expires in %d minutes.", m.Purpose, m.Code, int(m.TTL.Round(time.Minute)/time.Minute))
+}
+
+// CodeSender delivers one-time codes, e.g. by email or SMS.
+// Custom senders can be plugged with MFAManager.SetCodeSender.
+type CodeSender interface {
+	SendCode(ctx context.Context, message CodeMessage) error
+}
+
+// Mail is a plain text email.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MailSender delivers emails, e.g. magic links. The SMTP, webhook and file senders implement both
+// MailSender and CodeSender.
+type MailSender interface {
+	SendMail(ctx context.Context, mail Mail) error
+}
+
+// CodeSenderConfig selects and configures a code or mail sender.
+type CodeSenderConfig struct {
+	Driver  string              `mapstructure:"driver"` // "smtp", "webhook" or "file"
+	SMTP    SMTPConfig          `mapstructure:"smtp"`
+	Webhook WebhookSenderConfig `mapstructure:"webhook"`
+	File    string              `mapstructure:"file"` // path of the file, "stdout" or empty for the standard output
+}
+
+// SMTPConfig configures the SMTP email sender.
+type SMTPConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	From     string `mapstructure:"from"`
+	Subject  string `mapstructure:"subject"`
+}
+
+// WebhookSenderConfig configures the sender posting codes to an SMS gateway.
+type WebhookSenderConfig struct {
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"` // e.g. the Authorization header of the gateway
+	Timeout time.Duration     `mapstructure:"timeout"`
+}
+
+// sender is implemented by every built-in driver.
+type sender interface {
+	CodeSender
+	MailSender
+}
+
+// newCodeSender creates the sender described by the configuration, nil when no driver is configured.
+func newCodeSender(config CodeSenderConfig) (CodeSender, error) {
+	s, err := newSender(config)
+	if s == nil || err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newMailSender creates the mail sender described by the configuration, nil when no driver is configured.
+func newMailSender(config CodeSenderConfig) (MailSender, error) {
+	s, err := newSender(config)
+	if s == nil || err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newSender(config CodeSenderConfig) (sender, error) {
+	switch strings.ToLower(config.Driver) {
+	case "":
+		return nil, nil
+	case "smtp":
+		return NewSMTPCodeSender(config.SMTP)
+	case "webhook":
+		return NewWebhookCodeSender(config.Webhook)
+	case "file":
+		return NewFileCodeSender(config.File), nil
+	default:
+		return nil, fmt.Errorf("unknown code sender driver: %s", config.Driver)
+	}
+}
+
+// SMTPCodeSender sends codes by email, upgrading the connection with STARTTLS when the server offers it.
+type SMTPCodeSender struct {
+	config SMTPConfig
+	addr   string
+	auth   smtp.Auth
+}
+
+func NewSMTPCodeSender(config SMTPConfig) (*SMTPCodeSender, error) {
+	if config.Host == "" || config.From == "" {
+		return nil, fmt.Errorf("the smtp sender requires a host and a from address")
+	}
+	if config.Port == 0 {
+		config.Port = 587
+	}
+	if config.Subject == "" {
+		config.Subject = "Your verification code"
+	}
+
+	sender := &SMTPCodeSender{config: config, addr: net.JoinHostPort(config.Host, strconv.Itoa(config.Port))}
+	if config.Username != "" {
+		// net/smtp refuses to send PLAIN credentials over an unencrypted connection, except to localhost
+		sender.auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+	return sender, nil
+}
+
+func (s *SMTPCodeSender) SendCode(ctx context.Context, message CodeMessage) error {
+	return s.SendMail(ctx, Mail{To: message.To, Subject: s.config.Subject, Body: message.Text()})
+}
+
+func (s *SMTPCodeSender) SendMail(ctx context.Context, mail Mail) error {
+	if strings.ContainsAny(mail.To, "\r\n") {
+		return fmt.Errorf("invalid email address %q", mail.To)
+	}
+	if strings.ContainsAny(mail.Subject, "\r\n") {
+		return fmt.Errorf("invalid email subject %q", mail.Subject)
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", s.config.From)
+	fmt.Fprintf(&body, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&body, "Subject: %s\r\n", mail.Subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n") + "\r\n")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, s.auth, s.config.From, []string{mail.To}, body.Bytes())
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send email: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WebhookCodeSender posts codes as JSON to an HTTP endpoint, usually an SMS gateway or a small adapter in front of one.
+//
+// The body is {"to": "...", "method": "sms", "code": "...", "message": "...", "expires_in": 300}.
+type WebhookCodeSender struct {
+	config WebhookSenderConfig
+	client *http.Client
+}
+
+func NewWebhookCodeSender(config WebhookSenderConfig) (*WebhookCodeSender, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("the webhook sender requires a url")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &WebhookCodeSender{config: config, client: &http.Client{Timeout: config.Timeout}}, nil
+}
+
+func (s *WebhookCodeSender) SendCode(ctx context.Context, message CodeMessage) error {
+	return s.post(ctx, map[string]interface{}{
+		"to":         message.To,
+		"method":     message.Method,
+		"code":       message.Code,
+		"message":    message.Text(),
+		"expires_in": int(message.TTL.Seconds()),
+	})
+}
+
+// SendMail posts {"to": "...", "method": "email", "subject": "...", "message": "..."}.
+func (s *WebhookCodeSender) SendMail(ctx context.Context, mail Mail) error {
+	return s.post(ctx, map[string]interface{}{
+		"to":      mail.To,
+		"method":  MFAMethodEmail,
+		"subject": mail.Subject,
+		"message": mail.Body,
+	})
+}
+
+func (s *WebhookCodeSender) post(ctx context.Context, body map[string]interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call the code webhook: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("code webhook answered with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// FileCodeSender appends codes to a file or writes them to the standard output, for development only.
+type FileCodeSender struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileCodeSender(path string) *FileCodeSender {
+	return &FileCodeSender{path: path}
+}
+
+func (s *FileCodeSender) SendCode(_ context.Context, message CodeMessage) error {
+	return s.write(fmt.Sprintf("[%s] %s to %s: %s\n", time.Now().UTC().Format(time.RFC3339), message.Method, message.To, message.Text()))
+}
+
+func (s *FileCodeSender) SendMail(_ context.Context, mail Mail) error {
+	return s.write(fmt.Sprintf("[%s] email to %s: %s\n%s\n", time.Now().UTC().Format(time.RFC3339), mail.To, mail.Subject, mail.Body))
+}
+
+func (s *FileCodeSender) write(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path == "" || s.path == "stdout" {
+		_, err := fmt.Fprint(os.Stdout, line)
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open code file: %w", err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(line)
+	return err
+}
@@ -0,0 +1,202 @@
+package zephyrix
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTPServer speaks just enough SMTP for net/smtp.SendMail and records the received message.
+type fakeSMTPServer struct {
+	listener net.Listener
+	messages chan smtpMessage
+}
+
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeSMTPServer{listener: listener, messages: make(chan smtpMessage, 10)}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	var message smtpMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			message.From = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			message.To = append(message.To, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			message.Data = data.String()
+			s.messages <- message
+			message = smtpMessage{}
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPCodeSender(t *testing.T) {
+	server := newFakeSMTPServer(t)
+
+	sender, err := newCodeSender(CodeSenderConfig{
+		Driver: "smtp",
+		SMTP:   SMTPConfig{Host: "127.0.0.1", Port: server.port(), From: "noreply@example.com"},
+	})
+	require.NoError(t, err)
+
+	err = sender.SendCode(context.Background(), CodeMessage{
+		Method: MFAMethodEmail, To: "jane@example.com", Code: "123456", Purpose: "login", TTL: 5 * time.Minute,
+	})
+	require.NoError(t, err)
+
+	select {
+	case message := <-server.messages:
+		require.Equal(t, "noreply@example.com", message.From)
+		require.Equal(t, []string{"jane@example.com"}, message.To)
+		require.Contains(t, message.Data, "Subject: Your verification code")
+		require.Contains(t, message.Data, "Your login verification code is 123456. It expires in 5 minutes.")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the smtp server did not receive the message")
+	}
+
+	err = sender.SendCode(context.Background(), CodeMessage{Method: MFAMethodEmail, To: "jane@example.com\r\nBcc: x@example.com", Code: "1"})
+	require.Error(t, err)
+}
+
+func TestWebhookCodeSender(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer gateway-token", r.Header.Get("Authorization"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		if received["to"] == "+10000000000" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	sender, err := newCodeSender(CodeSenderConfig{
+		Driver:  "webhook",
+		Webhook: WebhookSenderConfig{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer gateway-token"}},
+	})
+	require.NoError(t, err)
+
+	message := CodeMessage{Method: MFAMethodSMS, To: "+15555550100", Code: "654321", Purpose: "login", TTL: 5 * time.Minute}
+	require.NoError(t, sender.SendCode(context.Background(), message))
+	require.Equal(t, "+15555550100", received["to"])
+	require.Equal(t, "sms", received["method"])
+	require.Equal(t, "654321", received["code"])
+	require.Equal(t, float64(300), received["expires_in"])
+
+	message.To = "+10000000000"
+	require.Error(t, sender.SendCode(context.Background(), message))
+}
+
+func TestFileCodeSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "codes.log")
+	sender, err := newCodeSender(CodeSenderConfig{Driver: "file", File: path})
+	require.NoError(t, err)
+
+	require.NoError(t, sender.SendCode(context.Background(), CodeMessage{Method: MFAMethodSMS, To: "+15555550100", Code: "111111", Purpose: "login", TTL: time.Minute}))
+	require.NoError(t, sender.SendCode(context.Background(), CodeMessage{Method: MFAMethodEmail, To: "jane@example.com", Code: "222222", Purpose: "login", TTL: time.Minute}))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], "sms to +15555550100")
+	require.Contains(t, lines[1], "222222")
+}
+
+func TestNewCodeSender(t *testing.T) {
+	sender, err := newCodeSender(CodeSenderConfig{})
+	require.NoError(t, err)
+	require.Nil(t, sender)
+
+	_, err = newCodeSender(CodeSenderConfig{Driver: "pigeon"})
+	require.Error(t, err)
+
+	_, err = newCodeSender(CodeSenderConfig{Driver: "smtp"})
+	require.Error(t, err)
+}
+
+func TestOTPCodeHelpers(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := generateNumericCode(6)
+		require.NoError(t, err)
+		require.Len(t, code, 6)
+		_, err = strconv.Atoi(code)
+		require.NoError(t, err)
+	}
+
+	require.NotEqual(t, hashOTPCode("a", "123456"), hashOTPCode("b", "123456"))
+
+	require.Equal(t, "j***@example.com", maskDestination("jane@example.com"))
+	require.Equal(t, "********0100", maskDestination("+15555550100"))
+	require.Equal(t, "***", maskDestination("123"))
+}
@@ -0,0 +1,444 @@
+package zephyrix
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionConfig holds the configuration of the response compression stage.
+type CompressionConfig struct {
+	Enabled      bool     `mapstructure:"enabled"`
+	Encodings    []string `mapstructure:"encodings"`     // supported encodings by server preference, defaults to br, zstd, gzip
+	Level        int      `mapstructure:"level"`         // compression level, 0 uses the default of each encoding
+	MinSize      int      `mapstructure:"min_size"`      // smaller responses are sent uncompressed
+	MimeTypes    []string `mapstructure:"mime_types"`    // compressible content types, "text/*" matches a whole family
+	ExcludePaths []string `mapstructure:"exclude_paths"` // path prefixes that are never compressed
+
+	DecompressRequests bool  `mapstructure:"decompress_requests"`   // accept gzip encoded request bodies
+	MaxRequestBodySize int64 `mapstructure:"max_request_body_size"` // limit of a decompressed request body
+}
+
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+	encodingZstd   = "zstd"
+)
+
+var defaultCompressionMimeTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/problem+json",
+	"application/manifest+json",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// compressionEncoder is the common interface of the gzip, brotli and zstd writers.
+type compressionEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressor negotiates the response encoding and hands out pooled encoders.
+type compressor struct {
+	config    CompressionConfig
+	encodings []string
+	pools     map[string]*sync.Pool
+}
+
+// newCompressor validates the compression configuration and prepares the encoder pools.
+func newCompressor(config CompressionConfig) (*compressor, error) {
+	if len(config.Encodings) == 0 {
+		config.Encodings = []string{encodingBrotli, encodingZstd, encodingGzip}
+	}
+	if config.MinSize <= 0 {
+		config.MinSize = 1024
+	}
+	if len(config.MimeTypes) == 0 {
+		config.MimeTypes = defaultCompressionMimeTypes
+	}
+	if config.MaxRequestBodySize <= 0 {
+		config.MaxRequestBodySize = 10 << 20 // 10 MiB
+	}
+
+	c := &compressor{config: config, pools: make(map[string]*sync.Pool)}
+	for _, encoding := range config.Encodings {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		newEncoder, err := encoderFactory(encoding, config.Level)
+		if err != nil {
+			return nil, err
+		}
+		c.encodings = append(c.encodings, encoding)
+		c.pools[encoding] = &sync.Pool{New: func() any { return newEncoder() }}
+	}
+	return c, nil
+}
+
+// encoderFactory returns a constructor of encoders for the given encoding and level.
+func encoderFactory(encoding string, level int) (func() compressionEncoder, error) {
+	switch encoding {
+	case encodingGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		} else if level > gzip.BestCompression {
+			level = gzip.BestCompression
+		}
+		if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+			return nil, fmt.Errorf("invalid gzip level %d: %w", level, err)
+		}
+		return func() compressionEncoder {
+			w, _ := gzip.NewWriterLevel(io.Discard, level)
+			return w
+		}, nil
+	case encodingBrotli:
+		if level == 0 {
+			level = brotli.DefaultCompression
+		} else if level > brotli.BestCompression {
+			level = brotli.BestCompression
+		}
+		return func() compressionEncoder {
+			return brotli.NewWriterLevel(io.Discard, level)
+		}, nil
+	case encodingZstd:
+		speed := zstd.SpeedDefault
+		if level != 0 {
+			speed = zstd.EncoderLevelFromZstd(level)
+		}
+		if _, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(speed)); err != nil {
+			return nil, fmt.Errorf("invalid zstd level %d: %w", level, err)
+		}
+		return func() compressionEncoder {
+			w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(1))
+			return w
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression encoding: %s", encoding)
+	}
+}
+
+// negotiate picks the encoding of a response from the Accept-Encoding header of the request.
+// The highest q-value wins, ties are broken by the server preference order.
+func (c *compressor) negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	weights := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			weights[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range c.encodings {
+		q, ok := weights[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether responses of the given content type are worth compressing.
+func (c *compressor) compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, allowed := range c.config.MimeTypes {
+		if family, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if strings.HasPrefix(mediaType, family+"/") {
+				return true
+			}
+		} else if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether the request path is excluded from compression.
+func (c *compressor) excluded(path string) bool {
+	for _, prefix := range c.config.ExcludePaths {
+		if hasPathPrefix(path, strings.TrimSuffix(prefix, "/*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns the gin middleware compressing responses and decompressing request bodies.
+func (c *compressor) handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if c.config.DecompressRequests && !c.decompressRequest(ctx) {
+			return
+		}
+
+		if c.excluded(ctx.Request.URL.Path) || ctx.Request.Method == http.MethodHead {
+			ctx.Next()
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: ctx.Writer,
+			compressor:     c,
+			encoding:       c.negotiate(ctx.GetHeader("Accept-Encoding")),
+		}
+		ctx.Writer = cw
+		defer func() {
+			cw.finish()
+			ctx.Writer = cw.ResponseWriter
+		}()
+
+		ctx.Next()
+	}
+}
+
+// decompressRequest replaces a gzip encoded request body by its decoded content.
+// It writes the error response and returns false when the body cannot be decoded.
+func (c *compressor) decompressRequest(ctx *gin.Context) bool {
+	encoding := strings.ToLower(strings.TrimSpace(ctx.GetHeader("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return true
+	case encodingGzip:
+	default:
+		ctx.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported content encoding"})
+		return false
+	}
+
+	reader, err := gzip.NewReader(ctx.Request.Body)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid gzip body"})
+		return false
+	}
+
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, gzipRequestBody{Reader: reader, body: ctx.Request.Body}, c.config.MaxRequestBodySize)
+	ctx.Request.Header.Del("Content-Encoding")
+	ctx.Request.Header.Del("Content-Length")
+	ctx.Request.ContentLength = -1
+	return true
+}
+
+// gzipRequestBody closes both the gzip reader and the original request body.
+type gzipRequestBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gzipRequestBody) Close() error {
+	_ = b.Reader.Close()
+	return b.body.Close()
+}
+
+// compressWriter buffers the beginning of a response until it knows whether compressing it is worth it.
+type compressWriter struct {
+	gin.ResponseWriter
+	compressor *compressor
+	encoding   string
+
+	decided     bool
+	compressing bool
+	buffer      []byte
+	encoder     compressionEncoder
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		if !w.eligible(data) {
+			w.decided = true
+			return w.ResponseWriter.Write(data)
+		}
+		w.buffer = append(w.buffer, data...)
+		if len(w.buffer) < w.compressor.config.MinSize {
+			return len(data), nil
+		}
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	if w.compressing {
+		return w.encoder.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteHeaderNow is called when the headers must be sent before any body,
+// the response is then sent uncompressed.
+func (w *compressWriter) WriteHeaderNow() {
+	w.decided = true
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Flush sends what has been written so far, streaming responses (SSE, chunked proxies) are
+// compressed from their first flush whatever their current size.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.eligible(w.buffer) {
+			if err := w.start(); err != nil {
+				Logger.Error("Failed to start response compression: %s", err)
+				return
+			}
+		} else {
+			w.decided = true
+			w.flushBuffer()
+		}
+	}
+
+	if w.compressing {
+		if err := w.encoder.Flush(); err != nil {
+			Logger.Error("Failed to flush compressed response: %s", err)
+			return
+		}
+	}
+	w.ResponseWriter.Flush()
+}
+
+// eligible decides from the response headers whether the response may be compressed.
+func (w *compressWriter) eligible(data []byte) bool {
+	header := w.Header()
+
+	if w.compressor.compressible(header.Get("Content-Type")) || (header.Get("Content-Type") == "" && len(data) > 0) {
+		// the response varies on Accept-Encoding even when this client gets it uncompressed
+		addVary(header, "Accept-Encoding")
+	}
+
+	if w.encoding == "" || w.ResponseWriter.Written() {
+		return false
+	}
+	// upstream (proxies) or precompressed (static files) responses are never encoded twice
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if status := w.Status(); status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return false
+	}
+	if length := header.Get("Content-Length"); length != "" {
+		if n, err := strconv.Atoi(length); err == nil && n < w.compressor.config.MinSize {
+			return false
+		}
+	}
+	if header.Get("Content-Type") == "" && len(data) > 0 {
+		header.Set("Content-Type", http.DetectContentType(data))
+	}
+	return w.compressor.compressible(header.Get("Content-Type"))
+}
+
+// start switches the response to compressed mode and writes the buffered data through the encoder.
+func (w *compressWriter) start() error {
+	w.decided = true
+	w.compressing = true
+
+	header := w.Header()
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	// the representation changes, a strong validator would no longer be valid
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+
+	w.encoder = w.compressor.pools[w.encoding].Get().(compressionEncoder)
+	w.encoder.Reset(w.ResponseWriter)
+
+	if len(w.buffer) > 0 {
+		buffered := w.buffer
+		w.buffer = nil
+		if _, err := w.encoder.Write(buffered); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushBuffer writes the buffered data uncompressed.
+func (w *compressWriter) flushBuffer() {
+	if len(w.buffer) == 0 {
+		return
+	}
+	buffered := w.buffer
+	w.buffer = nil
+	if _, err := w.ResponseWriter.Write(buffered); err != nil {
+		Logger.Error("Failed to write response: %s", err)
+	}
+}
+
+// finish completes the response once the handlers returned.
+func (w *compressWriter) finish() {
+	if !w.decided {
+		// the whole response is smaller than min_size
+		w.decided = true
+		w.flushBuffer()
+		return
+	}
+
+	if w.compressing {
+		if err := w.encoder.Close(); err != nil {
+			Logger.Error("Failed to complete compressed response: %s", err)
+		}
+		w.encoder.Reset(io.Discard)
+		w.compressor.pools[w.encoding].Put(w.encoder)
+		w.encoder = nil
+	}
+}
+
+// addVary adds a value to the Vary header unless it is already listed.
+func addVary(header http.Header, value string) {
+	for _, existing := range header.Values("Vary") {
+		for _, v := range strings.Split(existing, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), value) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", value)
+}
+
+// configureCompression installs the compression stage described under `server.compression`.
+func (z *zephyrix) configureCompression(handler *gin.Engine) {
+	if !z.config.Server.Compression.Enabled {
+		return
+	}
+	c, err := newCompressor(z.config.Server.Compression)
+	if err != nil {
+		Logger.Error("Failed to configure response compression: %s", err)
+		return
+	}
+	handler.Use(c.handler())
+}
@@ -0,0 +1,141 @@
+package zephyrix
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionNegotiate(t *testing.T) {
+	c, err := newCompressor(CompressionConfig{Enabled: true})
+	require.NoError(t, err)
+
+	require.Equal(t, "", c.negotiate(""))
+	require.Equal(t, "gzip", c.negotiate("gzip, deflate"))
+	require.Equal(t, "br", c.negotiate("gzip, br"))
+	require.Equal(t, "gzip", c.negotiate("gzip;q=1.0, br;q=0.5"))
+	require.Equal(t, "gzip", c.negotiate("gzip, br;q=0"))
+	require.Equal(t, "br", c.negotiate("*"))
+	require.Equal(t, "", c.negotiate("identity"))
+
+	_, err = newCompressor(CompressionConfig{Encodings: []string{"lzma"}})
+	require.Error(t, err)
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	c, err := newCompressor(CompressionConfig{
+		Enabled:            true,
+		MinSize:            64,
+		ExcludePaths:       []string{"/raw"},
+		DecompressRequests: true,
+	})
+	require.NoError(t, err)
+
+	large := strings.Repeat("zephyrix ", 100)
+	handler := gin.New()
+	handler.Use(c.handler())
+	handler.GET("/large", func(c *gin.Context) { c.String(http.StatusOK, large) })
+	handler.GET("/small", func(c *gin.Context) { c.String(http.StatusOK, "tiny") })
+	handler.GET("/raw", func(c *gin.Context) { c.String(http.StatusOK, large) })
+	handler.GET("/image", func(c *gin.Context) { c.Data(http.StatusOK, "image/png", []byte(large)) })
+	handler.GET("/encoded", func(c *gin.Context) {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(http.StatusOK, "text/plain", []byte(large))
+	})
+	handler.GET("/events", func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		_, _ = c.Writer.WriteString("data: one\n\n")
+		c.Writer.Flush()
+		_, _ = c.Writer.WriteString("data: two\n\n")
+	})
+	handler.POST("/echo", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		require.NoError(t, err)
+		c.String(http.StatusOK, string(body))
+	})
+
+	do := func(method, path, acceptEncoding string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("gzip", func(t *testing.T) {
+		w := do(http.MethodGet, "/large", "gzip", nil)
+		require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		reader, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		decoded, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, large, string(decoded))
+	})
+
+	t.Run("brotli", func(t *testing.T) {
+		w := do(http.MethodGet, "/large", "gzip, br", nil)
+		require.Equal(t, "br", w.Header().Get("Content-Encoding"))
+		decoded, err := io.ReadAll(brotli.NewReader(w.Body))
+		require.NoError(t, err)
+		require.Equal(t, large, string(decoded))
+	})
+
+	t.Run("uncompressed responses", func(t *testing.T) {
+		for _, path := range []string{"/small", "/raw", "/image"} {
+			w := do(http.MethodGet, path, "gzip", nil)
+			require.Empty(t, w.Header().Get("Content-Encoding"), path)
+		}
+
+		w := do(http.MethodGet, "/large", "", nil)
+		require.Empty(t, w.Header().Get("Content-Encoding"))
+		require.Equal(t, large, w.Body.String())
+		require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	})
+
+	t.Run("already encoded", func(t *testing.T) {
+		w := do(http.MethodGet, "/encoded", "gzip", nil)
+		require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		require.Equal(t, large, w.Body.String())
+	})
+
+	t.Run("streaming is compressed from the first flush", func(t *testing.T) {
+		w := do(http.MethodGet, "/events", "gzip", nil)
+		require.True(t, w.Flushed)
+		require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		reader, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		decoded, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "data: one\n\ndata: two\n\n", string(decoded))
+	})
+
+	t.Run("request decompression", func(t *testing.T) {
+		var body bytes.Buffer
+		gz := gzip.NewWriter(&body)
+		_, _ = gz.Write([]byte(`{"name":"zephyrix"}`))
+		require.NoError(t, gz.Close())
+
+		w := do(http.MethodPost, "/echo", "", &body, "Content-Encoding", "gzip")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, `{"name":"zephyrix"}`, w.Body.String())
+
+		w = do(http.MethodPost, "/echo", "", strings.NewReader("data"), "Content-Encoding", "compress")
+		require.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+}
@@ -17,3 +17,11 @@ func (z *zephyrix) newZephyrixContext(ginContext *gin.Context) *zephyrixContext
 func (z *zephyrixContext) JSON(code int, obj interface{}) {
 	z.Context.JSON(code, obj)
 }
+
+func (z *zephyrixContext) CSPNonce() string {
+	nonce := z.Context.GetString(cspNonceContextKey)
+	if nonce != "" {
+		z.Context.Set(cspNonceUsedContextKey, true)
+	}
+	return nonce
+}
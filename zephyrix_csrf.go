@@ -0,0 +1,149 @@
+package zephyrix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// CSRFModeSynchronizer keeps the token in the session, requests echo it in the header or form field.
+	CSRFModeSynchronizer = "synchronizer"
+	// CSRFModeDoubleSubmit keeps the token in a cookie readable by scripts, requests echo it in the header
+	// or form field. The token is bound to the session, a cookie planted from a sibling domain is refused.
+	CSRFModeDoubleSubmit = "double_submit"
+
+	defaultCSRFCookieName = "zephyrix_csrf"
+	defaultCSRFHeaderName = "X-CSRF-Token"
+	defaultCSRFFormField  = "csrf_token"
+	maxCSRFFormSize       = 1 << 20 // 1 MiB, larger forms send the header
+
+	// csrfSessionKey holds the token of the synchronizer mode in Session.Data.
+	csrfSessionKey = "csrf_token"
+)
+
+// normalize applies the defaults of the configuration.
+func (c CSRFConfig) normalize() CSRFConfig {
+	if c.Mode != CSRFModeDoubleSubmit {
+		c.Mode = CSRFModeSynchronizer
+	}
+	if c.CookieName == "" {
+		c.CookieName = defaultCSRFCookieName
+	}
+	if c.HeaderName == "" {
+		c.HeaderName = defaultCSRFHeaderName
+	}
+	if c.FormField == "" {
+		c.FormField = defaultCSRFFormField
+	}
+	return c
+}
+
+// CSRFEnabled reports whether unsafe requests authenticated with the session cookie must carry a CSRF token.
+func (sm *SessionManager) CSRFEnabled() bool {
+	return sm.config.CSRF.Enabled
+}
+
+// VerifyCSRF checks the token of an unsafe request made with the session, safe methods need none.
+// It returns ErrInvalidCSRFToken when the token is missing or does not belong to the session.
+func (sm *SessionManager) VerifyCSRF(r *http.Request, session *Session) error {
+	if !sm.CSRFEnabled() || isSafeMethod(r.Method) {
+		return nil
+	}
+	if session == nil {
+		return fmt.Errorf("%w: no session", ErrInvalidCSRFToken)
+	}
+
+	presented := r.Header.Get(sm.config.CSRF.HeaderName)
+	if presented == "" {
+		presented = csrfFormValue(r, sm.config.CSRF.FormField)
+	}
+	expected := sm.csrfToken(r, session)
+	if presented == "" || expected == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) != 1 {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
+
+// csrfToken returns the token of the session, empty when none was issued yet.
+func (sm *SessionManager) csrfToken(r *http.Request, session *Session) string {
+	if sm.config.CSRF.Mode == CSRFModeDoubleSubmit {
+		cookie, err := r.Cookie(sm.config.CSRF.CookieName)
+		if err != nil || !validDoubleSubmitToken(session.ID, cookie.Value) {
+			return ""
+		}
+		return cookie.Value
+	}
+	token, _ := session.Data[csrfSessionKey].(string)
+	return token
+}
+
+// issueCSRFToken creates a new token of the session. The synchronizer token is stored in the
+// session data, which the caller saves, the double submit token is sent in its cookie.
+func (sm *SessionManager) issueCSRFToken(w http.ResponseWriter, session *Session) (string, error) {
+	nonce, err := newOpaqueToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate CSRF token: %w", err)
+	}
+	if sm.config.CSRF.Mode != CSRFModeDoubleSubmit {
+		session.Data[csrfSessionKey] = nonce
+		return nonce, nil
+	}
+
+	token := doubleSubmitToken(session.ID, nonce)
+	// scripts read the cookie to echo it, it is not HttpOnly
+	http.SetCookie(w, sm.cookie(sm.config.CSRF.CookieName, token, session.ExpiresAt, false))
+	return token, nil
+}
+
+// doubleSubmitToken binds the nonce to the session, the session ID is secret so only the server can compute it.
+func doubleSubmitToken(sessionID, nonce string) string {
+	sum := sha256.Sum256([]byte(sessionID + "\x00" + nonce))
+	return nonce + "." + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func validDoubleSubmitToken(sessionID, token string) bool {
+	dot := strings.LastIndexByte(token, '.')
+	if dot <= 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(doubleSubmitToken(sessionID, token[:dot]))) == 1
+}
+
+// csrfFormValue reads the field of an url encoded form. The body is put back, the handlers parse it
+// again and the reverse proxy forwards it.
+func csrfFormValue(r *http.Request, field string) string {
+	if r.PostForm != nil {
+		return r.PostForm.Get(field)
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "application/x-www-form-urlencoded" || r.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCSRFFormSize))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return ""
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return ""
+	}
+	return values.Get(field)
+}
+
+// isSafeMethod reports whether the method is read-only and needs no CSRF protection.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -105,10 +105,12 @@ func (z *zephyrix) setupHandler(handlers *ZephyrixRouteHandlers, mw *ZephyrixMid
 
 	z.configureMiddleware(handler)
 	z.configureCORS(handler)
+	z.configureSecurityHeaders(handler)
 	z.configureTrustedProxies(handler)
 	z.assignHandler(handler)
 	z.registerRoutes(handler, handlers, mw)
 
+	z.setupStatic(handler)
 	z.setupProxies(handler)
 
 	return handler
@@ -126,6 +128,8 @@ func (z *zephyrix) getGinMode() string {
 func (z *zephyrix) createGinEngine() *gin.Engine {
 	handler := gin.New()
 	handler.UseH2C = true
+	// a path known to the route tree is never handed to the proxies, even for an unregistered method
+	handler.HandleMethodNotAllowed = true
 	viper.SetDefault("server.max_multipart_memory", 8<<20) // 8 MiB
 	handler.MaxMultipartMemory = z.config.Server.MaxMultipartMemory
 	return handler
@@ -135,6 +139,7 @@ func (z *zephyrix) createGinEngine() *gin.Engine {
 func (z *zephyrix) configureMiddleware(handler *gin.Engine) {
 	handler.Use(gin.CustomRecovery(z.panicRecovery))
 	handler.Use(z.customGinLogger())
+	z.configureCompression(handler)
 }
 
 // panicRecovery handles panics in the Gin engine.
@@ -211,8 +216,7 @@ func (z *zephyrix) registerRoutes(handler *gin.Engine, handlers *ZephyrixRouteHa
 
 		methods := route.Method()
 		path := route.Path()
-		middlewares := make([]any, 0, len(route.Handlers()))
-		middlewares = append(middlewares, route.Handlers()...)
+		var middlewares []any
 
 		if configExists {
 			Logger.Debug("Applying configuration for route: %s", routeName)
@@ -223,9 +227,11 @@ func (z *zephyrix) registerRoutes(handler *gin.Engine, handlers *ZephyrixRouteHa
 				path = routeConfig.Path
 			}
 			if len(routeConfig.Middlewares) > 0 {
+				// configured middlewares, like "auth", have to run before the handlers of the route
 				middlewares = append(middlewares, routeConfig.Middlewares...)
 			}
 		}
+		middlewares = append(middlewares, route.Handlers()...)
 
 		Logger.Debug("Route %s: %v %s", routeName, methods, path)
 
@@ -0,0 +1,165 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+const invitationClaimPrefix = "zephyrix:invitation:"
+
+// Invitation lets someone register, also while invitation_only is set.
+// Only the SHA-256 of its code is stored.
+type Invitation struct {
+	ID        uint64     `json:"id"`
+	Email     string     `json:"email,omitempty"`
+	Roles     []string   `json:"roles,omitempty"`
+	CreatedBy uint64     `json:"created_by,omitempty"`
+	UsedBy    uint64     `json:"used_by,omitempty"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	Revoked   bool       `json:"revoked"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+// NewInvitation holds the attributes of an invitation to create.
+type NewInvitation struct {
+	Email     string        // restricts the invitation to this address, which is emailed the code when a mail sender is configured
+	Roles     []string      // granted to the registered user, in addition to default_roles
+	ExpiresIn time.Duration // defaults to invitation_ttl
+	CreatedBy uint64        // the administrator creating the invitation
+}
+
+// CreateInvitation creates an invitation and returns its code, which is not stored and can not be shown again.
+func (rm *RegistrationManager) CreateInvitation(ctx context.Context, input NewInvitation) (*Invitation, string, error) {
+	code, err := newOpaqueToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate invitation code: %w", err)
+	}
+	if input.ExpiresIn <= 0 {
+		input.ExpiresIn = rm.config.InvitationTTL
+	}
+	roles, _ := json.Marshal(input.Roles)
+
+	now := time.Now().UTC()
+	orm := rm.orm.NewORM(ctx)
+	entity := beeorm.NewEntity[models.InvitationEntity](orm)
+	entity.CodeHash = hashInvitationCode(code)
+	entity.Email = normalizeUsername(input.Email)
+	entity.Roles = string(roles)
+	entity.CreatedBy = input.CreatedBy
+	entity.CreatedAt = now
+	entity.ExpiresAt = now.Add(input.ExpiresIn)
+	if err := orm.Flush(); err != nil {
+		return nil, "", fmt.Errorf("failed to create invitation: %w", err)
+	}
+
+	invitation := invitationFromEntity(entity)
+	rm.log(ctx, "invitation_created", input.CreatedBy, fmt.Sprintf("invitation=%d to=%s", invitation.ID, maskDestination(invitation.Email)))
+
+	if invitation.Email != "" && rm.mailer != nil && rm.config.InvitationURL != "" {
+		err := rm.mailer.SendMail(ctx, Mail{
+			To:      invitation.Email,
+			Subject: "You are invited",
+			Body: fmt.Sprintf("You are invited to create an account, open the link below before %s:\n\n%s",
+				invitation.ExpiresAt.Format(time.RFC1123), tokenLink(rm.config.InvitationURL, code)),
+		})
+		if err != nil {
+			Logger.Error("Failed to email invitation %d: %s", invitation.ID, err)
+		}
+	}
+	return invitation, code, nil
+}
+
+// Invitations returns every invitation, newest first.
+func (rm *RegistrationManager) Invitations(ctx context.Context) ([]*Invitation, error) {
+	invitations := make([]*Invitation, 0)
+	iterator := beeorm.Search[models.InvitationEntity](rm.orm.NewORM(ctx), beeorm.NewWhere("1 ORDER BY `ID` DESC"), nil)
+	for iterator.Next() {
+		invitations = append(invitations, invitationFromEntity(iterator.Entity()))
+	}
+	return invitations, nil
+}
+
+// RevokeInvitation stops an unused invitation from working.
+func (rm *RegistrationManager) RevokeInvitation(ctx context.Context, id uint64) error {
+	orm := rm.orm.NewORM(ctx)
+	entity, found := beeorm.GetByID[models.InvitationEntity](orm, id)
+	if !found {
+		return fmt.Errorf("invitation %d not found", id)
+	}
+	entity = beeorm.EditEntity(orm, entity)
+	entity.Revoked = true
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to revoke invitation: %w", err)
+	}
+	rm.log(ctx, "invitation_revoked", 0, fmt.Sprintf("invitation=%d", id))
+	return nil
+}
+
+// invitation returns the usable invitation with the code, for the email address.
+func (rm *RegistrationManager) invitation(ctx context.Context, code, email string) (*Invitation, error) {
+	entity, found := beeorm.GetByUniqueIndex[models.InvitationEntity](rm.orm.NewORM(ctx), "code_hash", hashInvitationCode(code))
+	if !found {
+		return nil, ErrInvalidInvitation
+	}
+	invitation := invitationFromEntity(entity)
+	if invitation.Revoked || invitation.UsedAt != nil || time.Now().After(invitation.ExpiresAt) {
+		return nil, ErrInvalidInvitation
+	}
+	if invitation.Email != "" && invitation.Email != email {
+		return nil, fmt.Errorf("%w: the invitation is for another email address", ErrInvalidInvitation)
+	}
+	return invitation, nil
+}
+
+// claimInvitation reserves the invitation for one registration, concurrent registrations race on it.
+func (rm *RegistrationManager) claimInvitation(ctx context.Context, invitation *Invitation) bool {
+	ttl := time.Until(invitation.ExpiresAt)
+	return ttl > 0 && rm.redisClient.SetNX(rm.orm.NewORM(ctx), invitationClaimPrefix+strconv.FormatUint(invitation.ID, 10), "1", ttl)
+}
+
+// releaseInvitation makes a claimed invitation usable again after the registration failed.
+func (rm *RegistrationManager) releaseInvitation(ctx context.Context, invitation *Invitation) {
+	rm.redisClient.Del(rm.orm.NewORM(ctx), invitationClaimPrefix+strconv.FormatUint(invitation.ID, 10))
+}
+
+func (rm *RegistrationManager) useInvitation(ctx context.Context, invitation *Invitation, userID uint64) error {
+	orm := rm.orm.NewORM(ctx)
+	entity, found := beeorm.GetByID[models.InvitationEntity](orm, invitation.ID)
+	if !found {
+		return fmt.Errorf("invitation %d not found", invitation.ID)
+	}
+	now := time.Now().UTC()
+	entity = beeorm.EditEntity(orm, entity)
+	entity.UsedBy = userID
+	entity.UsedAt = &now
+	return orm.Flush()
+}
+
+func invitationFromEntity(entity *models.InvitationEntity) *Invitation {
+	invitation := &Invitation{
+		ID:        entity.ID,
+		Email:     entity.Email,
+		CreatedBy: entity.CreatedBy,
+		UsedBy:    entity.UsedBy,
+		UsedAt:    entity.UsedAt,
+		Revoked:   entity.Revoked,
+		CreatedAt: entity.CreatedAt,
+		ExpiresAt: entity.ExpiresAt,
+	}
+	_ = json.Unmarshal([]byte(entity.Roles), &invitation.Roles)
+	return invitation
+}
+
+func hashInvitationCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,90 @@
+package zephyrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+// invitationCommand builds the `invitation` command managing the invitations of the user registration.
+func (z *zephyrix) invitationCommand(cancel context.CancelFunc) *cobra.Command {
+	var input NewInvitation
+
+	invitationCommand := &cobra.Command{
+		GroupID: authGroup.ID,
+		Use:     "invitation",
+		Short:   "Manage registration invitations",
+		Long:    "Create, list and revoke the invitations letting people register (authentication.user_registration)",
+		PersistentPreRun: func(_ *cobra.Command, _ []string) {
+			z.options = append(z.options, fx.Invoke(beeormInvoke))
+		},
+		PersistentPostRun: func(_ *cobra.Command, _ []string) {
+			defer cancel()
+		},
+	}
+
+	createCommand := &cobra.Command{
+		Use:   "create",
+		Short: "Create an invitation, emailed when --email is set and a mail sender is configured",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				invitation, code, err := ap.Registration().CreateInvitation(ctx, input)
+				if err != nil {
+					return err
+				}
+				Logger.Info("Created invitation %d, valid until %s, the code will not be shown again:", invitation.ID, invitation.ExpiresAt.Format(time.RFC3339))
+				fmt.Println(code)
+				return nil
+			})
+		},
+	}
+	createCommand.Flags().StringVarP(&input.Email, "email", "e", "", "only this address may use the invitation")
+	createCommand.Flags().StringSliceVarP(&input.Roles, "roles", "r", nil, "roles granted to the registered user")
+	createCommand.Flags().DurationVar(&input.ExpiresIn, "expires-in", 0, "lifetime of the invitation, defaults to authentication.user_registration.invitation_ttl")
+
+	listCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List the invitations",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				invitations, err := ap.Registration().Invitations(ctx)
+				if err != nil {
+					return err
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(invitations)
+			})
+		},
+	}
+
+	revokeCommand := &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an unused invitation",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			id, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid invitation id %q", args[0])
+			}
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				if err := ap.Registration().RevokeInvitation(ctx, id); err != nil {
+					return err
+				}
+				Logger.Info("Revoked invitation %d", id)
+				return nil
+			})
+		},
+	}
+
+	invitationCommand.AddCommand(createCommand, listCommand, revokeCommand)
+	return invitationCommand
+}
@@ -0,0 +1,521 @@
+package zephyrix
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// JWTKeyConfig describes a signing key loaded from PEM files.
+// Keys with only a public key are used to verify tokens signed before a rotation.
+type JWTKeyConfig struct {
+	ID         string `mapstructure:"id"`          // kid of the key, derived from the public key when empty
+	PrivateKey string `mapstructure:"private_key"` // path of a PKCS#8, PKCS#1 or SEC 1 PEM file
+	PublicKey  string `mapstructure:"public_key"`  // path of a PKIX PEM file
+}
+
+// jwtKey is a key of the key ring.
+type jwtKey struct {
+	id        string
+	private   crypto.Signer // nil for keys that only verify
+	public    crypto.PublicKey
+	createdAt time.Time
+	generated bool // written to the key directory by a rotation
+}
+
+// KeyRing holds the keys signing and verifying the JWTs issued by Zephyrix.
+//
+// The newest private key signs, every key of the ring verifies, so tokens signed
+// by a previous key stay valid until the key leaves the ring after key_retention.
+type KeyRing struct {
+	config JWTConfig
+	method jwt.SigningMethod
+	secret []byte // HMAC secret of the HS* methods
+
+	mu     sync.RWMutex
+	keys   []*jwtKey // newest first
+	active *jwtKey
+}
+
+// newKeyRing loads the keys of the configuration.
+func newKeyRing(config JWTConfig) (*KeyRing, error) {
+	method := jwt.GetSigningMethod(strings.ToUpper(config.SigningMethod))
+	if config.SigningMethod == "" {
+		method = jwt.SigningMethodHS256
+	} else if strings.EqualFold(config.SigningMethod, "eddsa") {
+		method = jwt.SigningMethodEdDSA
+	}
+	if method == nil || method == jwt.SigningMethodNone {
+		return nil, fmt.Errorf("unsupported JWT signing method: %s", config.SigningMethod)
+	}
+
+	kr := &KeyRing{config: config, method: method}
+	if kr.isHMAC() {
+		kr.secret = []byte(config.Secret)
+		return kr, nil
+	}
+
+	for _, keyConfig := range config.Keys {
+		key, err := loadJWTKey(keyConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := kr.checkKeyType(key); err != nil {
+			return nil, err
+		}
+		kr.keys = append(kr.keys, key)
+	}
+
+	if err := kr.loadDirectory(); err != nil {
+		return nil, err
+	}
+
+	if kr.signingKey() == nil {
+		if config.KeyDirectory == "" && len(config.Keys) == 0 {
+			Logger.Warn("No JWT signing key configured, generating an in-memory %s key, tokens will not survive a restart", method.Alg())
+		}
+		if err := kr.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	kr.selectActive()
+	return kr, nil
+}
+
+func (kr *KeyRing) isHMAC() bool {
+	_, ok := kr.method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+// Method returns the signing method of the ring.
+func (kr *KeyRing) Method() jwt.SigningMethod {
+	return kr.method
+}
+
+// Sign signs the claims with the active key, setting its kid header.
+func (kr *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(kr.method, claims)
+	if kr.isHMAC() {
+		return token.SignedString(kr.secret)
+	}
+
+	key := kr.signingKey()
+	if key == nil {
+		return "", errors.New("no JWT signing key available")
+	}
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+// Keyfunc resolves the verification key of a token from its kid header.
+// Tokens signed with another algorithm than the one of the ring are rejected.
+func (kr *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != kr.method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	if kr.isHMAC() {
+		return kr.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, key := range kr.keys {
+		if key.id == kid {
+			return key.public, nil
+		}
+	}
+	if kid == "" && len(kr.keys) == 1 {
+		return kr.keys[0].public, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func (kr *KeyRing) signingKey() *jwtKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if kr.active != nil {
+		return kr.active
+	}
+	for _, key := range kr.keys {
+		if key.private != nil {
+			return key
+		}
+	}
+	return nil
+}
+
+// selectActive makes the newest private key the signing key.
+func (kr *KeyRing) selectActive() {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	sort.SliceStable(kr.keys, func(i, j int) bool { return kr.keys[i].createdAt.After(kr.keys[j].createdAt) })
+	kr.active = nil
+	for _, key := range kr.keys {
+		if key.private != nil {
+			kr.active = key
+			return
+		}
+	}
+}
+
+// Rotate generates a new signing key, written to the key directory when one is configured
+// so every instance sharing the directory picks it up.
+func (kr *KeyRing) Rotate() error {
+	if kr.isHMAC() {
+		return errors.New("HMAC secrets can not be rotated automatically")
+	}
+
+	private, err := generateJWTKey(kr.method)
+	if err != nil {
+		return fmt.Errorf("failed to generate JWT key: %w", err)
+	}
+	key := &jwtKey{private: private, public: private.Public(), createdAt: time.Now(), generated: true}
+	if key.id, err = jwtKeyID(key.public); err != nil {
+		return err
+	}
+
+	if kr.config.KeyDirectory != "" {
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return fmt.Errorf("failed to encode JWT key: %w", err)
+		}
+		if err := os.MkdirAll(kr.config.KeyDirectory, 0700); err != nil {
+			return fmt.Errorf("failed to create JWT key directory: %w", err)
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(filepath.Join(kr.config.KeyDirectory, key.id+".pem"), data, 0600); err != nil {
+			return fmt.Errorf("failed to write JWT key: %w", err)
+		}
+	}
+
+	kr.mu.Lock()
+	kr.keys = append([]*jwtKey{key}, kr.keys...)
+	kr.mu.Unlock()
+	kr.selectActive()
+
+	Logger.Info("Rotated JWT signing key, new kid: %s", key.id)
+	return nil
+}
+
+// loadDirectory adds the keys of the key directory that are not in the ring yet.
+func (kr *KeyRing) loadDirectory() error {
+	if kr.config.KeyDirectory == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(kr.config.KeyDirectory, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+		if kr.hasKey(kid) {
+			continue
+		}
+		key, err := loadJWTKey(JWTKeyConfig{ID: kid, PrivateKey: file})
+		if err != nil {
+			return err
+		}
+		if err := kr.checkKeyType(key); err != nil {
+			return err
+		}
+		key.generated = true
+
+		kr.mu.Lock()
+		kr.keys = append(kr.keys, key)
+		kr.mu.Unlock()
+	}
+
+	kr.selectActive()
+	return nil
+}
+
+func (kr *KeyRing) hasKey(kid string) bool {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, key := range kr.keys {
+		if key.id == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// maintain reloads the key directory, rotates the signing key when it is older than
+// rotation_interval and drops the generated keys older than key_retention.
+func (kr *KeyRing) maintain() {
+	if err := kr.loadDirectory(); err != nil {
+		Logger.Error("Failed to reload JWT keys: %s", err)
+	}
+
+	if active := kr.signingKey(); active != nil && time.Since(active.createdAt) >= kr.config.RotationInterval {
+		if err := kr.Rotate(); err != nil {
+			Logger.Error("Failed to rotate JWT signing key: %s", err)
+		}
+	}
+
+	retention := kr.config.KeyRetention
+	if retention <= 0 {
+		// a retired key must verify the tokens it signed until they expire, the rotation
+		// itself may happen up to one maintenance interval after rotation_interval
+		retention = kr.config.RotationInterval + kr.maintenanceInterval() + kr.config.Expiration
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kept := kr.keys[:0]
+	for _, key := range kr.keys {
+		if key == kr.active || !key.generated || time.Since(key.createdAt) < retention {
+			kept = append(kept, key)
+			continue
+		}
+		if kr.config.KeyDirectory != "" {
+			if err := os.Remove(filepath.Join(kr.config.KeyDirectory, key.id+".pem")); err != nil && !errors.Is(err, os.ErrNotExist) {
+				Logger.Error("Failed to remove retired JWT key %s: %s", key.id, err)
+			}
+		}
+	}
+	kr.keys = kept
+}
+
+// startRotation runs the key maintenance until stop is closed.
+func (kr *KeyRing) startRotation(stop <-chan struct{}) {
+	if kr.isHMAC() || kr.config.RotationInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(kr.maintenanceInterval())
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				kr.maintain()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// maintenanceInterval returns how often the ring is maintained.
+func (kr *KeyRing) maintenanceInterval() time.Duration {
+	return min(time.Minute, kr.config.RotationInterval)
+}
+
+// checkKeyType makes sure a key matches the signing method of the ring.
+func (kr *KeyRing) checkKeyType(key *jwtKey) error {
+	var ok bool
+	switch kr.method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok = key.public.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		_, ok = key.public.(*ecdsa.PublicKey)
+	case *jwt.SigningMethodEd25519:
+		_, ok = key.public.(ed25519.PublicKey)
+	}
+	if !ok {
+		return fmt.Errorf("JWT key %s does not match the %s signing method", key.id, kr.method.Alg())
+	}
+	return nil
+}
+
+// loadJWTKey reads a key from its PEM files.
+func loadJWTKey(config JWTKeyConfig) (*jwtKey, error) {
+	key := &jwtKey{id: config.ID}
+
+	switch {
+	case config.PrivateKey != "":
+		block, err := readPEM(config.PrivateKey, key)
+		if err != nil {
+			return nil, err
+		}
+		private, err := parsePrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key %s: %w", config.PrivateKey, err)
+		}
+		key.private = private
+		key.public = private.Public()
+	case config.PublicKey != "":
+		block, err := readPEM(config.PublicKey, key)
+		if err != nil {
+			return nil, err
+		}
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %s: %w", config.PublicKey, err)
+		}
+		key.public = public
+	default:
+		return nil, errors.New("JWT key without private_key nor public_key")
+	}
+
+	if key.id == "" {
+		id, err := jwtKeyID(key.public)
+		if err != nil {
+			return nil, err
+		}
+		key.id = id
+	}
+	return key, nil
+}
+
+// readPEM decodes the first PEM block of a file, the key is dated by the modification time of the file.
+func readPEM(path string, key *jwtKey) (*pem.Block, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	key.createdAt = info.ModTime()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
+
+// generateJWTKey creates a key for the given signing method.
+func generateJWTKey(method jwt.SigningMethod) (crypto.Signer, error) {
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case *jwt.SigningMethodECDSA:
+		curve := elliptic.P256()
+		switch m.CurveBits {
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case *jwt.SigningMethodEd25519:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	default:
+		return nil, fmt.Errorf("can not generate keys for %s", method.Alg())
+	}
+}
+
+// jwtKeyID derives a stable kid from the public key.
+func jwtKeyID(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// JWK is a public key of the JWKS document (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS returns the public keys of the ring, HMAC secrets are never published.
+func (kr *KeyRing) JWKS() []JWK {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	keys := make([]JWK, 0, len(kr.keys))
+	for _, key := range kr.keys {
+		jwk := JWK{Kid: key.id, Use: "sig", Alg: kr.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = public.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return keys
+}
+
+// jwksRouteHandler publishes the JWKS document at /.well-known/jwks.json.
+type jwksRouteHandler struct {
+	ap *AuthProvider
+}
+
+func newJWKSRouteHandler(ap *AuthProvider) *jwksRouteHandler {
+	return &jwksRouteHandler{ap: ap}
+}
+
+func (h *jwksRouteHandler) Name() string     { return "jwks" }
+func (h *jwksRouteHandler) Method() []string { return []string{http.MethodGet} }
+func (h *jwksRouteHandler) Path() string     { return "/.well-known/jwks.json" }
+
+func (h *jwksRouteHandler) Handlers() []any {
+	return []any{
+		func(c *gin.Context) {
+			c.Header("Cache-Control", "public, max-age=300")
+			c.JSON(http.StatusOK, gin.H{"keys": h.ap.keyRing.JWKS()})
+		},
+	}
+}
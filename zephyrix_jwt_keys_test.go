@@ -0,0 +1,119 @@
+package zephyrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRingSignVerify(t *testing.T) {
+	for _, method := range []string{"HS256", "RS256", "ES256", "EdDSA"} {
+		t.Run(method, func(t *testing.T) {
+			kr, err := newKeyRing(JWTConfig{SigningMethod: method, Secret: "secret"})
+			require.NoError(t, err)
+
+			signed, err := kr.Sign(jwt.MapClaims{"sub": "1"})
+			require.NoError(t, err)
+
+			token, err := jwt.Parse(signed, kr.Keyfunc)
+			require.NoError(t, err)
+			require.True(t, token.Valid)
+			require.Equal(t, kr.Method().Alg(), token.Method.Alg())
+		})
+	}
+
+	_, err := newKeyRing(JWTConfig{SigningMethod: "none"})
+	require.Error(t, err)
+}
+
+func TestKeyRingRejectsAlgorithmSwitch(t *testing.T) {
+	rsa, err := newKeyRing(JWTConfig{SigningMethod: "RS256"})
+	require.NoError(t, err)
+	hmac, err := newKeyRing(JWTConfig{SigningMethod: "HS256", Secret: "secret"})
+	require.NoError(t, err)
+
+	signed, err := hmac.Sign(jwt.MapClaims{"sub": "1"})
+	require.NoError(t, err)
+	_, err = jwt.Parse(signed, rsa.Keyfunc)
+	require.Error(t, err)
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	dir := t.TempDir()
+	kr, err := newKeyRing(JWTConfig{SigningMethod: "ES256", KeyDirectory: dir, RotationInterval: time.Hour})
+	require.NoError(t, err)
+
+	old, err := kr.Sign(jwt.MapClaims{"sub": "1"})
+	require.NoError(t, err)
+	require.NoError(t, kr.Rotate())
+	current, err := kr.Sign(jwt.MapClaims{"sub": "1"})
+	require.NoError(t, err)
+
+	oldToken, err := jwt.Parse(old, kr.Keyfunc)
+	require.NoError(t, err, "tokens signed before the rotation stay valid")
+	currentToken, err := jwt.Parse(current, kr.Keyfunc)
+	require.NoError(t, err)
+	require.NotEqual(t, oldToken.Header["kid"], currentToken.Header["kid"])
+
+	// another instance sharing the directory verifies both and signs with the newest key
+	other, err := newKeyRing(JWTConfig{SigningMethod: "ES256", KeyDirectory: dir, RotationInterval: time.Hour})
+	require.NoError(t, err)
+	_, err = jwt.Parse(old, other.Keyfunc)
+	require.NoError(t, err)
+	require.Equal(t, currentToken.Header["kid"], other.signingKey().id)
+}
+
+func TestKeyRingRetention(t *testing.T) {
+	config := JWTConfig{SigningMethod: "ES256", RotationInterval: time.Hour, Expiration: 15 * time.Minute}
+	kr, err := newKeyRing(config)
+	require.NoError(t, err)
+	require.NoError(t, kr.Rotate())
+	require.NoError(t, kr.Rotate())
+	require.NoError(t, kr.Rotate())
+
+	// the newest key signs, the others retired one rotation interval after they were created
+	kr.keys[1].createdAt = time.Now().Add(-time.Hour - 10*time.Minute)
+	kr.keys[2].createdAt = time.Now().Add(-time.Hour - 17*time.Minute)
+	expired := kr.keys[2].id
+	kr.maintain()
+	require.Len(t, kr.keys, 3, "retired keys verify until their tokens expire")
+	require.False(t, kr.hasKey(expired), "then they leave the ring")
+
+	kr.config.KeyRetention = 5 * time.Minute
+	kr.maintain()
+	require.Len(t, kr.keys, 2, "key_retention counts from the creation of the key")
+}
+
+func TestJWKSRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	kr, err := newKeyRing(JWTConfig{SigningMethod: "RS256"})
+	require.NoError(t, err)
+
+	h := newJWKSRouteHandler(&AuthProvider{keyRing: kr})
+	r := gin.New()
+	r.GET(h.Path(), h.Handlers()[0].(func(*gin.Context)))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Keys []JWK `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Len(t, body.Keys, 1)
+	require.Equal(t, "RSA", body.Keys[0].Kty)
+	require.Equal(t, "RS256", body.Keys[0].Alg)
+	require.Equal(t, "AQAB", body.Keys[0].E)
+	require.Equal(t, kr.signingKey().id, body.Keys[0].Kid)
+
+	hmac, err := newKeyRing(JWTConfig{SigningMethod: "HS256", Secret: "secret"})
+	require.NoError(t, err)
+	require.Empty(t, hmac.JWKS(), "HMAC secrets are never published")
+}
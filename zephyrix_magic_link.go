@@ -0,0 +1,256 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+)
+
+const (
+	defaultMagicLinkTTL      = 15 * time.Minute
+	defaultMagicLinkRatePool = "magic_link"
+	defaultMagicLinkSubject  = "Your sign-in link"
+
+	magicLinkPrefix = "zephyrix:magic:"
+
+	// MagicLinkBindIPUserAgent binds a link to the IP address and user agent that requested it.
+	MagicLinkBindIPUserAgent = "ip_user_agent"
+	// MagicLinkBindUserAgent binds a link to the user agent only, for clients whose address changes.
+	MagicLinkBindUserAgent = "user_agent"
+	// MagicLinkBindNone lets a link be opened from any device.
+	MagicLinkBindNone = "none"
+)
+
+// MagicLinkConfig configures the "magic_link" passwordless method.
+type MagicLinkConfig struct {
+	// URL is the page receiving the token, "{token}" is replaced with it, otherwise a token query parameter is added.
+	URL           string           `mapstructure:"url"`
+	TTL           time.Duration    `mapstructure:"ttl"`
+	Subject       string           `mapstructure:"subject"`
+	Binding       string           `mapstructure:"binding"`         // ip_user_agent, user_agent or none
+	RateLimitPool string           `mapstructure:"rate_limit_pool"` // rate limiter pool limiting the links sent per address
+	Mail          CodeSenderConfig `mapstructure:"mail"`            // defaults to the email sender of MFA
+}
+
+// normalize applies the defaults of the configuration.
+func (c MagicLinkConfig) normalize() MagicLinkConfig {
+	if c.TTL <= 0 {
+		c.TTL = defaultMagicLinkTTL
+	}
+	if c.Subject == "" {
+		c.Subject = defaultMagicLinkSubject
+	}
+	switch c.Binding {
+	case MagicLinkBindUserAgent, MagicLinkBindNone:
+	default:
+		c.Binding = MagicLinkBindIPUserAgent
+	}
+	if c.RateLimitPool == "" {
+		c.RateLimitPool = defaultMagicLinkRatePool
+	}
+	return c
+}
+
+// magicLinkState is stored in redis under the hash of the token.
+type magicLinkState struct {
+	UserID      uint64 `json:"user_id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// MagicLinkManager issues and redeems the single-use tokens of magic links.
+//
+// Only the SHA-256 of a token is stored, next to a fingerprint of the device that requested it.
+type MagicLinkManager struct {
+	config      MagicLinkConfig
+	enabled     bool
+	orm         beeorm.Engine
+	redisClient beeorm.RedisCache
+	users       UserStore
+	limiter     *RateLimiter
+	audit       *AuditLogger
+	mailer      MailSender
+	lockout     *LockoutManager
+}
+
+func NewMagicLinkManager(conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, users UserStore, rl *RateLimiter, audit *AuditLogger) (*MagicLinkManager, error) {
+	auth := conf.Authentication
+	m := &MagicLinkManager{
+		config:      auth.Passwordless.MagicLink.normalize(),
+		enabled:     auth.Passwordless.Enabled && auth.FeatureToggles.Passwordless && slices.Contains(auth.Passwordless.Methods, "magic_link"),
+		orm:         orm,
+		redisClient: redisClient,
+		users:       users,
+		limiter:     rl,
+		audit:       audit,
+	}
+
+	mail := m.config.Mail
+	if mail.Driver == "" {
+		mail = auth.MFA.Email
+	}
+	var err error
+	if m.mailer, err = newMailSender(mail); err != nil {
+		return nil, fmt.Errorf("magic link: %w", err)
+	}
+	return m, nil
+}
+
+// Enabled reports whether magic links can be requested and redeemed.
+func (m *MagicLinkManager) Enabled() bool {
+	return m.enabled && m.config.URL != ""
+}
+
+// SetMailSender replaces the sender of the links, e.g. with a provider specific client.
+func (m *MagicLinkManager) SetMailSender(sender MailSender) {
+	m.mailer = sender
+}
+
+// Request emails a magic link to the user with the address. Unknown, disabled and locked accounts
+// get no link but no error either, so the answer does not reveal which accounts exist.
+func (m *MagicLinkManager) Request(ctx context.Context, email, ip, userAgent string) error {
+	if !m.Enabled() {
+		return errors.New("magic links are not enabled")
+	}
+	if m.mailer == nil {
+		return errors.New("no mail sender configured for magic links")
+	}
+
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return fmt.Errorf("%w: email is required", ErrInvalidCredentials)
+	}
+	if m.limiter != nil && !m.limiter.Limiter(ctx, m.config.RateLimitPool).Allow(ctx, "magic_link", email) {
+		return ErrRateLimited
+	}
+
+	user, err := m.users.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			m.log(ctx, "magic_link_unknown_address", 0, fmt.Sprintf("to=%s", maskDestination(email)))
+			return nil
+		}
+		return err
+	}
+	if !user.IsActive() || m.lockout.IsLocked(ctx, user) {
+		m.log(ctx, "magic_link_refused", user.ID(), "account disabled or locked")
+		return nil
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate magic link: %w", err)
+	}
+	state, _ := json.Marshal(magicLinkState{UserID: user.ID(), Fingerprint: m.fingerprint(ip, userAgent)})
+	key := magicLinkPrefix + hashMagicToken(token)
+	orm := m.orm.NewORM(ctx)
+	m.redisClient.Set(orm, key, string(state), m.config.TTL)
+
+	err = m.mailer.SendMail(ctx, Mail{
+		To:      user.Email(),
+		Subject: m.config.Subject,
+		Body: fmt.Sprintf("Open the link below to sign in, it expires in %s and works once:\n\n%s\n\n"+
+			"If you did not request it, you can ignore this email.", m.config.TTL, m.link(token)),
+	})
+	if err != nil {
+		m.redisClient.Del(orm, key)
+		return fmt.Errorf("failed to send magic link: %w", err)
+	}
+
+	m.log(ctx, "magic_link_issued", user.ID(), fmt.Sprintf("to=%s ip=%s", maskDestination(user.Email()), ip))
+	return nil
+}
+
+// Redeem consumes the token and returns its user. A token is consumed by the first attempt,
+// including one from another device, which fails.
+func (m *MagicLinkManager) Redeem(ctx context.Context, token, ip, userAgent string) (User, error) {
+	if !m.Enabled() {
+		return nil, fmt.Errorf("unsupported grant type: %s", GrantTypeMagicToken)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("%w: missing magic token", ErrInvalidToken)
+	}
+
+	orm := m.orm.NewORM(ctx)
+	key := magicLinkPrefix + hashMagicToken(token)
+	encoded, found := m.redisClient.Get(orm, key)
+	if !found || !m.redisClient.SetNX(orm, key+":used", "1", m.config.TTL) {
+		return nil, fmt.Errorf("%w: unknown, used or expired magic token", ErrInvalidToken)
+	}
+	m.redisClient.Del(orm, key)
+
+	var state magicLinkState
+	if err := json.Unmarshal([]byte(encoded), &state); err != nil {
+		return nil, fmt.Errorf("%w: malformed magic token state", ErrInvalidToken)
+	}
+	if subtle.ConstantTimeCompare([]byte(state.Fingerprint), []byte(m.fingerprint(ip, userAgent))) != 1 {
+		m.log(ctx, "magic_link_device_mismatch", state.UserID, fmt.Sprintf("ip=%s", ip))
+		return nil, fmt.Errorf("%w: magic link was requested from another device", ErrInvalidToken)
+	}
+
+	user, err := m.users.GetByID(ctx, state.UserID)
+	if err != nil {
+		return nil, err
+	}
+	m.log(ctx, "magic_link_redeemed", user.ID(), fmt.Sprintf("ip=%s", ip))
+	return user, nil
+}
+
+// link renders the URL of the configuration with the token.
+func (m *MagicLinkManager) link(token string) string {
+	return tokenLink(m.config.URL, token)
+}
+
+// tokenLink replaces "{token}" in the URL with the token, or adds a token query parameter.
+func tokenLink(link, token string) string {
+	if strings.Contains(link, "{token}") {
+		return strings.ReplaceAll(link, "{token}", url.QueryEscape(token))
+	}
+	separator := "?"
+	if strings.Contains(link, "?") {
+		separator = "&"
+	}
+	return link + separator + "token=" + url.QueryEscape(token)
+}
+
+// fingerprint hashes the parts of the client the links are bound to.
+func (m *MagicLinkManager) fingerprint(ip, userAgent string) string {
+	switch m.config.Binding {
+	case MagicLinkBindNone:
+		return ""
+	case MagicLinkBindUserAgent:
+		ip = ""
+	}
+	sum := sha256.Sum256([]byte(ip + "\x00" + userAgent))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *MagicLinkManager) log(ctx context.Context, action string, userID uint64, details string) {
+	if m.audit == nil {
+		return
+	}
+	if err := m.audit.Log(ctx, action, strconv.FormatUint(userID, 10), details); err != nil {
+		Logger.Error("Failed to write audit log: %s", err)
+	}
+}
+
+func hashMagicToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestMagicLink emails a sign-in link to the address, redeemed with AuthenticateUser and GrantTypeMagicToken
+// from the same IP address and user agent.
+func (ap *AuthProvider) RequestMagicLink(ctx context.Context, email, ip, userAgent string) error {
+	return ap.components.magicLinks.Request(ctx, email, ip, userAgent)
+}
@@ -0,0 +1,109 @@
+package zephyrix
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// magicLinkRouteHandler is one of the JSON endpoints of magic links:
+//
+//	POST /auth/magic-link         {"email"} -> 202, whether or not the address has an account
+//	POST /auth/magic-link/verify  {"token", "device_id", "remember_device_token"} -> AuthResult
+//
+// Both must be called from the same browser, links are bound to its IP address and user agent.
+// The endpoints answer 404 while magic links are disabled.
+type magicLinkRouteHandler struct {
+	name    string
+	path    string
+	handler []any
+}
+
+func (h *magicLinkRouteHandler) Name() string     { return h.name }
+func (h *magicLinkRouteHandler) Method() []string { return []string{http.MethodPost} }
+func (h *magicLinkRouteHandler) Path() string     { return h.path }
+func (h *magicLinkRouteHandler) Handlers() []any  { return h.handler }
+
+func newMagicLinkRequestRoute(ap *AuthProvider) *magicLinkRouteHandler {
+	return &magicLinkRouteHandler{
+		name: "magic_link_request",
+		path: "/auth/magic-link",
+		handler: []any{ap.requireMagicLinks, func(c *gin.Context) {
+			var body struct {
+				Email string `json:"email"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Email == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			if err := ap.RequestMagicLink(c.Request.Context(), body.Email, c.ClientIP(), c.Request.UserAgent()); err != nil {
+				writeMagicLinkError(c, err)
+				return
+			}
+			c.Status(http.StatusAccepted)
+		}},
+	}
+}
+
+func newMagicLinkVerifyRoute(ap *AuthProvider) *magicLinkRouteHandler {
+	return &magicLinkRouteHandler{
+		name: "magic_link_verify",
+		path: "/auth/magic-link/verify",
+		handler: []any{ap.requireMagicLinks, func(c *gin.Context) {
+			var body struct {
+				Token               string `json:"token"`
+				DeviceID            string `json:"device_id"`
+				RememberDeviceToken string `json:"remember_device_token"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Token == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			result, err := ap.AuthenticateUser(c.Request.Context(), Authenticate{
+				GrantType:           GrantTypeMagicToken,
+				MagicToken:          body.Token,
+				DeviceID:            body.DeviceID,
+				IP:                  c.ClientIP(),
+				UserAgent:           c.Request.UserAgent(),
+				RememberDeviceToken: body.RememberDeviceToken,
+			})
+			if err != nil {
+				writeMagicLinkError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, result)
+		}},
+	}
+}
+
+// requireMagicLinks hides the endpoints while magic links are disabled.
+func (ap *AuthProvider) requireMagicLinks(c *gin.Context) {
+	if ap.components.magicLinks == nil || !ap.components.magicLinks.Enabled() {
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// writeMagicLinkError maps the errors of magic links to JSON responses.
+func writeMagicLinkError(c *gin.Context, err error) {
+	var challenge *MFAChallenge
+	switch {
+	case errors.As(err, &challenge):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "mfa_required", "mfa": challenge})
+	case errors.Is(err, ErrMFAEnrollmentRequired):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "mfa_enrollment_required", "message": err.Error()})
+	case errors.Is(err, ErrInvalidToken):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_token", "message": err.Error()})
+	case errors.Is(err, ErrInvalidCredentials):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "message": err.Error()})
+	case errors.Is(err, ErrRateLimited):
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate_limited"})
+	case errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrAccountLocked):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "message": err.Error()})
+	default:
+		Logger.Error("Magic link failed: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+	}
+}
@@ -0,0 +1,72 @@
+package zephyrix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMagicLinkConfig(t *testing.T) {
+	config := MagicLinkConfig{Binding: "cookie"}.normalize()
+	require.Equal(t, defaultMagicLinkTTL, config.TTL)
+	require.Equal(t, MagicLinkBindIPUserAgent, config.Binding)
+	require.Equal(t, defaultMagicLinkRatePool, config.RateLimitPool)
+
+	m := &MagicLinkManager{config: MagicLinkConfig{URL: "https://app.example.com/login?next=%2F"}.normalize()}
+	require.Equal(t, "https://app.example.com/login?next=%2F&token=abc", m.link("abc"))
+
+	m.config.URL = "https://app.example.com/magic/{token}"
+	require.Equal(t, "https://app.example.com/magic/a%2Bb", m.link("a+b"))
+	require.False(t, m.Enabled())
+}
+
+func TestMagicLinkFingerprint(t *testing.T) {
+	m := &MagicLinkManager{config: MagicLinkConfig{}.normalize()}
+	require.Equal(t, m.fingerprint("10.0.0.1", "Firefox"), m.fingerprint("10.0.0.1", "Firefox"))
+	require.NotEqual(t, m.fingerprint("10.0.0.1", "Firefox"), m.fingerprint("10.0.0.2", "Firefox"))
+	require.NotEqual(t, m.fingerprint("10.0.0.1", "Firefox"), m.fingerprint("10.0.0.1", "Chrome"))
+
+	m.config.Binding = MagicLinkBindUserAgent
+	require.Equal(t, m.fingerprint("10.0.0.1", "Firefox"), m.fingerprint("10.0.0.2", "Firefox"))
+	require.NotEqual(t, m.fingerprint("10.0.0.1", "Firefox"), m.fingerprint("10.0.0.1", "Chrome"))
+
+	m.config.Binding = MagicLinkBindNone
+	require.Equal(t, m.fingerprint("10.0.0.1", "Firefox"), m.fingerprint("10.0.0.2", "Chrome"))
+
+	require.NotEqual(t, "abc", hashMagicToken("abc"))
+	require.Len(t, hashMagicToken("abc"), 64)
+}
+
+func TestMailSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	sender, err := newMailSender(CodeSenderConfig{Driver: "file", File: path})
+	require.NoError(t, err)
+
+	require.NoError(t, sender.SendMail(context.Background(), Mail{To: "jane@example.com", Subject: "Your sign-in link", Body: "https://app.example.com/magic/abc"}))
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "email to jane@example.com: Your sign-in link")
+	require.Contains(t, string(content), "https://app.example.com/magic/abc")
+
+	server := newFakeSMTPServer(t)
+	sender, err = newMailSender(CodeSenderConfig{
+		Driver: "smtp",
+		SMTP:   SMTPConfig{Host: "127.0.0.1", Port: server.port(), From: "noreply@example.com"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, sender.SendMail(context.Background(), Mail{To: "jane@example.com", Subject: "Your sign-in link", Body: "line 1\nline 2"}))
+
+	select {
+	case message := <-server.messages:
+		require.Contains(t, message.Data, "Subject: Your sign-in link")
+		require.Contains(t, message.Data, "line 1\r\nline 2")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the smtp server did not receive the message")
+	}
+
+	require.Error(t, sender.SendMail(context.Background(), Mail{To: "jane@example.com", Subject: "x\r\nBcc: x@example.com"}))
+}
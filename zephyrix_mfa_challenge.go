@@ -0,0 +1,270 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+const (
+	mfaChallengeTokenType        = "mfa_challenge"
+	defaultMFAChallengeTTL       = 5 * time.Minute
+	defaultMFAChallengeAttempts  = 5
+	mfaChallengeCachePrefix      = mfaCachePrefix + ":challenge:"
+	mfaRememberDeviceCachePrefix = mfaCachePrefix + ":remember:"
+)
+
+// MFAChallenge is returned by AuthenticateUser when the first factor succeeded and a second
+// factor is required. It unwraps to ErrMFARequired:
+//
+//	var challenge *MFAChallenge
+//	if errors.As(err, &challenge) {
+//		// ask for one of challenge.Methods, then call VerifyMFA with challenge.Token
+//	}
+type MFAChallenge struct {
+	Token     string      `json:"mfa_token"`
+	Methods   []MFAMethod `json:"methods"` // the methods enrolled by the user
+	ExpiresIn int64       `json:"expires_in"`
+}
+
+func (c *MFAChallenge) Error() string { return ErrMFARequired.Error() }
+func (c *MFAChallenge) Unwrap() error { return ErrMFARequired }
+
+// MFAVerification completes an MFA challenge.
+type MFAVerification struct {
+	Challenge string // MFAChallenge.Token
+	Method    string
+	Token     string // the code of the method
+	IP        string // address of the client, wrong codes count towards the account lockout
+
+	// RememberDevice issues a token that skips MFA on this device, see MFAConfig.RememberDevice.
+	RememberDevice bool
+}
+
+// mfaChallengeState is the server side state of a challenge, the signed token only carries its ID.
+type mfaChallengeState struct {
+	UserID   uint64      `json:"user_id"`
+	Methods  []MFAMethod `json:"methods"`
+	DeviceID string      `json:"device_id,omitempty"`
+}
+
+// newMFAChallenge starts the second factor of a user who proved the first one,
+// the *MFAChallenge is returned as the error of AuthenticateUser. A user required to use MFA
+// by mfa.enforce_for_roles without any enrolled method gets ErrMFAEnrollmentRequired instead,
+// a challenge nothing could complete would lock the account out.
+func (ap *AuthProvider) newMFAChallenge(ctx context.Context, user User, deviceID string) error {
+	config := ap.components.mfaManager.config
+
+	methods := make([]MFAMethod, 0)
+	for _, method := range user.EnabledMFAMethods() {
+		if ap.components.mfaManager.isMethodSupported(method) {
+			methods = append(methods, method)
+		}
+	}
+	if len(methods) == 0 {
+		ap.components.auditLogger.logFailedLogin(ctx, user.Username(), "mfa_enrollment_required")
+		return ErrMFAEnrollmentRequired
+	}
+
+	id := uuid.NewString()
+	token, err := ap.signMFAChallenge(id, user.ID(), config.ChallengeTTL)
+	if err != nil {
+		return fmt.Errorf("failed to sign MFA challenge: %w", err)
+	}
+
+	state, _ := json.Marshal(mfaChallengeState{UserID: user.ID(), Methods: methods, DeviceID: deviceID})
+	ap.redisClient.Set(ap.orm.NewORM(ctx), mfaChallengeCachePrefix+id, string(state), config.ChallengeTTL)
+
+	return &MFAChallenge{Token: token, Methods: methods, ExpiresIn: int64(config.ChallengeTTL.Seconds())}
+}
+
+func (ap *AuthProvider) signMFAChallenge(id string, userID uint64, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return ap.signClaims(jwt.MapClaims{
+		"typ": mfaChallengeTokenType,
+		"jti": id,
+		"sub": strconv.FormatUint(userID, 10),
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+		"iss": ap.config.JWT.Issuer,
+	})
+}
+
+// parseMFAChallenge verifies the signature and type of a challenge token and returns its ID and user.
+func (ap *AuthProvider) parseMFAChallenge(tokenString string) (string, uint64, error) {
+	token, err := ap.VerifyToken(tokenString)
+	if err != nil || !token.Valid {
+		return "", 0, ErrInvalidMFAChallenge
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != mfaChallengeTokenType {
+		return "", 0, ErrInvalidMFAChallenge
+	}
+	id, _ := claims["jti"].(string)
+	userID, err := claimUint64(claims, "sub")
+	if id == "" || err != nil {
+		return "", 0, ErrInvalidMFAChallenge
+	}
+	return id, userID, nil
+}
+
+// loadMFAChallenge returns the state of a pending challenge, with the user it belongs to.
+func (ap *AuthProvider) loadMFAChallenge(ctx context.Context, tokenString string) (string, *mfaChallengeState, User, error) {
+	id, userID, err := ap.parseMFAChallenge(tokenString)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	encoded, found := ap.redisClient.Get(ap.orm.NewORM(ctx), mfaChallengeCachePrefix+id)
+	if !found {
+		return "", nil, nil, ErrInvalidMFAChallenge
+	}
+	var state mfaChallengeState
+	if err := json.Unmarshal([]byte(encoded), &state); err != nil || state.UserID != userID {
+		return "", nil, nil, ErrInvalidMFAChallenge
+	}
+
+	user, err := ap.components.userStore.GetByID(ctx, state.UserID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err := ap.checkAccount(ctx, user); err != nil {
+		return "", nil, nil, err
+	}
+	return id, &state, user, nil
+}
+
+func (s *mfaChallengeState) allows(method MFAMethod) bool {
+	for _, allowed := range s.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyMFA completes the challenge returned by AuthenticateUser and issues the tokens of the user.
+// A challenge accepts a limited number of wrong codes and can only be completed once.
+func (ap *AuthProvider) VerifyMFA(ctx context.Context, input MFAVerification) (*AuthResult, error) {
+	id, state, user, err := ap.loadMFAChallenge(ctx, input.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	method := MFAMethod(input.Method)
+	if !state.allows(method) {
+		return nil, fmt.Errorf("MFA method %s is not enabled", method)
+	}
+
+	orm := ap.orm.NewORM(ctx)
+	key := mfaChallengeCachePrefix + id
+	config := ap.components.mfaManager.config
+
+	attempts := ap.redisClient.Incr(orm, key+":attempts")
+	if attempts == 1 {
+		ap.redisClient.Expire(orm, key+":attempts", config.ChallengeTTL)
+	}
+	if attempts > int64(config.ChallengeAttempts) {
+		ap.redisClient.Del(orm, key, key+":attempts")
+		ap.components.auditLogger.logFailedMFA(ctx, user.Username(), input.Method, "too many attempts")
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	valid, err := ap.components.mfaManager.VerifyMFA(ctx, user, method, input.Token)
+	if err != nil {
+		return nil, fmt.Errorf("MFA verification failed: %w", err)
+	}
+	if !valid {
+		ap.components.auditLogger.logFailedMFA(ctx, user.Username(), input.Method)
+		// every login starts a fresh challenge, only the lockout bounds the guesses across them
+		ap.components.lockout.Failed(ctx, user, input.IP)
+		return nil, ErrInvalidMFAToken
+	}
+
+	// concurrent verifications of the same challenge race on this marker
+	if !ap.redisClient.SetNX(orm, key+":done", "1", config.ChallengeTTL) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	ap.redisClient.Del(orm, key, key+":attempts")
+
+	result, err := ap.issueTokens(ctx, user, state.DeviceID, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue tokens after MFA: %w", err)
+	}
+	ap.components.lockout.Succeeded(ctx, user)
+
+	if input.RememberDevice && config.RememberDevice > 0 {
+		result.RememberDeviceToken, err = ap.components.mfaManager.rememberDevice(ctx, user)
+		if err != nil {
+			Logger.Error("Failed to remember MFA device: %s", err)
+		}
+	}
+
+	ap.components.auditLogger.logSuccessfulMFA(ctx, user.Username(), input.Method)
+	return result, nil
+}
+
+// SendMFACode sends the one-time login code of a pending challenge by email or SMS.
+func (ap *AuthProvider) SendMFACode(ctx context.Context, challenge, method string) error {
+	_, state, user, err := ap.loadMFAChallenge(ctx, challenge)
+	if err != nil {
+		return err
+	}
+	if !state.allows(MFAMethod(method)) {
+		return fmt.Errorf("MFA method %s is not enabled", method)
+	}
+	return ap.components.mfaManager.SendCode(ctx, user, MFAMethod(method))
+}
+
+// rememberDevice issues a token that skips MFA for the user until MFAConfig.RememberDevice elapsed.
+// Only the hash of the token is stored.
+func (mm *MFAManager) rememberDevice(ctx context.Context, user User) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	orm := mm.orm.NewORM(ctx)
+	hash := hashRememberDeviceToken(token)
+	mm.cache.Set(orm, mfaRememberDeviceCachePrefix+hash, strconv.FormatUint(user.ID(), 10), mm.config.RememberDevice)
+
+	devicesKey := mm.rememberedDevicesKey(user.ID())
+	mm.cache.SAdd(orm, devicesKey, hash)
+	mm.cache.Expire(orm, devicesKey, mm.config.RememberDevice)
+	return token, nil
+}
+
+// isDeviceRemembered reports whether the token was issued to the user by a completed MFA challenge.
+func (mm *MFAManager) isDeviceRemembered(ctx context.Context, user User, token string) bool {
+	if token == "" || mm.config.RememberDevice <= 0 {
+		return false
+	}
+	userID, found := mm.cache.Get(mm.orm.NewORM(ctx), mfaRememberDeviceCachePrefix+hashRememberDeviceToken(token))
+	return found && userID == strconv.FormatUint(user.ID(), 10)
+}
+
+// ForgetDevices revokes every remember-device token of the user, the next logins require MFA again.
+func (mm *MFAManager) ForgetDevices(ctx context.Context, userID uint64) {
+	orm := mm.orm.NewORM(ctx)
+	devicesKey := mm.rememberedDevicesKey(userID)
+	for _, hash := range mm.cache.SMembers(orm, devicesKey) {
+		mm.cache.Del(orm, mfaRememberDeviceCachePrefix+hash)
+	}
+	mm.cache.Del(orm, devicesKey)
+}
+
+func (mm *MFAManager) rememberedDevicesKey(userID uint64) string {
+	return mfaRememberDeviceCachePrefix + "user:" + strconv.FormatUint(userID, 10)
+}
+
+func hashRememberDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package zephyrix
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+func TestMFAChallengeToken(t *testing.T) {
+	ap := newTestAuthProvider(t, &models.UserEntity{ID: 1, Username: "alice", Active: true})
+
+	token, err := ap.signMFAChallenge("challenge-id", 1, time.Minute)
+	require.NoError(t, err)
+
+	id, userID, err := ap.parseMFAChallenge(token)
+	require.NoError(t, err)
+	require.Equal(t, "challenge-id", id)
+	require.Equal(t, uint64(1), userID)
+
+	// a challenge does not authenticate requests
+	_, err = ap.identityFromJWT(token)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// and an access token is not a challenge
+	user, err := ap.components.userStore.GetByID(context.Background(), 1)
+	require.NoError(t, err)
+	access, err := ap.generateJWT(user)
+	require.NoError(t, err)
+	_, _, err = ap.parseMFAChallenge(access)
+	require.ErrorIs(t, err, ErrInvalidMFAChallenge)
+
+	expired, err := ap.signMFAChallenge("challenge-id", 1, -time.Minute)
+	require.NoError(t, err)
+	_, _, err = ap.parseMFAChallenge(expired)
+	require.ErrorIs(t, err, ErrInvalidMFAChallenge)
+}
+
+func TestMFAChallengeError(t *testing.T) {
+	var err error = &MFAChallenge{Token: "token", Methods: []MFAMethod{MFAMethodTOTP}}
+	require.ErrorIs(t, err, ErrMFARequired)
+
+	var challenge *MFAChallenge
+	require.True(t, errors.As(err, &challenge))
+	require.Equal(t, "token", challenge.Token)
+
+	state := &mfaChallengeState{Methods: challenge.Methods}
+	require.True(t, state.allows(MFAMethodTOTP))
+	require.False(t, state.allows(MFAMethodSMS))
+}
+
+func TestMFAChallengeWithoutEnrolledMethod(t *testing.T) {
+	ap := newTestAuthProvider(t, &models.UserEntity{ID: 1, Username: "alice", Active: true, Roles: `["admin"]`})
+	ap.components.auditLogger = &AuditLogger{}
+	ap.components.mfaManager = &MFAManager{config: MFAConfig{Enabled: true, Methods: []string{"totp"}, EnforceForRoles: []string{"admin"}}}
+
+	user, err := ap.components.userStore.GetByID(context.Background(), 1)
+	require.NoError(t, err)
+	require.True(t, ap.components.mfaManager.IsRequired(user))
+
+	err = ap.newMFAChallenge(context.Background(), user, "")
+	require.ErrorIs(t, err, ErrMFAEnrollmentRequired, "a challenge without methods could never be completed")
+	require.NotErrorIs(t, err, ErrMFARequired)
+}
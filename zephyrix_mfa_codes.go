@@ -0,0 +1,238 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOTPCodeLength      = 6
+	defaultOTPCodeTTL         = 5 * time.Minute
+	defaultOTPCodeMaxAttempts = 5
+	defaultOTPCodeRatePool    = "mfa_code"
+
+	otpPurposeLogin      = "login"
+	otpPurposeEnrollment = "enrollment"
+)
+
+// OTPCodeConfig configures the one-time codes delivered by email and SMS.
+type OTPCodeConfig struct {
+	Length        int           `mapstructure:"length"`
+	TTL           time.Duration `mapstructure:"ttl"`
+	MaxAttempts   int           `mapstructure:"max_attempts"`    // wrong guesses before the code is discarded
+	RateLimitPool string        `mapstructure:"rate_limit_pool"` // rate limiter pool limiting the codes sent per user
+}
+
+// normalize applies the defaults of the configuration.
+func (c OTPCodeConfig) normalize() OTPCodeConfig {
+	if c.Length < 4 || c.Length > 10 {
+		c.Length = defaultOTPCodeLength
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultOTPCodeTTL
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultOTPCodeMaxAttempts
+	}
+	if c.RateLimitPool == "" {
+		c.RateLimitPool = defaultOTPCodeRatePool
+	}
+	return c
+}
+
+// SetCodeSender replaces the sender of the email or SMS method, e.g. with a provider specific client.
+func (mm *MFAManager) SetCodeSender(method MFAMethod, sender CodeSender) {
+	mm.senders[method] = sender
+}
+
+// setupCode enrolls the email of the user, or the phone number stored in the "phone" metadata.
+func (mm *MFAManager) setupCode(ctx context.Context, user User, method MFAMethod) error {
+	var destination string
+	switch method {
+	case MFAMethodEmail:
+		destination = user.Email()
+	case MFAMethodSMS:
+		if phone, err := user.GetMetadata("phone"); err == nil {
+			destination, _ = phone.(string)
+		}
+	}
+	return mm.BeginCodeEnrollment(ctx, user, method, destination)
+}
+
+// BeginCodeEnrollment sends a code to the destination, which is only enabled for MFA
+// once ConfirmCodeEnrollment received that code.
+func (mm *MFAManager) BeginCodeEnrollment(ctx context.Context, user User, method MFAMethod, destination string) error {
+	if method != MFAMethodEmail && method != MFAMethodSMS {
+		return fmt.Errorf("unsupported MFA method: %s", method)
+	}
+	if !mm.isMethodSupported(method) {
+		return fmt.Errorf("unsupported MFA method: %s", method)
+	}
+	destination = strings.TrimSpace(destination)
+	if destination == "" {
+		return fmt.Errorf("no %s destination to enroll", method)
+	}
+
+	if err := mm.sendCode(ctx, user, method, destination, otpPurposeEnrollment); err != nil {
+		return err
+	}
+	mm.cache.Set(mm.orm.NewORM(ctx), mm.codeKey(user, method, otpPurposeEnrollment)+":to", destination, mm.config.Codes.TTL)
+	return nil
+}
+
+// ConfirmCodeEnrollment enables the pending destination of the method.
+func (mm *MFAManager) ConfirmCodeEnrollment(ctx context.Context, user User, method MFAMethod, code string) error {
+	orm := mm.orm.NewORM(ctx)
+	destination, found := mm.cache.Get(orm, mm.codeKey(user, method, otpPurposeEnrollment)+":to")
+	if !found {
+		return fmt.Errorf("no pending %s enrollment, it may have expired", method)
+	}
+
+	if !mm.checkCode(ctx, user, method, otpPurposeEnrollment, code) {
+		return ErrInvalidMFAToken
+	}
+
+	if err := user.SetupMFA(method, destination); err != nil {
+		return err
+	}
+	if err := mm.users.Update(ctx, user); err != nil {
+		return fmt.Errorf("failed to enable %s MFA: %w", method, err)
+	}
+
+	mm.cache.Del(orm, mm.codeKey(user, method, otpPurposeEnrollment)+":to")
+	return nil
+}
+
+// SendCode sends a login code to the enrolled destination of the method.
+// Codes sent per user are limited by the rate limiter pool of the configuration.
+func (mm *MFAManager) SendCode(ctx context.Context, user User, method MFAMethod) error {
+	if !mm.isMethodSupported(method) {
+		return fmt.Errorf("unsupported MFA method: %s", method)
+	}
+	destination, err := user.GetMFASecret(method)
+	if err != nil {
+		return err
+	}
+	return mm.sendCode(ctx, user, method, destination, otpPurposeLogin)
+}
+
+func (mm *MFAManager) sendCode(ctx context.Context, user User, method MFAMethod, destination, purpose string) error {
+	sender := mm.senders[method]
+	if sender == nil {
+		return fmt.Errorf("no code sender configured for %s", method)
+	}
+
+	if mm.limiter != nil {
+		key := strconv.FormatUint(user.ID(), 10) + ":" + string(method)
+		if !mm.limiter.Limiter(ctx, mm.config.Codes.RateLimitPool).Allow(ctx, "mfa_code", key) {
+			return ErrRateLimited
+		}
+	}
+
+	code, err := generateNumericCode(mm.config.Codes.Length)
+	if err != nil {
+		return fmt.Errorf("failed to generate code: %w", err)
+	}
+
+	orm := mm.orm.NewORM(ctx)
+	key := mm.codeKey(user, method, purpose)
+	// a new code replaces the previous one and its failed attempts
+	mm.cache.Set(orm, key, hashOTPCode(key, code), mm.config.Codes.TTL)
+	mm.cache.Del(orm, key+":attempts")
+
+	message := CodeMessage{Method: method, To: destination, Code: code, Purpose: purpose, TTL: mm.config.Codes.TTL}
+	if err := sender.SendCode(ctx, message); err != nil {
+		mm.cache.Del(orm, key)
+		return fmt.Errorf("failed to send %s code: %w", method, err)
+	}
+
+	mm.logCode(ctx, user, "mfa_code_sent", fmt.Sprintf("method: %s\npurpose: %s\nto: %s", method, purpose, maskDestination(destination)))
+	return nil
+}
+
+func (mm *MFAManager) verifyCode(ctx context.Context, user User, method MFAMethod, token string) (bool, error) {
+	if _, err := user.GetMFASecret(method); err != nil {
+		return false, nil
+	}
+	return mm.checkCode(ctx, user, method, otpPurposeLogin, token), nil
+}
+
+// checkCode consumes the pending code of the purpose, a code is discarded once it was
+// accepted or after MaxAttempts wrong guesses.
+func (mm *MFAManager) checkCode(ctx context.Context, user User, method MFAMethod, purpose, token string) bool {
+	orm := mm.orm.NewORM(ctx)
+	key := mm.codeKey(user, method, purpose)
+
+	stored, found := mm.cache.Get(orm, key)
+	if !found {
+		return false
+	}
+
+	attempts := mm.cache.Incr(orm, key+":attempts")
+	if attempts == 1 {
+		mm.cache.Expire(orm, key+":attempts", mm.config.Codes.TTL)
+	}
+	if attempts > int64(mm.config.Codes.MaxAttempts) {
+		mm.cache.Del(orm, key, key+":attempts")
+		mm.logCode(ctx, user, "mfa_code_exhausted", fmt.Sprintf("method: %s\npurpose: %s", method, purpose))
+		return false
+	}
+
+	token = strings.TrimSpace(token)
+	if subtle.ConstantTimeCompare([]byte(hashOTPCode(key, token)), []byte(stored)) != 1 {
+		return false
+	}
+
+	mm.cache.Del(orm, key, key+":attempts")
+	mm.logCode(ctx, user, "mfa_code_verified", fmt.Sprintf("method: %s\npurpose: %s", method, purpose))
+	return true
+}
+
+func (mm *MFAManager) codeKey(user User, method MFAMethod, purpose string) string {
+	return fmt.Sprintf("%s:code:%s:%s:%d", mfaCachePrefix, purpose, method, user.ID())
+}
+
+func (mm *MFAManager) logCode(ctx context.Context, user User, action, details string) {
+	if mm.audit == nil {
+		return
+	}
+	if err := mm.audit.Log(ctx, action, user.Username(), details); err != nil {
+		Logger.Error("Failed to write audit log: %s", err)
+	}
+}
+
+// generateNumericCode returns a uniformly distributed code of the given number of digits.
+func generateNumericCode(length int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", length, n), nil
+}
+
+// hashOTPCode hashes a code together with its key, so equal codes of different users
+// do not share a hash.
+func hashOTPCode(key, code string) string {
+	sum := sha256.Sum256([]byte(key + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// maskDestination hides most of an email address or phone number for logs.
+func maskDestination(destination string) string {
+	if at := strings.LastIndex(destination, "@"); at > 0 {
+		return destination[:1] + "***" + destination[at:]
+	}
+	if len(destination) > 4 {
+		return strings.Repeat("*", len(destination)-4) + destination[len(destination)-4:]
+	}
+	return "***"
+}
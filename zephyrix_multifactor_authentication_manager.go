@@ -2,36 +2,101 @@ package zephyrix
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/latolukasz/beeorm/v3"
+	"github.com/skip2/go-qrcode"
 )
 
 type MFAConfig struct {
-	Enabled         bool     `mapstructure:"enabled"`
-	Methods         []string `mapstructure:"methods"`
-	EnforceForRoles []string `mapstructure:"enforce_for_roles"`
+	Enabled         bool       `mapstructure:"enabled"`
+	Methods         []string   `mapstructure:"methods"`
+	EnforceForRoles []string   `mapstructure:"enforce_for_roles"`
+	TOTP            TOTPConfig `mapstructure:"totp"`
+	RecoveryCodes   int        `mapstructure:"recovery_codes"` // number of codes issued when TOTP is enabled
+
+	ChallengeTTL      time.Duration `mapstructure:"challenge_ttl"`      // time to complete the second factor
+	ChallengeAttempts int           `mapstructure:"challenge_attempts"` // wrong codes accepted per challenge
+	RememberDevice    time.Duration `mapstructure:"remember_device"`    // how long a remembered device skips MFA, 0 disables it
+
+	Codes OTPCodeConfig    `mapstructure:"codes"` // one-time codes sent by email and SMS
+	Email CodeSenderConfig `mapstructure:"email"`
+	SMS   CodeSenderConfig `mapstructure:"sms"`
 }
 
 type MFAMethod string
 
 const (
-	MFAMethodTOTP  MFAMethod = "totp"
-	MFAMethodSMS   MFAMethod = "sms"
-	MFAMethodEmail MFAMethod = "email"
+	MFAMethodTOTP         MFAMethod = "totp"
+	MFAMethodSMS          MFAMethod = "sms"
+	MFAMethodEmail        MFAMethod = "email"
+	MFAMethodRecoveryCode MFAMethod = "recovery_code"
+	MFAMethodWebAuthn     MFAMethod = "webauthn"
+)
+
+const (
+	mfaCachePrefix        = "zephyrix:mfa"
+	totpEnrollmentTimeout = 10 * time.Minute
+	qrCodeSize            = 256
 )
 
+// TOTPEnrollment holds what a user needs to add the account to an authenticator app.
+// The secret only becomes active once ConfirmTOTPEnrollment received a valid code.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QRCode []byte `json:"qr_code"` // PNG rendering of the URI
+}
+
 type MFAManager struct {
-	config MFAConfig
-	cache  beeorm.RedisCache
+	config   MFAConfig
+	cache    beeorm.RedisCache
+	orm      beeorm.Engine
+	users    UserStore
+	webauthn *WebAuthnManager
+	limiter  *RateLimiter
+	audit    *AuditLogger
+	senders  map[MFAMethod]CodeSender
 }
 
-func NewMFAManager(config MFAConfig, cache beeorm.RedisCache) *MFAManager {
-	return &MFAManager{
-		config: config,
-		cache:  cache,
+func NewMFAManager(config MFAConfig, cache beeorm.RedisCache, orm beeorm.Engine, users UserStore, rl *RateLimiter, audit *AuditLogger) (*MFAManager, error) {
+	config.TOTP = config.TOTP.normalize()
+	config.Codes = config.Codes.normalize()
+	if config.RecoveryCodes <= 0 {
+		config.RecoveryCodes = defaultRecoveryCodeCount
+	}
+	if config.ChallengeTTL <= 0 {
+		config.ChallengeTTL = defaultMFAChallengeTTL
+	}
+	if config.ChallengeAttempts <= 0 {
+		config.ChallengeAttempts = defaultMFAChallengeAttempts
+	}
+
+	mm := &MFAManager{
+		config:  config,
+		cache:   cache,
+		orm:     orm,
+		users:   users,
+		limiter: rl,
+		audit:   audit,
+		senders: make(map[MFAMethod]CodeSender),
 	}
+
+	for method, senderConfig := range map[MFAMethod]CodeSenderConfig{MFAMethodEmail: config.Email, MFAMethodSMS: config.SMS} {
+		sender, err := newCodeSender(senderConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s code sender: %w", method, err)
+		}
+		if sender != nil {
+			mm.senders[method] = sender
+		}
+	}
+
+	return mm, nil
 }
 
 func (mm *MFAManager) IsRequired(user User) bool {
@@ -56,6 +121,7 @@ func (mm *MFAManager) GetAvailableMethods() []MFAMethod {
 	return methods
 }
 
+// SetupMFA starts the setup of a method, TOTP enrollments are completed with ConfirmTOTPEnrollment.
 func (mm *MFAManager) SetupMFA(ctx context.Context, user User, method MFAMethod) error {
 	if !mm.isMethodSupported(method) {
 		return fmt.Errorf("unsupported MFA method: %s", method)
@@ -64,10 +130,10 @@ func (mm *MFAManager) SetupMFA(ctx context.Context, user User, method MFAMethod)
 	switch method {
 	case MFAMethodTOTP:
 		return mm.setupTOTP(ctx, user)
-	case MFAMethodSMS:
-		return mm.setupSMS(ctx, user)
-	case MFAMethodEmail:
-		return mm.setupEmail(ctx, user)
+	case MFAMethodSMS, MFAMethodEmail:
+		return mm.setupCode(ctx, user, method)
+	case MFAMethodWebAuthn:
+		return errors.New("WebAuthn credentials are registered with WebAuthnManager.BeginRegistration")
 	default:
 		return fmt.Errorf("unknown MFA method: %s", method)
 	}
@@ -81,10 +147,12 @@ func (mm *MFAManager) VerifyMFA(ctx context.Context, user User, method MFAMethod
 	switch method {
 	case MFAMethodTOTP:
 		return mm.verifyTOTP(ctx, user, token)
-	case MFAMethodSMS:
-		return mm.verifySMS(ctx, user, token)
-	case MFAMethodEmail:
-		return mm.verifyEmail(ctx, user, token)
+	case MFAMethodSMS, MFAMethodEmail:
+		return mm.verifyCode(ctx, user, method, token)
+	case MFAMethodWebAuthn:
+		return mm.verifyWebAuthn(ctx, user, token)
+	case MFAMethodRecoveryCode:
+		return mm.verifyRecoveryCode(ctx, user, token)
 	default:
 		return false, fmt.Errorf("unknown MFA method: %s", method)
 	}
@@ -95,11 +163,27 @@ func (mm *MFAManager) DisableMFA(ctx context.Context, user User, method MFAMetho
 		return fmt.Errorf("unsupported MFA method: %s", method)
 	}
 
-	// Implement MFA disabling logic
-	return user.DisableMFA(method)
+	if err := user.DisableMFA(method); err != nil {
+		return err
+	}
+	if method == MFAMethodTOTP {
+		// recovery codes only make sense as a fallback of the authenticator app
+		if err := user.DisableMFA(MFAMethodRecoveryCode); err != nil {
+			return err
+		}
+	}
+	if err := mm.users.Update(ctx, user); err != nil {
+		return err
+	}
+	mm.ForgetDevices(ctx, user.ID())
+	return nil
 }
 
 func (mm *MFAManager) isMethodSupported(method MFAMethod) bool {
+	if method == MFAMethodRecoveryCode {
+		// recovery codes come with TOTP unless the methods are listed explicitly
+		return mm.isMethodSupported(MFAMethodTOTP)
+	}
 	for _, supportedMethod := range mm.config.Methods {
 		if MFAMethod(supportedMethod) == method {
 			return true
@@ -109,52 +193,170 @@ func (mm *MFAManager) isMethodSupported(method MFAMethod) bool {
 }
 
 func (mm *MFAManager) setupTOTP(ctx context.Context, user User) error {
-	// Implement TOTP setup logic
+	_, err := mm.BeginTOTPEnrollment(ctx, user)
+	return err
+}
+
+// BeginTOTPEnrollment generates a pending TOTP secret with its provisioning URI and QR code.
+func (mm *MFAManager) BeginTOTPEnrollment(ctx context.Context, user User) (*TOTPEnrollment, error) {
+	if !mm.isMethodSupported(MFAMethodTOTP) {
+		return nil, fmt.Errorf("unsupported MFA method: %s", MFAMethodTOTP)
+	}
+
 	secret, err := generateTOTPSecret()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+
+	account := user.Email()
+	if account == "" {
+		account = user.Username()
+	}
+	uri := totpProvisioningURI(mm.config.TOTP, account, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render TOTP QR code: %w", err)
+	}
+
+	mm.cache.Set(mm.orm.NewORM(ctx), mm.pendingTOTPKey(user), secret, totpEnrollmentTimeout)
+	return &TOTPEnrollment{Secret: secret, URI: uri, QRCode: png}, nil
+}
+
+// ConfirmTOTPEnrollment enables the pending secret once the user proved the app produces valid codes,
+// it returns the recovery codes of the user, which are shown once and only stored hashed.
+func (mm *MFAManager) ConfirmTOTPEnrollment(ctx context.Context, user User, token string) ([]string, error) {
+	orm := mm.orm.NewORM(ctx)
+	secret, found := mm.cache.Get(orm, mm.pendingTOTPKey(user))
+	if !found {
+		return nil, errors.New("no pending TOTP enrollment, it may have expired")
 	}
-	return user.SetTOTPSecret(secret)
+
+	counter, valid := verifyTOTPToken(mm.config.TOTP, secret, token, time.Now())
+	if !valid || !mm.markTOTPUsed(orm, user, counter) {
+		return nil, ErrInvalidMFAToken
+	}
+
+	if err := user.SetTOTPSecret(secret); err != nil {
+		return nil, err
+	}
+	codes, err := mm.setRecoveryCodes(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := mm.users.Update(ctx, user); err != nil {
+		return nil, fmt.Errorf("failed to enable TOTP: %w", err)
+	}
+
+	mm.cache.Del(orm, mm.pendingTOTPKey(user))
+	return codes, nil
 }
 
 func (mm *MFAManager) verifyTOTP(ctx context.Context, user User, token string) (bool, error) {
-	// Implement TOTP verification logic
 	secret, err := user.GetTOTPSecret()
 	if err != nil {
 		return false, err
 	}
-	return verifyTOTPToken(secret, token), nil
-}
 
-// TODO:
+	counter, valid := verifyTOTPToken(mm.config.TOTP, secret, token, time.Now())
+	if !valid {
+		return false, nil
+	}
+	return mm.markTOTPUsed(mm.orm.NewORM(ctx), user, counter), nil
+}
 
-func (mm *MFAManager) setupSMS(ctx context.Context, user User) error {
-	// Implement SMS setup logic
-	return errors.New("SMS MFA setup not implemented")
+// markTOTPUsed records the time step of an accepted code, a code observed by an attacker
+// can not be replayed while it is still inside the accepted window.
+func (mm *MFAManager) markTOTPUsed(orm beeorm.ORM, user User, counter uint64) bool {
+	key := fmt.Sprintf("%s:totp:used:%d:%d", mfaCachePrefix, user.ID(), counter)
+	window := mm.config.TOTP.Period * time.Duration(2*mm.config.TOTP.Skew+1)
+	return mm.cache.SetNX(orm, key, "1", window)
 }
 
-func (mm *MFAManager) setupEmail(ctx context.Context, user User) error {
-	// Implement Email setup logic
-	return errors.New("Email MFA setup not implemented")
+func (mm *MFAManager) pendingTOTPKey(user User) string {
+	return mfaCachePrefix + ":totp:pending:" + strconv.FormatUint(user.ID(), 10)
 }
 
-func (mm *MFAManager) verifySMS(ctx context.Context, user User, token string) (bool, error) {
-	// Implement SMS verification logic
-	return false, errors.New("SMS MFA verification not implemented")
+// RegenerateRecoveryCodes replaces the recovery codes of a user with TOTP enabled.
+func (mm *MFAManager) RegenerateRecoveryCodes(ctx context.Context, user User) ([]string, error) {
+	if _, err := user.GetTOTPSecret(); err != nil {
+		return nil, err
+	}
+	codes, err := mm.setRecoveryCodes(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := mm.users.Update(ctx, user); err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	return codes, nil
 }
 
-func (mm *MFAManager) verifyEmail(ctx context.Context, user User, token string) (bool, error) {
-	// Implement Email verification logic
-	return false, errors.New("Email MFA verification not implemented")
+func (mm *MFAManager) setRecoveryCodes(user User) ([]string, error) {
+	codes, err := generateRecoveryCodes(mm.config.RecoveryCodes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery codes: %w", err)
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	encoded, _ := json.Marshal(hashes)
+	if err := user.SetupMFA(MFAMethodRecoveryCode, string(encoded)); err != nil {
+		return nil, err
+	}
+	return codes, nil
 }
 
-// Helper functions (implement these)
-func generateTOTPSecret() (string, error) {
-	// Implement TOTP secret generation
-	return "", errors.New("TOTP secret generation not implemented")
+// verifyRecoveryCode consumes a recovery code, each code is accepted once.
+func (mm *MFAManager) verifyRecoveryCode(ctx context.Context, user User, code string) (bool, error) {
+	stored, err := user.GetMFASecret(MFAMethodRecoveryCode)
+	if err != nil {
+		return false, nil
+	}
+	var hashes []string
+	if err := json.Unmarshal([]byte(stored), &hashes); err != nil {
+		return false, fmt.Errorf("invalid recovery codes: %w", err)
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, candidate := range hashes {
+		if candidate != hash {
+			continue
+		}
+		// concurrent logins with the same code race on this marker, not on the user update
+		if !mm.cache.SetNX(mm.orm.NewORM(ctx), mfaCachePrefix+":recovery:used:"+hash, "1", 24*time.Hour) {
+			return false, nil
+		}
+		remaining := append(hashes[:i:i], hashes[i+1:]...)
+		encoded, _ := json.Marshal(remaining)
+		if err := user.SetupMFA(MFAMethodRecoveryCode, string(encoded)); err != nil {
+			return false, err
+		}
+		if err := mm.users.Update(ctx, user); err != nil {
+			return false, fmt.Errorf("failed to consume recovery code: %w", err)
+		}
+		return true, nil
+	}
+	return false, nil
 }
 
-func verifyTOTPToken(secret, token string) bool {
-	// Implement TOTP token verification
-	return false
+// verifyWebAuthn checks an assertion, the token is the JSON encoded WebAuthnCredentialAssertion
+// answering the options of WebAuthnManager.BeginLogin for the user.
+func (mm *MFAManager) verifyWebAuthn(ctx context.Context, user User, token string) (bool, error) {
+	if mm.webauthn == nil {
+		return false, errors.New("WebAuthn is not available")
+	}
+	var assertion WebAuthnCredentialAssertion
+	if err := json.Unmarshal([]byte(token), &assertion); err != nil {
+		return false, nil
+	}
+
+	login, err := mm.webauthn.FinishLogin(ctx, &assertion)
+	if errors.Is(err, ErrInvalidWebAuthn) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return login.User.ID() == user.ID(), nil
 }
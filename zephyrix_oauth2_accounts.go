@@ -0,0 +1,253 @@
+package zephyrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+// OAuth2Account is a provider account linked to a user.
+type OAuth2Account struct {
+	ID          uint64     `json:"id"`
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email,omitempty"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+func oauth2AccountFromEntity(entity *models.OAuth2AccountEntity) *OAuth2Account {
+	return &OAuth2Account{
+		ID:          entity.ID,
+		Provider:    entity.Provider,
+		Subject:     entity.Subject,
+		Email:       entity.Email,
+		LastLoginAt: entity.LastLoginAt,
+		CreatedAt:   entity.CreatedAt,
+	}
+}
+
+// OAuth2Callback is the outcome of a completed authorization request.
+type OAuth2Callback struct {
+	User     User
+	Identity *OAuth2Identity
+	Linked   bool // the account was linked to a signed in user, it is not a login
+}
+
+func (ap *AuthProvider) InitializeOAuth2(ctx context.Context) error {
+	return ap.components.oauth2Manager.Initialize(ctx)
+}
+
+// OAuth2 returns the manager of the OAuth2 and OIDC providers.
+func (ap *AuthProvider) OAuth2() *OAuth2Manager {
+	return ap.components.oauth2Manager
+}
+
+// GetOAuth2AuthURL returns the URL signing the user in with the provider,
+// the callback completes it with AuthenticateUser and GrantTypeAuthorization.
+func (ap *AuthProvider) GetOAuth2AuthURL(ctx context.Context, providerName string) (string, error) {
+	return ap.components.oauth2Manager.GetAuthURL(ctx, providerName)
+}
+
+// GetOAuth2LinkURL returns the URL linking an account of the provider to the signed in user.
+func (ap *AuthProvider) GetOAuth2LinkURL(ctx context.Context, user User, providerName string) (string, error) {
+	return ap.components.oauth2Manager.AuthCodeURL(ctx, providerName, user.ID())
+}
+
+// HandleOAuth2Callback completes an authorization request. It links the account when the request
+// was started by GetOAuth2LinkURL, otherwise it returns the user of the account, which is created
+// when neither the account nor its verified email address are known.
+func (ap *AuthProvider) HandleOAuth2Callback(ctx context.Context, providerName, code, state string) (*OAuth2Callback, error) {
+	identity, linkUserID, err := ap.components.oauth2Manager.Exchange(ctx, providerName, code, state)
+	if err != nil {
+		return nil, err
+	}
+
+	if linkUserID != 0 {
+		user, err := ap.components.userStore.GetByID(ctx, linkUserID)
+		if err != nil {
+			return nil, err
+		}
+		if err := ap.linkOAuth2Account(ctx, user, identity); err != nil {
+			return nil, err
+		}
+		ap.keepOAuth2Token(ctx, user, identity)
+		return &OAuth2Callback{User: user, Identity: identity, Linked: true}, nil
+	}
+
+	user, err := ap.findOrCreateOAuth2User(ctx, identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find or create OAuth2 user: %w", err)
+	}
+	ap.keepOAuth2Token(ctx, user, identity)
+	return &OAuth2Callback{User: user, Identity: identity}, nil
+}
+
+// OAuth2Accounts returns the provider accounts linked to the user.
+func (ap *AuthProvider) OAuth2Accounts(ctx context.Context, userID uint64) ([]*OAuth2Account, error) {
+	var accounts []*OAuth2Account
+	iterator := beeorm.Search[models.OAuth2AccountEntity](ap.orm.NewORM(ctx), beeorm.NewWhere("`UserID` = ?", userID), nil)
+	for iterator.Next() {
+		accounts = append(accounts, oauth2AccountFromEntity(iterator.Entity()))
+	}
+	return accounts, nil
+}
+
+// UnlinkOAuth2Account removes a linked account. The last account of a user without a password
+// can not be removed, the user could not sign in anymore.
+func (ap *AuthProvider) UnlinkOAuth2Account(ctx context.Context, user User, id uint64) error {
+	orm := ap.orm.NewORM(ctx)
+	entity, found := beeorm.GetByID[models.OAuth2AccountEntity](orm, id)
+	if !found || entity.UserID != user.ID() {
+		return fmt.Errorf("OAuth2 account %d not found", id)
+	}
+
+	if hu, ok := user.(PasswordHashUser); ok && hu.PasswordHash() == "" {
+		if accounts, err := ap.OAuth2Accounts(ctx, user.ID()); err != nil || len(accounts) <= 1 {
+			return errors.New("the last linked account of a user without a password can not be removed")
+		}
+	}
+
+	beeorm.DeleteEntity(orm, entity)
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to unlink OAuth2 account: %w", err)
+	}
+	ap.logOAuth2(ctx, "oauth2_account_unlinked", user.ID(), entity.Provider)
+	return nil
+}
+
+// findOrCreateOAuth2User returns the user linked to the provider account. Unknown accounts are linked
+// to the user owning their verified email address, or to a new user when the address is unknown.
+func (ap *AuthProvider) findOrCreateOAuth2User(ctx context.Context, identity *OAuth2Identity) (User, error) {
+	orm := ap.orm.NewORM(ctx)
+	if account, found := beeorm.GetByUniqueIndex[models.OAuth2AccountEntity](orm, "provider_subject", identity.Provider, identity.Subject); found {
+		user, err := ap.components.userStore.GetByID(ctx, account.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		edited := beeorm.EditEntity(orm, account)
+		edited.LastLoginAt = &now
+		if identity.Email != "" {
+			edited.Email = identity.Email
+		}
+		if err := orm.FlushAsync(); err != nil {
+			Logger.Error("Failed to update OAuth2 account %d: %s", account.ID, err)
+		}
+		return user, ap.applyOAuth2Claims(ctx, user, identity)
+	}
+
+	if identity.Email == "" {
+		return nil, fmt.Errorf("provider %s did not return an email address", identity.Provider)
+	}
+	if !identity.EmailVerified {
+		return nil, fmt.Errorf("email address of the %s account is not verified", identity.Provider)
+	}
+
+	user, err := ap.components.userStore.GetByEmail(ctx, identity.Email)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			return nil, err
+		}
+		if user, err = ap.createOAuth2User(ctx, identity); err != nil {
+			return nil, err
+		}
+	} else if err := ap.applyOAuth2Claims(ctx, user, identity); err != nil {
+		return nil, err
+	}
+
+	if err := ap.linkOAuth2Account(ctx, user, identity); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (ap *AuthProvider) createOAuth2User(ctx context.Context, identity *OAuth2Identity) (User, error) {
+	username := identity.Username
+	if username == "" {
+		username = identity.Email
+	}
+	if _, err := ap.components.userStore.GetByUsername(ctx, username); err == nil {
+		// the provider login is taken by another local account, fall back to the email address
+		username = identity.Email
+	}
+
+	metadata := map[string]interface{}{"oauth2_provider": identity.Provider}
+	for key, value := range identity.Metadata {
+		metadata[key] = value
+	}
+	if identity.Name != "" {
+		if _, ok := metadata["name"]; !ok {
+			metadata["name"] = identity.Name
+		}
+	}
+
+	return ap.components.userStore.Create(ctx, NewUser{
+		Username: username,
+		Email:    identity.Email,
+		Roles:    identity.Roles,
+		Active:   true,
+		Metadata: metadata,
+	})
+}
+
+// applyOAuth2Claims grants the mapped roles and stores the mapped metadata, roles are never revoked.
+func (ap *AuthProvider) applyOAuth2Claims(ctx context.Context, user User, identity *OAuth2Identity) error {
+	changed := false
+	for _, role := range identity.Roles {
+		if !slices.Contains(user.Roles(), role) {
+			if err := user.AddRole(role); err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+	for key, value := range identity.Metadata {
+		if err := user.SetMetadata(key, value); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return ap.components.userStore.Update(ctx, user)
+}
+
+// linkOAuth2Account links the provider account to the user, an account belongs to a single user.
+func (ap *AuthProvider) linkOAuth2Account(ctx context.Context, user User, identity *OAuth2Identity) error {
+	orm := ap.orm.NewORM(ctx)
+	if account, found := beeorm.GetByUniqueIndex[models.OAuth2AccountEntity](orm, "provider_subject", identity.Provider, identity.Subject); found {
+		if account.UserID != user.ID() {
+			return ErrAccountLinked
+		}
+		return nil
+	}
+
+	now := time.Now()
+	entity := beeorm.NewEntity[models.OAuth2AccountEntity](orm)
+	entity.Provider = identity.Provider
+	entity.Subject = identity.Subject
+	entity.UserID = user.ID()
+	entity.Email = identity.Email
+	entity.LastLoginAt = &now
+	entity.CreatedAt = now
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to link OAuth2 account: %w", err)
+	}
+	ap.logOAuth2(ctx, "oauth2_account_linked", user.ID(), identity.Provider)
+	return nil
+}
+
+func (ap *AuthProvider) logOAuth2(ctx context.Context, action string, userID uint64, provider string) {
+	if err := ap.components.auditLogger.Log(ctx, action, strconv.FormatUint(userID, 10), "provider="+provider); err != nil {
+		Logger.Error("Failed to write audit log: %s", err)
+	}
+}
@@ -0,0 +1,100 @@
+package zephyrix
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+// oauth2Command builds the `oauth2` command managing the OAuth2 providers stored in the database.
+func (z *zephyrix) oauth2Command(cancel context.CancelFunc) *cobra.Command {
+	var provider Provider
+
+	oauth2Command := &cobra.Command{
+		GroupID: authGroup.ID,
+		Use:     "oauth2",
+		Short:   "Manage OAuth2 providers",
+		Long:    "Save, list and remove the OAuth2 and OIDC providers stored in the database (authentication.oauth2.providers_source: database)",
+		PersistentPreRun: func(_ *cobra.Command, _ []string) {
+			z.options = append(z.options, fx.Invoke(beeormInvoke))
+		},
+		PersistentPostRun: func(_ *cobra.Command, _ []string) {
+			defer cancel()
+		},
+	}
+
+	saveCommand := &cobra.Command{
+		Use:   "save <name>",
+		Short: "Create or replace a provider, every running instance reloads it",
+		Long:  "Create or replace a provider. Without --client-secret the stored secret is kept, \"-\" reads it from stdin.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			if provider.ClientSecret == "-" {
+				secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+				if err != nil && secret == "" {
+					return fmt.Errorf("failed to read the client secret: %w", err)
+				}
+				provider.ClientSecret = strings.TrimSpace(secret)
+			}
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				if err := ap.OAuth2().SaveProvider(ctx, args[0], provider); err != nil {
+					return err
+				}
+				Logger.Info("Saved OAuth2 provider %s", args[0])
+				return nil
+			})
+		},
+	}
+	saveCommand.Flags().StringVar(&provider.ClientID, "client-id", "", "client ID registered at the provider")
+	saveCommand.Flags().StringVar(&provider.ClientSecret, "client-secret", "", "client secret registered at the provider, - reads it from stdin")
+	saveCommand.Flags().StringVar(&provider.RedirectURL, "redirect-url", "", "callback URL, e.g. https://example.com/auth/oauth2/<name>/callback")
+	saveCommand.Flags().StringSliceVar(&provider.Scopes, "scopes", nil, "scopes to request")
+	saveCommand.Flags().StringVar(&provider.Issuer, "issuer", "", "issuer of an OIDC provider, its endpoints are discovered")
+	saveCommand.Flags().StringVar(&provider.AuthURL, "auth-url", "", "authorization endpoint of a plain OAuth2 provider")
+	saveCommand.Flags().StringVar(&provider.TokenURL, "token-url", "", "token endpoint of a plain OAuth2 provider")
+	saveCommand.Flags().StringVar(&provider.UserInfoURL, "userinfo-url", "", "userinfo endpoint of a plain OAuth2 provider")
+	saveCommand.Flags().StringVar(&provider.JWKSURL, "jwks-url", "", "overrides the discovered JWKS endpoint")
+	saveCommand.Flags().BoolVar(&provider.DisablePKCE, "disable-pkce", false, "for providers refusing PKCE")
+	saveCommand.Flags().BoolVar(&provider.TrustEmail, "trust-email", false, "treat emails as verified when the provider sends no email_verified claim")
+
+	listCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List the stored providers, without their client secrets",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				providers, err := ap.OAuth2().StoredProviders(ctx)
+				if err != nil {
+					return err
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(providers)
+			})
+		},
+	}
+
+	removeCommand := &cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove a provider, the linked accounts are kept",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return runCommand(z, func(ctx context.Context, ap *AuthProvider) error {
+				if err := ap.OAuth2().DeleteProvider(ctx, args[0]); err != nil {
+					return err
+				}
+				Logger.Info("Removed OAuth2 provider %s", args[0])
+				return nil
+			})
+		},
+	}
+
+	oauth2Command.AddCommand(saveCommand, listCommand, removeCommand)
+	return oauth2Command
+}
@@ -6,42 +6,256 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/latolukasz/beeorm/v3"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/facebook"
 	"golang.org/x/oauth2/github"
-	"golang.org/x/oauth2/google"
+)
+
+const (
+	oauth2StatePrefix = "zephyrix:oauth2:state:"
+	oauth2StateTTL    = 10 * time.Minute
+	oauth2HTTPTimeout = 10 * time.Second
 )
 
 type OAuth2Config struct {
 	ProvidersSource string              `mapstructure:"providers_source"`
 	Providers       map[string]Provider `mapstructure:"providers"`
+
+	// EncryptionKeys are base64 encoded 32 byte keys encrypting the client secrets stored in the database
+	// and the tokens of the users. The first key encrypts, the others only decrypt old values.
+	EncryptionKeys []string      `mapstructure:"encryption_keys"`
+	SyncInterval   time.Duration `mapstructure:"sync_interval"` // full reload of database providers, on top of the pub/sub notifications
 }
 
+// Provider defines an OAuth2 or OpenID Connect provider.
+//
+// Providers with an issuer are OIDC providers, their endpoints are discovered from
+// <issuer>/.well-known/openid-configuration and their ID tokens verified with the keys of the issuer.
+// Other providers need explicit endpoints and a user info URL. "google", "github" and "facebook"
+// only need their client credentials.
 type Provider struct {
-	ClientID     string   `mapstructure:"client_id"`
-	ClientSecret string   `mapstructure:"client_secret"`
-	RedirectURL  string   `mapstructure:"redirect_url"`
-	Scopes       []string `mapstructure:"scopes"`
+	ClientID     string   `mapstructure:"client_id" json:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret" json:"-"`
+	RedirectURL  string   `mapstructure:"redirect_url" json:"redirect_url,omitempty"`
+	Scopes       []string `mapstructure:"scopes" json:"scopes,omitempty"`
+
+	Issuer      string `mapstructure:"issuer" json:"issuer,omitempty"`
+	AuthURL     string `mapstructure:"auth_url" json:"auth_url,omitempty"`
+	TokenURL    string `mapstructure:"token_url" json:"token_url,omitempty"`
+	UserInfoURL string `mapstructure:"userinfo_url" json:"userinfo_url,omitempty"`
+	JWKSURL     string `mapstructure:"jwks_url" json:"jwks_url,omitempty"`
+	EmailsURL   string `mapstructure:"emails_url" json:"emails_url,omitempty"` // GitHub style list of addresses, used when the user info has no verified email
+
+	DisablePKCE bool         `mapstructure:"disable_pkce" json:"disable_pkce,omitempty"` // for servers rejecting the code_challenge parameter
+	TrustEmail  bool         `mapstructure:"trust_email" json:"trust_email,omitempty"`   // treat addresses as verified when the provider sends no verification claim
+	Claims      ClaimMapping `mapstructure:"claims" json:"claims"`
+}
+
+// ClaimMapping tells which claims of the ID token or user info describe the user.
+// Names can be paths into nested objects, e.g. "realm_access.roles".
+type ClaimMapping struct {
+	Subject       string            `mapstructure:"subject" json:"subject,omitempty"`               // default "sub"
+	Email         string            `mapstructure:"email" json:"email,omitempty"`                   // default "email"
+	EmailVerified string            `mapstructure:"email_verified" json:"email_verified,omitempty"` // default "email_verified", addresses are unverified when absent unless trust_email is set
+	Username      string            `mapstructure:"username" json:"username,omitempty"`             // default "preferred_username"
+	Name          string            `mapstructure:"name" json:"name,omitempty"`                     // default "name"
+	Roles         string            `mapstructure:"roles" json:"roles,omitempty"`                   // list of roles granted to the user, none when empty
+	RoleMapping   map[string]string `mapstructure:"role_mapping" json:"role_mapping,omitempty"`     // provider role to local role, other roles are dropped
+	Metadata      map[string]string `mapstructure:"metadata" json:"metadata,omitempty"`             // user metadata key to claim
+}
+
+// normalize applies the defaults of the mapping.
+func (m ClaimMapping) normalize() ClaimMapping {
+	if m.Subject == "" {
+		m.Subject = "sub"
+	}
+	if m.Email == "" {
+		m.Email = "email"
+	}
+	if m.EmailVerified == "" {
+		m.EmailVerified = "email_verified"
+	}
+	if m.Username == "" {
+		m.Username = "preferred_username"
+	}
+	if m.Name == "" {
+		m.Name = "name"
+	}
+	return m
 }
 
+// oauth2Presets complete the configuration of well known providers.
+var oauth2Presets = map[string]Provider{
+	"google": {
+		Issuer: "https://accounts.google.com",
+		Scopes: []string{"openid", "email", "profile"},
+	},
+	"github": {
+		AuthURL:     github.Endpoint.AuthURL,
+		TokenURL:    github.Endpoint.TokenURL,
+		UserInfoURL: "https://api.github.com/user",
+		EmailsURL:   "https://api.github.com/user/emails",
+		Scopes:      []string{"read:user", "user:email"},
+		Claims:      ClaimMapping{Subject: "id", Username: "login"},
+	},
+	"facebook": {
+		AuthURL:     facebook.Endpoint.AuthURL,
+		TokenURL:    facebook.Endpoint.TokenURL,
+		UserInfoURL: "https://graph.facebook.com/me?fields=id,name,email",
+		Scopes:      []string{"email", "public_profile"},
+		Claims:      ClaimMapping{Subject: "id"},
+	},
+}
+
+// withPreset fills the settings left empty with the preset of the provider name.
+func (p Provider) withPreset(name string) Provider {
+	preset, ok := oauth2Presets[name]
+	if !ok {
+		return p
+	}
+	fill := func(value *string, preset string) {
+		if *value == "" {
+			*value = preset
+		}
+	}
+	fill(&p.Issuer, preset.Issuer)
+	fill(&p.AuthURL, preset.AuthURL)
+	fill(&p.TokenURL, preset.TokenURL)
+	fill(&p.UserInfoURL, preset.UserInfoURL)
+	fill(&p.EmailsURL, preset.EmailsURL)
+	fill(&p.Claims.Subject, preset.Claims.Subject)
+	fill(&p.Claims.Username, preset.Claims.Username)
+	if len(p.Scopes) == 0 {
+		p.Scopes = preset.Scopes
+	}
+	return p
+}
+
+// OAuth2Identity is the account of a user at a provider, as described by the mapped claims.
+type OAuth2Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	Name          string
+	Roles         []string
+	Metadata      map[string]interface{}
+	Claims        map[string]interface{}
+	Token         *oauth2.Token
+}
+
+// oauth2State is stored server side under the state parameter of an authorization request.
+type oauth2State struct {
+	Provider   string `json:"provider"`
+	Verifier   string `json:"verifier,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`
+	LinkUserID uint64 `json:"link_user_id,omitempty"` // the account is linked to this user instead of logging in
+}
+
+// oauth2Provider is a configured provider, the OIDC discovery happens on first use.
+type oauth2Provider struct {
+	name   string
+	config Provider
+
+	mu          sync.Mutex
+	oauth2      *oauth2.Config
+	userInfoURL string
+	jwks        *jwksCache
+}
+
+func (p *oauth2Provider) isOIDC() bool {
+	return p.config.Issuer != ""
+}
+
+// resolve returns the client configuration, discovering the endpoints of OIDC providers.
+// A failed discovery is retried by the next call.
+func (p *oauth2Provider) resolve(ctx context.Context, client *http.Client) (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p.oauth2, nil
+	}
+
+	config := p.config
+	scopes := slices.Clone(config.Scopes)
+	if p.isOIDC() {
+		doc, err := discoverOIDC(ctx, client, config.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		if config.AuthURL == "" {
+			config.AuthURL = doc.AuthorizationEndpoint
+		}
+		if config.TokenURL == "" {
+			config.TokenURL = doc.TokenEndpoint
+		}
+		if config.UserInfoURL == "" {
+			config.UserInfoURL = doc.UserInfoEndpoint
+		}
+		if config.JWKSURL == "" {
+			config.JWKSURL = doc.JWKSURI
+		}
+		if !slices.Contains(scopes, "openid") {
+			scopes = append([]string{"openid"}, scopes...)
+		}
+		p.jwks = newJWKSCache(config.JWKSURL, client)
+	}
+
+	p.userInfoURL = config.UserInfoURL
+	p.oauth2 = &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		RedirectURL:  config.RedirectURL,
+		Scopes:       scopes,
+		Endpoint:     oauth2.Endpoint{AuthURL: config.AuthURL, TokenURL: config.TokenURL},
+	}
+	return p.oauth2, nil
+}
+
+// OAuth2Manager runs the authorization code flow against the configured providers.
+//
+// The state, PKCE verifier and OIDC nonce of a request are kept in redis, a state can only be used once.
 type OAuth2Manager struct {
-	config    OAuth2Config
-	orm       beeorm.Engine
-	providers map[string]*oauth2.Config
-	mu        sync.RWMutex
+	config      OAuth2Config
+	orm         beeorm.Engine
+	redisClient beeorm.RedisCache
+	pubsub      *redis.Client // notifies the instances of changed database providers
+	box         *secretBox    // nil without encryption keys, tokens are not stored then
+	client      *http.Client
+	providers   map[string]*oauth2Provider
+	mu          sync.RWMutex
 }
 
-func NewOAuth2Manager(config OAuth2Config, orm beeorm.Engine) *OAuth2Manager {
+func NewOAuth2Manager(config OAuth2Config, orm beeorm.Engine, redisClient beeorm.RedisCache) (*OAuth2Manager, error) {
 	manager := &OAuth2Manager{
-		config:    config,
-		orm:       orm,
-		providers: make(map[string]*oauth2.Config),
+		config:      config,
+		orm:         orm,
+		redisClient: redisClient,
+		client:      &http.Client{Timeout: oauth2HTTPTimeout},
+		providers:   make(map[string]*oauth2Provider),
+	}
+
+	if len(config.EncryptionKeys) > 0 {
+		box, err := newSecretBox(config.EncryptionKeys)
+		if err != nil {
+			return nil, fmt.Errorf("oauth2: %w", err)
+		}
+		manager.box = box
+	} else if config.ProvidersSource == "database" {
+		return nil, errors.New("oauth2: encryption_keys are required to store providers in the database")
 	}
 
-	return manager
+	return manager, nil
 }
 
 func (om *OAuth2Manager) Initialize(ctx context.Context) error {
@@ -60,35 +274,35 @@ func (om *OAuth2Manager) loadProvidersFromConfig() error {
 	return nil
 }
 
-func (om *OAuth2Manager) loadProvidersFromDatabase(ctx context.Context) error {
-	// Implement loading providers from the database
-	// This is a placeholder implementation
-	return errors.New("loading providers from database not implemented")
-}
-
+// AddProvider registers or replaces a provider, the endpoints of OIDC providers are discovered on first use.
 func (om *OAuth2Manager) AddProvider(name string, provider Provider) error {
+	registered, err := newOAuth2Provider(name, provider)
+	if err != nil {
+		return err
+	}
+
 	om.mu.Lock()
 	defer om.mu.Unlock()
+	om.providers[name] = registered
+	return nil
+}
 
-	var endpoint oauth2.Endpoint
-	switch name {
-	case "github":
-		endpoint = github.Endpoint
-	case "google":
-		endpoint = google.Endpoint
-	default:
-		return fmt.Errorf("unsupported provider: %s", name)
-	}
-
-	om.providers[name] = &oauth2.Config{
-		ClientID:     provider.ClientID,
-		ClientSecret: provider.ClientSecret,
-		RedirectURL:  provider.RedirectURL,
-		Scopes:       provider.Scopes,
-		Endpoint:     endpoint,
+// newOAuth2Provider applies the preset and the defaults of a provider and validates it.
+func newOAuth2Provider(name string, provider Provider) (*oauth2Provider, error) {
+	provider = provider.withPreset(name)
+	provider.Claims = provider.Claims.normalize()
+
+	switch {
+	case name == "":
+		return nil, errors.New("name is required")
+	case provider.ClientID == "":
+		return nil, errors.New("client_id is required")
+	case provider.Issuer == "" && (provider.AuthURL == "" || provider.TokenURL == ""):
+		return nil, errors.New("either issuer or auth_url and token_url are required")
+	case provider.Issuer == "" && provider.UserInfoURL == "":
+		return nil, errors.New("userinfo_url is required without issuer")
 	}
-
-	return nil
+	return &oauth2Provider{name: name, config: provider}, nil
 }
 
 func (om *OAuth2Manager) RemoveProvider(name string) {
@@ -97,72 +311,235 @@ func (om *OAuth2Manager) RemoveProvider(name string) {
 	delete(om.providers, name)
 }
 
-func (om *OAuth2Manager) GetAuthURL(providerName string, state string) (string, error) {
+// Providers returns the names of the registered providers.
+func (om *OAuth2Manager) Providers() []string {
 	om.mu.RLock()
 	defer om.mu.RUnlock()
 
-	provider, ok := om.providers[providerName]
-	if !ok {
-		return "", fmt.Errorf("provider not found: %s", providerName)
+	names := make([]string, 0, len(om.providers))
+	for name := range om.providers {
+		names = append(names, name)
 	}
-
-	return provider.AuthCodeURL(state), nil
+	sort.Strings(names)
+	return names
 }
 
-func (om *OAuth2Manager) Exchange(ctx context.Context, providerName string, code string) (*oauth2.Token, error) {
+func (om *OAuth2Manager) provider(name string) (*oauth2Provider, error) {
 	om.mu.RLock()
 	defer om.mu.RUnlock()
 
-	provider, ok := om.providers[providerName]
+	provider, ok := om.providers[name]
 	if !ok {
-		return nil, fmt.Errorf("provider not found: %s", providerName)
+		return nil, fmt.Errorf("%w: provider not found: %s", ErrUnsupportedOAuth, name)
+	}
+	return provider, nil
+}
+
+// AuthCodeURL starts an authorization request, linkUserID links the account to that user instead of logging in.
+func (om *OAuth2Manager) AuthCodeURL(ctx context.Context, providerName string, linkUserID uint64) (string, error) {
+	provider, err := om.provider(providerName)
+	if err != nil {
+		return "", err
+	}
+	config, err := provider.resolve(ctx, om.client)
+	if err != nil {
+		return "", err
 	}
 
-	return provider.Exchange(ctx, code)
+	state, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	stored := oauth2State{Provider: providerName, LinkUserID: linkUserID}
+
+	var options []oauth2.AuthCodeOption
+	if !provider.config.DisablePKCE {
+		stored.Verifier = oauth2.GenerateVerifier()
+		options = append(options, oauth2.S256ChallengeOption(stored.Verifier))
+	}
+	if provider.isOIDC() {
+		if stored.Nonce, err = newOpaqueToken(); err != nil {
+			return "", err
+		}
+		options = append(options, oauth2.SetAuthURLParam("nonce", stored.Nonce))
+	}
+
+	encoded, _ := json.Marshal(stored)
+	om.redisClient.Set(om.orm.NewORM(ctx), oauth2StatePrefix+state, string(encoded), oauth2StateTTL)
+	return config.AuthCodeURL(state, options...), nil
 }
 
-func (om *OAuth2Manager) GetUserInfo(ctx context.Context, providerName string, token *oauth2.Token) (map[string]interface{}, error) {
-	om.mu.RLock()
-	provider, ok := om.providers[providerName]
-	om.mu.RUnlock()
+// GetAuthURL returns the URL of a login with the provider.
+func (om *OAuth2Manager) GetAuthURL(ctx context.Context, providerName string) (string, error) {
+	return om.AuthCodeURL(ctx, providerName, 0)
+}
 
-	if !ok {
-		return nil, fmt.Errorf("provider not found: %s", providerName)
+// consumeState returns the stored request of a state, a state can only be used once.
+func (om *OAuth2Manager) consumeState(ctx context.Context, providerName, state string) (*oauth2State, error) {
+	if state == "" {
+		return nil, fmt.Errorf("%w: missing state", ErrInvalidToken)
 	}
+	orm := om.orm.NewORM(ctx)
+	key := oauth2StatePrefix + state
 
-	client := provider.Client(ctx, token)
-	resp, err := client.Get(om.getUserInfoURL(providerName))
+	encoded, found := om.redisClient.Get(orm, key)
+	if !found || !om.redisClient.SetNX(orm, key+":used", "1", oauth2StateTTL) {
+		return nil, fmt.Errorf("%w: unknown, used or expired state", ErrInvalidToken)
+	}
+	om.redisClient.Del(orm, key)
+
+	var stored oauth2State
+	if err := json.Unmarshal([]byte(encoded), &stored); err != nil || stored.Provider != providerName {
+		return nil, fmt.Errorf("%w: state was issued for another provider", ErrInvalidToken)
+	}
+	return &stored, nil
+}
+
+// pendingLink returns the user a pending request links an account to, 0 for a login or an unknown state.
+func (om *OAuth2Manager) pendingLink(ctx context.Context, state string) uint64 {
+	encoded, found := om.redisClient.Get(om.orm.NewORM(ctx), oauth2StatePrefix+state)
+	if !found {
+		return 0
+	}
+	var stored oauth2State
+	if err := json.Unmarshal([]byte(encoded), &stored); err != nil {
+		return 0
+	}
+	return stored.LinkUserID
+}
+
+// Exchange completes an authorization request, it returns the identity of the user at the provider
+// and the user the account must be linked to, 0 for a login.
+func (om *OAuth2Manager) Exchange(ctx context.Context, providerName, code, state string) (*OAuth2Identity, uint64, error) {
+	stored, err := om.consumeState(ctx, providerName, state)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user info: %w", err)
+		return nil, 0, err
 	}
-	defer resp.Body.Close()
+	provider, err := om.provider(providerName)
+	if err != nil {
+		return nil, 0, err
+	}
+	identity, err := om.exchange(ctx, provider, code, stored)
+	if err != nil {
+		return nil, 0, err
+	}
+	return identity, stored.LinkUserID, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get user info: status code %d", resp.StatusCode)
+func (om *OAuth2Manager) exchange(ctx context.Context, provider *oauth2Provider, code string, stored *oauth2State) (*OAuth2Identity, error) {
+	config, err := provider.resolve(ctx, om.client)
+	if err != nil {
+		return nil, err
 	}
 
-	var userInfo map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		return nil, fmt.Errorf("failed to decode user info: %w", err)
+	var options []oauth2.AuthCodeOption
+	if stored.Verifier != "" {
+		options = append(options, oauth2.VerifierOption(stored.Verifier))
+	}
+	token, err := config.Exchange(context.WithValue(ctx, oauth2.HTTPClient, om.client), code, options...)
+	if err != nil {
+		return nil, fmt.Errorf("OAuth2 code exchange failed: %w", err)
 	}
 
+	claims := map[string]interface{}{}
+	if provider.isOIDC() {
+		rawIDToken, _ := token.Extra("id_token").(string)
+		if rawIDToken == "" {
+			return nil, fmt.Errorf("provider %s did not return an ID token", provider.name)
+		}
+		idClaims, err := verifyIDToken(ctx, provider.jwks, rawIDToken, provider.config.Issuer, provider.config.ClientID, stored.Nonce)
+		if err != nil {
+			return nil, err
+		}
+		claims = idClaims
+	}
+
+	if provider.userInfoURL != "" {
+		userInfo, err := om.userInfo(ctx, config, provider.userInfoURL, token)
+		if err != nil {
+			return nil, err
+		}
+		// the user info of OIDC providers must describe the subject of the ID token
+		if provider.isOIDC() && claimString(userInfo, "sub") != claimString(claims, "sub") {
+			return nil, errors.New("user info describes another subject than the ID token")
+		}
+		for name, value := range userInfo {
+			if _, ok := claims[name]; !ok {
+				claims[name] = value
+			}
+		}
+	}
+
+	identity, err := provider.config.Claims.identity(provider.name, claims, provider.config.TrustEmail)
+	if err != nil {
+		return nil, err
+	}
+	identity.Token = token
+
+	if (identity.Email == "" || !identity.EmailVerified) && provider.config.EmailsURL != "" {
+		identity.Email, identity.EmailVerified = om.primaryEmail(ctx, config, provider.config.EmailsURL, token)
+	}
+	return identity, nil
+}
+
+// GetUserInfo fetches the user info of the provider with the token.
+func (om *OAuth2Manager) GetUserInfo(ctx context.Context, providerName string, token *oauth2.Token) (map[string]interface{}, error) {
+	provider, err := om.provider(providerName)
+	if err != nil {
+		return nil, err
+	}
+	config, err := provider.resolve(ctx, om.client)
+	if err != nil {
+		return nil, err
+	}
+	if provider.userInfoURL == "" {
+		return nil, fmt.Errorf("provider %s has no user info endpoint", providerName)
+	}
+	return om.userInfo(ctx, config, provider.userInfoURL, token)
+}
+
+func (om *OAuth2Manager) userInfo(ctx context.Context, config *oauth2.Config, url string, token *oauth2.Token) (map[string]interface{}, error) {
+	var userInfo map[string]interface{}
+	if err := getJSON(ctx, config.Client(context.WithValue(ctx, oauth2.HTTPClient, om.client), token), url, &userInfo); err != nil {
+		return nil, fmt.Errorf("failed to get user info: %w", err)
+	}
 	return userInfo, nil
 }
 
-func (om *OAuth2Manager) RefreshToken(ctx context.Context, providerName string, token *oauth2.Token) (*oauth2.Token, error) {
-	om.mu.RLock()
-	provider, ok := om.providers[providerName]
-	om.mu.RUnlock()
+// primaryEmail returns the primary address of a GitHub style list of addresses.
+func (om *OAuth2Manager) primaryEmail(ctx context.Context, config *oauth2.Config, url string, token *oauth2.Token) (string, bool) {
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, config.Client(context.WithValue(ctx, oauth2.HTTPClient, om.client), token), url, &emails); err != nil {
+		Logger.Error("Failed to get the email addresses of an OAuth2 account: %s", err)
+		return "", false
+	}
+	for _, email := range emails {
+		if email.Primary {
+			return email.Email, email.Verified
+		}
+	}
+	return "", false
+}
 
-	if !ok {
-		return nil, fmt.Errorf("provider not found: %s", providerName)
+func (om *OAuth2Manager) RefreshToken(ctx context.Context, providerName string, token *oauth2.Token) (*oauth2.Token, error) {
+	provider, err := om.provider(providerName)
+	if err != nil {
+		return nil, err
+	}
+	config, err := provider.resolve(ctx, om.client)
+	if err != nil {
+		return nil, err
 	}
 
-	if !token.Expiry.IsZero() && token.Expiry.After(time.Now()) {
+	if token.Valid() {
 		return token, nil
 	}
 
-	src := provider.TokenSource(ctx, token)
+	src := config.TokenSource(context.WithValue(ctx, oauth2.HTTPClient, om.client), token)
 	newToken, err := src.Token()
 	if err != nil {
 		return nil, fmt.Errorf("failed to refresh token: %w", err)
@@ -171,23 +548,96 @@ func (om *OAuth2Manager) RefreshToken(ctx context.Context, providerName string,
 	return newToken, nil
 }
 
-func (om *OAuth2Manager) getUserInfoURL(providerName string) string {
-	switch providerName {
-	case "github":
-		return "https://api.github.com/user"
-	case "google":
-		return "https://www.googleapis.com/oauth2/v2/userinfo"
+// identity maps the claims of a provider account, trustEmail tells whether the email is verified when no claim says so.
+func (m ClaimMapping) identity(provider string, claims map[string]interface{}, trustEmail bool) (*OAuth2Identity, error) {
+	identity := &OAuth2Identity{
+		Provider:      provider,
+		Subject:       claimString(claims, m.Subject),
+		Email:         strings.TrimSpace(claimString(claims, m.Email)),
+		EmailVerified: trustEmail,
+		Username:      claimString(claims, m.Username),
+		Name:          claimString(claims, m.Name),
+		Claims:        claims,
+	}
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("provider %s did not return the %q claim", provider, m.Subject)
+	}
+	if verified, ok := claimValue(claims, m.EmailVerified); ok {
+		identity.EmailVerified = verified == true || verified == "true"
+	}
+
+	if m.Roles != "" {
+		for _, role := range claimList(claims, m.Roles) {
+			if len(m.RoleMapping) > 0 {
+				if role = m.RoleMapping[role]; role == "" {
+					continue
+				}
+			}
+			if !slices.Contains(identity.Roles, role) {
+				identity.Roles = append(identity.Roles, role)
+			}
+		}
+	}
+
+	if len(m.Metadata) > 0 {
+		identity.Metadata = make(map[string]interface{}, len(m.Metadata))
+		for key, claim := range m.Metadata {
+			if value, ok := claimValue(claims, claim); ok {
+				identity.Metadata[key] = value
+			}
+		}
+	}
+	return identity, nil
+}
+
+// claimValue returns a claim by name, or by its path into nested objects, e.g. "realm_access.roles".
+func claimValue(claims map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := claims[name]; ok {
+		return value, true
+	}
+	head, rest, nested := strings.Cut(name, ".")
+	if !nested {
+		return nil, false
+	}
+	object, ok := claims[head].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return claimValue(object, rest)
+}
+
+// claimString returns a string, number or boolean claim as a string.
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claimValue(claims, name)
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
 	default:
 		return ""
 	}
 }
 
-func (om *OAuth2Manager) SyncProviders(ctx context.Context) error {
-	if om.config.ProvidersSource != "database" {
+// claimList returns a list claim, or a string claim separated by spaces or commas.
+func claimList(claims map[string]interface{}, name string) []string {
+	value, _ := claimValue(claims, name)
+	switch v := value.(type) {
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	default:
 		return nil
 	}
-
-	// Implement syncing providers with the database
-	// This is a placeholder implementation
-	return errors.New("syncing providers with database not implemented")
 }
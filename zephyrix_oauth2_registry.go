@@ -0,0 +1,233 @@
+package zephyrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+const (
+	oauth2ProvidersChannel    = "zephyrix:oauth2:providers"
+	defaultOAuth2SyncInterval = 5 * time.Minute
+)
+
+// StoredProvider is a provider defined in the database, its client secret is never returned.
+type StoredProvider struct {
+	Name      string    `json:"name"`
+	Provider  Provider  `json:"provider"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SaveProvider creates or replaces a provider in the database, an empty client secret keeps the stored one.
+// Every instance reloads it.
+func (om *OAuth2Manager) SaveProvider(ctx context.Context, name string, provider Provider) error {
+	if om.box == nil {
+		return fmt.Errorf("oauth2: encryption_keys are required to store providers")
+	}
+	if _, err := newOAuth2Provider(name, provider); err != nil {
+		return err
+	}
+
+	orm := om.orm.NewORM(ctx)
+	now := time.Now()
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2ProviderEntity](orm, "name", name)
+	if found {
+		entity = beeorm.EditEntity(orm, entity)
+	} else {
+		entity = beeorm.NewEntity[models.OAuth2ProviderEntity](orm)
+		entity.Name = name
+		entity.CreatedAt = now
+	}
+
+	if provider.ClientSecret != "" || !found {
+		secret, err := om.box.Seal(provider.ClientSecret, "oauth2_provider:"+name)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt the client secret: %w", err)
+		}
+		entity.ClientSecret = secret
+	}
+	scopes, _ := json.Marshal(provider.Scopes)
+	claims, _ := json.Marshal(provider.Claims)
+	entity.ClientID = provider.ClientID
+	entity.RedirectURL = provider.RedirectURL
+	entity.Scopes = string(scopes)
+	entity.Issuer = provider.Issuer
+	entity.AuthURL = provider.AuthURL
+	entity.TokenURL = provider.TokenURL
+	entity.UserInfoURL = provider.UserInfoURL
+	entity.JWKSURL = provider.JWKSURL
+	entity.EmailsURL = provider.EmailsURL
+	entity.DisablePKCE = provider.DisablePKCE
+	entity.TrustEmail = provider.TrustEmail
+	entity.Claims = string(claims)
+	entity.UpdatedAt = now
+
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to save OAuth2 provider %s: %w", name, err)
+	}
+	return om.reloadProvider(ctx, name, true)
+}
+
+// DeleteProvider removes a provider from the database and from every instance.
+func (om *OAuth2Manager) DeleteProvider(ctx context.Context, name string) error {
+	orm := om.orm.NewORM(ctx)
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2ProviderEntity](orm, "name", name)
+	if !found {
+		return fmt.Errorf("%w: provider not found: %s", ErrUnsupportedOAuth, name)
+	}
+	beeorm.DeleteEntity(orm, entity)
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to delete OAuth2 provider %s: %w", name, err)
+	}
+	return om.reloadProvider(ctx, name, true)
+}
+
+// StoredProviders returns the providers defined in the database.
+func (om *OAuth2Manager) StoredProviders(ctx context.Context) ([]*StoredProvider, error) {
+	var providers []*StoredProvider
+	iterator := beeorm.Search[models.OAuth2ProviderEntity](om.orm.NewORM(ctx), beeorm.NewWhere("1"), nil)
+	for iterator.Next() {
+		entity := iterator.Entity()
+		provider, err := om.providerFromEntity(entity, false)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, &StoredProvider{Name: entity.Name, Provider: provider, CreatedAt: entity.CreatedAt, UpdatedAt: entity.UpdatedAt})
+	}
+	return providers, nil
+}
+
+// providerFromEntity decodes a stored provider, the client secret is only decrypted when asked.
+func (om *OAuth2Manager) providerFromEntity(entity *models.OAuth2ProviderEntity, secret bool) (Provider, error) {
+	provider := Provider{
+		ClientID:    entity.ClientID,
+		RedirectURL: entity.RedirectURL,
+		Issuer:      entity.Issuer,
+		AuthURL:     entity.AuthURL,
+		TokenURL:    entity.TokenURL,
+		UserInfoURL: entity.UserInfoURL,
+		JWKSURL:     entity.JWKSURL,
+		EmailsURL:   entity.EmailsURL,
+		DisablePKCE: entity.DisablePKCE,
+		TrustEmail:  entity.TrustEmail,
+	}
+	if entity.Scopes != "" {
+		if err := json.Unmarshal([]byte(entity.Scopes), &provider.Scopes); err != nil {
+			return provider, fmt.Errorf("invalid scopes of OAuth2 provider %s: %w", entity.Name, err)
+		}
+	}
+	if entity.Claims != "" {
+		if err := json.Unmarshal([]byte(entity.Claims), &provider.Claims); err != nil {
+			return provider, fmt.Errorf("invalid claims of OAuth2 provider %s: %w", entity.Name, err)
+		}
+	}
+	if secret {
+		clientSecret, err := om.box.Open(entity.ClientSecret, "oauth2_provider:"+entity.Name)
+		if err != nil {
+			return provider, fmt.Errorf("client secret of OAuth2 provider %s: %w", entity.Name, err)
+		}
+		provider.ClientSecret = clientSecret
+	}
+	return provider, nil
+}
+
+// loadProvidersFromDatabase replaces the registered providers with the ones of the database.
+func (om *OAuth2Manager) loadProvidersFromDatabase(ctx context.Context) error {
+	loaded := make(map[string]*oauth2Provider)
+	iterator := beeorm.Search[models.OAuth2ProviderEntity](om.orm.NewORM(ctx), beeorm.NewWhere("1"), nil)
+	for iterator.Next() {
+		entity := iterator.Entity()
+		provider, err := om.providerFromEntity(entity, true)
+		if err != nil {
+			return err
+		}
+		registered, err := newOAuth2Provider(entity.Name, provider)
+		if err != nil {
+			return fmt.Errorf("invalid OAuth2 provider %s: %w", entity.Name, err)
+		}
+		loaded[entity.Name] = registered
+	}
+
+	om.mu.Lock()
+	om.providers = loaded
+	om.mu.Unlock()
+	return nil
+}
+
+// SyncProviders reloads the providers of the database.
+func (om *OAuth2Manager) SyncProviders(ctx context.Context) error {
+	if om.config.ProvidersSource != "database" {
+		return nil
+	}
+	return om.loadProvidersFromDatabase(ctx)
+}
+
+// reloadProvider loads a provider from the database, or removes it when it was deleted.
+// notify tells the other instances to do the same.
+func (om *OAuth2Manager) reloadProvider(ctx context.Context, name string, notify bool) error {
+	if om.config.ProvidersSource == "database" {
+		entity, found := beeorm.GetByUniqueIndex[models.OAuth2ProviderEntity](om.orm.NewORM(ctx), "name", name)
+		if !found {
+			om.RemoveProvider(name)
+		} else {
+			provider, err := om.providerFromEntity(entity, true)
+			if err != nil {
+				return err
+			}
+			if err := om.AddProvider(name, provider); err != nil {
+				return err
+			}
+		}
+	}
+
+	if notify && om.pubsub != nil {
+		if err := om.pubsub.Publish(ctx, oauth2ProvidersChannel, name).Err(); err != nil {
+			Logger.Error("Failed to notify the OAuth2 provider change of %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// startProviderSync applies the provider changes published by the other instances, and reloads
+// every provider periodically in case a notification was missed.
+func (om *OAuth2Manager) startProviderSync(ctx context.Context) {
+	if om.pubsub == nil {
+		return
+	}
+	subscription := om.pubsub.Subscribe(ctx, oauth2ProvidersChannel)
+
+	interval := om.config.SyncInterval
+	if interval <= 0 {
+		interval = defaultOAuth2SyncInterval
+	}
+
+	go func() {
+		defer subscription.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		messages := subscription.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				if err := om.reloadProvider(ctx, message.Payload, false); err != nil {
+					Logger.Error("Failed to reload OAuth2 provider %s: %s", message.Payload, err)
+				}
+			case <-ticker.C:
+				if err := om.SyncProviders(ctx); err != nil {
+					Logger.Error("Failed to sync OAuth2 providers: %s", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,149 @@
+package zephyrix
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// oauth2RouteHandler is one of the endpoints of the OAuth2 and OIDC providers:
+//
+//	GET  /auth/oauth2/:provider           redirects to the provider to sign in
+//	POST /auth/oauth2/:provider/link      (authenticated) -> {"url"} linking an account to the user
+//	GET  /auth/oauth2/:provider/callback  ?code&state&device_id -> AuthResult, or {"linked"} for a link
+//
+// The redirect_url of a provider points at the callback, or at a page of the application posting
+// the same parameters as JSON to it.
+type oauth2RouteHandler struct {
+	name    string
+	methods []string
+	path    string
+	handler []any
+}
+
+func (h *oauth2RouteHandler) Name() string     { return h.name }
+func (h *oauth2RouteHandler) Method() []string { return h.methods }
+func (h *oauth2RouteHandler) Path() string     { return h.path }
+func (h *oauth2RouteHandler) Handlers() []any  { return h.handler }
+
+func newOAuth2LoginRoute(ap *AuthProvider) *oauth2RouteHandler {
+	return &oauth2RouteHandler{
+		name:    "oauth2_login",
+		methods: []string{http.MethodGet},
+		path:    "/auth/oauth2/:provider",
+		handler: []any{ap.requireSocialLogin, func(c *gin.Context) {
+			url, err := ap.GetOAuth2AuthURL(c.Request.Context(), c.Param("provider"))
+			if err != nil {
+				writeOAuth2Error(c, err)
+				return
+			}
+			c.Redirect(http.StatusFound, url)
+		}},
+	}
+}
+
+func newOAuth2LinkRoute(ap *AuthProvider) *oauth2RouteHandler {
+	return &oauth2RouteHandler{
+		name:    "oauth2_link",
+		methods: []string{http.MethodPost},
+		path:    "/auth/oauth2/:provider/link",
+		handler: []any{ap.requireSocialLogin, ap.Middleware(), func(c *gin.Context) {
+			url, err := ap.GetOAuth2LinkURL(c.Request.Context(), c.Value(userContextKey).(User), c.Param("provider"))
+			if err != nil {
+				writeOAuth2Error(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"url": url})
+		}},
+	}
+}
+
+func newOAuth2CallbackRoute(ap *AuthProvider) *oauth2RouteHandler {
+	return &oauth2RouteHandler{
+		name:    "oauth2_callback",
+		methods: []string{http.MethodGet, http.MethodPost},
+		path:    "/auth/oauth2/:provider/callback",
+		handler: []any{ap.requireSocialLogin, func(c *gin.Context) {
+			var params struct {
+				Code             string `form:"code" json:"code"`
+				State            string `form:"state" json:"state"`
+				DeviceID         string `form:"device_id" json:"device_id"`
+				Error            string `form:"error" json:"error"`
+				ErrorDescription string `form:"error_description" json:"error_description"`
+			}
+			if err := c.ShouldBind(&params); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+			if params.Error != "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": params.Error, "message": params.ErrorDescription})
+				return
+			}
+			if params.Code == "" || params.State == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			ctx := c.Request.Context()
+			provider := c.Param("provider")
+			if ap.components.oauth2Manager.pendingLink(ctx, params.State) != 0 {
+				callback, err := ap.HandleOAuth2Callback(ctx, provider, params.Code, params.State)
+				if err != nil {
+					writeOAuth2Error(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"linked": provider, "subject": callback.Identity.Subject})
+				return
+			}
+
+			result, err := ap.AuthenticateUser(ctx, Authenticate{
+				GrantType: GrantTypeAuthorization,
+				Provider:  provider,
+				Code:      params.Code,
+				State:     params.State,
+				DeviceID:  params.DeviceID,
+				IP:        c.ClientIP(),
+				UserAgent: c.Request.UserAgent(),
+			})
+			if err != nil {
+				writeOAuth2Error(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, result)
+		}},
+	}
+}
+
+// requireSocialLogin hides the endpoints while social_login is disabled.
+func (ap *AuthProvider) requireSocialLogin(c *gin.Context) {
+	if !ap.config.FeatureToggles.SocialLogin {
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// writeOAuth2Error maps the errors of the authorization code flow to JSON responses.
+func writeOAuth2Error(c *gin.Context, err error) {
+	var challenge *MFAChallenge
+	switch {
+	case errors.As(err, &challenge):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "mfa_required", "mfa": challenge})
+	case errors.Is(err, ErrMFAEnrollmentRequired):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "mfa_enrollment_required", "message": err.Error()})
+	case errors.Is(err, ErrUnsupportedOAuth):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown_provider"})
+	case errors.Is(err, ErrInvalidToken):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "message": err.Error()})
+	case errors.Is(err, ErrAccountLinked):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "account_linked", "message": err.Error()})
+	case errors.Is(err, ErrRateLimited):
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate_limited"})
+	case errors.Is(err, ErrEmailNotVerified):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "email_not_verified", "message": err.Error()})
+	case errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrAccountLocked):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "message": err.Error()})
+	default:
+		Logger.Error("OAuth2 login failed: %s", err)
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "server_error"})
+	}
+}
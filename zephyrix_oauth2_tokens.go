@@ -0,0 +1,160 @@
+package zephyrix
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oauth2RefreshLockPrefix = "zephyrix:oauth2:refresh:"
+	oauth2RefreshLockTTL    = 30 * time.Second
+	oauth2RefreshWait       = 200 * time.Millisecond
+	oauth2RefreshAttempts   = 10
+)
+
+// OAuth2Token returns the token of the provider account of the user, refreshed when it expired,
+// to call the API of the provider on behalf of the user.
+func (ap *AuthProvider) OAuth2Token(ctx context.Context, userID uint64, providerName string) (*oauth2.Token, error) {
+	om := ap.components.oauth2Manager
+	if om.box == nil {
+		return nil, fmt.Errorf("%w: encryption_keys are not configured", ErrNoOAuth2Token)
+	}
+
+	orm := ap.orm.NewORM(ctx)
+	entity, found := beeorm.SearchOne[models.OAuth2AccountEntity](orm, beeorm.NewWhere("`UserID` = ? AND `Provider` = ?", userID, providerName))
+	if !found {
+		return nil, fmt.Errorf("%w: no %s account linked", ErrNoOAuth2Token, providerName)
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := om.openToken(entity)
+		if err != nil {
+			return nil, err
+		}
+		if token.Valid() {
+			return token, nil
+		}
+		if token.RefreshToken == "" {
+			return nil, fmt.Errorf("%w: the %s token expired", ErrNoOAuth2Token, providerName)
+		}
+
+		// a refresh token may only be usable once, a single instance refreshes it
+		lock := oauth2RefreshLockPrefix + strconv.FormatUint(entity.ID, 10)
+		if ap.redisClient.SetNX(orm, lock, "1", oauth2RefreshLockTTL) {
+			defer ap.redisClient.Del(orm, lock)
+			return ap.refreshOAuth2Token(ctx, entity, token)
+		}
+		if attempt == oauth2RefreshAttempts {
+			return nil, fmt.Errorf("the %s token is being refreshed", providerName)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(oauth2RefreshWait):
+		}
+		entity, found = beeorm.GetByID[models.OAuth2AccountEntity](ap.orm.NewORM(ctx), entity.ID)
+		if !found {
+			return nil, fmt.Errorf("%w: the %s account was unlinked", ErrNoOAuth2Token, providerName)
+		}
+	}
+}
+
+// refreshOAuth2Token refreshes the token of the account and stores the new one.
+func (ap *AuthProvider) refreshOAuth2Token(ctx context.Context, entity *models.OAuth2AccountEntity, token *oauth2.Token) (*oauth2.Token, error) {
+	refreshed, err := ap.components.oauth2Manager.RefreshToken(ctx, entity.Provider, token)
+	if err != nil {
+		ap.logOAuth2(ctx, "oauth2_token_refresh_failed", entity.UserID, entity.Provider)
+		return nil, err
+	}
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = token.RefreshToken
+	}
+	if err := ap.saveOAuth2Token(ctx, entity, refreshed); err != nil {
+		return nil, err
+	}
+	return refreshed, nil
+}
+
+// storeOAuth2Token stores the token of the provider account the user signed in or linked with.
+// Tokens are only stored when encryption_keys are configured.
+func (ap *AuthProvider) storeOAuth2Token(ctx context.Context, user User, identity *OAuth2Identity) error {
+	if ap.components.oauth2Manager.box == nil || identity.Token == nil {
+		return nil
+	}
+
+	entity, found := beeorm.GetByUniqueIndex[models.OAuth2AccountEntity](ap.orm.NewORM(ctx), "provider_subject", identity.Provider, identity.Subject)
+	if !found || entity.UserID != user.ID() {
+		return fmt.Errorf("%s account %s is not linked to user %d", identity.Provider, identity.Subject, user.ID())
+	}
+	return ap.saveOAuth2Token(ctx, entity, identity.Token)
+}
+
+// keepOAuth2Token stores the token of a callback, the sign in does not depend on it.
+func (ap *AuthProvider) keepOAuth2Token(ctx context.Context, user User, identity *OAuth2Identity) {
+	if err := ap.storeOAuth2Token(ctx, user, identity); err != nil {
+		Logger.Error("Failed to store OAuth2 token: %s", err)
+	}
+}
+
+func (ap *AuthProvider) saveOAuth2Token(ctx context.Context, entity *models.OAuth2AccountEntity, token *oauth2.Token) error {
+	om := ap.components.oauth2Manager
+	binding := oauth2TokenContext(entity)
+	accessToken, err := om.box.Seal(token.AccessToken, binding)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := om.box.Seal(token.RefreshToken, binding)
+	if err != nil {
+		return err
+	}
+
+	orm := ap.orm.NewORM(ctx)
+	entity = beeorm.EditEntity(orm, entity)
+	entity.AccessToken = accessToken
+	entity.RefreshToken = refreshToken
+	entity.TokenType = token.TokenType
+	entity.TokenExpiry = nil
+	if !token.Expiry.IsZero() {
+		expiry := token.Expiry
+		entity.TokenExpiry = &expiry
+	}
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to store OAuth2 token: %w", err)
+	}
+	return nil
+}
+
+// openToken decrypts the token stored in the account.
+func (om *OAuth2Manager) openToken(entity *models.OAuth2AccountEntity) (*oauth2.Token, error) {
+	if entity.AccessToken == "" {
+		return nil, fmt.Errorf("%w: no %s token was stored", ErrNoOAuth2Token, entity.Provider)
+	}
+
+	binding := oauth2TokenContext(entity)
+	accessToken, err := om.box.Open(entity.AccessToken, binding)
+	if err != nil {
+		return nil, fmt.Errorf("access token of OAuth2 account %d: %w", entity.ID, err)
+	}
+	refreshToken, err := om.box.Open(entity.RefreshToken, binding)
+	if err != nil {
+		return nil, fmt.Errorf("refresh token of OAuth2 account %d: %w", entity.ID, err)
+	}
+
+	token := &oauth2.Token{AccessToken: accessToken, RefreshToken: refreshToken, TokenType: entity.TokenType}
+	if entity.TokenExpiry != nil {
+		token.Expiry = *entity.TokenExpiry
+	}
+	return token, nil
+}
+
+// oauth2TokenContext binds the encrypted tokens to their account.
+func oauth2TokenContext(entity *models.OAuth2AccountEntity) string {
+	return "oauth2_account:" + entity.Provider + ":" + entity.Subject
+}
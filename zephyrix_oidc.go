@@ -0,0 +1,240 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// jwksMaxAge is how long fetched provider keys are used before they are fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh bounds the fetches caused by tokens naming unknown keys.
+	jwksMinRefresh = time.Minute
+
+	oidcMaxDocumentSize = 1 << 20
+)
+
+// idTokenMethods are the algorithms accepted for ID tokens, secrets shared with the provider are not.
+var idTokenMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// oidcDiscovery is the part of the OpenID Provider Metadata the client uses.
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserInfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// discoverOIDC fetches <issuer>/.well-known/openid-configuration, the document must name the same issuer.
+func discoverOIDC(ctx context.Context, client *http.Client, issuer string) (*oidcDiscovery, error) {
+	var doc oidcDiscovery
+	if err := getJSON(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("OIDC discovery of %s failed: %w", issuer, err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("OIDC discovery of %s returned the issuer %q", issuer, doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery of %s is missing endpoints", issuer)
+	}
+	return &doc, nil
+}
+
+// getJSON decodes the JSON answer of a GET request, numbers are kept as json.Number.
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return doJSON(client, req, v)
+}
+
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxDocumentSize))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// jwksCache holds the signing keys of a provider, they are fetched again when a token names an unknown key.
+type jwksCache struct {
+	url       string
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newJWKSCache(url string, client *http.Client) *jwksCache {
+	return &jwksCache{url: url, client: client}
+}
+
+// key returns the key with the kid, or the only key of the set when the token names none.
+func (c *jwksCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.lookup(kid); ok && time.Since(c.fetchedAt) < jwksMaxAge {
+		return key, nil
+	}
+	if time.Since(c.fetchedAt) >= jwksMinRefresh {
+		if err := c.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (c *jwksCache) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+func (c *jwksCache) fetch(ctx context.Context) error {
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := getJSON(ctx, c.client, c.url, &set); err != nil {
+		return fmt.Errorf("failed to fetch JWKS %s: %w", c.url, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			// keys of unsupported types are skipped, the provider may publish some for other clients
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	return nil
+}
+
+// parseJWK decodes the public key of a JWK (RFC 7517), RSA, EC and Ed25519 keys are supported.
+func parseJWK(jwk JWK) (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(raw) == 0 {
+			return nil, fmt.Errorf("invalid %s key %q", jwk.Kty, jwk.Kid)
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA key %q", jwk.Kid)
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key %q is shorter than 2048 bits", jwk.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if _, err := key.ECDH(); err != nil {
+			return nil, fmt.Errorf("invalid EC key %q: %w", jwk.Kid, err)
+		}
+		return key, nil
+	case "OKP":
+		raw, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid OKP key %q", jwk.Kid)
+		}
+		return ed25519.PublicKey(raw), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+// verifyIDToken checks the signature, issuer, audience, lifetime and nonce of an ID token and returns its claims.
+func verifyIDToken(ctx context.Context, keys *jwksCache, raw, issuer, clientID, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(idTokenMethods), jwt.WithJSONNumber())
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return keys.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	switch {
+	case !claims.VerifyExpiresAt(time.Now().Unix(), true):
+		return nil, errors.New("invalid ID token: missing expiration")
+	case strings.TrimSuffix(claimString(claims, "iss"), "/") != strings.TrimSuffix(issuer, "/"):
+		return nil, fmt.Errorf("invalid ID token: issued by %q", claimString(claims, "iss"))
+	case !claims.VerifyAudience(clientID, true):
+		return nil, errors.New("invalid ID token: issued for another client")
+	case nonce != "" && claimString(claims, "nonce") != nonce:
+		return nil, errors.New("invalid ID token: nonce mismatch")
+	}
+	// a token for several audiences must be authorized for this client
+	if audiences, ok := claims["aud"].([]interface{}); ok && len(audiences) > 1 && claimString(claims, "azp") != clientID {
+		return nil, errors.New("invalid ID token: authorized party mismatch")
+	}
+	return claims, nil
+}
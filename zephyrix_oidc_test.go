@@ -0,0 +1,254 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// stubIdP is a minimal OpenID provider issuing ID tokens for the code "valid-code".
+type stubIdP struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	verifier string // the PKCE verifier the token endpoint expects
+	nonce    string // the nonce put in the ID token
+	issuer   string // the issuer of the discovery document, the server URL by default
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idp := &stubIdP{key: key, clientID: "zephyrix"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := idp.issuer
+		if issuer == "" {
+			issuer = idp.URL
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 issuer,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"userinfo_endpoint":      idp.URL + "/userinfo",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []JWK{{
+			Kty: "RSA", Kid: "stub", Use: "sig", Alg: "RS256",
+			N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("code") != "valid-code" || r.PostForm.Get("code_verifier") != idp.verifier {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "stub-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idp.idToken(t, jwt.MapClaims{}),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer stub-access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":        "user-42",
+			"department": "billing",
+			"email":      "ignored@example.com", // the ID token wins
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *stubIdP) idToken(t *testing.T, overrides jwt.MapClaims) string {
+	claims := jwt.MapClaims{
+		"iss":                idp.URL,
+		"aud":                idp.clientID,
+		"sub":                "user-42",
+		"email":              "jane@example.com",
+		"email_verified":     true,
+		"preferred_username": "jane",
+		"nonce":              idp.nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"realm_access":       map[string]interface{}{"roles": []string{"idp-admin", "offline_access"}},
+	}
+	for name, value := range overrides {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "stub"
+	signed, err := token.SignedString(idp.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func (idp *stubIdP) manager(t *testing.T, claims ClaimMapping) (*OAuth2Manager, *oauth2Provider) {
+	om, err := NewOAuth2Manager(OAuth2Config{}, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, om.AddProvider("corp", Provider{
+		ClientID:     idp.clientID,
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:8000/auth/oauth2/corp/callback",
+		Issuer:       idp.URL,
+		Claims:       claims,
+	}))
+	provider, err := om.provider("corp")
+	require.NoError(t, err)
+	return om, provider
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newStubIdP(t)
+	idp.verifier, idp.nonce = "verifier-verifier-verifier-verifier-verifier", "nonce-1"
+	om, provider := idp.manager(t, ClaimMapping{
+		Roles:       "realm_access.roles",
+		RoleMapping: map[string]string{"idp-admin": "admin"},
+		Metadata:    map[string]string{"department": "department"},
+	})
+
+	identity, err := om.exchange(context.Background(), provider, "valid-code", &oauth2State{Provider: "corp", Verifier: idp.verifier, Nonce: idp.nonce})
+	require.NoError(t, err)
+	require.Equal(t, "corp", identity.Provider)
+	require.Equal(t, "user-42", identity.Subject)
+	require.Equal(t, "jane@example.com", identity.Email)
+	require.True(t, identity.EmailVerified)
+	require.Equal(t, "jane", identity.Username)
+	require.Equal(t, []string{"admin"}, identity.Roles)
+	require.Equal(t, map[string]interface{}{"department": "billing"}, identity.Metadata)
+	require.Equal(t, "stub-access-token", identity.Token.AccessToken)
+	require.Contains(t, provider.oauth2.Scopes, "openid")
+
+	_, err = om.exchange(context.Background(), provider, "valid-code", &oauth2State{Provider: "corp", Verifier: "another-verifier", Nonce: idp.nonce})
+	require.Error(t, err, "the token endpoint must receive the verifier of the request")
+
+	_, err = om.exchange(context.Background(), provider, "valid-code", &oauth2State{Provider: "corp", Verifier: idp.verifier, Nonce: "nonce-2"})
+	require.ErrorContains(t, err, "nonce")
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	idp := newStubIdP(t)
+	keys := newJWKSCache(idp.URL+"/jwks", http.DefaultClient)
+	ctx := context.Background()
+
+	claims, err := verifyIDToken(ctx, keys, idp.idToken(t, nil), idp.URL, idp.clientID, "")
+	require.NoError(t, err)
+	require.Equal(t, "user-42", claimString(claims, "sub"))
+
+	for name, overrides := range map[string]jwt.MapClaims{
+		"expired":        {"exp": time.Now().Add(-time.Minute).Unix()},
+		"no expiration":  {"exp": nil},
+		"other issuer":   {"iss": "https://evil.example.com"},
+		"other audience": {"aud": "other-client"},
+		"other azp":      {"aud": []string{idp.clientID, "other-client"}, "azp": "other-client"},
+	} {
+		_, err := verifyIDToken(ctx, keys, idp.idToken(t, overrides), idp.URL, idp.clientID, "")
+		require.Error(t, err, name)
+	}
+	_, err = verifyIDToken(ctx, keys, idp.idToken(t, jwt.MapClaims{"nonce": "replayed"}), idp.URL, idp.clientID, "expected")
+	require.Error(t, err)
+
+	// tokens signed with the client secret are refused
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": idp.URL, "aud": idp.clientID, "exp": time.Now().Add(time.Minute).Unix()}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+	_, err = verifyIDToken(ctx, keys, hmacToken, idp.URL, idp.clientID, "")
+	require.Error(t, err)
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	idp := newStubIdP(t)
+	doc, err := discoverOIDC(context.Background(), http.DefaultClient, idp.URL+"/")
+	require.NoError(t, err)
+	require.Equal(t, idp.URL+"/token", doc.TokenEndpoint)
+
+	idp.issuer = "https://evil.example.com"
+	_, err = discoverOIDC(context.Background(), http.DefaultClient, idp.URL)
+	require.Error(t, err)
+}
+
+func TestOAuth2Providers(t *testing.T) {
+	om, err := NewOAuth2Manager(OAuth2Config{}, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, om.AddProvider("facebook", Provider{ClientID: "id", ClientSecret: "secret"}))
+	require.NoError(t, om.AddProvider("github", Provider{ClientID: "id", ClientSecret: "secret"}))
+	require.Error(t, om.AddProvider("corp", Provider{ClientID: "id", AuthURL: "https://corp.example.com/authorize", TokenURL: "https://corp.example.com/token"}))
+	require.Error(t, om.AddProvider("corp", Provider{Issuer: "https://corp.example.com"}))
+	require.Equal(t, []string{"facebook", "github"}, om.Providers())
+
+	github, err := om.provider("github")
+	require.NoError(t, err)
+	require.Equal(t, "id", github.config.Claims.Subject)
+	require.Equal(t, "login", github.config.Claims.Username)
+	require.Equal(t, "email", github.config.Claims.Email)
+
+	_, err = om.provider("myspace")
+	require.ErrorIs(t, err, ErrUnsupportedOAuth)
+}
+
+func TestClaimMapping(t *testing.T) {
+	var claims map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"id": 1234567890123, "login": "jane", "email_verified": "false", "groups": "admins, users", "https://example.com/tenant": "acme"}`), &claims))
+
+	identity, err := ClaimMapping{Subject: "id", Username: "login", Roles: "groups", Metadata: map[string]string{"tenant": "https://example.com/tenant"}}.normalize().identity("github", claims, true)
+	require.NoError(t, err)
+	require.Equal(t, "1234567890123", identity.Subject)
+	require.Equal(t, "jane", identity.Username)
+	require.False(t, identity.EmailVerified)
+	require.Equal(t, []string{"admins", "users"}, identity.Roles)
+	require.Equal(t, "acme", identity.Metadata["tenant"])
+
+	delete(claims, "email_verified")
+	identity, err = ClaimMapping{Subject: "id"}.normalize().identity("github", claims, false)
+	require.NoError(t, err)
+	require.False(t, identity.EmailVerified, "addresses are unverified without a claim")
+	identity, err = ClaimMapping{Subject: "id"}.normalize().identity("github", claims, true)
+	require.NoError(t, err)
+	require.True(t, identity.EmailVerified, "unless the provider is trusted")
+
+	_, err = ClaimMapping{}.normalize().identity("corp", claims, true)
+	require.Error(t, err, "the sub claim is missing")
+}
+
+func TestParseJWK(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwk := JWK{Kty: "EC", Crv: "P-256", X: base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))), Y: base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32)))}
+
+	public, err := parseJWK(jwk)
+	require.NoError(t, err)
+	require.True(t, key.PublicKey.Equal(public))
+
+	sum := sha256.Sum256([]byte("not a point"))
+	jwk.Y = base64.RawURLEncoding.EncodeToString(sum[:])
+	_, err = parseJWK(jwk)
+	require.Error(t, err)
+
+	_, err = parseJWK(JWK{Kty: "RSA", N: base64.RawURLEncoding.EncodeToString(make([]byte, 128)), E: "AQAB"})
+	require.Error(t, err, "1024 bit keys are refused")
+}
@@ -0,0 +1,109 @@
+package zephyrix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// hashListLineSize is enough for one line of the list, a 40 characters SHA-1 and its count.
+const hashListLineSize = 128
+
+// hashList is a BreachedPasswordSource reading a local copy of a breached password list, e.g. the
+// Pwned Passwords SHA-1 list ordered by hash. Every line holds an uppercase or lowercase hex hash,
+// optionally followed by ":COUNT". The file is not loaded in memory, ranges are found with a binary
+// search, so lists of several gigabytes are fine.
+type hashList struct {
+	file *os.File
+	size int64
+}
+
+func openHashList(path string) (*hashList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the breached password list: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open the breached password list: %w", err)
+	}
+	return &hashList{file: file, size: info.Size()}, nil
+}
+
+// Range returns the suffixes of the hashes starting with the prefix.
+func (l *hashList) Range(_ context.Context, prefix string) ([]string, error) {
+	prefix = strings.ToUpper(prefix)
+
+	// smallest offset whose next line is not before the prefix, the lines are sorted
+	lo, hi := int64(0), l.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		hash, _, err := l.lineAt(mid)
+		if err != nil {
+			return nil, err
+		}
+		if hash == "" || hash[:min(len(hash), len(prefix))] >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	var suffixes []string
+	for offset := lo; ; {
+		hash, next, err := l.lineAt(offset)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(hash, prefix) {
+			return suffixes, nil
+		}
+		suffixes = append(suffixes, hash[len(prefix):])
+		offset = next
+	}
+}
+
+func (l *hashList) Close() error {
+	return l.file.Close()
+}
+
+// lineAt returns the hash of the first line starting at or after the offset and the offset of the
+// line after it. The hash is empty at the end of the file.
+func (l *hashList) lineAt(offset int64) (string, int64, error) {
+	buf := make([]byte, 2*hashListLineSize)
+	start := offset
+	if offset > 0 {
+		// a line starts at the offset when the byte before it ends the previous line
+		start = offset - 1
+	}
+
+	n, err := l.file.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return "", 0, fmt.Errorf("failed to read the breached password list: %w", err)
+	}
+	buf = buf[:n]
+	if offset > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return "", l.size, nil
+		}
+		buf, start = buf[i+1:], start+int64(i+1)
+	}
+	if len(buf) == 0 {
+		return "", l.size, nil
+	}
+
+	line := buf
+	next := start + int64(len(buf))
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		line, next = buf[:i], start+int64(i+1)
+	}
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(strings.TrimSpace(string(line))), next, nil
+}
@@ -0,0 +1,214 @@
+package zephyrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+const (
+	passwordChangeTokenType   = "password_change"
+	defaultPasswordChangeTTL  = 10 * time.Minute
+	passwordChangeCachePrefix = "zephyrix:password_change:"
+)
+
+// PasswordChangeRequired is returned by AuthenticateUser instead of tokens when the password is
+// older than password_policy.max_age. It unwraps to ErrPasswordExpired:
+//
+//	var change *PasswordChangeRequired
+//	if errors.As(err, &change) {
+//		// ask for a new password, then call ChangeExpiredPassword with change.Token
+//	}
+type PasswordChangeRequired struct {
+	Token     string `json:"password_change_token"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+func (c *PasswordChangeRequired) Error() string { return ErrPasswordExpired.Error() }
+func (c *PasswordChangeRequired) Unwrap() error { return ErrPasswordExpired }
+
+// ExpiredPasswordChange completes a PasswordChangeRequired.
+type ExpiredPasswordChange struct {
+	Token       string // PasswordChangeRequired.Token
+	NewPassword string
+}
+
+// passwordChangeState is the server side state of a required change, the signed token only carries its ID.
+type passwordChangeState struct {
+	UserID      uint64 `json:"user_id"`
+	DeviceID    string `json:"device_id,omitempty"`
+	MFARequired bool   `json:"mfa_required"`
+}
+
+// PasswordValidator returns the validator of the password policy, e.g. to plug a breached password source.
+func (ap *AuthProvider) PasswordValidator() *PasswordValidator {
+	return ap.components.passwords
+}
+
+// ValidatePassword checks a password against the password policy, user may be nil for new accounts.
+func (ap *AuthProvider) ValidatePassword(ctx context.Context, password string, user User) error {
+	return ap.components.passwords.Validate(ctx, password, user)
+}
+
+// CreateUser creates a user whose password satisfies the password policy.
+func (ap *AuthProvider) CreateUser(ctx context.Context, input NewUser) (User, error) {
+	if input.Password != "" {
+		if err := ap.components.passwords.Validate(ctx, input.Password, nil); err != nil {
+			return nil, err
+		}
+	}
+	user, err := ap.components.userStore.Create(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if input.Password != "" {
+		ap.rememberPassword(ctx, user, input.Password)
+	}
+	return user, nil
+}
+
+// SetPassword replaces the password of the user after checking it against the password policy,
+// e.g. for a reset by an administrator. The password history is updated.
+func (ap *AuthProvider) SetPassword(ctx context.Context, user User, password string) error {
+	if err := ap.components.passwords.Validate(ctx, password, user); err != nil {
+		return err
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	if err := ap.components.userStore.Update(ctx, user); err != nil {
+		return fmt.Errorf("failed to update the password: %w", err)
+	}
+	ap.rememberPassword(ctx, user, password)
+
+	if err := ap.components.auditLogger.Log(ctx, "password_changed", strconv.FormatUint(user.ID(), 10), ""); err != nil {
+		Logger.Error("Failed to write password_changed to the audit log: %s", err)
+	}
+	return nil
+}
+
+// ChangePassword replaces the password of the user once the current one is confirmed.
+func (ap *AuthProvider) ChangePassword(ctx context.Context, userID uint64, currentPassword, newPassword string) error {
+	user, err := ap.components.userStore.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !user.CheckPassword(currentPassword) {
+		ap.components.auditLogger.logFailedLogin(ctx, user.Username(), "invalid_password", "password change")
+		return fmt.Errorf("%w: %w", ErrInvalidCredentials, ErrInvalidPassword)
+	}
+	return ap.SetPassword(ctx, user, newPassword)
+}
+
+// ChangeExpiredPassword sets the new password of a user who was asked to change it by AuthenticateUser
+// and continues the login: it returns the tokens, or an *MFAChallenge when a second factor is required.
+func (ap *AuthProvider) ChangeExpiredPassword(ctx context.Context, input ExpiredPasswordChange) (*AuthResult, error) {
+	id, userID, err := ap.parsePasswordChangeToken(input.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	orm := ap.orm.NewORM(ctx)
+	key := passwordChangeCachePrefix + id
+	encoded, found := ap.redisClient.Get(orm, key)
+	if !found {
+		return nil, fmt.Errorf("%w: unknown or expired password change", ErrInvalidToken)
+	}
+	var state passwordChangeState
+	if err := json.Unmarshal([]byte(encoded), &state); err != nil || state.UserID != userID {
+		return nil, fmt.Errorf("%w: unknown or expired password change", ErrInvalidToken)
+	}
+
+	user, err := ap.components.userStore.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ap.checkAccount(ctx, user); err != nil {
+		return nil, err
+	}
+
+	// concurrent changes race on this marker, a rejected password releases it to try another one
+	if !ap.redisClient.SetNX(orm, key+":done", "1", defaultPasswordChangeTTL) {
+		return nil, fmt.Errorf("%w: password change was already completed", ErrInvalidToken)
+	}
+	if err := ap.SetPassword(ctx, user, input.NewPassword); err != nil {
+		ap.redisClient.Del(orm, key+":done")
+		return nil, err
+	}
+	ap.redisClient.Del(orm, key)
+
+	if state.MFARequired {
+		return nil, ap.newMFAChallenge(ctx, user, state.DeviceID)
+	}
+	result, err := ap.issueTokens(ctx, user, state.DeviceID, "")
+	if err != nil {
+		return nil, err
+	}
+	ap.components.lockout.Succeeded(ctx, user)
+	ap.components.auditLogger.logSuccessfulLogin(ctx, user.Username(), "after a password change")
+	return result, nil
+}
+
+// newPasswordChangeRequired asks a user with an expired password for a new one,
+// the *PasswordChangeRequired is returned as the error of AuthenticateUser.
+func (ap *AuthProvider) newPasswordChangeRequired(ctx context.Context, user User, deviceID string, mfaRequired bool) error {
+	id := uuid.NewString()
+	now := time.Now()
+	token, err := ap.signClaims(jwt.MapClaims{
+		"typ": passwordChangeTokenType,
+		"jti": id,
+		"sub": strconv.FormatUint(user.ID(), 10),
+		"iat": now.Unix(),
+		"exp": now.Add(defaultPasswordChangeTTL).Unix(),
+		"iss": ap.config.JWT.Issuer,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sign password change: %w", err)
+	}
+
+	state, _ := json.Marshal(passwordChangeState{UserID: user.ID(), DeviceID: deviceID, MFARequired: mfaRequired})
+	ap.redisClient.Set(ap.orm.NewORM(ctx), passwordChangeCachePrefix+id, string(state), defaultPasswordChangeTTL)
+
+	ap.components.auditLogger.logFailedLogin(ctx, user.Username(), "password_expired")
+	return &PasswordChangeRequired{Token: token, ExpiresIn: int64(defaultPasswordChangeTTL.Seconds())}
+}
+
+// parsePasswordChangeToken verifies the signature and type of a password change token and returns its ID and user.
+func (ap *AuthProvider) parsePasswordChangeToken(tokenString string) (string, uint64, error) {
+	token, err := ap.VerifyToken(tokenString)
+	if err != nil || !token.Valid {
+		return "", 0, fmt.Errorf("%w: invalid password change token", ErrInvalidToken)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != passwordChangeTokenType {
+		return "", 0, fmt.Errorf("%w: invalid password change token", ErrInvalidToken)
+	}
+	id, _ := claims["jti"].(string)
+	userID, err := claimUint64(claims, "sub")
+	if id == "" || err != nil {
+		return "", 0, fmt.Errorf("%w: invalid password change token", ErrInvalidToken)
+	}
+	return id, userID, nil
+}
+
+// rememberPassword adds the password to the history of the user, a failure only weakens the reuse check.
+func (ap *AuthProvider) rememberPassword(ctx context.Context, user User, password string) {
+	var hash string
+	if hu, ok := user.(PasswordHashUser); ok {
+		hash = hu.PasswordHash()
+	} else {
+		var err error
+		if hash, err = ap.components.passwordHasher.Hash(password); err != nil {
+			Logger.Error("Failed to hash the password history of user %d: %s", user.ID(), err)
+			return
+		}
+	}
+	if err := ap.components.passwords.remember(ctx, user, hash); err != nil {
+		Logger.Error("Failed to remember the password of user %d: %s", user.ID(), err)
+	}
+}
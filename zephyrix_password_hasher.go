@@ -0,0 +1,77 @@
+package zephyrix
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords with bcrypt.
+//
+// When a pepper is configured (authentication.hashing_salt), passwords are first keyed with
+// HMAC-SHA256, so a leaked database alone is not enough to brute force the hashes.
+// This also removes the 72 bytes input limit of bcrypt.
+type PasswordHasher struct {
+	cost   int
+	pepper []byte
+}
+
+// defaultPasswordHashingCost is used when authentication.hashing_cost is not set.
+const defaultPasswordHashingCost = 12
+
+// NewPasswordHasher creates a hasher for the given bcrypt cost, 0 means defaultPasswordHashingCost.
+func NewPasswordHasher(cost int, pepper string) *PasswordHasher {
+	switch {
+	case cost == 0:
+		cost = defaultPasswordHashingCost
+	case cost < bcrypt.MinCost:
+		cost = bcrypt.MinCost
+	case cost > bcrypt.MaxCost:
+		cost = bcrypt.MaxCost
+	}
+
+	h := &PasswordHasher{cost: cost}
+	if pepper != "" {
+		h.pepper = []byte(pepper)
+	}
+	return h
+}
+
+// Hash returns the bcrypt hash of the password.
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(h.prepare(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify reports whether the password matches the hash.
+func (h *PasswordHasher) Verify(hash, password string) bool {
+	if hash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), h.prepare(password)) == nil
+}
+
+// NeedsRehash reports whether the hash was produced with a different cost than the configured one.
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost
+}
+
+// Cost returns the bcrypt cost used for new hashes.
+func (h *PasswordHasher) Cost() int {
+	return h.cost
+}
+
+func (h *PasswordHasher) prepare(password string) []byte {
+	if h.pepper == nil {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, h.pepper)
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,40 @@
+package zephyrix
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	h := NewPasswordHasher(bcrypt.MinCost, "")
+	hash, err := h.Hash("correct horse")
+	require.NoError(t, err)
+	require.True(t, h.Verify(hash, "correct horse"))
+	require.False(t, h.Verify(hash, "battery staple"))
+	require.False(t, h.Verify("", "correct horse"))
+	require.False(t, h.NeedsRehash(hash))
+
+	stronger := NewPasswordHasher(bcrypt.MinCost+1, "")
+	require.True(t, stronger.NeedsRehash(hash), "a cost change requires a rehash")
+	require.True(t, stronger.Verify(hash, "correct horse"), "old hashes stay valid")
+
+	require.Equal(t, defaultPasswordHashingCost, NewPasswordHasher(0, "").Cost())
+}
+
+func TestPasswordHasherPepper(t *testing.T) {
+	peppered := NewPasswordHasher(bcrypt.MinCost, "pepper")
+	hash, err := peppered.Hash("correct horse")
+	require.NoError(t, err)
+	require.True(t, peppered.Verify(hash, "correct horse"))
+	require.False(t, NewPasswordHasher(bcrypt.MinCost, "").Verify(hash, "correct horse"))
+	require.False(t, NewPasswordHasher(bcrypt.MinCost, "other").Verify(hash, "correct horse"))
+
+	// the pepper removes the 72 bytes input limit of bcrypt
+	long := strings.Repeat("a", 100)
+	hash, err = peppered.Hash(long)
+	require.NoError(t, err)
+	require.False(t, peppered.Verify(hash, strings.Repeat("a", 99)+"b"))
+}
@@ -0,0 +1,234 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+// Rules of the password policy, reported in PasswordPolicyViolation.Rule.
+const (
+	PasswordRuleMinLength    = "min_length"
+	PasswordRuleUppercase    = "require_uppercase"
+	PasswordRuleLowercase    = "require_lowercase"
+	PasswordRuleNumbers      = "require_numbers"
+	PasswordRuleSpecialChars = "require_special_chars"
+	PasswordRuleHistory      = "history_count"
+	PasswordRuleBreached     = "breached"
+)
+
+// PasswordPolicyViolation is a rule of the password policy a password does not satisfy.
+type PasswordPolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password violates. It unwraps to ErrWeakPassword:
+//
+//	var policy *PasswordPolicyError
+//	if errors.As(err, &policy) {
+//		// show policy.Violations next to the password field
+//	}
+type PasswordPolicyError struct {
+	Violations []PasswordPolicyViolation `json:"violations"`
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return fmt.Sprintf("%s: %s", ErrWeakPassword, strings.Join(messages, ", "))
+}
+
+func (e *PasswordPolicyError) Unwrap() error { return ErrWeakPassword }
+
+// BreachedPasswordSource answers k-anonymity range queries: Range returns the suffixes (the 35
+// uppercase hex characters after the prefix) of the breached SHA-1 hashes starting with the 5
+// character prefix. The local hash list implements it, a client of a remote service can be plugged
+// with PasswordValidator.SetBreachedPasswordSource.
+type BreachedPasswordSource interface {
+	Range(ctx context.Context, prefix string) ([]string, error)
+}
+
+// PasswordValidator enforces the PasswordPolicy on new passwords and keeps the hashes
+// of the previous passwords of the users.
+type PasswordValidator struct {
+	config   PasswordPolicy
+	orm      beeorm.Engine
+	hasher   *PasswordHasher
+	breached BreachedPasswordSource
+}
+
+func NewPasswordValidator(conf *Config, orm beeorm.Engine, hasher *PasswordHasher) (*PasswordValidator, error) {
+	pv := &PasswordValidator{
+		config: conf.Authentication.PasswordPolicy,
+		orm:    orm,
+		hasher: hasher,
+	}
+	if pv.config.BreachedPasswords != "" {
+		list, err := openHashList(pv.config.BreachedPasswords)
+		if err != nil {
+			return nil, fmt.Errorf("password policy: %w", err)
+		}
+		pv.breached = list
+	}
+	return pv, nil
+}
+
+// SetBreachedPasswordSource replaces the breached password list, nil disables the check.
+func (pv *PasswordValidator) SetBreachedPasswordSource(source BreachedPasswordSource) {
+	pv.Close()
+	pv.breached = source
+}
+
+// Close releases the local breached password list.
+func (pv *PasswordValidator) Close() {
+	if list, ok := pv.breached.(*hashList); ok {
+		list.Close()
+	}
+}
+
+// Validate checks the password against the policy and, when a user is given, against the previous
+// passwords of the user. A violated policy is reported as a *PasswordPolicyError.
+func (pv *PasswordValidator) Validate(ctx context.Context, password string, user User) error {
+	violations := pv.config.check(password)
+
+	if user != nil && pv.config.HistoryCount > 0 && pv.reused(ctx, user, password) {
+		violations = append(violations, PasswordPolicyViolation{
+			Rule:    PasswordRuleHistory,
+			Message: fmt.Sprintf("must differ from the last %d passwords", pv.config.HistoryCount),
+		})
+	}
+
+	if pv.breached != nil && password != "" {
+		breached, err := isBreachedPassword(ctx, pv.breached, password)
+		if err != nil {
+			// the other rules still apply, an unreadable list must not block every password change
+			Logger.Error("Failed to check the breached password list: %s", err)
+		} else if breached {
+			violations = append(violations, PasswordPolicyViolation{
+				Rule:    PasswordRuleBreached,
+				Message: "appeared in a data breach, choose another password",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// Expired reports whether the password of the user is older than max_age.
+// Users without a password, e.g. signed up with OAuth2, never expire.
+func (pv *PasswordValidator) Expired(user User) bool {
+	changed := user.PasswordLastChanged()
+	return pv.config.MaxAge > 0 && !changed.IsZero() && time.Since(changed) > pv.config.MaxAge
+}
+
+// remember stores the hash of the new password of the user and forgets the ones beyond history_count.
+func (pv *PasswordValidator) remember(ctx context.Context, user User, hash string) error {
+	if pv.config.HistoryCount <= 0 {
+		return nil
+	}
+
+	orm := pv.orm.NewORM(ctx)
+	entry := beeorm.NewEntity[models.PasswordHistoryEntity](orm)
+	entry.UserID = user.ID()
+	entry.Hash = hash
+	entry.CreatedAt = time.Now().UTC()
+
+	// the current password is part of the history, so history_count - 1 older entries are kept
+	history := pv.history(ctx, user.ID(), nil)
+	for i := len(history) - 1; i >= pv.config.HistoryCount-1; i-- {
+		beeorm.DeleteEntity(orm, history[i])
+	}
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to store the password history: %w", err)
+	}
+	return nil
+}
+
+// reused reports whether the password is the current one or one of the remembered ones.
+func (pv *PasswordValidator) reused(ctx context.Context, user User, password string) bool {
+	if user.CheckPassword(password) {
+		return true
+	}
+	for _, entry := range pv.history(ctx, user.ID(), beeorm.NewPager(1, pv.config.HistoryCount)) {
+		if pv.hasher.Verify(entry.Hash, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// history returns the remembered passwords of the user, newest first.
+func (pv *PasswordValidator) history(ctx context.Context, userID uint64, pager *beeorm.Pager) []*models.PasswordHistoryEntity {
+	iterator := beeorm.Search[models.PasswordHistoryEntity](pv.orm.NewORM(ctx), beeorm.NewWhere("`UserID` = ? ORDER BY `ID` DESC", userID), pager)
+	history := make([]*models.PasswordHistoryEntity, 0, iterator.Len())
+	for iterator.Next() {
+		history = append(history, iterator.Entity())
+	}
+	return history
+}
+
+// check applies the rules of the policy that only depend on the password itself.
+func (p PasswordPolicy) check(password string) []PasswordPolicyViolation {
+	var violations []PasswordPolicyViolation
+	if p.MinLength > 0 && utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordPolicyViolation{
+			Rule:    PasswordRuleMinLength,
+			Message: fmt.Sprintf("must be at least %d characters long", p.MinLength),
+		})
+	}
+
+	var upper, lower, number, special bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			number = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			special = true
+		}
+	}
+	for _, rule := range []struct {
+		required, satisfied bool
+		rule, message       string
+	}{
+		{p.RequireUppercase, upper, PasswordRuleUppercase, "must contain an uppercase letter"},
+		{p.RequireLowercase, lower, PasswordRuleLowercase, "must contain a lowercase letter"},
+		{p.RequireNumbers, number, PasswordRuleNumbers, "must contain a number"},
+		{p.RequireSpecialChars, special, PasswordRuleSpecialChars, "must contain a special character"},
+	} {
+		if rule.required && !rule.satisfied {
+			violations = append(violations, PasswordPolicyViolation{Rule: rule.rule, Message: rule.message})
+		}
+	}
+	return violations
+}
+
+// isBreachedPassword looks the password up with a k-anonymity range query, only the first five
+// characters of its SHA-1 hash are passed to the source.
+func isBreachedPassword(ctx context.Context, source BreachedPasswordSource, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, err := source.Range(ctx, hash[:5])
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(suffixes, hash[5:]), nil
+}
@@ -0,0 +1,97 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 12, RequireUppercase: true, RequireLowercase: true, RequireNumbers: true, RequireSpecialChars: true}
+	require.Empty(t, policy.check("Correct-Horse-7-Battery"))
+	require.Empty(t, policy.check("Ünïcödé pässwörd 9"), "letters and symbols are not limited to ASCII")
+
+	rules := func(violations []PasswordPolicyViolation) []string {
+		names := make([]string, len(violations))
+		for i, violation := range violations {
+			names[i] = violation.Rule
+		}
+		return names
+	}
+	require.Equal(t, []string{PasswordRuleMinLength, PasswordRuleUppercase, PasswordRuleNumbers, PasswordRuleSpecialChars}, rules(policy.check("short")))
+	require.Equal(t, []string{PasswordRuleLowercase}, rules(policy.check("CORRECT-HORSE-7")))
+	require.Empty(t, PasswordPolicy{}.check(""), "an empty policy accepts everything")
+
+	err := error(&PasswordPolicyError{Violations: policy.check("short")})
+	require.ErrorIs(t, err, ErrWeakPassword)
+	require.Contains(t, err.Error(), "must be at least 12 characters long")
+}
+
+func TestBreachedPasswordList(t *testing.T) {
+	hash := func(password string) string {
+		sum := sha1.Sum([]byte(password))
+		return strings.ToUpper(hex.EncodeToString(sum[:]))
+	}
+	breached := []string{"password", "123456", "qwerty", "letmein", "dragon", "monkey", "iloveyou", "trustno1"}
+	lines := make([]string, 0, len(breached)+200)
+	for _, password := range breached {
+		lines = append(lines, hash(password)+":42")
+	}
+	for i := 0; i < 200; i++ {
+		lines = append(lines, hash(strings.Repeat("x", i+1))+":1")
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600))
+	list, err := openHashList(path)
+	require.NoError(t, err)
+	defer list.Close()
+
+	ctx := context.Background()
+	for _, password := range append(breached, "x", strings.Repeat("x", 200)) {
+		found, err := isBreachedPassword(ctx, list, password)
+		require.NoError(t, err)
+		require.True(t, found, password)
+	}
+	for _, password := range []string{"Correct-Horse-7-Battery", "", strings.Repeat("x", 201)} {
+		found, err := isBreachedPassword(ctx, list, password)
+		require.NoError(t, err)
+		require.False(t, found, password)
+	}
+
+	first := lines[0]
+	suffixes, err := list.Range(ctx, strings.ToLower(first[:5]))
+	require.NoError(t, err)
+	require.Contains(t, suffixes, first[5:40])
+
+	pv := &PasswordValidator{breached: list}
+	err = pv.Validate(ctx, "letmein", nil)
+	var policy *PasswordPolicyError
+	require.True(t, errors.As(err, &policy))
+	require.Equal(t, PasswordRuleBreached, policy.Violations[0].Rule)
+}
+
+func TestPasswordExpired(t *testing.T) {
+	ap := newTestAuthProvider(t)
+	store := ap.components.userStore.(*testUserStore)
+	pv := &PasswordValidator{config: PasswordPolicy{MaxAge: 24 * time.Hour}}
+
+	require.False(t, pv.Expired(store.wrap(&models.UserEntity{ID: 1})), "users without a password never expire")
+	require.False(t, pv.Expired(store.wrap(&models.UserEntity{ID: 1, PasswordChangedAt: time.Now().Add(-time.Hour)})))
+	require.True(t, pv.Expired(store.wrap(&models.UserEntity{ID: 1, PasswordChangedAt: time.Now().Add(-48 * time.Hour)})))
+	require.False(t, (&PasswordValidator{}).Expired(store.wrap(&models.UserEntity{ID: 1, PasswordChangedAt: time.Now().Add(-48 * time.Hour)})))
+
+	change := error(&PasswordChangeRequired{Token: "token"})
+	require.ErrorIs(t, change, ErrPasswordExpired)
+}
@@ -3,7 +3,7 @@ package zephyrix
 import (
 	"context"
 	"fmt"
-	"strconv"
+	"math"
 	"sync"
 	"time"
 
@@ -111,21 +111,30 @@ func (rl *RateLimiter) getPoolConfig(pool string) *RateLimiterPool {
 //	    - name: "default"
 //	      limit: 100
 //	      burst: 10
-//	      interval: "1m"
+//	      expire_time: "1m"
 //	    - name: "api"
 //	      limit: 10
 //	      burst: 5
-//	      interval: "5m"
+//	      expire_time: "5m"
 func (rl *RateLimiter) Limiter(ctx context.Context, pool string) *Limiter {
 	p := rl.getPoolConfig(pool)
 	if p == nil {
 		p = rl.getPoolConfig("")
 	}
+	if p == nil {
+		// no pool configured at all, nothing is limited
+		p = &RateLimiterPool{Limit: rate.Inf, Burst: math.MaxInt32}
+	}
+	expireTime := p.ExpireTime
+	if expireTime <= 0 {
+		// without a window the redis counters would never reset
+		expireTime = time.Minute
+	}
 	return &Limiter{
 		rl:         rl,
 		limiter:    rate.NewLimiter(p.Limit, p.Burst),
 		Burst:      p.Burst,
-		ExpireTime: p.ExpireTime,
+		ExpireTime: expireTime,
 	}
 }
 
@@ -170,8 +179,8 @@ type Limiter struct {
 func (l *Limiter) Allow(ctx context.Context, action, key string) bool {
 	limiterKey := fmt.Sprintf("ratelimiter:%s:%s", action, key)
 
-	if l.allowLocal(limiterKey) {
-		return true
+	if !l.allowLocal(limiterKey) {
+		return false
 	}
 
 	return l.allowRedis(ctx, limiterKey)
@@ -182,18 +191,14 @@ func (l *Limiter) allowLocal(key string) bool {
 	return l.limiter.Allow()
 }
 
-// allowRedis checks if the action is allowed based on the Redis-based limiter.
+// allowRedis checks if the action is allowed based on the Redis-based limiter,
+// which allows Burst actions per key in every ExpireTime window.
 func (l *Limiter) allowRedis(ctx context.Context, key string) bool {
-	l.rl.mu.Lock()
-	defer l.rl.mu.Unlock()
-
-	current, _ := l.rl.client.Get(l.rl.orm, key)
-	count, _ := strconv.Atoi(current)
-
-	if count >= l.Burst {
-		return false
+	count := l.rl.client.Incr(l.rl.orm, key)
+	if count == 1 {
+		// the first action of the window starts it
+		l.rl.client.Expire(l.rl.orm, key, l.ExpireTime)
 	}
 
-	l.rl.client.Set(l.rl.orm, key, strconv.Itoa(count+1), l.ExpireTime)
-	return true
+	return count <= int64(l.Burst)
 }
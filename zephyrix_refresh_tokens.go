@@ -0,0 +1,463 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+// defaultRefreshExpiration is used when authentication.jwt.refresh_expiration is not set.
+const defaultRefreshExpiration = 30 * 24 * time.Hour
+
+// AuthResult is the token pair returned by a successful authentication.
+type AuthResult struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // lifetime of the access token, in seconds
+
+	// RememberDeviceToken skips MFA on later logins of this device, see Authenticate.RememberDeviceToken.
+	RememberDeviceToken string `json:"remember_device_token,omitempty"`
+
+	User User `json:"-"`
+}
+
+// RefreshToken is the stored state of an issued refresh token.
+//
+// Every token belongs to a family, started by a login and continued by each rotation.
+// Only the SHA-256 hash of the token is stored.
+type RefreshToken struct {
+	TokenHash string     `json:"token_hash"`
+	FamilyID  string     `json:"family_id"`
+	UserID    uint64     `json:"user_id"`
+	DeviceID  string     `json:"device_id,omitempty"`
+	ClientID  string     `json:"client_id,omitempty"` // set for the tokens of the authorization server
+	Scopes    []string   `json:"scopes,omitempty"`
+	Revoked   bool       `json:"revoked"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+// RefreshTokenStore persists refresh tokens and their families.
+type RefreshTokenStore interface {
+	Save(ctx context.Context, token *RefreshToken) error
+	// Get returns the token with the given hash, ErrInvalidToken when it does not exist.
+	Get(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	// Consume marks the token as used, it returns false when the token was already used.
+	Consume(ctx context.Context, tokenHash string) (bool, error)
+	RevokeFamily(ctx context.Context, familyID string) error
+	// RevokeUser revokes every family of the user, or only the families of a device when deviceID is set.
+	RevokeUser(ctx context.Context, userID uint64, deviceID string) error
+	Cleanup(ctx context.Context) error
+}
+
+func newRefreshTokenStore(conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache) (RefreshTokenStore, error) {
+	config := conf.Authentication.JWT
+	prefix := conf.Authentication.Session.Prefix
+	if prefix == "" {
+		prefix = "zephyrix"
+	}
+
+	switch config.RefreshStorage {
+	case "redis", "":
+		client := redisClient
+		if config.RefreshPool != "" {
+			client = orm.Redis(config.RefreshPool)
+		}
+		return NewRedisRefreshTokenStore(orm.NewORM(context.Background()), client, prefix), nil
+	case "mysql":
+		return NewMySQLRefreshTokenStore(orm), nil
+	default:
+		return nil, fmt.Errorf("unsupported refresh token storage type: %s", config.RefreshStorage)
+	}
+}
+
+// hashRefreshToken returns the stored representation of a refresh token.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newOpaqueToken returns a random URL-safe token of 256 bits.
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueTokens creates the access token and a new refresh token of the given family,
+// an empty familyID starts a new family.
+func (ap *AuthProvider) issueTokens(ctx context.Context, user User, deviceID, familyID string) (*AuthResult, error) {
+	accessToken, err := ap.generateJWT(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate JWT: %w", err)
+	}
+
+	result := &AuthResult{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(ap.config.JWT.Expiration.Seconds()),
+		User:        user,
+	}
+
+	if ap.components.refreshTokens == nil {
+		return result, nil
+	}
+
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	if familyID == "" {
+		familyID = uuid.NewString()
+	}
+
+	expiration := ap.config.JWT.RefreshExpiration
+	if expiration <= 0 {
+		expiration = defaultRefreshExpiration
+	}
+
+	now := time.Now().UTC()
+	if err := ap.components.refreshTokens.Save(ctx, &RefreshToken{
+		TokenHash: hashRefreshToken(refreshToken),
+		FamilyID:  familyID,
+		UserID:    user.ID(),
+		DeviceID:  deviceID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(expiration),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	result.RefreshToken = refreshToken
+	return result, nil
+}
+
+// authenticateWithRefreshToken consumes a refresh token and returns its user and family.
+func (ap *AuthProvider) authenticateWithRefreshToken(ctx context.Context, refreshToken, deviceID string) (User, string, error) {
+	user, stored, err := ap.consumeRefreshToken(ctx, refreshToken, deviceID, "")
+	if err != nil {
+		return nil, "", err
+	}
+	return user, stored.FamilyID, nil
+}
+
+// consumeRefreshToken consumes a refresh token issued to the client, an empty clientID stands for
+// the tokens of AuthenticateUser.
+//
+// A refresh token can only be used once, presenting an already used token means it leaked:
+// the whole family is revoked, logging out both the attacker and the legitimate client.
+func (ap *AuthProvider) consumeRefreshToken(ctx context.Context, refreshToken, deviceID, clientID string) (User, *RefreshToken, error) {
+	store := ap.components.refreshTokens
+	if store == nil || refreshToken == "" {
+		return nil, nil, ErrInvalidToken
+	}
+
+	stored, err := store.Get(ctx, hashRefreshToken(refreshToken))
+	if err != nil {
+		return nil, nil, err
+	}
+	if stored.Revoked || time.Now().After(stored.ExpiresAt) {
+		return nil, nil, ErrInvalidToken
+	}
+	if stored.ClientID != clientID {
+		return nil, nil, fmt.Errorf("%w: issued to another client", ErrInvalidToken)
+	}
+	// a token bound to a device is only redeemed by that device, leaving the device out does not help
+	if stored.DeviceID != "" && stored.DeviceID != deviceID {
+		return nil, nil, fmt.Errorf("%w: device mismatch", ErrInvalidToken)
+	}
+
+	fresh, err := store.Consume(ctx, stored.TokenHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fresh {
+		if err := store.RevokeFamily(ctx, stored.FamilyID); err != nil {
+			Logger.Error("Failed to revoke refresh token family %s: %s", stored.FamilyID, err)
+		}
+		_ = ap.components.auditLogger.Log(ctx, "refresh_token_reuse", strconv.FormatUint(stored.UserID, 10),
+			fmt.Sprintf("family: %s, device: %s", stored.FamilyID, stored.DeviceID))
+		return nil, nil, ErrRefreshTokenReused
+	}
+
+	user, err := ap.components.userStore.GetByID(ctx, stored.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ap.checkAccount(ctx, user); err != nil {
+		return nil, nil, err
+	}
+	return user, stored, nil
+}
+
+// startRefreshTokenCleanup periodically removes the expired refresh tokens, until the context is done.
+func (ap *AuthProvider) startRefreshTokenCleanup(ctx context.Context) {
+	interval := ap.config.Session.CleanupInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ap.components.refreshTokens.Cleanup(ctx); err != nil {
+					Logger.Error("failed to cleanup refresh tokens: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// RevokeRefreshToken revokes the family of a refresh token, e.g. on logout.
+func (ap *AuthProvider) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+	if ap.components.refreshTokens == nil {
+		return nil
+	}
+	stored, err := ap.components.refreshTokens.Get(ctx, hashRefreshToken(refreshToken))
+	if err != nil {
+		return err
+	}
+	return ap.components.refreshTokens.RevokeFamily(ctx, stored.FamilyID)
+}
+
+// RevokeRefreshTokens revokes the refresh tokens of a user, on every device when deviceID is empty.
+func (ap *AuthProvider) RevokeRefreshTokens(ctx context.Context, userID uint64, deviceID string) error {
+	if ap.components.refreshTokens == nil {
+		return nil
+	}
+	return ap.components.refreshTokens.RevokeUser(ctx, userID, deviceID)
+}
+
+// RedisRefreshTokenStore stores refresh tokens in redis, keys expire with the tokens.
+type RedisRefreshTokenStore struct {
+	client beeorm.RedisCache
+	orm    beeorm.ORM
+	prefix string
+}
+
+func NewRedisRefreshTokenStore(orm beeorm.ORM, client beeorm.RedisCache, prefix string) *RedisRefreshTokenStore {
+	return &RedisRefreshTokenStore{
+		client: client,
+		orm:    orm,
+		prefix: prefix,
+	}
+}
+
+func (r *RedisRefreshTokenStore) Save(ctx context.Context, token *RefreshToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(token.ExpiresAt)
+	r.client.Set(r.orm, r.tokenKey(token.TokenHash), data, ttl)
+
+	familyKey := r.familyKey(token.FamilyID)
+	r.client.HSet(r.orm, familyKey, "user_id", token.UserID, "device_id", token.DeviceID)
+	r.client.Expire(r.orm, familyKey, ttl)
+
+	userKey := r.userKey(token.UserID)
+	r.client.SAdd(r.orm, userKey, token.FamilyID)
+	r.client.Expire(r.orm, userKey, ttl)
+	return nil
+}
+
+func (r *RedisRefreshTokenStore) Get(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	data, has := r.client.Get(r.orm, r.tokenKey(tokenHash))
+	if !has {
+		return nil, ErrInvalidToken
+	}
+
+	var token RefreshToken
+	if err := json.Unmarshal([]byte(data), &token); err != nil {
+		return nil, err
+	}
+
+	if revoked, _ := r.client.HGet(r.orm, r.familyKey(token.FamilyID), "revoked"); revoked == "1" {
+		token.Revoked = true
+	}
+	if used, has := r.client.Get(r.orm, r.usedKey(tokenHash)); has {
+		if unix, err := strconv.ParseInt(used, 10, 64); err == nil {
+			usedAt := time.Unix(unix, 0).UTC()
+			token.UsedAt = &usedAt
+		}
+	}
+	return &token, nil
+}
+
+func (r *RedisRefreshTokenStore) Consume(ctx context.Context, tokenHash string) (bool, error) {
+	token, err := r.Get(ctx, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	return r.client.SetNX(r.orm, r.usedKey(tokenHash), time.Now().Unix(), time.Until(token.ExpiresAt)), nil
+}
+
+func (r *RedisRefreshTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	// the family is kept until it expires, so a replayed token is still recognized as revoked
+	r.client.HSet(r.orm, r.familyKey(familyID), "revoked", "1")
+	return nil
+}
+
+func (r *RedisRefreshTokenStore) RevokeUser(ctx context.Context, userID uint64, deviceID string) error {
+	userKey := r.userKey(userID)
+	for _, familyID := range r.client.SMembers(r.orm, userKey) {
+		if deviceID != "" {
+			if device, _ := r.client.HGet(r.orm, r.familyKey(familyID), "device_id"); device != deviceID {
+				continue
+			}
+		}
+		if err := r.RevokeFamily(ctx, familyID); err != nil {
+			return err
+		}
+		r.client.SRem(r.orm, userKey, familyID)
+	}
+	return nil
+}
+
+func (r *RedisRefreshTokenStore) Cleanup(ctx context.Context) error {
+	// Redis automatically removes expired keys, so no cleanup is needed
+	return nil
+}
+
+func (r *RedisRefreshTokenStore) tokenKey(tokenHash string) string {
+	return fmt.Sprintf("%s:refresh:token:%s", r.prefix, tokenHash)
+}
+
+func (r *RedisRefreshTokenStore) usedKey(tokenHash string) string {
+	return fmt.Sprintf("%s:refresh:used:%s", r.prefix, tokenHash)
+}
+
+func (r *RedisRefreshTokenStore) familyKey(familyID string) string {
+	return fmt.Sprintf("%s:refresh:family:%s", r.prefix, familyID)
+}
+
+func (r *RedisRefreshTokenStore) userKey(userID uint64) string {
+	return fmt.Sprintf("%s:refresh:user:%d", r.prefix, userID)
+}
+
+// MySQLRefreshTokenStore stores refresh tokens in the zephyrix_refresh_tokens table.
+//
+// A token is consumed with a conditional UPDATE, so only one of the instances racing on it wins.
+type MySQLRefreshTokenStore struct {
+	orm beeorm.Engine
+}
+
+func NewMySQLRefreshTokenStore(orm beeorm.Engine) *MySQLRefreshTokenStore {
+	return &MySQLRefreshTokenStore{orm: orm}
+}
+
+func (m *MySQLRefreshTokenStore) Save(ctx context.Context, token *RefreshToken) error {
+	orm := m.orm.NewORM(ctx)
+	entity := beeorm.NewEntity[models.RefreshTokenEntity](orm)
+	entity.TokenHash = token.TokenHash
+	entity.FamilyID = token.FamilyID
+	entity.UserID = token.UserID
+	entity.DeviceID = token.DeviceID
+	entity.ClientID = token.ClientID
+	if len(token.Scopes) > 0 {
+		scopes, _ := json.Marshal(token.Scopes)
+		entity.Scopes = string(scopes)
+	}
+	entity.CreatedAt = token.CreatedAt.UTC()
+	entity.ExpiresAt = token.ExpiresAt.UTC()
+	return orm.Flush()
+}
+
+func (m *MySQLRefreshTokenStore) Get(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	entity, found := beeorm.GetByUniqueIndex[models.RefreshTokenEntity](m.orm.NewORM(ctx), "token_hash", tokenHash)
+	if !found {
+		return nil, ErrInvalidToken
+	}
+	token := &RefreshToken{
+		TokenHash: entity.TokenHash,
+		FamilyID:  entity.FamilyID,
+		UserID:    entity.UserID,
+		DeviceID:  entity.DeviceID,
+		ClientID:  entity.ClientID,
+		Revoked:   entity.Revoked,
+		UsedAt:    entity.UsedAt,
+		CreatedAt: entity.CreatedAt,
+		ExpiresAt: entity.ExpiresAt,
+	}
+	if entity.Scopes != "" {
+		_ = json.Unmarshal([]byte(entity.Scopes), &token.Scopes)
+	}
+	return token, nil
+}
+
+func (m *MySQLRefreshTokenStore) Consume(ctx context.Context, tokenHash string) (bool, error) {
+	orm := m.orm.NewORM(ctx)
+	entity, found := beeorm.GetByUniqueIndex[models.RefreshTokenEntity](orm, "token_hash", tokenHash)
+	if !found {
+		return false, ErrInvalidToken
+	}
+	if entity.UsedAt != nil {
+		return false, nil
+	}
+
+	// the row is only claimed while it is unused, the instance updating it is the one consuming the token
+	result := m.orm.DB(beeorm.DefaultPoolCode).Exec(orm,
+		"UPDATE `zephyrix_refresh_tokens` SET `UsedAt` = ? WHERE `ID` = ? AND `UsedAt` IS NULL", time.Now().UTC(), entity.ID)
+	return result.RowsAffected() == 1, nil
+}
+
+func (m *MySQLRefreshTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	orm := m.orm.NewORM(ctx)
+	iterator := beeorm.Search[models.RefreshTokenEntity](orm, beeorm.NewWhere("`FamilyID` = ?", familyID), nil)
+	for iterator.Next() {
+		entity := beeorm.EditEntity(orm, iterator.Entity())
+		entity.Revoked = true
+	}
+	return orm.Flush()
+}
+
+func (m *MySQLRefreshTokenStore) RevokeUser(ctx context.Context, userID uint64, deviceID string) error {
+	where := beeorm.NewWhere("`UserID` = ? AND `Revoked` = 0", userID)
+	if deviceID != "" {
+		where = beeorm.NewWhere("`UserID` = ? AND `DeviceID` = ? AND `Revoked` = 0", userID, deviceID)
+	}
+
+	orm := m.orm.NewORM(ctx)
+	families := make(map[string]struct{})
+	iterator := beeorm.Search[models.RefreshTokenEntity](orm, where, nil)
+	for iterator.Next() {
+		families[iterator.Entity().FamilyID] = struct{}{}
+	}
+
+	var errs []error
+	for familyID := range families {
+		errs = append(errs, m.RevokeFamily(ctx, familyID))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MySQLRefreshTokenStore) Cleanup(ctx context.Context) error {
+	orm := m.orm.NewORM(ctx)
+
+	iterator := beeorm.Search[models.RefreshTokenEntity](orm, beeorm.NewWhere("`ExpiresAt` < ?", time.Now().UTC()), nil)
+	for iterator.Next() {
+		beeorm.DeleteEntity(orm, iterator.Entity())
+	}
+
+	return orm.FlushAsync()
+}
@@ -0,0 +1,169 @@
+package zephyrix
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+// testRefreshTokenStore is an in-memory RefreshTokenStore, Consume claims a token once like the real stores.
+type testRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*RefreshToken
+}
+
+func (s *testRefreshTokenStore) Save(_ context.Context, token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *token
+	s.tokens[token.TokenHash] = &copied
+	return nil
+}
+
+func (s *testRefreshTokenStore) Get(_ context.Context, tokenHash string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[tokenHash]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (s *testRefreshTokenStore) Consume(_ context.Context, tokenHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[tokenHash]
+	if !ok {
+		return false, ErrInvalidToken
+	}
+	if token.UsedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	token.UsedAt = &now
+	return true, nil
+}
+
+func (s *testRefreshTokenStore) RevokeFamily(_ context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokens {
+		if token.FamilyID == familyID {
+			token.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *testRefreshTokenStore) RevokeUser(_ context.Context, userID uint64, deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokens {
+		if token.UserID == userID && (deviceID == "" || token.DeviceID == deviceID) {
+			token.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *testRefreshTokenStore) Cleanup(context.Context) error { return nil }
+
+func newTestRefreshProvider(t *testing.T) (*AuthProvider, User) {
+	ap := newTestAuthProvider(t, &models.UserEntity{ID: 1, Username: "alice", Active: true})
+	ap.components.refreshTokens = &testRefreshTokenStore{tokens: make(map[string]*RefreshToken)}
+	ap.components.auditLogger = &AuditLogger{}
+	user, err := ap.components.userStore.GetByID(context.Background(), 1)
+	require.NoError(t, err)
+	return ap, user
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	ap, user := newTestRefreshProvider(t)
+	ctx := context.Background()
+
+	first, err := ap.issueTokens(ctx, user, "", "")
+	require.NoError(t, err)
+	require.NotEmpty(t, first.RefreshToken)
+
+	refreshed, family, err := ap.authenticateWithRefreshToken(ctx, first.RefreshToken, "")
+	require.NoError(t, err)
+	require.Equal(t, user.ID(), refreshed.ID())
+
+	second, err := ap.issueTokens(ctx, user, "", family)
+	require.NoError(t, err)
+	require.NotEqual(t, first.RefreshToken, second.RefreshToken, "every refresh rotates the token")
+	stored, err := ap.components.refreshTokens.Get(ctx, hashRefreshToken(second.RefreshToken))
+	require.NoError(t, err)
+	require.Equal(t, family, stored.FamilyID, "the rotated token continues the family")
+
+	// the first token was used, presenting it again means it leaked
+	_, _, err = ap.authenticateWithRefreshToken(ctx, first.RefreshToken, "")
+	require.ErrorIs(t, err, ErrRefreshTokenReused)
+	_, _, err = ap.authenticateWithRefreshToken(ctx, second.RefreshToken, "")
+	require.ErrorIs(t, err, ErrInvalidToken, "the reuse revoked the whole family")
+
+	// other families are left alone
+	other, err := ap.issueTokens(ctx, user, "", "")
+	require.NoError(t, err)
+	_, _, err = ap.authenticateWithRefreshToken(ctx, other.RefreshToken, "")
+	require.NoError(t, err)
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	ap, user := newTestRefreshProvider(t)
+	ctx := context.Background()
+
+	ap.config.JWT.RefreshExpiration = time.Millisecond
+	result, err := ap.issueTokens(ctx, user, "", "")
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	_, _, err = ap.authenticateWithRefreshToken(ctx, result.RefreshToken, "")
+	require.ErrorIs(t, err, ErrInvalidToken)
+	_, _, err = ap.authenticateWithRefreshToken(ctx, "unknown", "")
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestRefreshTokenDeviceBinding(t *testing.T) {
+	ap, user := newTestRefreshProvider(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		device string
+		ok     bool
+	}{
+		{"other device", "laptop", false},
+		{"device left out", "", false},
+		{"same device", "phone", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ap.issueTokens(ctx, user, "phone", "")
+			require.NoError(t, err)
+			_, _, err = ap.authenticateWithRefreshToken(ctx, result.RefreshToken, tt.device)
+			if tt.ok {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenDisabledUser(t *testing.T) {
+	ap, user := newTestRefreshProvider(t)
+	ctx := context.Background()
+
+	result, err := ap.issueTokens(ctx, user, "", "")
+	require.NoError(t, err)
+	ap.components.userStore.(*testUserStore).users[1].Active = false
+	_, _, err = ap.authenticateWithRefreshToken(ctx, result.RefreshToken, "")
+	require.ErrorIs(t, err, ErrAccountDisabled)
+}
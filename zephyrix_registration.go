@@ -0,0 +1,341 @@
+package zephyrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/latolukasz/beeorm/v3"
+)
+
+const (
+	defaultVerificationTTL      = 48 * time.Hour
+	defaultInvitationTTL        = 7 * 24 * time.Hour
+	defaultRegistrationRatePool = "registration"
+
+	emailVerificationTokenType = "email_verification"
+
+	// emailVerifiedMetadata is false on accounts registered while email_verification_required
+	// until the address is verified. Accounts created otherwise do not have it and are not blocked.
+	emailVerifiedMetadata = "email_verified"
+)
+
+// normalize applies the defaults of the configuration.
+func (c UserRegistration) normalize() UserRegistration {
+	if c.VerificationTTL <= 0 {
+		c.VerificationTTL = defaultVerificationTTL
+	}
+	if c.InvitationTTL <= 0 {
+		c.InvitationTTL = defaultInvitationTTL
+	}
+	if c.RateLimitPool == "" {
+		c.RateLimitPool = defaultRegistrationRatePool
+	}
+	domains := make([]string, len(c.AllowedDomains))
+	for i, domain := range c.AllowedDomains {
+		domains[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+	}
+	c.AllowedDomains = domains
+	return c
+}
+
+// domainAllowed reports whether the address belongs to one of allowed_domains, any domain is allowed
+// when the list is empty.
+func (c UserRegistration) domainAllowed(email string) bool {
+	if len(c.AllowedDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndexByte(email, '@')
+	return at >= 0 && slices.Contains(c.AllowedDomains, strings.ToLower(email[at+1:]))
+}
+
+// Registration is an account requested by a visitor.
+type Registration struct {
+	Username       string // defaults to the email address
+	Email          string
+	Password       string // may be empty when passwordless login is enabled
+	InvitationCode string // required when invitation_only is set
+
+	IP string // the client, registrations are rate limited per address
+}
+
+// RegistrationManager enforces the UserRegistration settings: domain allow-lists, invitations
+// and the verification of the email addresses.
+type RegistrationManager struct {
+	config      UserRegistration
+	orm         beeorm.Engine
+	redisClient beeorm.RedisCache
+	limiter     *RateLimiter
+	audit       *AuditLogger
+	mailer      MailSender
+	webhook     *WebhookCodeSender
+}
+
+func NewRegistrationManager(conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, rl *RateLimiter, audit *AuditLogger) (*RegistrationManager, error) {
+	auth := conf.Authentication
+	rm := &RegistrationManager{
+		config:      auth.UserRegistration.normalize(),
+		orm:         orm,
+		redisClient: redisClient,
+		limiter:     rl,
+		audit:       audit,
+	}
+
+	mail := rm.config.Mail
+	if mail.Driver == "" {
+		mail = auth.MFA.Email
+	}
+	var err error
+	if rm.mailer, err = newMailSender(mail); err != nil {
+		return nil, fmt.Errorf("user registration: %w", err)
+	}
+	if url := auth.Webhooks.UserRegistered; url != "" {
+		if rm.webhook, err = NewWebhookCodeSender(WebhookSenderConfig{URL: url, Timeout: 10 * time.Second}); err != nil {
+			return nil, fmt.Errorf("user registration: %w", err)
+		}
+	}
+	return rm, nil
+}
+
+// Enabled reports whether visitors can register.
+func (rm *RegistrationManager) Enabled() bool {
+	return rm.config.Enabled
+}
+
+// SetMailSender replaces the sender of the verification and invitation emails,
+// e.g. with a FileCodeSender during development.
+func (rm *RegistrationManager) SetMailSender(sender MailSender) {
+	rm.mailer = sender
+}
+
+// sendVerification emails the verification link to the user.
+func (rm *RegistrationManager) sendVerification(ctx context.Context, user User, token string) error {
+	if rm.mailer == nil || rm.config.VerificationURL == "" {
+		return errors.New("no mail sender or verification_url configured for email verification")
+	}
+	return rm.mailer.SendMail(ctx, Mail{
+		To:      user.Email(),
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Open the link below to verify your email address, it expires in %s:\n\n%s\n\n"+
+			"If you did not create an account, you can ignore this email.", rm.config.VerificationTTL, tokenLink(rm.config.VerificationURL, token)),
+	})
+}
+
+// notify posts the event to the user_registered webhook in the background.
+func (rm *RegistrationManager) notify(ctx context.Context, event string, user User) {
+	if rm.webhook == nil {
+		return
+	}
+	body := map[string]interface{}{
+		"event":    event,
+		"user_id":  user.ID(),
+		"username": user.Username(),
+		"email":    user.Email(),
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := rm.webhook.post(ctx, body); err != nil {
+			Logger.Error("Failed to notify %s of user %d: %s", event, user.ID(), err)
+		}
+	}()
+}
+
+func (rm *RegistrationManager) log(ctx context.Context, action string, userID uint64, details string) {
+	if rm.audit == nil {
+		return
+	}
+	if err := rm.audit.Log(ctx, action, strconv.FormatUint(userID, 10), details); err != nil {
+		Logger.Error("Failed to write %s to the audit log: %s", action, err)
+	}
+}
+
+// Registration returns the manager of the registrations and invitations.
+func (ap *AuthProvider) Registration() *RegistrationManager {
+	return ap.components.registration
+}
+
+// Register creates the account of a visitor. The account is active right away, but while
+// email_verification_required is set it can not log in before VerifyEmail is called with the
+// token emailed to it. Invitations addressed to the email address verify it.
+func (ap *AuthProvider) Register(ctx context.Context, input Registration) (User, error) {
+	rm := ap.components.registration
+	if !rm.Enabled() {
+		return nil, errors.New("registration is not enabled")
+	}
+
+	email := normalizeUsername(input.Email)
+	if !strings.Contains(email, "@") {
+		return nil, fmt.Errorf("%w: a valid email address is required", ErrInvalidCredentials)
+	}
+	if input.Username == "" {
+		input.Username = email
+	}
+	if input.Password == "" && !ap.config.Passwordless.Enabled {
+		return nil, &PasswordPolicyError{Violations: []PasswordPolicyViolation{{Rule: PasswordRuleMinLength, Message: "a password is required"}}}
+	}
+	if rm.limiter != nil && !rm.limiter.Limiter(ctx, rm.config.RateLimitPool).Allow(ctx, "registration", input.IP) {
+		return nil, ErrRateLimited
+	}
+
+	var invitation *Invitation
+	if input.InvitationCode != "" {
+		var err error
+		if invitation, err = rm.invitation(ctx, input.InvitationCode, email); err != nil {
+			return nil, err
+		}
+	} else if rm.config.InvitationOnly {
+		return nil, fmt.Errorf("%w: registration requires an invitation", ErrInvalidInvitation)
+	}
+
+	invited := invitation != nil && invitation.Email != ""
+	// invitations addressed to someone were vetted by an administrator
+	if !invited && !rm.config.domainAllowed(email) {
+		return nil, ErrDomainNotAllowed
+	}
+
+	roles := slices.Clone(rm.config.DefaultRoles)
+	if invitation != nil {
+		roles = append(roles, invitation.Roles...)
+		if !rm.claimInvitation(ctx, invitation) {
+			return nil, ErrInvalidInvitation
+		}
+	}
+	verified := !rm.config.EmailVerificationRequired || invited
+
+	user, err := ap.CreateUser(ctx, NewUser{
+		Username: input.Username,
+		Email:    email,
+		Password: input.Password,
+		Roles:    roles,
+		Active:   true,
+		Metadata: map[string]interface{}{emailVerifiedMetadata: verified},
+	})
+	if err != nil {
+		if invitation != nil {
+			rm.releaseInvitation(ctx, invitation)
+		}
+		return nil, err
+	}
+
+	details := fmt.Sprintf("email=%s ip=%s", maskDestination(email), input.IP)
+	if invitation != nil {
+		if err := rm.useInvitation(ctx, invitation, user.ID()); err != nil {
+			Logger.Error("Failed to mark invitation %d as used: %s", invitation.ID, err)
+		}
+		details += fmt.Sprintf(" invitation=%d", invitation.ID)
+	}
+	rm.log(ctx, "user_registered", user.ID(), details)
+	rm.notify(ctx, "user_registered", user)
+
+	if !verified {
+		if err := ap.sendEmailVerification(ctx, user); err != nil {
+			Logger.Error("Failed to send the verification email of user %d: %s", user.ID(), err)
+		}
+	}
+	return user, nil
+}
+
+// VerifyEmail marks the address of the user as verified with a token sent by Register or
+// ResendEmailVerification. Tokens stop working when the address of the user changes.
+func (ap *AuthProvider) VerifyEmail(ctx context.Context, tokenString string) (User, error) {
+	token, err := ap.VerifyToken(tokenString)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("%w: invalid email verification token", ErrInvalidToken)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != emailVerificationTokenType {
+		return nil, fmt.Errorf("%w: invalid email verification token", ErrInvalidToken)
+	}
+	userID, err := claimUint64(claims, "sub")
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid email verification token", ErrInvalidToken)
+	}
+
+	user, err := ap.components.userStore.GetByID(ctx, userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, fmt.Errorf("%w: unknown user", ErrInvalidToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if email, _ := claims["email"].(string); email == "" || email != normalizeUsername(user.Email()) {
+		return nil, fmt.Errorf("%w: the email address changed since the token was issued", ErrInvalidToken)
+	}
+	if isEmailVerified(user) {
+		return user, nil
+	}
+	if err := ap.markEmailVerified(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ResendEmailVerification emails a new verification link. Unknown and verified addresses get
+// no email but no error either, so the answer does not reveal which accounts exist.
+func (ap *AuthProvider) ResendEmailVerification(ctx context.Context, email string) error {
+	rm := ap.components.registration
+	email = normalizeUsername(email)
+	if rm.limiter != nil && !rm.limiter.Limiter(ctx, rm.config.RateLimitPool).Allow(ctx, "email_verification", email) {
+		return ErrRateLimited
+	}
+
+	user, err := ap.components.userStore.GetByEmail(ctx, email)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isEmailVerified(user) {
+		return nil
+	}
+	return ap.sendEmailVerification(ctx, user)
+}
+
+func (ap *AuthProvider) sendEmailVerification(ctx context.Context, user User) error {
+	now := time.Now()
+	token, err := ap.signClaims(jwt.MapClaims{
+		"typ":   emailVerificationTokenType,
+		"sub":   strconv.FormatUint(user.ID(), 10),
+		"email": normalizeUsername(user.Email()),
+		"iat":   now.Unix(),
+		"exp":   now.Add(ap.components.registration.config.VerificationTTL).Unix(),
+		"iss":   ap.config.JWT.Issuer,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sign email verification: %w", err)
+	}
+	if err := ap.components.registration.sendVerification(ctx, user, token); err != nil {
+		return err
+	}
+	ap.components.registration.log(ctx, "email_verification_sent", user.ID(), fmt.Sprintf("to=%s", maskDestination(user.Email())))
+	return nil
+}
+
+func (ap *AuthProvider) markEmailVerified(ctx context.Context, user User) error {
+	if err := user.SetMetadata(emailVerifiedMetadata, true); err != nil {
+		return err
+	}
+	if err := ap.components.userStore.Update(ctx, user); err != nil {
+		return fmt.Errorf("failed to verify the email address: %w", err)
+	}
+	ap.components.registration.log(ctx, "email_verified", user.ID(), "")
+	ap.components.registration.notify(ctx, "email_verified", user)
+	return nil
+}
+
+// isEmailVerified reports whether the user may log in while email_verification_required is set,
+// only accounts registered unverified are refused.
+func isEmailVerified(user User) bool {
+	verified, err := user.GetMetadata(emailVerifiedMetadata)
+	if err != nil {
+		return true
+	}
+	value, ok := verified.(bool)
+	return !ok || value
+}
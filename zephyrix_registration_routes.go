@@ -0,0 +1,144 @@
+package zephyrix
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registrationRouteHandler is one of the JSON endpoints of the user registration:
+//
+//	POST /auth/register                    {"username", "email", "password", "invitation"} -> 201 user
+//	POST /auth/verify-email                {"token"} -> user
+//	POST /auth/verify-email/resend         {"email"} -> 202, whether or not the address has an account
+//
+// The endpoints answer 404 while user_registration.enabled is off.
+type registrationRouteHandler struct {
+	name    string
+	path    string
+	handler []any
+}
+
+func (h *registrationRouteHandler) Name() string     { return h.name }
+func (h *registrationRouteHandler) Method() []string { return []string{http.MethodPost} }
+func (h *registrationRouteHandler) Path() string     { return h.path }
+func (h *registrationRouteHandler) Handlers() []any  { return h.handler }
+
+func newRegisterRoute(ap *AuthProvider) *registrationRouteHandler {
+	return &registrationRouteHandler{
+		name: "register",
+		path: "/auth/register",
+		handler: []any{ap.requireRegistration, func(c *gin.Context) {
+			var body struct {
+				Username   string `json:"username"`
+				Email      string `json:"email"`
+				Password   string `json:"password"`
+				Invitation string `json:"invitation"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Email == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			user, err := ap.Register(c.Request.Context(), Registration{
+				Username:       body.Username,
+				Email:          body.Email,
+				Password:       body.Password,
+				InvitationCode: body.Invitation,
+				IP:             c.ClientIP(),
+			})
+			if err != nil {
+				writeRegistrationError(c, err)
+				return
+			}
+			c.JSON(http.StatusCreated, registeredUser(user))
+		}},
+	}
+}
+
+func newVerifyEmailRoute(ap *AuthProvider) *registrationRouteHandler {
+	return &registrationRouteHandler{
+		name: "verify_email",
+		path: "/auth/verify-email",
+		handler: []any{ap.requireRegistration, func(c *gin.Context) {
+			var body struct {
+				Token string `json:"token"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Token == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			user, err := ap.VerifyEmail(c.Request.Context(), body.Token)
+			if err != nil {
+				writeRegistrationError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, registeredUser(user))
+		}},
+	}
+}
+
+func newResendEmailVerificationRoute(ap *AuthProvider) *registrationRouteHandler {
+	return &registrationRouteHandler{
+		name: "verify_email_resend",
+		path: "/auth/verify-email/resend",
+		handler: []any{ap.requireRegistration, func(c *gin.Context) {
+			var body struct {
+				Email string `json:"email"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Email == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			if err := ap.ResendEmailVerification(c.Request.Context(), body.Email); err != nil {
+				writeRegistrationError(c, err)
+				return
+			}
+			c.Status(http.StatusAccepted)
+		}},
+	}
+}
+
+// requireRegistration hides the endpoints while registration is disabled.
+func (ap *AuthProvider) requireRegistration(c *gin.Context) {
+	if ap.components.registration == nil || !ap.components.registration.Enabled() {
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// registeredUser is the public view of a registered user.
+func registeredUser(user User) gin.H {
+	return gin.H{
+		"id":             user.ID(),
+		"username":       user.Username(),
+		"email":          user.Email(),
+		"email_verified": isEmailVerified(user),
+	}
+}
+
+// writeRegistrationError maps the errors of the registration to JSON responses.
+func writeRegistrationError(c *gin.Context, err error) {
+	var policy *PasswordPolicyError
+	switch {
+	case errors.As(err, &policy):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "weak_password", "violations": policy.Violations})
+	case errors.Is(err, ErrUserExists):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "user_exists"})
+	case errors.Is(err, ErrInvalidInvitation):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid_invitation", "message": err.Error()})
+	case errors.Is(err, ErrDomainNotAllowed):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "domain_not_allowed"})
+	case errors.Is(err, ErrInvalidToken):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_token", "message": err.Error()})
+	case errors.Is(err, ErrInvalidCredentials):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "message": err.Error()})
+	case errors.Is(err, ErrRateLimited):
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate_limited"})
+	default:
+		Logger.Error("Registration failed: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+	}
+}
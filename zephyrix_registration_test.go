@@ -0,0 +1,61 @@
+package zephyrix
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+func TestUserRegistrationConfig(t *testing.T) {
+	domains := []string{" Example.com", "@Trusted.org"}
+	config := UserRegistration{AllowedDomains: domains}.normalize()
+	require.Equal(t, defaultVerificationTTL, config.VerificationTTL)
+	require.Equal(t, defaultInvitationTTL, config.InvitationTTL)
+	require.Equal(t, defaultRegistrationRatePool, config.RateLimitPool)
+	require.Equal(t, []string{"example.com", "trusted.org"}, config.AllowedDomains)
+	require.Equal(t, " Example.com", domains[0], "the configuration is not modified")
+
+	require.True(t, config.domainAllowed("jane@example.com"))
+	require.True(t, config.domainAllowed("jane@TRUSTED.org"))
+	require.False(t, config.domainAllowed("jane@example.com.evil.org"))
+	require.False(t, config.domainAllowed("jane@sub.example.com"))
+	require.False(t, config.domainAllowed("example.com"))
+	require.True(t, UserRegistration{}.domainAllowed("jane@anywhere.org"), "no allow-list allows every domain")
+}
+
+func TestEmailVerified(t *testing.T) {
+	store := newTestAuthProvider(t).components.userStore.(*testUserStore)
+
+	require.True(t, isEmailVerified(store.wrap(&models.UserEntity{ID: 1})), "accounts created without registration are not blocked")
+	require.False(t, isEmailVerified(store.wrap(&models.UserEntity{ID: 1, Metadata: `{"email_verified": false}`})))
+	require.True(t, isEmailVerified(store.wrap(&models.UserEntity{ID: 1, Metadata: `{"email_verified": true}`})))
+}
+
+func TestEmailVerificationToken(t *testing.T) {
+	ap := newTestAuthProvider(t, &models.UserEntity{ID: 7, Email: "jane@example.com", Metadata: `{"email_verified": false}`})
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := ap.signClaims(claims)
+		require.NoError(t, err)
+		return token
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	_, err := ap.VerifyEmail(context.Background(), sign(jwt.MapClaims{"typ": emailVerificationTokenType, "sub": "7", "email": "john@example.com", "exp": exp}))
+	require.ErrorIs(t, err, ErrInvalidToken, "the address changed since the token was issued")
+	_, err = ap.VerifyEmail(context.Background(), sign(jwt.MapClaims{"typ": passwordChangeTokenType, "sub": "7", "email": "jane@example.com", "exp": exp}))
+	require.ErrorIs(t, err, ErrInvalidToken, "other signed tokens are refused")
+	_, err = ap.VerifyEmail(context.Background(), sign(jwt.MapClaims{"typ": emailVerificationTokenType, "sub": "8", "email": "jane@example.com", "exp": exp}))
+	require.ErrorIs(t, err, ErrInvalidToken)
+	_, err = ap.VerifyEmail(context.Background(), sign(jwt.MapClaims{"typ": emailVerificationTokenType, "sub": "7", "email": "jane@example.com", "exp": time.Now().Add(-time.Minute).Unix()}))
+	require.ErrorIs(t, err, ErrInvalidToken, "expired")
+}
+
+func TestTokenLink(t *testing.T) {
+	require.Equal(t, "https://app.example.com/register?invitation=a%2Bb", tokenLink("https://app.example.com/register?invitation={token}", "a+b"))
+	require.Equal(t, "https://app.example.com/verify?lang=en&token=abc", tokenLink("https://app.example.com/verify?lang=en", "abc"))
+}
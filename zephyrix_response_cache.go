@@ -0,0 +1,721 @@
+package zephyrix
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/latolukasz/beeorm/v3"
+)
+
+// ResponseCacheConfig represents the configuration of the HTTP response cache.
+//
+// Responses are stored in a small in-process LRU cache and, when a redis pool is configured,
+// in Redis so that every instance shares them. Entries in the local tier never outlive LocalTTL,
+// which bounds how long an instance can serve a response that was invalidated elsewhere.
+type ResponseCacheConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	RedisPool   string        `mapstructure:"redis_pool"`    // leave empty to only use the local cache
+	Prefix      string        `mapstructure:"prefix"`        // prefix of every redis key
+	LocalSize   int           `mapstructure:"local_size"`    // maximum number of entries in the local cache
+	LocalTTL    time.Duration `mapstructure:"local_ttl"`     // maximum lifetime of an entry in the local cache
+	DefaultTTL  time.Duration `mapstructure:"default_ttl"`   // used when neither the route nor the response sets one
+	MaxBodySize int           `mapstructure:"max_body_size"` // responses larger than this are never cached
+}
+
+// ProxyCacheConfig enables response caching for a reverse proxy.
+type ProxyCacheConfig struct {
+	Enabled bool          `mapstructure:"enabled"`
+	TTL     time.Duration `mapstructure:"ttl"`
+	Tags    []string      `mapstructure:"tags"`
+}
+
+// ResponseCacheStats is a snapshot of the response cache counters.
+type ResponseCacheStats struct {
+	Hits          int64 `json:"hits"`
+	LocalHits     int64 `json:"local_hits"`
+	Misses        int64 `json:"misses"`
+	Stores        int64 `json:"stores"`
+	Bypasses      int64 `json:"bypasses"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+// ResponseCache caches HTTP responses of routes and proxies.
+//
+// It honors Cache-Control, Vary and ETag, collapses concurrent misses for the same
+// resource into a single upstream request, and supports tag based invalidation.
+type ResponseCache struct {
+	config  ResponseCacheConfig
+	client  beeorm.RedisCache
+	orm     beeorm.ORM
+	local   *localResponseCache
+	flights *cacheFlightGroup
+
+	hits, localHits, misses, stores, bypasses, invalidations atomic.Int64
+}
+
+// cachedResponse is the stored representation of a response.
+type cachedResponse struct {
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	ETag      string      `json:"etag"`
+	Tags      []string    `json:"tags"`
+	StoredAt  time.Time   `json:"stored_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// NewResponseCache creates the response cache described by the server.cache configuration.
+func NewResponseCache(conf *Config, orm beeorm.Engine) *ResponseCache {
+	config := conf.Server.Cache
+	if config.Prefix == "" {
+		config.Prefix = "zephyrix"
+	}
+	if config.LocalSize <= 0 {
+		config.LocalSize = 1000
+	}
+	if config.LocalTTL <= 0 {
+		config.LocalTTL = 5 * time.Second
+	}
+	if config.DefaultTTL <= 0 {
+		config.DefaultTTL = time.Minute
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 1 << 20 // 1 MiB
+	}
+
+	rc := &ResponseCache{
+		config:  config,
+		local:   newLocalResponseCache(config.LocalSize),
+		flights: &cacheFlightGroup{calls: make(map[string]*cacheFlight)},
+	}
+
+	if config.Enabled && config.RedisPool != "" {
+		rc.client = orm.Redis(config.RedisPool)
+		rc.orm = orm.NewORM(context.Background())
+	}
+
+	return rc
+}
+
+// Stats returns the current hit/miss counters of the cache.
+func (rc *ResponseCache) Stats() ResponseCacheStats {
+	return ResponseCacheStats{
+		Hits:          rc.hits.Load(),
+		LocalHits:     rc.localHits.Load(),
+		Misses:        rc.misses.Load(),
+		Stores:        rc.stores.Load(),
+		Bypasses:      rc.bypasses.Load(),
+		Invalidations: rc.invalidations.Load(),
+	}
+}
+
+// Middleware returns a gin middleware caching the responses of the routes it is attached to.
+//
+// A ttl of zero falls back to the response's own Cache-Control max-age, then to the configured default.
+func (rc *ResponseCache) Middleware(ttl time.Duration, tags ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rc.serve(c, ttl, tags, c.Next)
+	}
+}
+
+// InvalidateTags removes every cached response that was stored with one of the given tags.
+func (rc *ResponseCache) InvalidateTags(ctx context.Context, tags ...string) {
+	for _, tag := range tags {
+		rc.local.invalidateTag(tag)
+		if rc.client != nil {
+			tagKey := rc.tagKey(tag)
+			keys := rc.client.SMembers(rc.orm, tagKey)
+			if len(keys) > 0 {
+				rc.client.Del(rc.orm, keys...)
+			}
+			rc.client.Del(rc.orm, tagKey, tagKey+":expires")
+		}
+		rc.invalidations.Add(1)
+	}
+}
+
+// InvalidatePath removes every cached response of the given request path, whatever its query or variant.
+func (rc *ResponseCache) InvalidatePath(ctx context.Context, path string) {
+	rc.InvalidateTags(ctx, pathCacheTag(path))
+}
+
+// serve answers the request from the cache, or runs next and stores its response.
+func (rc *ResponseCache) serve(c *gin.Context, ttl time.Duration, tags []string, next func()) {
+	if !rc.config.Enabled || !rc.cacheableRequest(c) {
+		rc.bypasses.Add(1)
+		next()
+		return
+	}
+
+	baseKey := rc.baseKey(c.Request)
+	revalidate := hasCacheDirective(c.Request.Header.Get("Cache-Control"), "no-cache")
+
+	if !revalidate {
+		if entry := rc.lookup(baseKey, c.Request); entry != nil {
+			rc.hits.Add(1)
+			rc.writeCached(c, entry)
+			return
+		}
+	}
+
+	flight, leader := rc.flights.join(baseKey)
+	if !leader {
+		// another request is already fetching this resource, wait for it instead of hitting the origin again
+		select {
+		case <-flight.done:
+		case <-c.Request.Context().Done():
+			c.Abort()
+			return
+		}
+		if entry := rc.lookup(baseKey, c.Request); entry != nil {
+			rc.hits.Add(1)
+			rc.writeCached(c, entry)
+			return
+		}
+		rc.misses.Add(1)
+		next()
+		return
+	}
+	defer rc.flights.finish(baseKey, flight)
+
+	rc.misses.Add(1)
+	writer := &cacheResponseWriter{ResponseWriter: c.Writer, limit: rc.config.MaxBodySize}
+	c.Writer = writer
+	c.Header("X-Cache", "MISS")
+	next()
+	c.Writer = writer.ResponseWriter
+
+	entry := rc.buildEntry(c, writer, ttl, tags)
+	if entry == nil {
+		return
+	}
+	rc.store(baseKey, c.Request, entry)
+}
+
+// cacheableRequest reports whether the response to this request may come from, or go to, the cache.
+func (rc *ResponseCache) cacheableRequest(c *gin.Context) bool {
+	if c.Request.Method != http.MethodGet {
+		return false
+	}
+	return !hasCacheDirective(c.Request.Header.Get("Cache-Control"), "no-store")
+}
+
+// buildEntry turns a captured response into a cache entry, or returns nil when it must not be stored.
+func (rc *ResponseCache) buildEntry(c *gin.Context, w *cacheResponseWriter, ttl time.Duration, tags []string) *cachedResponse {
+	// the nonce is per request, a shared copy of the page would hand it to every visitor
+	if w.overflow || !cacheableStatus(w.Status()) || c.GetBool(cspNonceUsedContextKey) {
+		return nil
+	}
+
+	header := w.Header()
+	cacheControl := header.Get("Cache-Control")
+	if hasCacheDirective(cacheControl, "no-store") || hasCacheDirective(cacheControl, "private") ||
+		hasCacheDirective(cacheControl, "no-cache") || header.Get("Set-Cookie") != "" ||
+		strings.TrimSpace(header.Get("Vary")) == "*" {
+		return nil
+	}
+
+	// a shared cache must not store responses to authenticated requests unless they are explicitly public
+	_, authenticated := c.Get(identityContextKey)
+	if (authenticated || c.Request.Header.Get("Authorization") != "") &&
+		!hasCacheDirective(cacheControl, "public") && !hasCacheDirective(cacheControl, "s-maxage") {
+		return nil
+	}
+
+	if ttl <= 0 {
+		ttl = responseMaxAge(cacheControl)
+	}
+	if ttl <= 0 {
+		ttl = rc.config.DefaultTTL
+	}
+
+	// the security headers are set again for every request, a stored policy would replace its fresh nonce
+	gateway, _ := c.Request.Context().Value(securityHeadersContextKey{}).([]string)
+	stored := make(http.Header, len(header))
+	for name, values := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case "X-Cache", "Age", "Connection", "Keep-Alive", "Transfer-Encoding", "Date":
+			continue
+		}
+		if slices.Contains(gateway, http.CanonicalHeaderKey(name)) {
+			continue
+		}
+		stored[name] = append([]string(nil), values...)
+	}
+
+	etag := header.Get("ETag")
+	if etag == "" {
+		sum := sha256.Sum256(w.body)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		stored.Set("ETag", etag)
+	}
+
+	now := time.Now()
+	return &cachedResponse{
+		Status:    w.Status(),
+		Header:    stored,
+		Body:      w.body,
+		ETag:      etag,
+		Tags:      append(append([]string(nil), tags...), pathCacheTag(c.Request.URL.Path)),
+		StoredAt:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+// lookup finds the entry matching the request, taking the stored Vary headers into account.
+func (rc *ResponseCache) lookup(baseKey string, r *http.Request) *cachedResponse {
+	vary, ok := rc.local.getVary(baseKey)
+	if !ok && rc.client != nil {
+		if raw, has := rc.client.Get(rc.orm, rc.varyKey(baseKey)); has {
+			if raw != "" {
+				vary = strings.Split(raw, ",")
+			}
+			ok = true
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	key := variantKey(baseKey, vary, r)
+	if entry := rc.local.get(key); entry != nil {
+		rc.localHits.Add(1)
+		return entry
+	}
+
+	if rc.client == nil {
+		return nil
+	}
+
+	raw, has := rc.client.Get(rc.orm, key)
+	if !has {
+		return nil
+	}
+
+	var entry cachedResponse
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		Logger.Warn("Failed to decode cached response %s: %s", key, err)
+		return nil
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		return nil
+	}
+
+	rc.local.set(key, baseKey, vary, &entry, rc.localExpiry(entry.ExpiresAt))
+	return &entry
+}
+
+// store saves an entry in both tiers and registers it under its tags.
+func (rc *ResponseCache) store(baseKey string, r *http.Request, entry *cachedResponse) {
+	vary := varyHeaders(entry.Header)
+	key := variantKey(baseKey, vary, r)
+
+	rc.local.set(key, baseKey, vary, entry, rc.localExpiry(entry.ExpiresAt))
+	rc.stores.Add(1)
+
+	if rc.client == nil {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		Logger.Warn("Failed to encode response for cache: %s", err)
+		return
+	}
+
+	ttl := time.Until(entry.ExpiresAt)
+	rc.client.Set(rc.orm, rc.varyKey(baseKey), strings.Join(vary, ","), ttl)
+	rc.client.Set(rc.orm, key, data, ttl)
+	for _, tag := range entry.Tags {
+		tagKey := rc.tagKey(tag)
+		rc.client.SAdd(rc.orm, tagKey, key)
+		rc.extendTag(tagKey, entry.ExpiresAt)
+	}
+}
+
+// extendTag keeps the tag set alive until expiresAt unless it already lives longer,
+// a short lived entry must not expire the set while longer lived entries still use it.
+func (rc *ResponseCache) extendTag(tagKey string, expiresAt time.Time) {
+	expiresKey := tagKey + ":expires"
+	if raw, has := rc.client.Get(rc.orm, expiresKey); has {
+		if current, err := strconv.ParseInt(raw, 10, 64); err == nil && current >= expiresAt.UnixMilli() {
+			return
+		}
+	}
+	ttl := time.Until(expiresAt)
+	rc.client.Set(rc.orm, expiresKey, expiresAt.UnixMilli(), ttl)
+	rc.client.Expire(rc.orm, tagKey, ttl)
+}
+
+// writeCached writes a cached entry as the response of the current request.
+func (rc *ResponseCache) writeCached(c *gin.Context, entry *cachedResponse) {
+	header := c.Writer.Header()
+	for name, values := range entry.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("X-Cache", "HIT")
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+
+	if etagMatches(c.Request.Header.Get("If-None-Match"), entry.ETag) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
+
+	c.Status(entry.Status)
+	if _, err := c.Writer.Write(entry.Body); err != nil {
+		Logger.Debug("Failed to write cached response: %s", err)
+	}
+	c.Abort()
+}
+
+func (rc *ResponseCache) localExpiry(expiresAt time.Time) time.Time {
+	if limit := time.Now().Add(rc.config.LocalTTL); limit.Before(expiresAt) {
+		return limit
+	}
+	return expiresAt
+}
+
+func (rc *ResponseCache) baseKey(r *http.Request) string {
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteString(" ")
+	b.WriteString(r.Host)
+	b.WriteString(r.URL.Path)
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			b.WriteString("&")
+			b.WriteString(url.QueryEscape(k))
+			b.WriteString("=")
+			b.WriteString(url.QueryEscape(v))
+		}
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return fmt.Sprintf("%s:resp:%s", rc.config.Prefix, hex.EncodeToString(sum[:]))
+}
+
+func (rc *ResponseCache) varyKey(baseKey string) string {
+	return baseKey + ":vary"
+}
+
+func (rc *ResponseCache) tagKey(tag string) string {
+	return fmt.Sprintf("%s:resp-tag:%s", rc.config.Prefix, tag)
+}
+
+// variantKey derives the key of one variant of a resource from the request headers listed in Vary.
+func variantKey(baseKey string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return baseKey + ":v"
+	}
+	h := sha256.New()
+	for _, name := range vary {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write([]byte(r.Header.Get(name)))
+		h.Write([]byte{0})
+	}
+	return baseKey + ":v:" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// varyHeaders returns the normalized, sorted list of header names in the Vary header.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func pathCacheTag(path string) string {
+	return "path:" + path
+}
+
+func cacheableStatus(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// hasCacheDirective reports whether a Cache-Control header value contains the given directive.
+func hasCacheDirective(cacheControl, directive string) bool {
+	for _, part := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseMaxAge returns the s-maxage, or max-age, of a Cache-Control header value.
+func responseMaxAge(cacheControl string) time.Duration {
+	var maxAge, sharedMaxAge int
+	for _, part := range strings.Split(cacheControl, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "max-age":
+			maxAge = seconds
+		case "s-maxage":
+			sharedMaxAge = seconds
+		}
+	}
+	if sharedMaxAge > 0 {
+		return time.Duration(sharedMaxAge) * time.Second
+	}
+	return time.Duration(maxAge) * time.Second
+}
+
+// etagMatches reports whether an If-None-Match header value matches the given ETag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheResponseWriter passes the response through to the client while keeping a copy of the body.
+type cacheResponseWriter struct {
+	gin.ResponseWriter
+	body     []byte
+	limit    int
+	overflow bool
+}
+
+func (w *cacheResponseWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *cacheResponseWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *cacheResponseWriter) capture(data []byte) {
+	if w.overflow {
+		return
+	}
+	if len(w.body)+len(data) > w.limit {
+		w.overflow = true
+		w.body = nil
+		return
+	}
+	w.body = append(w.body, data...)
+}
+
+// cacheFlightGroup collapses concurrent cache misses for the same key.
+type cacheFlightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*cacheFlight
+}
+
+type cacheFlight struct {
+	done chan struct{}
+}
+
+// join returns the in-flight request for key, and whether the caller is the one that has to perform it.
+func (g *cacheFlightGroup) join(key string) (*cacheFlight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if flight, ok := g.calls[key]; ok {
+		return flight, false
+	}
+	flight := &cacheFlight{done: make(chan struct{})}
+	g.calls[key] = flight
+	return flight, true
+}
+
+func (g *cacheFlightGroup) finish(key string, flight *cacheFlight) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(flight.done)
+}
+
+// localResponseCache is the in-process LRU tier of the response cache.
+type localResponseCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	vary    map[string][]string
+	tags    map[string]map[string]struct{}
+	bases   map[string]map[string]struct{} // variant keys of every base key
+}
+
+type localCacheItem struct {
+	key       string
+	baseKey   string
+	entry     *cachedResponse
+	expiresAt time.Time
+}
+
+func newLocalResponseCache(size int) *localResponseCache {
+	return &localResponseCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		vary:    make(map[string][]string),
+		tags:    make(map[string]map[string]struct{}),
+		bases:   make(map[string]map[string]struct{}),
+	}
+}
+
+func (l *localResponseCache) get(key string) *cachedResponse {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.entries[key]
+	if !ok {
+		return nil
+	}
+	item := element.Value.(*localCacheItem)
+	if time.Now().After(item.expiresAt) {
+		l.remove(element)
+		return nil
+	}
+	l.order.MoveToFront(element)
+	return item.entry
+}
+
+func (l *localResponseCache) getVary(baseKey string) ([]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	vary, ok := l.vary[baseKey]
+	return vary, ok
+}
+
+func (l *localResponseCache) set(key, baseKey string, vary []string, entry *cachedResponse, expiresAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if element, ok := l.entries[key]; ok {
+		l.remove(element)
+	}
+
+	l.vary[baseKey] = vary
+	l.entries[key] = l.order.PushFront(&localCacheItem{key: key, baseKey: baseKey, entry: entry, expiresAt: expiresAt})
+	if l.bases[baseKey] == nil {
+		l.bases[baseKey] = make(map[string]struct{})
+	}
+	l.bases[baseKey][key] = struct{}{}
+	for _, tag := range entry.Tags {
+		if l.tags[tag] == nil {
+			l.tags[tag] = make(map[string]struct{})
+		}
+		l.tags[tag][key] = struct{}{}
+	}
+
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back())
+	}
+}
+
+func (l *localResponseCache) invalidateTag(tag string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key := range l.tags[tag] {
+		if element, ok := l.entries[key]; ok {
+			l.remove(element)
+		}
+	}
+	delete(l.tags, tag)
+}
+
+// remove drops an element from the cache, the caller must hold the lock.
+func (l *localResponseCache) remove(element *list.Element) {
+	item := element.Value.(*localCacheItem)
+	l.order.Remove(element)
+	delete(l.entries, item.key)
+	for _, tag := range item.entry.Tags {
+		delete(l.tags[tag], item.key)
+		if len(l.tags[tag]) == 0 {
+			delete(l.tags, tag)
+		}
+	}
+
+	// forget the vary list once no variant of the resource is left
+	delete(l.bases[item.baseKey], item.key)
+	if len(l.bases[item.baseKey]) == 0 {
+		delete(l.bases, item.baseKey)
+		delete(l.vary, item.baseKey)
+	}
+}
+
+// responseCacheMiddleware exposes the response cache as the named middleware "cache".
+//
+// Usage: "cache" or "cache:5m" or "cache:5m,products,catalog" where the first argument,
+// when it parses as a duration, is the TTL and every other argument is a tag.
+type responseCacheMiddleware struct {
+	cache *ResponseCache
+}
+
+func newResponseCacheMiddleware(rc *ResponseCache) *responseCacheMiddleware {
+	return &responseCacheMiddleware{cache: rc}
+}
+
+func (m *responseCacheMiddleware) Name() string {
+	return "cache"
+}
+
+func (m *responseCacheMiddleware) Handler(args ...any) any {
+	var ttl time.Duration
+	tags := make([]string, 0, len(args))
+	for i, arg := range args {
+		value := fmt.Sprint(arg)
+		if i == 0 {
+			if d, err := time.ParseDuration(value); err == nil {
+				ttl = d
+				continue
+			}
+		}
+		tags = append(tags, value)
+	}
+	return m.cache.Middleware(ttl, tags...)
+}
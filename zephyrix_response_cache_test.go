@@ -0,0 +1,240 @@
+package zephyrix
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestResponseCache() *ResponseCache {
+	return NewResponseCache(&Config{Server: ServerConfig{Cache: ResponseCacheConfig{Enabled: true, LocalTTL: time.Minute}}}, nil)
+}
+
+func cacheRequest(handler http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestResponseCacheStorage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rc := newTestResponseCache()
+
+	var calls atomic.Int64
+	respond := func(header http.Header) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			calls.Add(1)
+			for name, values := range header {
+				c.Writer.Header()[name] = values
+			}
+			c.String(http.StatusOK, "%d", calls.Load())
+		}
+	}
+	r := gin.New()
+	r.GET("/plain", rc.Middleware(time.Minute), respond(nil))
+	r.GET("/vary", rc.Middleware(time.Minute), respond(http.Header{"Vary": {"Accept-Language"}}))
+	r.GET("/no-store", rc.Middleware(time.Minute), respond(http.Header{"Cache-Control": {"no-store"}}))
+	r.GET("/private", rc.Middleware(time.Minute), respond(http.Header{"Cache-Control": {"private, max-age=60"}}))
+	r.GET("/cookie", rc.Middleware(time.Minute), respond(http.Header{"Set-Cookie": {"a=b"}}))
+	r.GET("/authenticated", func(c *gin.Context) { c.Set(identityContextKey, &Identity{UserID: 1}) }, rc.Middleware(time.Minute), respond(nil))
+	r.GET("/public", rc.Middleware(time.Minute), respond(http.Header{"Cache-Control": {"public, max-age=60"}}))
+
+	tests := []struct {
+		name         string
+		path         string
+		first, again http.Header
+		cached       bool
+	}{
+		{"plain", "/plain", nil, nil, true},
+		{"query order", "/plain?a=1&b=2", nil, nil, true},
+		{"same variant", "/vary", http.Header{"Accept-Language": {"en"}}, http.Header{"Accept-Language": {"en"}}, true},
+		{"other variant", "/vary", http.Header{"Accept-Language": {"fr"}}, http.Header{"Accept-Language": {"de"}}, false},
+		{"no-store response", "/no-store", nil, nil, false},
+		{"private response", "/private", nil, nil, false},
+		{"response setting a cookie", "/cookie", nil, nil, false},
+		{"no-store request", "/plain?fresh", http.Header{"Cache-Control": {"no-store"}}, http.Header{"Cache-Control": {"no-store"}}, false},
+		{"authenticated identity", "/authenticated", nil, nil, false},
+		{"authorization header", "/plain?private", http.Header{"Authorization": {"Bearer x"}}, http.Header{"Authorization": {"Bearer x"}}, false},
+		{"authenticated but public", "/public", http.Header{"Authorization": {"Bearer x"}}, http.Header{"Authorization": {"Bearer x"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := cacheRequest(r, tt.path, tt.first)
+			require.Equal(t, http.StatusOK, first.Code)
+			again := cacheRequest(r, tt.path, tt.again)
+			require.Equal(t, http.StatusOK, again.Code)
+			if tt.cached {
+				require.Equal(t, "HIT", again.Header().Get("X-Cache"))
+				require.Equal(t, first.Body.String(), again.Body.String())
+			} else {
+				require.NotEqual(t, "HIT", again.Header().Get("X-Cache"))
+				require.NotEqual(t, first.Body.String(), again.Body.String())
+			}
+		})
+	}
+
+	w := cacheRequest(r, "/plain?a=1&b=2", nil)
+	w = cacheRequest(r, "/plain?b=2&a=1", http.Header{"If-None-Match": {w.Header().Get("ETag")}})
+	require.Equal(t, http.StatusNotModified, w.Code)
+}
+
+func TestResponseCacheInvalidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rc := newTestResponseCache()
+
+	var calls atomic.Int64
+	handler := func(c *gin.Context) { c.String(http.StatusOK, "%d", calls.Add(1)) }
+	r := gin.New()
+	r.GET("/products", rc.Middleware(time.Minute, "catalog"), handler)
+	r.GET("/categories", rc.Middleware(time.Minute, "catalog"), handler)
+	r.GET("/users", rc.Middleware(time.Minute, "people"), handler)
+
+	for _, path := range []string{"/products", "/categories", "/users"} {
+		cacheRequest(r, path, nil)
+		require.Equal(t, "HIT", cacheRequest(r, path, nil).Header().Get("X-Cache"), path)
+	}
+
+	rc.InvalidateTags(context.Background(), "catalog")
+	require.Equal(t, "MISS", cacheRequest(r, "/products", nil).Header().Get("X-Cache"))
+	require.Equal(t, "MISS", cacheRequest(r, "/categories", nil).Header().Get("X-Cache"))
+	require.Equal(t, "HIT", cacheRequest(r, "/users", nil).Header().Get("X-Cache"), "other tags are kept")
+
+	rc.InvalidatePath(context.Background(), "/users")
+	require.Equal(t, "MISS", cacheRequest(r, "/users", nil).Header().Get("X-Cache"))
+	require.EqualValues(t, 2, rc.Stats().Invalidations)
+}
+
+func TestResponseCacheSingleFlight(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rc := newTestResponseCache()
+
+	var calls atomic.Int64
+	release := make(chan struct{})
+	r := gin.New()
+	r.GET("/slow", rc.Middleware(time.Minute), func(c *gin.Context) {
+		calls.Add(1)
+		<-release
+		c.String(http.StatusOK, "slow")
+	})
+
+	const clients = 8
+	var wg sync.WaitGroup
+	bodies := make([]string, clients)
+	wg.Add(clients)
+	for i := 0; i < clients; i++ {
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = cacheRequest(r, "/slow", nil).Body.String()
+		}(i)
+	}
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	// let the followers queue up behind the leader before it answers
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.EqualValues(t, 1, calls.Load(), "concurrent misses reach the origin once")
+	for _, body := range bodies {
+		require.Equal(t, "slow", body)
+	}
+}
+
+func TestResponseCacheCSPNonce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	z := &zephyrix{cache: newTestResponseCache(), config: &Config{Authentication: AuthConfig{SecurityHeaders: SecurityHeaders{
+		CSPEnabled: true,
+		CSPNonce:   true,
+	}}}}
+
+	r := gin.New()
+	z.configureSecurityHeaders(r)
+	r.GET("/nonce", z.cache.Middleware(time.Minute), z.convertToGinHandlerFunc(func(c Context) {
+		c.JSON(http.StatusOK, gin.H{"nonce": c.CSPNonce()})
+	}))
+	r.GET("/static", z.cache.Middleware(time.Minute), func(c *gin.Context) { c.String(http.StatusOK, "static") })
+
+	first := cacheRequest(r, "/nonce", nil)
+	again := cacheRequest(r, "/nonce", nil)
+	require.NotEqual(t, "HIT", again.Header().Get("X-Cache"), "pages reading the nonce are not cached")
+	require.NotEqual(t, first.Body.String(), again.Body.String())
+
+	first = cacheRequest(r, "/static", nil)
+	again = cacheRequest(r, "/static", nil)
+	require.Equal(t, "HIT", again.Header().Get("X-Cache"))
+	require.NotEqual(t, first.Header().Get("Content-Security-Policy"), again.Header().Get("Content-Security-Policy"),
+		"cached pages keep the policy of their own request")
+}
+
+func TestLocalResponseCacheIndexes(t *testing.T) {
+	l := newLocalResponseCache(2)
+	expiry := time.Now().Add(time.Minute)
+	l.set("a:v:1", "a", []string{"Accept"}, &cachedResponse{Tags: []string{"t"}}, expiry)
+	l.set("a:v:2", "a", []string{"Accept"}, &cachedResponse{Tags: []string{"t"}}, expiry)
+
+	l.set("b:v", "b", nil, &cachedResponse{}, expiry)
+	_, ok := l.getVary("a")
+	require.True(t, ok, "a variant of a is left after the eviction")
+	require.Len(t, l.bases["a"], 1)
+
+	l.invalidateTag("t")
+	_, ok = l.getVary("a")
+	require.False(t, ok, "the vary list goes with the last variant")
+	require.NotContains(t, l.bases, "a")
+	require.Empty(t, l.tags)
+	require.NotNil(t, l.get("b:v"))
+}
+
+func TestProxyCacheKeepsStrippedPrefixesApart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name+":"+r.URL.Path)
+		}))
+	}
+	a := upstream("a")
+	defer a.Close()
+	b := upstream("b")
+	defer b.Close()
+
+	cache := ProxyCacheConfig{Enabled: true, TTL: time.Minute}
+	z := &zephyrix{cache: newTestResponseCache(), config: &Config{Server: ServerConfig{Proxies: []ProxyConfig{
+		{Name: "a", Address: a.URL, Path: []string{"/a/*"}, StripPrefix: true, Cache: cache},
+		{Name: "b", Address: b.URL, Path: []string{"/b/*"}, StripPrefix: true, Cache: cache},
+	}}}}
+	handler := gin.New()
+	z.setupProxies(handler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(path string) (string, string) {
+		resp, err := server.Client().Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body), resp.Header.Get("X-Cache")
+	}
+	body, _ := get("/a/items")
+	require.Equal(t, "a:/items", body)
+	body, _ = get("/b/items")
+	require.Equal(t, "b:/items", body, "the entry of the other proxy is not served")
+	body, hit := get("/a/items")
+	require.Equal(t, "a:/items", body)
+	require.Equal(t, "HIT", hit)
+
+	z.cache.InvalidatePath(context.Background(), "/a/items")
+	_, hit = get("/a/items")
+	require.Equal(t, "MISS", hit, "the requested path is the one invalidated")
+}
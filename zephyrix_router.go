@@ -18,10 +18,13 @@ type zephyrixRouter struct {
 	gHandler        *gin.RouterGroup
 	afterExecution  []func()
 	childExecutions []func()
+	fallbacks       []gin.HandlerFunc // root static mounts, served from the NoRoute stage
 }
 
 func (z *zephyrix) assignHandler(handler *gin.Engine) *zephyrixRouter {
+	z.Router()
 	z.r.handler = handler
+	z.r.fallbacks = nil
 	return z.r
 }
 
@@ -134,3 +137,26 @@ func (z *zephyrixRouter) Match(httpMethods []HTTPVerb, relativePath string, hand
 		z.handleHTTPMethod(method, relativePath, handlerFunction, middlewareFunctions...)
 	}
 }
+
+// Static serves the files of root, a directory on disk or an fs.FS such as an embed.FS, under relativePath.
+// A mount at "/" never shadows routes nor proxies, it only serves the requests nothing else matched.
+func (z *zephyrixRouter) Static(relativePath string, root any, config ...StaticConfig) {
+	var staticConfig StaticConfig
+	if len(config) > 0 {
+		staticConfig = config[0]
+	}
+	staticConfig.Path = relativePath
+
+	z.assign(func() {
+		h, err := newStaticHandler(root, staticConfig)
+		if err != nil {
+			Logger.Error("Failed to mount static files at %s: %s", relativePath, err)
+			return
+		}
+		group := z.gHandler
+		if group == nil {
+			group = &z.handler.RouterGroup
+		}
+		z.z.mountStatic(group, relativePath, h)
+	})
+}
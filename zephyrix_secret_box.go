@@ -0,0 +1,99 @@
+package zephyrix
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// secretBox encrypts secrets stored in the database with AES-256-GCM.
+//
+// The first key encrypts, every key decrypts, so keys can be rotated by prepending a new one.
+// Ciphertexts look like `<key id>.<base64 nonce and sealed data>` and are bound to a context
+// string, e.g. the row they belong to, so they can not be swapped between rows.
+type secretBox struct {
+	ids   []string
+	aeads map[string]cipher.AEAD
+}
+
+// newSecretBox creates a box from base64 encoded 32 byte keys.
+func newSecretBox(keys []string) (*secretBox, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption key configured")
+	}
+
+	box := &secretBox{aeads: make(map[string]cipher.AEAD, len(keys))}
+	for i, encoded := range keys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			key, err = base64.RawURLEncoding.DecodeString(strings.TrimSpace(encoded))
+		}
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %d must be 32 base64 encoded bytes", i+1)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:4])
+		box.ids = append(box.ids, id)
+		box.aeads[id] = aead
+	}
+	return box, nil
+}
+
+// Seal encrypts the plaintext with the first key, an empty plaintext stays empty.
+func (b *secretBox) Seal(plaintext, context string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	id := b.ids[0]
+	aead := b.aeads[id]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(context))
+	return id + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a ciphertext of Seal sealed with the same context.
+func (b *secretBox) Open(ciphertext, context string) (string, error) {
+	if ciphertext == "" {
+		return "", nil
+	}
+	id, encoded, ok := strings.Cut(ciphertext, ".")
+	aead, known := b.aeads[id]
+	if !ok || !known {
+		return "", errors.New("secret was encrypted with an unknown key")
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted secret")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(context))
+	if err != nil {
+		return "", errors.New("failed to decrypt secret")
+	}
+	return string(plaintext), nil
+}
+
+// NeedsReseal reports whether the ciphertext was not sealed with the current key.
+func (b *secretBox) NeedsReseal(ciphertext string) bool {
+	return ciphertext != "" && !strings.HasPrefix(ciphertext, b.ids[0]+".")
+}
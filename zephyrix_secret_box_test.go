@@ -0,0 +1,109 @@
+package zephyrix
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+func newTestKey(t *testing.T) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestSecretBox(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	box, err := newSecretBox([]string{oldKey})
+	require.NoError(t, err)
+
+	sealed, err := box.Seal("client-secret", "oauth2_provider:corp")
+	require.NoError(t, err)
+	require.NotContains(t, sealed, "client-secret")
+
+	opened, err := box.Open(sealed, "oauth2_provider:corp")
+	require.NoError(t, err)
+	require.Equal(t, "client-secret", opened)
+
+	_, err = box.Open(sealed, "oauth2_provider:other")
+	require.Error(t, err, "ciphertexts are bound to their context")
+
+	empty, err := box.Seal("", "oauth2_provider:corp")
+	require.NoError(t, err)
+	require.Empty(t, empty)
+
+	// rotation: the new key encrypts, the old one still decrypts
+	rotated, err := newSecretBox([]string{newKey, oldKey})
+	require.NoError(t, err)
+	require.True(t, rotated.NeedsReseal(sealed))
+	opened, err = rotated.Open(sealed, "oauth2_provider:corp")
+	require.NoError(t, err)
+	require.Equal(t, "client-secret", opened)
+
+	resealed, err := rotated.Seal(opened, "oauth2_provider:corp")
+	require.NoError(t, err)
+	require.False(t, rotated.NeedsReseal(resealed))
+	_, err = box.Open(resealed, "oauth2_provider:corp")
+	require.Error(t, err, "the removed key can not decrypt the new secrets")
+
+	for _, keys := range [][]string{nil, {"c2hvcnQ="}, {"not base64!"}} {
+		_, err := newSecretBox(keys)
+		require.Error(t, err)
+	}
+}
+
+func TestOAuth2StoredSecrets(t *testing.T) {
+	om, err := NewOAuth2Manager(OAuth2Config{EncryptionKeys: []string{newTestKey(t)}}, nil, nil)
+	require.NoError(t, err)
+	_, err = NewOAuth2Manager(OAuth2Config{ProvidersSource: "database"}, nil, nil)
+	require.Error(t, err, "database providers require encryption keys")
+
+	secret, err := om.box.Seal("client-secret", "oauth2_provider:corp")
+	require.NoError(t, err)
+	entity := &models.OAuth2ProviderEntity{
+		Name:         "corp",
+		ClientID:     "zephyrix",
+		ClientSecret: secret,
+		Issuer:       "https://id.example.com",
+		Scopes:       `["profile","email"]`,
+		Claims:       `{"roles":"groups"}`,
+	}
+
+	provider, err := om.providerFromEntity(entity, false)
+	require.NoError(t, err)
+	require.Empty(t, provider.ClientSecret)
+	require.Equal(t, []string{"profile", "email"}, provider.Scopes)
+	require.Equal(t, "groups", provider.Claims.Roles)
+
+	provider, err = om.providerFromEntity(entity, true)
+	require.NoError(t, err)
+	require.Equal(t, "client-secret", provider.ClientSecret)
+
+	entity.Name = "other"
+	_, err = om.providerFromEntity(entity, true)
+	require.Error(t, err, "a secret can not be moved to another provider")
+
+	// tokens of linked accounts
+	account := &models.OAuth2AccountEntity{Provider: "corp", Subject: "user-42", TokenType: "Bearer"}
+	account.AccessToken, err = om.box.Seal("access", oauth2TokenContext(account))
+	require.NoError(t, err)
+	account.RefreshToken, err = om.box.Seal("refresh", oauth2TokenContext(account))
+	require.NoError(t, err)
+	expiry := time.Now().Add(-time.Minute)
+	account.TokenExpiry = &expiry
+
+	token, err := om.openToken(account)
+	require.NoError(t, err)
+	require.Equal(t, "access", token.AccessToken)
+	require.Equal(t, "refresh", token.RefreshToken)
+	require.False(t, token.Valid(), "expired tokens are refreshed")
+
+	account.Subject = "user-43"
+	_, err = om.openToken(account)
+	require.Error(t, err)
+}
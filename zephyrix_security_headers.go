@@ -0,0 +1,378 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// cspNonceContextKey is the gin context key holding the CSP nonce of the request.
+	cspNonceContextKey = "zephyrix.csp_nonce"
+	// cspNonceUsedContextKey marks the requests whose handler read the nonce, their responses are never cached.
+	cspNonceUsedContextKey = "zephyrix.csp_nonce_used"
+	// cspNoncePlaceholder is replaced by the nonce of each request in the prebuilt policy.
+	cspNoncePlaceholder = "{nonce}"
+
+	defaultCSPReportPath = "/_zephyrix/csp-report"
+	defaultCSPReportPool = "csp_report"
+	maxCSPReportSize     = 64 << 10 // 64 KiB
+	maxCSPViolations     = 20       // violations kept per report, the rest is dropped
+)
+
+// securityHeadersContextKey carries the names of the headers set by the gateway, so the reverse proxy
+// can drop their upstream counterparts instead of sending duplicated values.
+type securityHeadersContextKey struct{}
+
+var defaultCSPDirectives = map[string][]string{
+	"default-src":     {"'self'"},
+	"base-uri":        {"'self'"},
+	"object-src":      {"'none'"},
+	"frame-ancestors": {"'self'"},
+	"form-action":     {"'self'"},
+}
+
+// securityHeaders emits the headers configured under authentication.security_headers.
+type securityHeaders struct {
+	config  SecurityHeaders
+	static  http.Header // headers that are the same for every response
+	csp     string      // policy, with the nonce placeholder when nonces are enabled
+	cspName string
+	names   []string
+	proxies []*net.IPNet // trusted proxies, the only peers whose X-Forwarded-Proto is believed
+}
+
+// newSecurityHeaders prebuilds the headers of the configuration.
+func newSecurityHeaders(config SecurityHeaders, trustedProxies []string) *securityHeaders {
+	if config.ReferrerPolicy == "" {
+		config.ReferrerPolicy = "strict-origin-when-cross-origin"
+	}
+	if config.HSTSMaxAge <= 0 {
+		config.HSTSMaxAge = 365 * 24 * time.Hour
+	}
+	if config.CSPReportOnly && config.CSPReportPath == "" {
+		config.CSPReportPath = defaultCSPReportPath
+	}
+	if config.CSPReportPool == "" {
+		config.CSPReportPool = defaultCSPReportPool
+	}
+
+	sh := &securityHeaders{config: config, static: make(http.Header), proxies: parseTrustedProxies(trustedProxies)}
+	sh.static.Set("X-Content-Type-Options", "nosniff")
+	sh.static.Set("Referrer-Policy", config.ReferrerPolicy)
+	if config.XFrameOptions != "" {
+		sh.static.Set("X-Frame-Options", strings.ToUpper(config.XFrameOptions))
+	}
+	if config.PermissionsPolicy != "" {
+		sh.static.Set("Permissions-Policy", config.PermissionsPolicy)
+	}
+	if config.CrossOriginOpenerPolicy != "" {
+		sh.static.Set("Cross-Origin-Opener-Policy", config.CrossOriginOpenerPolicy)
+	}
+	if config.CrossOriginEmbedderPolicy != "" {
+		sh.static.Set("Cross-Origin-Embedder-Policy", config.CrossOriginEmbedderPolicy)
+	}
+
+	for name := range sh.static {
+		sh.names = append(sh.names, name)
+	}
+
+	if config.CSPEnabled {
+		sh.csp = buildCSP(config)
+		sh.cspName = "Content-Security-Policy"
+		if config.CSPReportOnly {
+			sh.cspName = "Content-Security-Policy-Report-Only"
+		}
+		sh.names = append(sh.names, sh.cspName)
+	}
+	if config.HSTSEnabled {
+		sh.names = append(sh.names, "Strict-Transport-Security")
+	}
+
+	return sh
+}
+
+// buildCSP renders the policy of the configuration, directives are sorted to keep the header stable.
+func buildCSP(config SecurityHeaders) string {
+	directives := make(map[string][]string)
+	source := config.CSPDirectives
+	if len(source) == 0 {
+		source = defaultCSPDirectives
+	}
+	for name, values := range source {
+		directives[strings.ToLower(name)] = append([]string(nil), values...)
+	}
+
+	if config.CSPNonce {
+		for _, name := range []string{"script-src", "style-src"} {
+			if _, ok := directives[name]; !ok {
+				// without its own directive the nonce would replace the default-src fallback
+				directives[name] = append([]string(nil), directives["default-src"]...)
+			}
+			directives[name] = append(directives[name], "'nonce-"+cspNoncePlaceholder+"'")
+		}
+	}
+	if config.CSPReportPath != "" {
+		directives["report-uri"] = []string{config.CSPReportPath}
+	}
+
+	names := make([]string, 0, len(directives))
+	for name := range directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, strings.TrimSpace(name+" "+strings.Join(directives[name], " ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// handler returns the gin middleware setting the security headers of every response.
+func (sh *securityHeaders) handler() gin.HandlerFunc {
+	hsts := "max-age=" + strconv.Itoa(int(sh.config.HSTSMaxAge.Seconds()))
+	if sh.config.HSTSIncludeSubdomains {
+		hsts += "; includeSubDomains"
+	}
+	if sh.config.HSTSPreload {
+		hsts += "; preload"
+	}
+
+	return func(c *gin.Context) {
+		header := c.Writer.Header()
+		for name, values := range sh.static {
+			header[name] = append([]string(nil), values...)
+		}
+
+		// browsers ignore HSTS received over plain HTTP
+		if sh.config.HSTSEnabled && sh.isHTTPSRequest(c.Request) {
+			header.Set("Strict-Transport-Security", hsts)
+		}
+
+		if sh.csp != "" {
+			policy := sh.csp
+			if sh.config.CSPNonce {
+				nonce, err := newCSPNonce()
+				if err != nil {
+					Logger.Error("Failed to generate CSP nonce: %s", err)
+					c.AbortWithStatus(http.StatusInternalServerError)
+					return
+				}
+				c.Set(cspNonceContextKey, nonce)
+				policy = strings.ReplaceAll(policy, cspNoncePlaceholder, nonce)
+			}
+			header.Set(sh.cspName, policy)
+		}
+
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), securityHeadersContextKey{}, sh.names))
+		c.Next()
+	}
+}
+
+// newCSPNonce returns a random base64 nonce of 128 bits.
+func newCSPNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// isHTTPSRequest reports whether the client reached the server over TLS, directly or through a trusted proxy.
+// X-Forwarded-Proto is ignored unless the peer is one of server.trusted_proxies, anyone else could set it.
+func (sh *securityHeaders) isHTTPSRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") && sh.trustedPeer(r)
+}
+
+// trustedPeer reports whether the request comes straight from one of the trusted proxies.
+func (sh *securityHeaders) trustedPeer(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range sh.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies reads the addresses and CIDRs of server.trusted_proxies like gin does,
+// invalid entries are already reported by configureTrustedProxies and skipped here.
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			proxy += "/" + strconv.Itoa(bits)
+		}
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// stripGatewaySecurityHeaders removes from an upstream response the security headers already set by the gateway.
+func stripGatewaySecurityHeaders(res *http.Response) {
+	names, _ := res.Request.Context().Value(securityHeadersContextKey{}).([]string)
+	for _, name := range names {
+		res.Header.Del(name)
+	}
+}
+
+// cspViolation is the part of a CSP violation report that is kept in the audit log.
+type cspViolation struct {
+	DocumentURI        string `json:"document_uri"`
+	EffectiveDirective string `json:"effective_directive"`
+	BlockedURI         string `json:"blocked_uri"`
+	SourceFile         string `json:"source_file,omitempty"`
+	LineNumber         int    `json:"line_number,omitempty"`
+	Disposition        string `json:"disposition,omitempty"`
+}
+
+// parseCSPReports reads both the legacy `application/csp-report` format
+// and the Reporting API `application/reports+json` format.
+func parseCSPReports(body []byte) ([]cspViolation, error) {
+	var legacy struct {
+		Report *struct {
+			DocumentURI        string `json:"document-uri"`
+			ViolatedDirective  string `json:"violated-directive"`
+			EffectiveDirective string `json:"effective-directive"`
+			BlockedURI         string `json:"blocked-uri"`
+			SourceFile         string `json:"source-file"`
+			LineNumber         int    `json:"line-number"`
+			Disposition        string `json:"disposition"`
+		} `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &legacy); err == nil && legacy.Report != nil {
+		r := legacy.Report
+		directive := r.EffectiveDirective
+		if directive == "" {
+			directive = r.ViolatedDirective
+		}
+		return []cspViolation{{
+			DocumentURI:        r.DocumentURI,
+			EffectiveDirective: directive,
+			BlockedURI:         r.BlockedURI,
+			SourceFile:         r.SourceFile,
+			LineNumber:         r.LineNumber,
+			Disposition:        r.Disposition,
+		}}, nil
+	}
+
+	var reports []struct {
+		Type string `json:"type"`
+		Body struct {
+			DocumentURL        string `json:"documentURL"`
+			EffectiveDirective string `json:"effectiveDirective"`
+			BlockedURL         string `json:"blockedURL"`
+			SourceFile         string `json:"sourceFile"`
+			LineNumber         int    `json:"lineNumber"`
+			Disposition        string `json:"disposition"`
+		} `json:"body"`
+	}
+	if err := json.Unmarshal(body, &reports); err != nil {
+		return nil, err
+	}
+
+	violations := make([]cspViolation, 0, len(reports))
+	for _, r := range reports {
+		if r.Type != "csp-violation" {
+			continue
+		}
+		violations = append(violations, cspViolation{
+			DocumentURI:        r.Body.DocumentURL,
+			EffectiveDirective: r.Body.EffectiveDirective,
+			BlockedURI:         r.Body.BlockedURL,
+			SourceFile:         r.Body.SourceFile,
+			LineNumber:         r.Body.LineNumber,
+			Disposition:        r.Body.Disposition,
+		})
+	}
+	return violations, nil
+}
+
+// cspReportHandler collects the violation reports sent by browsers and writes them to the audit log.
+// The endpoint is public, so the reports are rate limited per client IP and their size is capped.
+func (z *zephyrix) cspReportHandler(pool string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if z.rl != nil && !z.rl.Limiter(ctx, pool).Allow(ctx, "csp_report", c.ClientIP()) {
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxCSPReportSize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+				return
+			}
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		violations, err := parseCSPReports(body)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if len(violations) > maxCSPViolations {
+			violations = violations[:maxCSPViolations]
+		}
+		z.logCSPViolations(c, violations)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// logCSPViolations writes the violations to the audit log, or to the logger without one.
+func (z *zephyrix) logCSPViolations(c *gin.Context, violations []cspViolation) {
+	for _, violation := range violations {
+		details, _ := json.Marshal(violation)
+		if z.audit == nil {
+			Logger.Warn("CSP violation: %s", details)
+			continue
+		}
+		if err := z.audit.Log(c.Request.Context(), "csp_violation", "", string(details)); err != nil {
+			Logger.Error("Failed to write CSP violation to the audit log: %s", err)
+		}
+	}
+}
+
+// configureSecurityHeaders installs the security headers middleware and the CSP report endpoint.
+func (z *zephyrix) configureSecurityHeaders(handler *gin.Engine) {
+	sh := newSecurityHeaders(z.config.Authentication.SecurityHeaders, z.config.Server.TrustedProxies)
+	handler.Use(sh.handler())
+	if sh.config.CSPEnabled && sh.config.CSPReportPath != "" {
+		handler.POST(sh.config.CSPReportPath, z.cspReportHandler(sh.config.CSPReportPool))
+	}
+}
@@ -0,0 +1,108 @@
+package zephyrix
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	z := &zephyrix{config: &Config{Server: ServerConfig{TrustedProxies: []string{"192.0.2.1"}}, Authentication: AuthConfig{SecurityHeaders: SecurityHeaders{
+		HSTSEnabled:           true,
+		HSTSIncludeSubdomains: true,
+		CSPEnabled:            true,
+		CSPNonce:              true,
+		CSPReportOnly:         true,
+		XFrameOptions:         "deny",
+	}}}}
+
+	handler := gin.New()
+	z.configureSecurityHeaders(handler)
+	handler.GET("/", z.convertToGinHandlerFunc(func(c Context) {
+		c.JSON(http.StatusOK, gin.H{"nonce": c.CSPNonce()})
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+	require.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	require.Empty(t, w.Header().Get("Strict-Transport-Security"), "HSTS is only sent over HTTPS")
+	require.Empty(t, w.Header().Get("Content-Security-Policy"))
+
+	policy := w.Header().Get("Content-Security-Policy-Report-Only")
+	require.Contains(t, policy, "report-uri "+defaultCSPReportPath)
+	require.Contains(t, policy, "script-src 'self' 'nonce-")
+	nonce := strings.TrimSuffix(strings.SplitN(w.Body.String(), `"nonce":"`, 2)[1], `"}`)
+	require.NotEmpty(t, nonce)
+	require.Contains(t, policy, "'nonce-"+nonce+"'")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, "max-age=31536000; includeSubDomains", w.Header().Get("Strict-Transport-Security"))
+	require.NotContains(t, w.Header().Get("Content-Security-Policy-Report-Only"), nonce, "nonces are per request")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Empty(t, w.Header().Get("Strict-Transport-Security"), "X-Forwarded-Proto of an untrusted peer is ignored")
+
+	req = httptest.NewRequest(http.MethodPost, defaultCSPReportPath, strings.NewReader(
+		`{"csp-report":{"document-uri":"https://example.com/","violated-directive":"script-src","blocked-uri":"inline"}}`))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestParseCSPReports(t *testing.T) {
+	violations, err := parseCSPReports([]byte(`[
+		{"type":"csp-violation","body":{"documentURL":"https://example.com/","effectiveDirective":"img-src","blockedURL":"https://cdn.test/a.png"}},
+		{"type":"deprecation","body":{}}
+	]`))
+	require.NoError(t, err)
+	require.Equal(t, []cspViolation{{
+		DocumentURI:        "https://example.com/",
+		EffectiveDirective: "img-src",
+		BlockedURI:         "https://cdn.test/a.png",
+	}}, violations)
+
+	_, err = parseCSPReports([]byte("not json"))
+	require.Error(t, err)
+}
+
+func TestCSPReportLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	z := &zephyrix{config: &Config{Authentication: AuthConfig{SecurityHeaders: SecurityHeaders{CSPEnabled: true, CSPReportOnly: true}}}}
+	handler := gin.New()
+	z.configureSecurityHeaders(handler)
+
+	report := func(body string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, defaultCSPReportPath, strings.NewReader(body)))
+		return w.Code
+	}
+	require.Equal(t, http.StatusNoContent, report(`[{"type":"csp-violation","body":{"effectiveDirective":"img-src"}}]`))
+	require.Equal(t, http.StatusBadRequest, report(`not json`))
+	require.Equal(t, http.StatusRequestEntityTooLarge, report(`[`+strings.Repeat(" ", maxCSPReportSize)+`]`))
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	sh := &securityHeaders{proxies: parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "::1", "nope"})}
+	require.Len(t, sh.proxies, 3)
+
+	for addr, trusted := range map[string]bool{"10.1.2.3:80": true, "192.0.2.1:80": true, "192.0.2.2:80": false, "[::1]:80": true, "garbage": false} {
+		r := &http.Request{RemoteAddr: addr}
+		require.Equal(t, trusted, sh.trustedPeer(r), addr)
+	}
+}
@@ -24,7 +24,11 @@ type ServerConfig struct {
 	SkipLogPaths       []string   `mapstructure:"skip_log_path"`
 	MaxMultipartMemory int64      `mapstructure:"max_multipart_memory"` // todo: make this string and add unit suffixes (parse them)
 
-	Proxies []ProxyConfig `mapstructure:"proxies"`
+	Proxies []ProxyConfig       `mapstructure:"proxies"`
+	Cache   ResponseCacheConfig `mapstructure:"cache"`
+	Static  []StaticConfig      `mapstructure:"static"`
+
+	Compression CompressionConfig `mapstructure:"compression"`
 
 	Routes map[string]RouteConfig `mapstructure:"routes"`
 }
@@ -17,6 +17,22 @@ type SessionConfig struct {
 	Expiration      time.Duration `mapstructure:"expiration"`
 	RefreshWindow   time.Duration `mapstructure:"refresh_window"`
 	CleanupInterval time.Duration `mapstructure:"cleanup_interval"`
+	CookieName      string        `mapstructure:"cookie_name"`
+	CookieDomain    string        `mapstructure:"cookie_domain"`
+	CookiePath      string        `mapstructure:"cookie_path"`      // defaults to /
+	CookieSameSite  string        `mapstructure:"cookie_same_site"` // lax, strict or none, defaults to lax
+	CookieSecure    *bool         `mapstructure:"cookie_secure"`    // defaults to true, none always sets it
+	CookieHTTPOnly  *bool         `mapstructure:"cookie_http_only"` // defaults to true
+	CSRF            CSRFConfig    `mapstructure:"csrf"`
+}
+
+// CSRFConfig protects the unsafe requests authenticated with the session cookie against cross-site request forgery.
+type CSRFConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	Mode       string `mapstructure:"mode"`        // "synchronizer" keeps the token in the session, "double_submit" in a cookie
+	CookieName string `mapstructure:"cookie_name"` // cookie of the double_submit mode, defaults to zephyrix_csrf
+	HeaderName string `mapstructure:"header_name"` // defaults to X-CSRF-Token
+	FormField  string `mapstructure:"form_field"`  // alternative to the header for HTML forms, defaults to csrf_token
 }
 
 type Session struct {
@@ -43,15 +59,16 @@ type SessionManager struct {
 func NewSessionManager(lc fx.Lifecycle, conf *Config, orm beeorm.Engine) (*SessionManager, error) {
 	var storage SessionStorage
 	config := conf.Authentication.Session
+	config.CSRF = config.CSRF.normalize()
 
 	switch config.StorageType {
-	case "redis":
-	default:
+	case "redis", "":
 		storage = NewRedisSessionStorage(orm.NewORM(context.Background()), orm.Redis(config.Pool), config.Prefix)
 	case "mysql":
 		storage = NewMySQLSessionStorage(orm, config.Prefix)
 	case "memory":
 		storage = NewMemorySessionStorage()
+	default:
 		return nil, fmt.Errorf("unsupported storage type: %s", config.StorageType)
 	}
 
@@ -71,6 +88,14 @@ func NewSessionManager(lc fx.Lifecycle, conf *Config, orm beeorm.Engine) (*Sessi
 	return sm, nil
 }
 
+// CookieName returns the name of the cookie that carries the session ID.
+func (sm *SessionManager) CookieName() string {
+	if sm.config.CookieName == "" {
+		return "zephyrix_session"
+	}
+	return sm.config.CookieName
+}
+
 func (sm *SessionManager) CreateSession(ctx context.Context, userID uint64) (*Session, error) {
 	sessionID := uuid.New().String()
 	now := time.Now()
@@ -131,12 +156,45 @@ func (sm *SessionManager) UpdateSessionData(ctx context.Context, sessionID strin
 	return sm.storage.Update(ctx, session)
 }
 
+// RotateSession moves the session to a new ID and destroys the old one, e.g. on a privilege change
+// to prevent session fixation. The user and data are kept.
+func (sm *SessionManager) RotateSession(ctx context.Context, session *Session) (*Session, error) {
+	now := time.Now()
+	rotated := &Session{
+		ID:        uuid.New().String(),
+		UserID:    session.UserID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sm.config.Expiration),
+		Data:      make(map[string]interface{}, len(session.Data)),
+	}
+	for k, v := range session.Data {
+		rotated.Data[k] = v
+	}
+
+	if err := sm.storage.Create(ctx, rotated); err != nil {
+		return nil, fmt.Errorf("failed to rotate session: %w", err)
+	}
+	if err := sm.storage.Delete(ctx, session.ID); err != nil {
+		Logger.Error("failed to destroy rotated session %s: %v", session.ID, err)
+	}
+	return rotated, nil
+}
+
+// SaveSession stores the data of the session.
+func (sm *SessionManager) SaveSession(ctx context.Context, session *Session) error {
+	return sm.storage.Update(ctx, session)
+}
+
 func (sm *SessionManager) DestroySession(ctx context.Context, sessionID string) error {
 	return sm.storage.Delete(ctx, sessionID)
 }
 
 func (sm *SessionManager) StartCleanupTask(ctx context.Context) {
-	ticker := time.NewTicker(sm.config.CleanupInterval)
+	interval := sm.config.CleanupInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
 	go func() {
 		for {
 			select {
@@ -0,0 +1,323 @@
+package zephyrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionContextKey is the gin context key holding the *requestSession of a request.
+const sessionContextKey = "zephyrix.session"
+
+// requestSession is the session attached to a request, its data is saved after the handlers when it changed.
+type requestSession struct {
+	session  *Session
+	snapshot []byte
+	csrf     string
+}
+
+// sessionMiddleware exposes the cookie sessions as the named middleware "session".
+//
+// Usage: "session" attaches the session of the cookie to the request, starting an anonymous one
+// when there is none, so handlers can keep data in Context.Session() before the user logs in.
+type sessionMiddleware struct {
+	ap *AuthProvider
+}
+
+func newSessionMiddleware(ap *AuthProvider) *sessionMiddleware {
+	return &sessionMiddleware{ap: ap}
+}
+
+func (m *sessionMiddleware) Name() string {
+	return "session"
+}
+
+func (m *sessionMiddleware) Handler(args ...any) any {
+	return m.ap.SessionMiddleware()
+}
+
+// SessionMiddleware returns a gin middleware attaching the session of the cookie to the request, a new
+// anonymous session is started when there is none. Unsafe requests must carry the CSRF token of the session.
+func (ap *AuthProvider) SessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sm := ap.components.sessionManager
+		session := ap.sessionFromCookie(c.Request)
+		// checked first, an unsafe request can not carry the token of a session it does not have yet
+		if err := sm.VerifyCSRF(c.Request, session); err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid_csrf_token"})
+			return
+		}
+		if session == nil {
+			var err error
+			if session, err = sm.CreateSession(c.Request.Context(), 0); err != nil {
+				Logger.Error("Failed to start a session: %s", err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := ap.attachSession(c, session); err != nil {
+			Logger.Error("Failed to attach session %s: %s", session.ID, err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Next()
+		ap.saveSession(c)
+	}
+}
+
+// StartSession signs the user in with a new session cookie. The session of the request is replaced
+// by one with a new ID, so an identifier planted before the login is worthless; the data of an
+// anonymous session is carried over.
+func (ap *AuthProvider) StartSession(c *gin.Context, user User) (*Session, error) {
+	sm := ap.components.sessionManager
+	ctx := c.Request.Context()
+
+	data := make(map[string]interface{})
+	if previous := ap.sessionFromCookie(c.Request); previous != nil {
+		if previous.UserID == 0 || previous.UserID == user.ID() {
+			for k, v := range previous.Data {
+				data[k] = v
+			}
+		}
+		if err := sm.DestroySession(ctx, previous.ID); err != nil {
+			Logger.Error("Failed to destroy session %s on login: %s", previous.ID, err)
+		}
+	}
+
+	session, err := sm.CreateSession(ctx, user.ID())
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range data {
+		session.Data[k] = v
+	}
+	delete(session.Data, csrfSessionKey)
+	session.Data["roles"] = user.Roles()
+	if err := ap.renewSession(c, session); err != nil {
+		return nil, err
+	}
+
+	ap.logSession(c, "session_started", user.ID())
+	return session, nil
+}
+
+// RotateSession moves the session of the request to a new ID with a new CSRF token, e.g. after the
+// privileges of the user changed. The "auth" middleware rotates the session when the roles of the
+// user differ from those it was started with.
+func (ap *AuthProvider) RotateSession(c *gin.Context) (*Session, error) {
+	rs, ok := c.Value(sessionContextKey).(*requestSession)
+	if !ok || rs == nil {
+		return nil, errors.New("no session attached to the request")
+	}
+	session, err := ap.components.sessionManager.RotateSession(c.Request.Context(), rs.session)
+	if err != nil {
+		return nil, err
+	}
+	delete(session.Data, csrfSessionKey)
+	if err := ap.renewSession(c, session); err != nil {
+		return nil, err
+	}
+
+	ap.logSession(c, "session_rotated", session.UserID)
+	return session, nil
+}
+
+// EndSession destroys the session of the request and clears its cookies, e.g. on logout.
+func (ap *AuthProvider) EndSession(c *gin.Context) error {
+	sm := ap.components.sessionManager
+	session := ap.sessionFromCookie(c.Request)
+	if rs, ok := c.Value(sessionContextKey).(*requestSession); ok && rs != nil {
+		session = rs.session
+	}
+	c.Set(sessionContextKey, (*requestSession)(nil))
+
+	http.SetCookie(c.Writer, sm.expiredCookie(sm.CookieName(), true))
+	if sm.config.CSRF.Mode == CSRFModeDoubleSubmit {
+		http.SetCookie(c.Writer, sm.expiredCookie(sm.config.CSRF.CookieName, false))
+	}
+	if session == nil {
+		return nil
+	}
+	if err := sm.DestroySession(c.Request.Context(), session.ID); err != nil {
+		return err
+	}
+	ap.logSession(c, "session_ended", session.UserID)
+	return nil
+}
+
+// renewSession stores a new or rotated session and attaches it to the request with a new CSRF token.
+func (ap *AuthProvider) renewSession(c *gin.Context, session *Session) error {
+	if err := ap.components.sessionManager.SaveSession(c.Request.Context(), session); err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	if err := ap.attachSession(c, session); err != nil {
+		return err
+	}
+	ap.saveSession(c)
+	return nil
+}
+
+// attachSession makes the session available through Context.Session() and sends its cookie,
+// a CSRF token is issued when the session has none.
+func (ap *AuthProvider) attachSession(c *gin.Context, session *Session) error {
+	if rs, ok := c.Value(sessionContextKey).(*requestSession); ok && rs != nil && rs.session.ID == session.ID {
+		return nil
+	}
+
+	sm := ap.components.sessionManager
+	rs := &requestSession{session: session}
+	rs.snapshot, _ = json.Marshal(session.Data)
+	if sm.CSRFEnabled() {
+		if rs.csrf = sm.csrfToken(c.Request, session); rs.csrf == "" {
+			token, err := sm.issueCSRFToken(c.Writer, session)
+			if err != nil {
+				return err
+			}
+			rs.csrf = token
+			c.Header(sm.config.CSRF.HeaderName, token)
+		}
+	}
+
+	// sent on every response, the expiry follows the sliding expiration of the session
+	http.SetCookie(c.Writer, sm.cookie(sm.CookieName(), session.ID, session.ExpiresAt, sm.config.CookieHTTPOnly == nil || *sm.config.CookieHTTPOnly))
+	c.Set(sessionContextKey, rs)
+	return nil
+}
+
+// saveSession stores the data of the session of the request when the handlers changed it.
+func (ap *AuthProvider) saveSession(c *gin.Context) {
+	rs, ok := c.Value(sessionContextKey).(*requestSession)
+	if !ok || rs == nil {
+		return
+	}
+	data, err := json.Marshal(rs.session.Data)
+	if err != nil {
+		Logger.Error("Failed to encode the data of session %s: %s", rs.session.ID, err)
+		return
+	}
+	if bytes.Equal(data, rs.snapshot) {
+		return
+	}
+	if err := ap.components.sessionManager.SaveSession(c.Request.Context(), rs.session); err != nil {
+		Logger.Error("Failed to save session %s: %s", rs.session.ID, err)
+		return
+	}
+	rs.snapshot = data
+}
+
+// rotateOnPrivilegeChange rotates the session of the identity when the roles of the user changed since it was started.
+func (ap *AuthProvider) rotateOnPrivilegeChange(c *gin.Context, identity *Identity, user User) {
+	roles := user.Roles()
+	if slices.Equal(sessionRoles(identity.session), roles) {
+		return
+	}
+	identity.session.Data["roles"] = roles
+	session, err := ap.RotateSession(c)
+	if err != nil {
+		Logger.Error("Failed to rotate session %s after a privilege change: %s", identity.SessionID, err)
+		return
+	}
+	identity.session, identity.SessionID = session, session.ID
+}
+
+// sessionFromCookie returns the live session of the cookie of the request, nil when there is none.
+func (ap *AuthProvider) sessionFromCookie(r *http.Request) *Session {
+	sm := ap.components.sessionManager
+	cookie, err := r.Cookie(sm.CookieName())
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	session, err := sm.GetSession(r.Context(), cookie.Value)
+	if err != nil {
+		return nil
+	}
+	if session.UserID != 0 && ap.sessionRevoked(r.Context(), session.UserID, session.CreatedAt) {
+		if err := sm.DestroySession(r.Context(), session.ID); err != nil {
+			Logger.Error("Failed to destroy revoked session %s: %s", session.ID, err)
+		}
+		return nil
+	}
+	return session
+}
+
+func (ap *AuthProvider) logSession(c *gin.Context, action string, userID uint64) {
+	if ap.components.auditLogger == nil {
+		return
+	}
+	if err := ap.components.auditLogger.Log(c.Request.Context(), action, strconv.FormatUint(userID, 10), fmt.Sprintf("ip=%s", c.ClientIP())); err != nil {
+		Logger.Error("Failed to write %s to the audit log: %s", action, err)
+	}
+}
+
+// sessionRoles returns the roles the session was started with.
+func sessionRoles(session *Session) []string {
+	switch raw := session.Data["roles"].(type) {
+	case []string:
+		return raw
+	case []interface{}:
+		roles := make([]string, 0, len(raw))
+		for _, role := range raw {
+			if s, ok := role.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+		return roles
+	}
+	return nil
+}
+
+// cookie builds a cookie with the attributes of the session configuration.
+func (sm *SessionManager) cookie(name, value string, expires time.Time, httpOnly bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     sm.config.CookiePath,
+		Domain:   sm.config.CookieDomain,
+		Expires:  expires,
+		Secure:   sm.config.CookieSecure == nil || *sm.config.CookieSecure,
+		HttpOnly: httpOnly,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	switch strings.ToLower(sm.config.CookieSameSite) {
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers drop SameSite=None cookies without Secure
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	}
+	return cookie
+}
+
+// expiredCookie builds a cookie removing the one with the name from the browser.
+func (sm *SessionManager) expiredCookie(name string, httpOnly bool) *http.Cookie {
+	cookie := sm.cookie(name, "", time.Unix(0, 0), httpOnly)
+	cookie.MaxAge = -1
+	return cookie
+}
+
+func (z *zephyrixContext) Session() *Session {
+	if rs, ok := z.Context.Value(sessionContextKey).(*requestSession); ok && rs != nil {
+		return rs.session
+	}
+	return nil
+}
+
+func (z *zephyrixContext) CSRFToken() string {
+	if rs, ok := z.Context.Value(sessionContextKey).(*requestSession); ok && rs != nil {
+		return rs.csrf
+	}
+	return ""
+}
@@ -0,0 +1,201 @@
+package zephyrix
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"go.mamad.dev/zephyrix/models"
+)
+
+func newTestSessionProvider(t *testing.T, csrf CSRFConfig, users ...*models.UserEntity) *AuthProvider {
+	ap := newTestAuthProvider(t, users...)
+	ap.components.sessionManager = &SessionManager{
+		config:  SessionConfig{Expiration: time.Hour, CSRF: csrf.normalize()},
+		storage: NewMemorySessionStorage(),
+	}
+	return ap
+}
+
+// sessionClient replays the cookies of the responses like a browser.
+type sessionClient struct {
+	t       *testing.T
+	handler http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func (sc *sessionClient) do(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	for _, cookie := range sc.cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	sc.handler.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(sc.cookies, cookie.Name)
+		} else {
+			sc.cookies[cookie.Name] = cookie
+		}
+	}
+	return w
+}
+
+func TestSessionMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ap := newTestSessionProvider(t, CSRFConfig{Enabled: true})
+	z := &zephyrix{}
+
+	r := gin.New()
+	r.GET("/cart", ap.SessionMiddleware(), func(c *gin.Context) {
+		ctx := z.newZephyrixContext(c)
+		ctx.Session().Data["cart"] = "book"
+		c.String(http.StatusOK, ctx.CSRFToken())
+	})
+	r.POST("/cart", ap.SessionMiddleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, "%v", z.newZephyrixContext(c).Session().Data["cart"])
+	})
+	client := &sessionClient{t: t, handler: r, cookies: make(map[string]*http.Cookie)}
+
+	w := client.do(http.MethodPost, "/cart", "", nil)
+	require.Equal(t, http.StatusForbidden, w.Code, "an unsafe request can not start a session")
+
+	w = client.do(http.MethodGet, "/cart", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	token := w.Body.String()
+	require.NotEmpty(t, token)
+	require.Equal(t, token, w.Header().Get(defaultCSRFHeaderName))
+	cookie := client.cookies["zephyrix_session"]
+	require.NotNil(t, cookie)
+	require.True(t, cookie.HttpOnly)
+	require.True(t, cookie.Secure)
+	require.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+
+	w = client.do(http.MethodPost, "/cart", "", nil)
+	require.Equal(t, http.StatusForbidden, w.Code, "missing CSRF token")
+	w = client.do(http.MethodPost, "/cart", "", http.Header{defaultCSRFHeaderName: {"forged"}})
+	require.Equal(t, http.StatusForbidden, w.Code)
+	w = client.do(http.MethodPost, "/cart", "", http.Header{defaultCSRFHeaderName: {token}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "book", w.Body.String(), "the data written by the handler was saved")
+
+	w = client.do(http.MethodPost, "/cart", defaultCSRFFormField+"="+token, http.Header{"Content-Type": {"application/x-www-form-urlencoded"}})
+	require.Equal(t, http.StatusOK, w.Code, "the token can be sent in the form")
+}
+
+func TestStartSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ap := newTestSessionProvider(t, CSRFConfig{Enabled: true},
+		&models.UserEntity{ID: 1, Username: "alice", Active: true, Roles: `["editor"]`},
+	)
+	store := ap.components.userStore.(*testUserStore)
+	z := &zephyrix{}
+
+	r := gin.New()
+	r.GET("/cart", ap.SessionMiddleware(), func(c *gin.Context) {
+		z.newZephyrixContext(c).Session().Data["cart"] = "book"
+		c.String(http.StatusOK, z.newZephyrixContext(c).CSRFToken())
+	})
+	r.POST("/login", func(c *gin.Context) {
+		user, _ := store.GetByID(c.Request.Context(), 1)
+		_, err := ap.StartSession(c, user)
+		require.NoError(t, err)
+		c.String(http.StatusOK, z.newZephyrixContext(c).CSRFToken())
+	})
+	r.POST("/me", ap.Middleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, "%s %v", z.newZephyrixContext(c).User().Username(), z.newZephyrixContext(c).Session().Data["cart"])
+	})
+	client := &sessionClient{t: t, handler: r, cookies: make(map[string]*http.Cookie)}
+
+	w := client.do(http.MethodGet, "/cart", "", nil)
+	anonymous, anonymousToken := client.cookies["zephyrix_session"].Value, w.Body.String()
+
+	w = client.do(http.MethodPost, "/login", "", nil)
+	token := w.Body.String()
+	session := client.cookies["zephyrix_session"].Value
+	require.NotEqual(t, anonymous, session, "the login rotates the session ID")
+	require.NotEqual(t, anonymousToken, token, "and the CSRF token")
+	_, err := ap.components.sessionManager.GetSession(context.Background(), anonymous)
+	require.Error(t, err, "the anonymous session is destroyed")
+
+	w = client.do(http.MethodPost, "/me", "", http.Header{defaultCSRFHeaderName: {anonymousToken}})
+	require.Equal(t, http.StatusForbidden, w.Code, "the token of the anonymous session is worthless")
+	w = client.do(http.MethodPost, "/me", "", http.Header{defaultCSRFHeaderName: {token}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "alice book", w.Body.String(), "the anonymous data is carried over")
+
+	store.users[1].Roles = `["editor","admin"]`
+	w = client.do(http.MethodPost, "/me", "", http.Header{defaultCSRFHeaderName: {token}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEqual(t, session, client.cookies["zephyrix_session"].Value, "a privilege change rotates the session ID")
+	rotatedToken := w.Header().Get(defaultCSRFHeaderName)
+	require.NotEmpty(t, rotatedToken)
+	require.NotEqual(t, token, rotatedToken)
+
+	w = client.do(http.MethodPost, "/me", "", http.Header{defaultCSRFHeaderName: {rotatedToken}})
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDoubleSubmitCSRF(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ap := newTestSessionProvider(t, CSRFConfig{Enabled: true, Mode: CSRFModeDoubleSubmit})
+
+	r := gin.New()
+	r.Any("/", ap.SessionMiddleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	client := &sessionClient{t: t, handler: r, cookies: make(map[string]*http.Cookie)}
+
+	client.do(http.MethodGet, "/", "", nil)
+	cookie := client.cookies[defaultCSRFCookieName]
+	require.NotNil(t, cookie)
+	require.False(t, cookie.HttpOnly, "scripts echo the cookie")
+
+	w := client.do(http.MethodPost, "/", "", http.Header{defaultCSRFHeaderName: {cookie.Value}})
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	// a cookie planted for another session is refused
+	planted := doubleSubmitToken("another session", "nonce")
+	client.cookies[defaultCSRFCookieName] = &http.Cookie{Name: defaultCSRFCookieName, Value: planted}
+	w = client.do(http.MethodPost, "/", "", http.Header{defaultCSRFHeaderName: {planted}})
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	require.True(t, validDoubleSubmitToken("session", doubleSubmitToken("session", "nonce")))
+	require.False(t, validDoubleSubmitToken("session", "nonce"))
+}
+
+func TestCSRFFormValueKeepsBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("a=1&csrf_token=abc"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	require.Equal(t, "abc", csrfFormValue(req, "csrf_token"))
+
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, "a=1&csrf_token=abc", string(body), "the body is forwarded untouched")
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"csrf_token":"abc"}`))
+	req.Header.Set("Content-Type", "application/json")
+	require.Empty(t, csrfFormValue(req, "csrf_token"))
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	insecure := false
+	sm := &SessionManager{config: SessionConfig{CookieDomain: "example.com", CookieSameSite: "none", CookieSecure: &insecure}}
+	cookie := sm.cookie("name", "value", time.Time{}, true)
+	require.Equal(t, "/", cookie.Path)
+	require.Equal(t, "example.com", cookie.Domain)
+	require.Equal(t, http.SameSiteNoneMode, cookie.SameSite)
+	require.True(t, cookie.Secure, "SameSite=None requires Secure")
+
+	sm.config.CookieSameSite = "Strict"
+	cookie = sm.cookie("name", "value", time.Time{}, true)
+	require.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+	require.False(t, cookie.Secure)
+}
@@ -0,0 +1,104 @@
+package zephyrix
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionRouteHandler is one of the endpoints of the cookie sessions:
+//
+//	GET    /auth/session  -> {"authenticated", "user_id", "expires_at", "csrf_token"}, starts an anonymous session
+//	POST   /auth/session  (bearer access token) -> 201, signs the user in with a session cookie
+//	DELETE /auth/session  (authenticated) -> 204, signs the session out
+//
+// Single page applications log in with any grant, trade the access token for the cookie and read
+// the CSRF token of their unsafe requests from GET /auth/session.
+type sessionRouteHandler struct {
+	name    string
+	method  string
+	handler []any
+}
+
+func (h *sessionRouteHandler) Name() string     { return h.name }
+func (h *sessionRouteHandler) Method() []string { return []string{h.method} }
+func (h *sessionRouteHandler) Path() string     { return "/auth/session" }
+func (h *sessionRouteHandler) Handlers() []any  { return h.handler }
+
+func newSessionInfoRoute(ap *AuthProvider) *sessionRouteHandler {
+	return &sessionRouteHandler{
+		name:   "session",
+		method: http.MethodGet,
+		handler: []any{ap.requireSessions, ap.SessionMiddleware(), func(c *gin.Context) {
+			c.Header("Cache-Control", "no-store")
+			c.JSON(http.StatusOK, sessionInfo(c))
+		}},
+	}
+}
+
+func newSessionLoginRoute(ap *AuthProvider) *sessionRouteHandler {
+	return &sessionRouteHandler{
+		name:   "session_login",
+		method: http.MethodPost,
+		handler: []any{ap.requireSessions, func(c *gin.Context) {
+			// a bearer token can not be attached by another site, the login itself needs no CSRF token
+			if bearerToken(c.Request) == "" {
+				abortUnauthorized(c, ErrUnauthenticated)
+				return
+			}
+			identity, user, err := ap.authenticateRequest(c)
+			if err != nil || identity.Method != IdentityMethodJWT {
+				abortUnauthorized(c, ErrInvalidToken)
+				return
+			}
+
+			if _, err := ap.StartSession(c, user); err != nil {
+				Logger.Error("Failed to start the session of user %d: %s", user.ID(), err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+				return
+			}
+			c.JSON(http.StatusCreated, sessionInfo(c))
+		}},
+	}
+}
+
+func newSessionLogoutRoute(ap *AuthProvider) *sessionRouteHandler {
+	return &sessionRouteHandler{
+		name:   "session_logout",
+		method: http.MethodDelete,
+		handler: []any{ap.requireSessions, ap.Middleware(), func(c *gin.Context) {
+			if err := ap.EndSession(c); err != nil {
+				Logger.Error("Failed to end session: %s", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+				return
+			}
+			c.Status(http.StatusNoContent)
+		}},
+	}
+}
+
+// requireSessions hides the endpoints when no session manager is configured.
+func (ap *AuthProvider) requireSessions(c *gin.Context) {
+	if ap.components.sessionManager == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// sessionInfo is the public view of the session attached to the request.
+func sessionInfo(c *gin.Context) gin.H {
+	rs, _ := c.Value(sessionContextKey).(*requestSession)
+	if rs == nil {
+		return gin.H{"authenticated": false}
+	}
+	info := gin.H{
+		"authenticated": rs.session.UserID != 0,
+		"expires_at":    rs.session.ExpiresAt,
+	}
+	if rs.session.UserID != 0 {
+		info["user_id"] = rs.session.UserID
+	}
+	if rs.csrf != "" {
+		info["csrf_token"] = rs.csrf
+	}
+	return info
+}
@@ -0,0 +1,332 @@
+package zephyrix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StaticConfig describes a static file mount, either from the `server.static` configuration
+// or passed to Router.Static.
+type StaticConfig struct {
+	Path             string        `mapstructure:"path"`              // URL prefix of the mount
+	Root             string        `mapstructure:"root"`              // directory on disk, or sub directory of an fs.FS
+	Index            string        `mapstructure:"index"`             // index file of directories, defaults to index.html
+	SPA              bool          `mapstructure:"spa"`               // serve the root index for unknown paths (history fallback)
+	Precompressed    bool          `mapstructure:"precompressed"`     // serve .br / .gz siblings when the client accepts them
+	Listing          bool          `mapstructure:"listing"`           // list directories without an index file
+	MaxAge           time.Duration `mapstructure:"max_age"`           // Cache-Control max-age of regular files
+	ImmutablePattern string        `mapstructure:"immutable_pattern"` // regex of hashed file names, cached forever
+}
+
+// defaultImmutablePattern matches the hashed file names produced by common bundlers,
+// e.g. app.3f9a1c2b.js or chunk-5NRDDZ3K.css.
+const defaultImmutablePattern = `[.-][0-9a-zA-Z]{8,}\.[a-z0-9]+$`
+
+// staticHandler serves the files of a static mount.
+type staticHandler struct {
+	config    StaticConfig
+	fsys      fs.FS
+	immutable *regexp.Regexp
+	etags     sync.Map // file name -> staticETag
+}
+
+type staticETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// newStaticHandler creates the handler of a static mount,
+// root is either a directory on disk (string) or an fs.FS such as an embed.FS.
+func newStaticHandler(root any, config StaticConfig) (*staticHandler, error) {
+	var fsys fs.FS
+	switch r := root.(type) {
+	case string:
+		fsys = os.DirFS(r)
+	case fs.FS:
+		fsys = r
+		if config.Root != "" {
+			sub, err := fs.Sub(r, strings.Trim(config.Root, "/"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid static root %s: %w", config.Root, err)
+			}
+			fsys = sub
+		}
+	default:
+		return nil, fmt.Errorf("unsupported static root type %T, expected a directory or an fs.FS", root)
+	}
+
+	if config.Index == "" {
+		config.Index = "index.html"
+	}
+
+	pattern := config.ImmutablePattern
+	if pattern == "" {
+		pattern = defaultImmutablePattern
+	}
+	immutable, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid immutable_pattern: %w", err)
+	}
+
+	return &staticHandler{
+		config:    config,
+		fsys:      fsys,
+		immutable: immutable,
+	}, nil
+}
+
+// routeHandler returns the gin handler of a mount registered as `<path>/*filepath`.
+func (h *staticHandler) routeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.serve(c, c.Param("filepath")) {
+			c.AbortWithStatus(http.StatusNotFound)
+		}
+	}
+}
+
+// fallbackHandler returns the handler of a root mount, which runs in the NoRoute stage.
+func (h *staticHandler) fallbackHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.serve(c, c.Request.URL.Path) {
+			c.Abort()
+		}
+	}
+}
+
+// serve writes the file matching the request path, and reports whether anything was served.
+func (h *staticHandler) serve(c *gin.Context, requestPath string) bool {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+requestPath), "/")
+	if name == "" {
+		name = "."
+	}
+
+	info, err := fs.Stat(h.fsys, name)
+	if err == nil && info.IsDir() {
+		index := path.Join(name, h.config.Index)
+		if indexInfo, err := fs.Stat(h.fsys, index); err == nil && !indexInfo.IsDir() {
+			return h.serveFile(c, index, indexInfo, true)
+		}
+		if h.config.Listing {
+			return h.serveListing(c, name, requestPath)
+		}
+		err = fs.ErrNotExist
+	}
+
+	if err != nil {
+		if h.config.SPA && acceptsHTML(c.Request) && path.Ext(name) == "" {
+			if indexInfo, err := fs.Stat(h.fsys, h.config.Index); err == nil {
+				return h.serveFile(c, h.config.Index, indexInfo, true)
+			}
+		}
+		return false
+	}
+
+	return h.serveFile(c, name, info, name == h.config.Index)
+}
+
+// serveFile writes a single file, picking a precompressed variant when possible.
+func (h *staticHandler) serveFile(c *gin.Context, name string, info fs.FileInfo, isIndex bool) bool {
+	header := c.Writer.Header()
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	servedName, servedInfo := name, info
+	if h.config.Precompressed {
+		addVary(header, "Accept-Encoding")
+		for _, variant := range []struct{ encoding, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+			if !acceptsEncoding(c.Request, variant.encoding) {
+				continue
+			}
+			if variantInfo, err := fs.Stat(h.fsys, name+variant.ext); err == nil && !variantInfo.IsDir() {
+				servedName, servedInfo = name+variant.ext, variantInfo
+				header.Set("Content-Encoding", variant.encoding)
+				break
+			}
+		}
+	}
+
+	content, err := h.open(servedName)
+	if err != nil {
+		Logger.Error("Failed to open static file %s: %s", servedName, err)
+		return false
+	}
+	defer content.Close()
+
+	etag, err := h.etag(servedName, servedInfo, content)
+	if err != nil {
+		Logger.Error("Failed to compute ETag of %s: %s", servedName, err)
+		return false
+	}
+
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("ETag", etag)
+	switch {
+	case isIndex:
+		// the index references the hashed assets, it must always be revalidated
+		header.Set("Cache-Control", "no-cache")
+	case h.immutable.MatchString(path.Base(name)):
+		header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	case h.config.MaxAge > 0:
+		header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(h.config.MaxAge.Seconds())))
+	}
+
+	http.ServeContent(c.Writer, c.Request, name, servedInfo.ModTime(), content)
+	return true
+}
+
+// staticContent is an open file that can be served with http.ServeContent.
+type staticContent interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// open opens a file for reading, buffering it in memory when the file system does not support seeking.
+func (h *staticHandler) open(name string) (staticContent, error) {
+	file, err := h.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if rs, ok := file.(staticContent); ok {
+		return rs, nil
+	}
+
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloserReadSeeker{bytes.NewReader(data)}, nil
+}
+
+type nopCloserReadSeeker struct {
+	*bytes.Reader
+}
+
+func (nopCloserReadSeeker) Close() error { return nil }
+
+// etag returns the strong ETag of a file, computed from its content and cached until the file changes.
+func (h *staticHandler) etag(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	if cached, ok := h.etags.Load(name); ok {
+		entry := cached.(staticETag)
+		if entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+			return entry.etag, nil
+		}
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	h.etags.Store(name, staticETag{modTime: info.ModTime(), size: info.Size(), etag: etag})
+	return etag, nil
+}
+
+// serveListing writes a minimal HTML listing of a directory.
+func (h *staticHandler) serveListing(c *gin.Context, name, requestPath string) bool {
+	entries, err := fs.ReadDir(h.fsys, name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			Logger.Error("Failed to list static directory %s: %s", name, err)
+		}
+		return false
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	base := c.Request.URL.Path
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	var b strings.Builder
+	b.WriteString("<!doctype html>\n<meta charset=\"utf-8\">\n<title>Index of ")
+	b.WriteString(html.EscapeString(path.Clean("/" + requestPath)))
+	b.WriteString("</title>\n<pre>\n")
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(base+entryName), html.EscapeString(entryName))
+	}
+	b.WriteString("</pre>\n")
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(b.String()))
+	return true
+}
+
+// acceptsHTML reports whether the request is a navigation that expects an HTML document.
+func acceptsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return accept == "" || strings.Contains(accept, "text/html") || strings.Contains(accept, "*/*")
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request allows the given encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		// "gzip;q=0" explicitly refuses the encoding
+		params = strings.ReplaceAll(params, " ", "")
+		return params != "q=0" && params != "q=0.0" && params != "q=0.00" && params != "q=0.000"
+	}
+	return false
+}
+
+// mountStatic registers a static mount on the given router group,
+// mounts at the root of the engine are served from the NoRoute stage so they never shadow other routes.
+func (z *zephyrix) mountStatic(group *gin.RouterGroup, relativePath string, h *staticHandler) {
+	fullPath := path.Join(group.BasePath(), relativePath)
+	if fullPath == "/" {
+		z.r.fallbacks = append(z.r.fallbacks, h.fallbackHandler())
+		return
+	}
+
+	route := strings.TrimSuffix(relativePath, "/") + "/*filepath"
+	group.GET(route, h.routeHandler())
+	group.HEAD(route, h.routeHandler())
+}
+
+// setupStatic registers the static mounts of the `server.static` configuration.
+func (z *zephyrix) setupStatic(handler *gin.Engine) {
+	for _, config := range z.config.Server.Static {
+		h, err := newStaticHandler(config.Root, config)
+		if err != nil {
+			Logger.Error("Failed to mount static files at %s: %s", config.Path, err)
+			continue
+		}
+		Logger.Debug("Serving static files from %s at %s", config.Root, config.Path)
+		z.mountStatic(&handler.RouterGroup, config.Path, h)
+	}
+}
@@ -0,0 +1,93 @@
+package zephyrix
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticMount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	files := fstest.MapFS{
+		"index.html":                {Data: []byte("<html>app</html>")},
+		"assets/app.3f9a1c2b.js":    {Data: []byte("console.log('app')")},
+		"assets/app.3f9a1c2b.js.br": {Data: []byte("brotli")},
+		"assets/app.3f9a1c2b.js.gz": {Data: []byte("gzip")},
+		"docs/readme.txt":           {Data: []byte("readme")},
+	}
+
+	z := &zephyrix{config: &Config{}}
+	handler := gin.New()
+	z.assignHandler(handler)
+	handler.GET("/api/ping", func(c *gin.Context) { c.String(http.StatusOK, "pong") })
+	z.setupProxies(handler)
+	z.r.Static("/", files, StaticConfig{SPA: true, Precompressed: true})
+	z.r.Static("/listing", files, StaticConfig{Listing: true})
+	z.r.execute()
+
+	do := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("routes take precedence", func(t *testing.T) {
+		w := do("/api/ping", nil)
+		require.Equal(t, "pong", w.Body.String())
+	})
+
+	t.Run("spa history fallback", func(t *testing.T) {
+		w := do("/settings/profile", map[string]string{"Accept": "text/html"})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "<html>app</html>", w.Body.String())
+		require.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	})
+
+	t.Run("missing asset is not a navigation", func(t *testing.T) {
+		w := do("/assets/missing.js", map[string]string{"Accept": "*/*"})
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("precompressed variant", func(t *testing.T) {
+		w := do("/assets/app.3f9a1c2b.js", map[string]string{"Accept-Encoding": "gzip, br"})
+		require.Equal(t, "brotli", w.Body.String())
+		require.Equal(t, "br", w.Header().Get("Content-Encoding"))
+		require.Contains(t, w.Header().Get("Content-Type"), "javascript")
+		require.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+
+		w = do("/assets/app.3f9a1c2b.js", map[string]string{"Accept-Encoding": "gzip, br;q=0"})
+		require.Equal(t, "gzip", w.Body.String())
+
+		w = do("/assets/app.3f9a1c2b.js", nil)
+		require.Equal(t, "console.log('app')", w.Body.String())
+		require.Empty(t, w.Header().Get("Content-Encoding"))
+	})
+
+	t.Run("strong etag", func(t *testing.T) {
+		w := do("/docs/readme.txt", nil)
+		etag := w.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+		require.NotContains(t, etag, "W/")
+
+		w = do("/docs/readme.txt", map[string]string{"If-None-Match": etag})
+		require.Equal(t, http.StatusNotModified, w.Code)
+	})
+
+	t.Run("directory listing", func(t *testing.T) {
+		w := do("/docs/", map[string]string{"Accept": "application/json"})
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		w = do("/listing/docs/", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), `href="/listing/docs/readme.txt"`)
+	})
+}
@@ -0,0 +1,171 @@
+package zephyrix
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTOTPDigits        = 6
+	defaultTOTPPeriod        = 30 * time.Second
+	defaultTOTPSkew          = 1
+	defaultRecoveryCodeCount = 10
+	totpSecretSize           = 20 // 160 bits, as recommended by RFC 4226
+)
+
+// TOTPConfig configures the RFC 6238 time-based one-time passwords.
+type TOTPConfig struct {
+	Issuer    string        `mapstructure:"issuer"`    // shown by authenticator apps
+	Digits    int           `mapstructure:"digits"`    // 6 or 8
+	Period    time.Duration `mapstructure:"period"`    // lifetime of a code
+	Skew      int           `mapstructure:"skew"`      // periods accepted before and after the current one
+	Algorithm string        `mapstructure:"algorithm"` // SHA1 (default, widest app support), SHA256 or SHA512
+}
+
+// normalize applies the defaults of the configuration.
+func (c TOTPConfig) normalize() TOTPConfig {
+	if c.Issuer == "" {
+		c.Issuer = "Zephyrix"
+	}
+	if c.Digits != 8 {
+		c.Digits = defaultTOTPDigits
+	}
+	if c.Period < time.Second {
+		c.Period = defaultTOTPPeriod
+	}
+	if c.Skew < 0 {
+		c.Skew = 0
+	} else if c.Skew == 0 {
+		c.Skew = defaultTOTPSkew
+	}
+	switch strings.ToUpper(c.Algorithm) {
+	case "SHA256", "SHA512":
+		c.Algorithm = strings.ToUpper(c.Algorithm)
+	default:
+		c.Algorithm = "SHA1"
+	}
+	return c
+}
+
+func (c TOTPConfig) hash() func() hash.Hash {
+	switch c.Algorithm {
+	case "SHA256":
+		return sha256.New
+	case "SHA512":
+		return sha512.New
+	default:
+		return sha1.New
+	}
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a random base32 secret.
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode computes the code of a time step (RFC 4226 section 5.3).
+func totpCode(config TOTPConfig, secret string, counter uint64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.ReplaceAll(secret, " ", "")))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(config.hash(), key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < config.Digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", config.Digits, value%modulo), nil
+}
+
+// verifyTOTPToken checks a code against the time steps around t, it returns the matching step
+// so the caller can refuse to accept it twice.
+func verifyTOTPToken(config TOTPConfig, secret, token string, t time.Time) (uint64, bool) {
+	token = strings.ReplaceAll(strings.TrimSpace(token), " ", "")
+	if len(token) != config.Digits {
+		return 0, false
+	}
+
+	current := uint64(t.Unix()) / uint64(config.Period/time.Second)
+	for delta := -config.Skew; delta <= config.Skew; delta++ {
+		counter := current + uint64(delta)
+		if delta < 0 && current < uint64(-delta) {
+			continue
+		}
+		code, err := totpCode(config, secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(token)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI returns the otpauth:// URI that authenticator apps enroll from.
+func totpProvisioningURI(config TOTPConfig, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", config.Issuer)
+	query.Set("algorithm", config.Algorithm)
+	query.Set("digits", strconv.Itoa(config.Digits))
+	query.Set("period", strconv.Itoa(int(config.Period/time.Second)))
+
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + config.Issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+// generateRecoveryCodes returns count codes of 80 random bits, formatted as xxxx-xxxx-xxxx-xxxx.
+func generateRecoveryCodes(count int) ([]string, error) {
+	encoding := base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+	codes := make([]string, count)
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := encoding.EncodeToString(raw)
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case and separators.
+// A fast hash is enough, the codes carry 80 bits of entropy.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
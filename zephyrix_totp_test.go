@@ -0,0 +1,92 @@
+package zephyrix
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTOTPVectors checks the test vectors of RFC 6238 appendix B.
+func TestTOTPVectors(t *testing.T) {
+	secrets := map[string]string{
+		"SHA1":   "12345678901234567890",
+		"SHA256": "12345678901234567890123456789012",
+		"SHA512": "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	vectors := []struct {
+		unix      int64
+		algorithm string
+		code      string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1234567890, "SHA256", "91819424"},
+		{20000000000, "SHA512", "47863826"},
+	}
+
+	for _, v := range vectors {
+		config := TOTPConfig{Digits: 8, Algorithm: v.algorithm}.normalize()
+		secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(secrets[v.algorithm]))
+		counter := uint64(v.unix) / 30
+
+		code, err := totpCode(config, secret, counter)
+		require.NoError(t, err)
+		require.Equal(t, v.code, code, "%s at %d", v.algorithm, v.unix)
+	}
+}
+
+func TestVerifyTOTPToken(t *testing.T) {
+	config := TOTPConfig{}.normalize()
+	secret, err := generateTOTPSecret()
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	current := uint64(now.Unix()) / 30
+	code, err := totpCode(config, secret, current)
+	require.NoError(t, err)
+
+	counter, ok := verifyTOTPToken(config, secret, code, now)
+	require.True(t, ok)
+	require.Equal(t, current, counter)
+
+	_, ok = verifyTOTPToken(config, secret, code, now.Add(30*time.Second))
+	require.True(t, ok, "the previous period is accepted with a skew of 1")
+	_, ok = verifyTOTPToken(config, secret, code, now.Add(90*time.Second))
+	require.False(t, ok)
+	_, ok = verifyTOTPToken(config, secret, "12345", now)
+	require.False(t, ok)
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	config := TOTPConfig{Issuer: "Acme"}.normalize()
+	uri, err := url.Parse(totpProvisioningURI(config, "alice@example.com", "JBSWY3DPEHPK3PXP"))
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "totp", uri.Host)
+	require.Equal(t, "/Acme:alice@example.com", uri.Path)
+	require.Equal(t, "JBSWY3DPEHPK3PXP", uri.Query().Get("secret"))
+	require.Equal(t, "6", uri.Query().Get("digits"))
+	require.Equal(t, "30", uri.Query().Get("period"))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes(10)
+	require.NoError(t, err)
+	require.Len(t, codes, 10)
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		require.Len(t, code, 19)
+		require.False(t, seen[code])
+		seen[code] = true
+	}
+
+	require.Equal(t, hashRecoveryCode(codes[0]), hashRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[0], "-", " "))),
+		"codes are accepted regardless of case and separators")
+}
@@ -2,7 +2,9 @@ package zephyrix
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -58,6 +60,10 @@ const (
 	GrantTypeRefreshToken  GrantType = "refresh_token"
 	GrantTypeAuthorization GrantType = "authorization_code"
 	GrantTypeMagicToken    GrantType = "magic_token" // AKA "magic link"
+	GrantTypeWebAuthn      GrantType = "webauthn"    // passkeys, see WebAuthnManager
+
+	// GrantTypeClientCredentials is only accepted by the token endpoint of the authorization server.
+	GrantTypeClientCredentials GrantType = "client_credentials"
 )
 
 type Authenticate struct {
@@ -67,84 +73,248 @@ type Authenticate struct {
 	Password string
 
 	RefreshToken string
+	DeviceID     string // binds the issued refresh token to a client device
 
 	Provider string
 	Token    string
 	Code     string
+	State    string // state of the authorization request, see GetOAuth2AuthURL
 
 	MagicToken string
+
+	// IP and UserAgent identify the client, magic tokens are only accepted from the device that requested them.
+	IP        string
+	UserAgent string
+
+	WebAuthn *WebAuthnCredentialAssertion
+
+	// RememberDeviceToken is the token of a previous VerifyMFA with RememberDevice,
+	// it skips MFA while it is valid.
+	RememberDeviceToken string
 }
 
-func (ap *AuthProvider) AuthenticateUser(ctx context.Context, input Authenticate) (string, error) {
+// AuthenticateUser authenticates a user with the given grant and returns a new token pair.
+// The refresh token grant rotates the presented refresh token, which can not be used again.
+func (ap *AuthProvider) AuthenticateUser(ctx context.Context, input Authenticate) (*AuthResult, error) {
 	// Rate limiting
 	rl := ap.components.rateLimiter.Limiter(ctx, "login")
-	rlKey := fmt.Sprintf("login:%s:%s:%s:%s", input.Auth, input.RefreshToken, input.Provider+input.Token, input.MagicToken)
-	if !rl.Allow(ctx, "login", rlKey) {
-		return "", ErrRateLimited
+	if !rl.Allow(ctx, "login", loginRateLimitKey(input)) {
+		return nil, ErrRateLimited
+	}
+	if err := ap.components.lockout.CheckIP(ctx, input.IP); err != nil {
+		ap.components.auditLogger.logFailedLogin(ctx, input.Auth, "ip_blocked", input.IP)
+		return nil, err
 	}
 
 	var user User
+	var familyID string
+	var userVerified bool // the grant already proved a second factor
 	var err error
 
 	switch input.GrantType {
 	case GrantTypePassword:
-		user, err = ap.authenticateWithPassword(ctx, input.Auth, input.Password)
+		user, err = ap.authenticateWithPassword(ctx, input.Auth, input.Password, input.IP)
 	case GrantTypeRefreshToken:
-		user, err = ap.authenticateWithRefreshToken(ctx, input.RefreshToken)
+		user, familyID, err = ap.authenticateWithRefreshToken(ctx, input.RefreshToken, input.DeviceID)
 	case GrantTypeAuthorization:
-		user, err = ap.authenticateWithAuthorizationCode(ctx, input.Provider, input.Code)
+		user, err = ap.authenticateWithAuthorizationCode(ctx, input.Provider, input.Code, input.State)
 	case GrantTypeMagicToken:
-		user, err = ap.authenticateWithMagicToken(ctx, input.MagicToken)
+		user, err = ap.authenticateWithMagicToken(ctx, input.MagicToken, input.IP, input.UserAgent)
+	case GrantTypeWebAuthn:
+		user, userVerified, err = ap.authenticateWithWebAuthn(ctx, input.WebAuthn)
 	default:
-		return "", fmt.Errorf("unsupported grant type: %s", input.GrantType)
+		return nil, fmt.Errorf("unsupported grant type: %s", input.GrantType)
 	}
 
 	if err != nil {
-		return "", fmt.Errorf("authentication failed: %w", err)
+		if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrInvalidWebAuthn) {
+			ap.components.lockout.FailedFromIP(ctx, input.IP)
+		}
+		return nil, fmt.Errorf("authentication failed: %w", err)
+	}
+
+	// accounts registered while email_verification_required wait for VerifyEmail, a magic link proves the address
+	if input.GrantType != GrantTypeRefreshToken && ap.config.UserRegistration.EmailVerificationRequired && !isEmailVerified(user) {
+		if input.GrantType != GrantTypeMagicToken {
+			ap.components.auditLogger.logFailedLogin(ctx, user.Username(), "email_not_verified")
+			return nil, ErrEmailNotVerified
+		}
+		if err := ap.markEmailVerified(ctx, user); err != nil {
+			return nil, err
+		}
 	}
 
-	// Check if MFA is required
-	if ap.config.MFA.Enabled && ap.components.mfaManager.IsRequired(user) {
-		return "", ErrMFARequired
+	// Check if MFA is required, tokens are only issued once the challenge is completed with VerifyMFA
+	mfaRequired := input.GrantType != GrantTypeRefreshToken && !userVerified && ap.config.MFA.Enabled && ap.components.mfaManager.IsRequired(user) &&
+		!ap.components.mfaManager.isDeviceRemembered(ctx, user, input.RememberDeviceToken)
+
+	// an expired password is changed with ChangeExpiredPassword first, which continues with MFA
+	if input.GrantType == GrantTypePassword && ap.components.passwords.Expired(user) {
+		return nil, ap.newPasswordChangeRequired(ctx, user, input.DeviceID, mfaRequired)
+	}
+	if mfaRequired {
+		return nil, ap.newMFAChallenge(ctx, user, input.DeviceID)
 	}
 
-	// Generate JWT token
-	token, err := ap.generateJWT(user)
+	result, err := ap.issueTokens(ctx, user, input.DeviceID, familyID)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate JWT: %w", err)
+		return nil, err
+	}
+
+	// the failures are only forgotten once the login completed, a pending second factor keeps them
+	if input.GrantType == GrantTypePassword {
+		ap.components.lockout.Succeeded(ctx, user)
 	}
 
 	// Log successful login
-	ap.components.auditLogger.logSuccessfulLogin(ctx, user.Username())
-	return token, nil
+	if input.GrantType != GrantTypeRefreshToken {
+		ap.components.auditLogger.logSuccessfulLogin(ctx, user.Username())
+	}
+	return result, nil
+}
+
+// loginRateLimitKey identifies the client of a login attempt: its address and, for credentials
+// that can be guessed, the account. Tokens are never part of the key.
+func loginRateLimitKey(input Authenticate) string {
+	key := string(input.GrantType) + ":" + input.IP
+	switch input.GrantType {
+	case GrantTypePassword:
+		key += ":" + normalizeUsername(input.Auth)
+	case GrantTypeAuthorization:
+		key += ":" + input.Provider
+	case GrantTypeWebAuthn:
+		if input.WebAuthn != nil {
+			key += ":" + input.WebAuthn.ID
+		}
+	}
+	return key
 }
 
 // Helper functions for each authentication method
-func (ap *AuthProvider) authenticateWithPassword(ctx context.Context, auth, password string) (User, error) {
-	// Implement password-based authentication
-	// This might involve querying a database, checking password hashes, etc.
-	// Return the authenticated user or an error if authentication fails
-	return nil, fmt.Errorf("not implemented")
+func (ap *AuthProvider) authenticateWithPassword(ctx context.Context, auth, password, ip string) (User, error) {
+	ap.components.auditLogger.logAttemptLogin(ctx, auth)
+
+	user, err := ap.getUserByUsername(ctx, auth)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			// spend the same time as a real check, so response times do not reveal existing users
+			ap.components.passwordHasher.Verify(ap.dummyPasswordHash(), password)
+			ap.components.auditLogger.logFailedLogin(ctx, auth, "user_not_found")
+			return nil, fmt.Errorf("%w: %w", ErrInvalidCredentials, ErrUserNotFound)
+		}
+		return nil, err
+	}
+
+	// guesses against a locked account are not verified, they would reveal the password
+	if ap.components.lockout.IsLocked(ctx, user) {
+		ap.components.auditLogger.logFailedLogin(ctx, auth, "account_locked")
+		return nil, ErrAccountLocked
+	}
+	if !user.CheckPassword(password) {
+		ap.components.auditLogger.logFailedLogin(ctx, auth, "invalid_password")
+		ap.components.lockout.Failed(ctx, user, ip)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCredentials, ErrInvalidPassword)
+	}
+
+	// upgrade the hash when hashing_cost changed since the password was set, admitUser stores it
+	if hu, ok := user.(PasswordHashUser); ok && ap.components.passwordHasher.NeedsRehash(hu.PasswordHash()) {
+		if hash, err := ap.components.passwordHasher.Hash(password); err == nil {
+			hu.SetPasswordHash(hash)
+		} else {
+			Logger.Error("Failed to rehash password of user %d: %s", user.ID(), err)
+		}
+	}
+
+	if err := ap.admitUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkAccount refuses the disabled and locked accounts, every grant goes through it so the
+// rules can not differ between them.
+func (ap *AuthProvider) checkAccount(ctx context.Context, user User) error {
+	if !user.IsActive() {
+		ap.components.auditLogger.logFailedLogin(ctx, user.Username(), "account_disabled")
+		return ErrAccountDisabled
+	}
+	if ap.components.lockout.IsLocked(ctx, user) {
+		ap.components.auditLogger.logFailedLogin(ctx, user.Username(), "account_locked")
+		return ErrAccountLocked
+	}
+	return nil
+}
+
+// admitUser completes the login of a user whose credentials were verified: the account is
+// checked with checkAccount and the time of the login is recorded.
+func (ap *AuthProvider) admitUser(ctx context.Context, user User) error {
+	if err := ap.checkAccount(ctx, user); err != nil {
+		return err
+	}
+	if err := user.SetLastLoginAt(time.Now()); err != nil {
+		return err
+	}
+	if err := ap.components.userStore.Update(ctx, user); err != nil {
+		Logger.Error("Failed to update user %d after login: %s", user.ID(), err)
+	}
+	return nil
+}
+
+var (
+	dummyPasswordHashOnce sync.Once
+	dummyPasswordHash     string
+)
+
+// dummyPasswordHash returns a hash with the configured cost, compared against when the user does not exist.
+func (ap *AuthProvider) dummyPasswordHash() string {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = ap.components.passwordHasher.Hash("zephyrix-dummy-password")
+	})
+	return dummyPasswordHash
 }
 
-func (ap *AuthProvider) authenticateWithRefreshToken(ctx context.Context, refreshToken string) (User, error) {
-	// Implement refresh token-based authentication
-	// This might involve validating the refresh token, fetching the associated user, etc.
-	// Return the authenticated user or an error if authentication fails
-	return nil, fmt.Errorf("not implemented")
+// authenticateWithAuthorizationCode completes a login started with GetOAuth2AuthURL.
+func (ap *AuthProvider) authenticateWithAuthorizationCode(ctx context.Context, provider, code, state string) (User, error) {
+	if ap.components.oauth2Manager.pendingLink(ctx, state) != 0 {
+		return nil, fmt.Errorf("%w: state was issued to link an account", ErrInvalidToken)
+	}
+
+	callback, err := ap.HandleOAuth2Callback(ctx, provider, code, state)
+	if err != nil {
+		ap.components.auditLogger.logFailedLogin(ctx, provider, "oauth2_failed")
+		return nil, err
+	}
+	if err := ap.admitUser(ctx, callback.User); err != nil {
+		return nil, err
+	}
+	return callback.User, nil
 }
 
-func (ap *AuthProvider) authenticateWithAuthorizationCode(ctx context.Context, provider, code string) (User, error) {
-	// Implement authorization code-based authentication (e.g., OAuth)
-	// This might involve exchanging the code for tokens, validating the provider, fetching user info, etc.
-	// Return the authenticated user or an error if authentication fails
-	return nil, fmt.Errorf("not implemented")
+// authenticateWithMagicToken redeems the token of a link sent by RequestMagicLink.
+func (ap *AuthProvider) authenticateWithMagicToken(ctx context.Context, magicToken, ip, userAgent string) (User, error) {
+	user, err := ap.components.magicLinks.Redeem(ctx, magicToken, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	if err := ap.admitUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
-func (ap *AuthProvider) authenticateWithMagicToken(ctx context.Context, magicToken string) (User, error) {
-	// Implement magic token (magic link) based authentication
-	// This might involve validating the token, fetching the associated user, etc.
-	// Return the authenticated user or an error if authentication fails
+// authenticateWithWebAuthn verifies a passkey assertion, the second value reports whether the
+// authenticator verified the user, which satisfies MFA on its own.
+func (ap *AuthProvider) authenticateWithWebAuthn(ctx context.Context, assertion *WebAuthnCredentialAssertion) (User, bool, error) {
+	if !ap.components.webauthn.PasswordlessEnabled() {
+		return nil, false, fmt.Errorf("unsupported grant type: %s", GrantTypeWebAuthn)
+	}
 
-	return nil, fmt.Errorf("not implemented")
+	login, err := ap.components.webauthn.FinishLogin(ctx, assertion)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := ap.admitUser(ctx, login.User); err != nil {
+		return nil, false, err
+	}
+	return login.User, login.UserVerified, nil
 }
@@ -0,0 +1,326 @@
+package zephyrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+// UserStore is the storage backend of the users known to the AuthProvider.
+//
+// The default implementation stores users in the BeeORM `zephyrix_users` table,
+// a custom store can be plugged with Zephyrix.RegisterUserStore.
+// Lookups return ErrUserNotFound when no user matches.
+type UserStore interface {
+	GetByID(ctx context.Context, id uint64) (User, error)
+	GetByUsername(ctx context.Context, username string) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	Create(ctx context.Context, input NewUser) (User, error)
+	Update(ctx context.Context, user User) error
+}
+
+// NewUser holds the attributes of a user to create.
+type NewUser struct {
+	Username string
+	Email    string
+	Password string
+	Roles    []string
+	Active   bool
+	Metadata map[string]interface{}
+}
+
+// PasswordHashUser is implemented by users exposing their password hash,
+// the AuthProvider uses it to upgrade hashes in place when the hashing cost changes.
+type PasswordHashUser interface {
+	PasswordHash() string
+	SetPasswordHash(hash string)
+}
+
+// BeeORMUserStore is the default UserStore, backed by models.UserEntity.
+type BeeORMUserStore struct {
+	orm    beeorm.Engine
+	hasher *PasswordHasher
+}
+
+func NewBeeORMUserStore(orm beeorm.Engine, conf *Config) *BeeORMUserStore {
+	return &BeeORMUserStore{
+		orm:    orm,
+		hasher: NewPasswordHasher(conf.Authentication.PasswordHashingCost, conf.Authentication.PasswordHashingSalt),
+	}
+}
+
+func (s *BeeORMUserStore) GetByID(ctx context.Context, id uint64) (User, error) {
+	entity, found := beeorm.GetByID[models.UserEntity](s.orm.NewORM(ctx), id)
+	if !found {
+		return nil, ErrUserNotFound
+	}
+	return s.wrap(entity), nil
+}
+
+func (s *BeeORMUserStore) GetByUsername(ctx context.Context, username string) (User, error) {
+	entity, found := beeorm.GetByUniqueIndex[models.UserEntity](s.orm.NewORM(ctx), "username", normalizeUsername(username))
+	if !found {
+		return nil, ErrUserNotFound
+	}
+	return s.wrap(entity), nil
+}
+
+func (s *BeeORMUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	email = normalizeUsername(email)
+	if email == "" {
+		return nil, ErrUserNotFound
+	}
+	entity, found := beeorm.GetByUniqueIndex[models.UserEntity](s.orm.NewORM(ctx), "email", email)
+	if !found {
+		return nil, ErrUserNotFound
+	}
+	return s.wrap(entity), nil
+}
+
+func (s *BeeORMUserStore) Create(ctx context.Context, input NewUser) (User, error) {
+	username := normalizeUsername(input.Username)
+	email := normalizeUsername(input.Email)
+	if username == "" {
+		return nil, fmt.Errorf("username is required")
+	}
+
+	orm := s.orm.NewORM(ctx)
+	if _, found := beeorm.GetByUniqueIndex[models.UserEntity](orm, "username", username); found {
+		return nil, ErrUserExists
+	}
+	if email != "" {
+		if _, found := beeorm.GetByUniqueIndex[models.UserEntity](orm, "email", email); found {
+			return nil, ErrUserExists
+		}
+	}
+
+	now := time.Now().UTC()
+	entity := beeorm.NewEntity[models.UserEntity](orm)
+	entity.Username = username
+	entity.Email = email
+	entity.Active = input.Active
+	entity.CreatedAt = now
+	entity.UpdatedAt = now
+
+	user := s.wrap(entity)
+	user.roles = append(user.roles, input.Roles...)
+	for k, v := range input.Metadata {
+		user.metadata[k] = v
+	}
+	if input.Password != "" {
+		if err := user.SetPassword(input.Password); err != nil {
+			return nil, err
+		}
+	}
+	if err := user.encode(entity); err != nil {
+		return nil, err
+	}
+
+	if err := orm.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+	return user, nil
+}
+
+func (s *BeeORMUserStore) Update(ctx context.Context, u User) error {
+	user, ok := u.(*beeormUser)
+	if !ok {
+		return fmt.Errorf("user %d was not loaded from the BeeORM user store", u.ID())
+	}
+
+	orm := s.orm.NewORM(ctx)
+	entity := beeorm.EditEntity(orm, user.entity)
+	if err := user.encode(entity); err != nil {
+		return err
+	}
+	entity.UpdatedAt = time.Now().UTC()
+
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	user.entity = entity
+	return nil
+}
+
+func (s *BeeORMUserStore) wrap(entity *models.UserEntity) *beeormUser {
+	u := &beeormUser{
+		entity:   entity,
+		hasher:   s.hasher,
+		mfa:      make(map[string]string),
+		metadata: make(map[string]interface{}),
+		hash:     entity.PasswordHash,
+		changed:  entity.PasswordChangedAt,
+		active:   entity.Active,
+		locked:   entity.Locked,
+	}
+	if entity.LastLoginAt != nil {
+		u.lastLogin = *entity.LastLoginAt
+	}
+	_ = json.Unmarshal([]byte(entity.Roles), &u.roles)
+	_ = json.Unmarshal([]byte(entity.MFAMethods), &u.mfa)
+	_ = json.Unmarshal([]byte(entity.Metadata), &u.metadata)
+	return u
+}
+
+// normalizeUsername makes username and email lookups case-insensitive.
+func normalizeUsername(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// beeormUser implements User on top of models.UserEntity,
+// changes are kept in memory until the user is passed to BeeORMUserStore.Update.
+type beeormUser struct {
+	entity *models.UserEntity
+	hasher *PasswordHasher
+
+	hash      string
+	changed   time.Time
+	roles     []string
+	mfa       map[string]string
+	metadata  map[string]interface{}
+	active    bool
+	locked    bool
+	lastLogin time.Time
+}
+
+// encode writes the in-memory state of the user to an entity.
+func (u *beeormUser) encode(entity *models.UserEntity) error {
+	roles, err := json.Marshal(u.roles)
+	if err != nil {
+		return err
+	}
+	mfa, err := json.Marshal(u.mfa)
+	if err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(u.metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode user metadata: %w", err)
+	}
+
+	entity.PasswordHash = u.hash
+	entity.PasswordChangedAt = u.changed
+	entity.Roles = string(roles)
+	entity.MFAMethods = string(mfa)
+	entity.Metadata = string(metadata)
+	entity.Active = u.active
+	entity.Locked = u.locked
+	if !u.lastLogin.IsZero() {
+		lastLogin := u.lastLogin
+		entity.LastLoginAt = &lastLogin
+	}
+	return nil
+}
+
+func (u *beeormUser) ID() uint64       { return u.entity.ID }
+func (u *beeormUser) Username() string { return u.entity.Username }
+func (u *beeormUser) Email() string    { return u.entity.Email }
+
+func (u *beeormUser) CheckPassword(password string) bool {
+	return u.hasher.Verify(u.hash, password)
+}
+
+func (u *beeormUser) SetPassword(password string) error {
+	hash, err := u.hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	u.hash = hash
+	u.changed = time.Now().UTC()
+	return nil
+}
+
+func (u *beeormUser) PasswordLastChanged() time.Time { return u.changed }
+func (u *beeormUser) PasswordHash() string           { return u.hash }
+func (u *beeormUser) SetPasswordHash(hash string)    { u.hash = hash }
+
+func (u *beeormUser) Roles() []string { return u.roles }
+
+func (u *beeormUser) HasRole(role string) bool {
+	for _, r := range u.roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *beeormUser) AddRole(role string) error {
+	if !u.HasRole(role) {
+		u.roles = append(u.roles, role)
+	}
+	return nil
+}
+
+func (u *beeormUser) RemoveRole(role string) error {
+	for i, r := range u.roles {
+		if r == role {
+			u.roles = append(u.roles[:i], u.roles[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (u *beeormUser) HasMFAEnabled() bool { return len(u.mfa) > 0 }
+
+func (u *beeormUser) EnabledMFAMethods() []MFAMethod {
+	methods := make([]MFAMethod, 0, len(u.mfa))
+	for method := range u.mfa {
+		methods = append(methods, MFAMethod(method))
+	}
+	return methods
+}
+
+func (u *beeormUser) SetupMFA(method MFAMethod, secret string) error {
+	u.mfa[string(method)] = secret
+	return nil
+}
+
+func (u *beeormUser) DisableMFA(method MFAMethod) error {
+	delete(u.mfa, string(method))
+	return nil
+}
+
+func (u *beeormUser) GetMFASecret(method MFAMethod) (string, error) {
+	secret, ok := u.mfa[string(method)]
+	if !ok {
+		return "", fmt.Errorf("MFA method %s is not enabled", method)
+	}
+	return secret, nil
+}
+
+func (u *beeormUser) SetTOTPSecret(secret string) error { return u.SetupMFA(MFAMethodTOTP, secret) }
+func (u *beeormUser) GetTOTPSecret() (string, error)    { return u.GetMFASecret(MFAMethodTOTP) }
+
+func (u *beeormUser) IsActive() bool { return u.active }
+func (u *beeormUser) IsLocked() bool { return u.locked }
+func (u *beeormUser) Lock() error    { u.locked = true; return nil }
+func (u *beeormUser) Unlock() error  { u.locked = false; return nil }
+
+func (u *beeormUser) CreatedAt() time.Time   { return u.entity.CreatedAt }
+func (u *beeormUser) UpdatedAt() time.Time   { return u.entity.UpdatedAt }
+func (u *beeormUser) LastLoginAt() time.Time { return u.lastLogin }
+
+func (u *beeormUser) SetLastLoginAt(t time.Time) error {
+	u.lastLogin = t.UTC()
+	return nil
+}
+
+func (u *beeormUser) SetMetadata(key string, value interface{}) error {
+	u.metadata[key] = value
+	return nil
+}
+
+func (u *beeormUser) GetMetadata(key string) (interface{}, error) {
+	value, ok := u.metadata[key]
+	if !ok {
+		return nil, fmt.Errorf("metadata %s not found", key)
+	}
+	return value, nil
+}
@@ -0,0 +1,611 @@
+package zephyrix
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/latolukasz/beeorm/v3"
+	"go.mamad.dev/zephyrix/models"
+)
+
+const (
+	defaultWebAuthnTimeout  = 5 * time.Minute
+	webAuthnChallengeSize   = 32
+	webAuthnChallengePrefix = "zephyrix:webauthn:challenge:"
+
+	webAuthnCeremonyCreate = "webauthn.create"
+	webAuthnCeremonyGet    = "webauthn.get"
+)
+
+// WebAuthnConfig configures the relying party of the WebAuthn ceremonies.
+type WebAuthnConfig struct {
+	RPID             string        `mapstructure:"rp_id"`             // the domain of the site, e.g. example.com
+	RPName           string        `mapstructure:"rp_name"`           // shown by authenticators
+	Origins          []string      `mapstructure:"origins"`           // accepted origins, defaults to https://<rp_id>
+	Timeout          time.Duration `mapstructure:"timeout"`           // lifetime of a ceremony challenge
+	UserVerification string        `mapstructure:"user_verification"` // "required", "preferred" (default) or "discouraged"
+	ResidentKey      string        `mapstructure:"resident_key"`      // "required", "preferred" (default) or "discouraged"
+	Attestation      string        `mapstructure:"attestation"`       // "none" (default) or "direct"
+}
+
+// normalize applies the defaults of the configuration.
+func (c WebAuthnConfig) normalize() WebAuthnConfig {
+	if c.RPID == "" && len(c.Origins) > 0 {
+		if origin, err := url.Parse(c.Origins[0]); err == nil {
+			c.RPID = origin.Hostname()
+		}
+	}
+	if len(c.Origins) == 0 && c.RPID != "" {
+		c.Origins = []string{"https://" + c.RPID}
+	}
+	if c.RPName == "" {
+		c.RPName = c.RPID
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultWebAuthnTimeout
+	}
+	switch c.UserVerification {
+	case "required", "discouraged":
+	default:
+		c.UserVerification = "preferred"
+	}
+	switch c.ResidentKey {
+	case "required", "discouraged":
+	default:
+		c.ResidentKey = "preferred"
+	}
+	if c.Attestation != "direct" {
+		c.Attestation = "none"
+	}
+	return c
+}
+
+// WebAuthnCredential is the public description of a registered authenticator.
+type WebAuthnCredential struct {
+	ID           uint64     `json:"id"`
+	CredentialID string     `json:"credential_id"` // base64url encoded
+	Name         string     `json:"name"`
+	UserID       uint64     `json:"user_id"`
+	AAGUID       string     `json:"aaguid"`
+	Attestation  string     `json:"attestation"`
+	Transports   []string   `json:"transports,omitempty"`
+	SignCount    uint32     `json:"sign_count"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// The types below follow the JSON serialization of WebAuthn level 3, binary values are base64url encoded.
+// The options are passed to PublicKeyCredential.parseCreationOptionsFromJSON and parseRequestOptionsFromJSON,
+// the responses are the result of PublicKeyCredential.toJSON.
+
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebAuthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// WebAuthnCreationOptions starts the registration of a credential.
+type WebAuthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUserEntity             `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+// WebAuthnRequestOptions starts an authentication, AllowCredentials is empty for discoverable credentials.
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	Timeout          int64                          `json:"timeout"`
+	RPID             string                         `json:"rpId"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+type WebAuthnAttestationResponse struct {
+	ClientDataJSON    string   `json:"clientDataJSON"`
+	AttestationObject string   `json:"attestationObject"`
+	Transports        []string `json:"transports,omitempty"`
+}
+
+// WebAuthnCredentialCreation is the credential created by navigator.credentials.create.
+type WebAuthnCredentialCreation struct {
+	ID       string                      `json:"id"`
+	RawID    string                      `json:"rawId"`
+	Type     string                      `json:"type"`
+	Response WebAuthnAttestationResponse `json:"response"`
+}
+
+type WebAuthnAssertionResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// WebAuthnCredentialAssertion is the assertion returned by navigator.credentials.get.
+type WebAuthnCredentialAssertion struct {
+	ID       string                    `json:"id"`
+	RawID    string                    `json:"rawId"`
+	Type     string                    `json:"type"`
+	Response WebAuthnAssertionResponse `json:"response"`
+}
+
+// WebAuthnLogin is the outcome of a verified assertion.
+type WebAuthnLogin struct {
+	User       User
+	Credential *WebAuthnCredential
+
+	// UserVerified tells the authenticator verified the user with a PIN or biometrics,
+	// which makes the assertion a multi-factor authentication on its own.
+	UserVerified bool
+}
+
+// webAuthnSession is the server side state of a ceremony, keyed by its challenge.
+type webAuthnSession struct {
+	Ceremony string `json:"ceremony"`
+	UserID   uint64 `json:"user_id,omitempty"` // 0 when any discoverable credential may answer
+}
+
+// WebAuthnManager runs the WebAuthn (passkey) registration and authentication ceremonies.
+//
+// Credentials serve as a passwordless login when passwordless.webauthn is enabled, and as a second
+// factor when "webauthn" is one of the MFA methods.
+type WebAuthnManager struct {
+	config       WebAuthnConfig
+	passwordless bool
+	mfa          bool
+	orm          beeorm.Engine
+	redisClient  beeorm.RedisCache
+	users        UserStore
+	audit        *AuditLogger
+}
+
+func NewWebAuthnManager(conf *Config, orm beeorm.Engine, redisClient beeorm.RedisCache, users UserStore, audit *AuditLogger) *WebAuthnManager {
+	auth := conf.Authentication
+	return &WebAuthnManager{
+		config:       auth.Passwordless.WebAuthn.normalize(),
+		passwordless: auth.Passwordless.Enabled && auth.FeatureToggles.Passwordless && slices.Contains(auth.Passwordless.Methods, "webauthn"),
+		mfa:          auth.MFA.Enabled && slices.Contains(auth.MFA.Methods, string(MFAMethodWebAuthn)),
+		orm:          orm,
+		redisClient:  redisClient,
+		users:        users,
+		audit:        audit,
+	}
+}
+
+// Enabled reports whether credentials can be registered, for passwordless login or MFA.
+func (m *WebAuthnManager) Enabled() bool {
+	return (m.passwordless || m.mfa) && m.config.RPID != ""
+}
+
+// PasswordlessEnabled reports whether credentials may log users in without a password.
+func (m *WebAuthnManager) PasswordlessEnabled() bool {
+	return m.passwordless && m.config.RPID != ""
+}
+
+// BeginRegistration returns the options of navigator.credentials.create for a new credential of the user.
+func (m *WebAuthnManager) BeginRegistration(ctx context.Context, user User) (*WebAuthnCreationOptions, error) {
+	if !m.Enabled() {
+		return nil, errors.New("WebAuthn is not enabled")
+	}
+
+	credentials, err := m.Credentials(ctx, user.ID())
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := m.newChallenge(ctx, webAuthnSession{Ceremony: webAuthnCeremonyCreate, UserID: user.ID()})
+	if err != nil {
+		return nil, err
+	}
+
+	displayName := user.Email()
+	if displayName == "" {
+		displayName = user.Username()
+	}
+
+	options := &WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP:        WebAuthnRelyingParty{ID: m.config.RPID, Name: m.config.RPName},
+		User: WebAuthnUserEntity{
+			ID:          base64.RawURLEncoding.EncodeToString(webAuthnUserHandle(user.ID())),
+			Name:        user.Username(),
+			DisplayName: displayName,
+		},
+		Timeout:            m.config.Timeout.Milliseconds(),
+		ExcludeCredentials: m.descriptors(credentials),
+		AuthenticatorSelection: WebAuthnAuthenticatorSelection{
+			ResidentKey:        m.config.ResidentKey,
+			RequireResidentKey: m.config.ResidentKey == "required",
+			UserVerification:   m.config.UserVerification,
+		},
+		Attestation: m.config.Attestation,
+	}
+	for _, alg := range webAuthnSupportedAlgorithms {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, WebAuthnCredentialParameter{Type: "public-key", Alg: alg})
+	}
+	return options, nil
+}
+
+// FinishRegistration verifies the created credential and stores it for the user.
+func (m *WebAuthnManager) FinishRegistration(ctx context.Context, user User, name string, credential *WebAuthnCredentialCreation) (*WebAuthnCredential, error) {
+	if !m.Enabled() {
+		return nil, errors.New("WebAuthn is not enabled")
+	}
+
+	clientData, attestation, err := m.config.verifyCreation(credential)
+	if err != nil {
+		return nil, err
+	}
+	session, err := m.consumeChallenge(ctx, clientData.Challenge, webAuthnCeremonyCreate)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != user.ID() {
+		return nil, fmt.Errorf("%w: the challenge was issued to another user", ErrInvalidWebAuthn)
+	}
+
+	orm := m.orm.NewORM(ctx)
+	credentialID := base64.RawURLEncoding.EncodeToString(attestation.AuthData.CredentialID)
+	if _, found := beeorm.GetByUniqueIndex[models.WebAuthnCredentialEntity](orm, "credential_id", credentialID); found {
+		return nil, fmt.Errorf("%w: the credential is already registered", ErrInvalidWebAuthn)
+	}
+
+	transports, _ := json.Marshal(credential.Response.Transports)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	entity := beeorm.NewEntity[models.WebAuthnCredentialEntity](orm)
+	entity.CredentialID = credentialID
+	entity.UserID = user.ID()
+	entity.Name = name
+	entity.PublicKey = base64.RawURLEncoding.EncodeToString(attestation.AuthData.PublicKey)
+	entity.SignCount = attestation.AuthData.SignCount
+	entity.AAGUID = hex.EncodeToString(attestation.AuthData.AAGUID)
+	entity.Attestation = attestation.Format
+	entity.Transports = string(transports)
+	entity.CreatedAt = time.Now().UTC()
+	if err := orm.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to save WebAuthn credential: %w", err)
+	}
+
+	if m.mfa {
+		// the credentials live in their own table, the MFA entry only marks the method as enabled
+		if err := user.SetupMFA(MFAMethodWebAuthn, ""); err == nil {
+			if err := m.users.Update(ctx, user); err != nil {
+				Logger.Error("Failed to enable WebAuthn MFA for user %d: %s", user.ID(), err)
+			}
+		}
+	}
+
+	m.log(ctx, "webauthn_registered", user.ID(), fmt.Sprintf("credential=%d attestation=%s", entity.ID, entity.Attestation))
+	return webAuthnCredentialFromEntity(entity), nil
+}
+
+// BeginLogin returns the options of navigator.credentials.get. With a nil user any discoverable
+// credential may answer, otherwise only the credentials of the user are allowed.
+func (m *WebAuthnManager) BeginLogin(ctx context.Context, user User) (*WebAuthnRequestOptions, error) {
+	if !m.Enabled() {
+		return nil, errors.New("WebAuthn is not enabled")
+	}
+
+	session := webAuthnSession{Ceremony: webAuthnCeremonyGet}
+	var credentials []*WebAuthnCredential
+	if user != nil {
+		var err error
+		if credentials, err = m.Credentials(ctx, user.ID()); err != nil {
+			return nil, err
+		}
+		if len(credentials) == 0 {
+			return nil, fmt.Errorf("%w: no credential registered", ErrInvalidWebAuthn)
+		}
+		session.UserID = user.ID()
+	}
+
+	challenge, err := m.newChallenge(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          m.config.Timeout.Milliseconds(),
+		RPID:             m.config.RPID,
+		AllowCredentials: m.descriptors(credentials),
+		UserVerification: m.config.UserVerification,
+	}, nil
+}
+
+// FinishLogin verifies an assertion and returns the user owning the credential.
+func (m *WebAuthnManager) FinishLogin(ctx context.Context, assertion *WebAuthnCredentialAssertion) (*WebAuthnLogin, error) {
+	if !m.Enabled() {
+		return nil, errors.New("WebAuthn is not enabled")
+	}
+
+	rawID, err := decodeWebAuthnBase64(assertion.ID)
+	if err != nil || len(rawID) == 0 {
+		return nil, fmt.Errorf("%w: malformed credential ID", ErrInvalidWebAuthn)
+	}
+
+	orm := m.orm.NewORM(ctx)
+	entity, found := beeorm.GetByUniqueIndex[models.WebAuthnCredentialEntity](orm, "credential_id", base64.RawURLEncoding.EncodeToString(rawID))
+	if !found {
+		return nil, fmt.Errorf("%w: unknown credential", ErrInvalidWebAuthn)
+	}
+
+	publicKey, err := decodeWebAuthnBase64(entity.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stored WebAuthn key: %w", err)
+	}
+	clientData, authData, err := m.config.verifyAssertion(assertion, publicKey, entity.SignCount)
+	if err != nil {
+		if errors.Is(err, errWebAuthnSignCount) {
+			m.log(ctx, "webauthn_clone_detected", entity.UserID, fmt.Sprintf("credential=%d", entity.ID))
+		}
+		return nil, err
+	}
+
+	session, err := m.consumeChallenge(ctx, clientData.Challenge, webAuthnCeremonyGet)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != 0 && session.UserID != entity.UserID {
+		return nil, fmt.Errorf("%w: the credential belongs to another user", ErrInvalidWebAuthn)
+	}
+	if assertion.Response.UserHandle != "" {
+		handle, err := decodeWebAuthnBase64(assertion.Response.UserHandle)
+		if err != nil || string(handle) != string(webAuthnUserHandle(entity.UserID)) {
+			return nil, fmt.Errorf("%w: user handle mismatch", ErrInvalidWebAuthn)
+		}
+	}
+
+	user, err := m.users.GetByID(ctx, entity.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	edited := beeorm.EditEntity(orm, entity)
+	edited.SignCount = authData.SignCount
+	edited.LastUsedAt = &now
+	if err := orm.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to update WebAuthn credential: %w", err)
+	}
+
+	m.log(ctx, "webauthn_login", entity.UserID, fmt.Sprintf("credential=%d", entity.ID))
+	return &WebAuthnLogin{User: user, Credential: webAuthnCredentialFromEntity(edited), UserVerified: authData.userVerified()}, nil
+}
+
+// Credentials returns the credentials registered by a user.
+func (m *WebAuthnManager) Credentials(ctx context.Context, userID uint64) ([]*WebAuthnCredential, error) {
+	var credentials []*WebAuthnCredential
+	iterator := beeorm.Search[models.WebAuthnCredentialEntity](m.orm.NewORM(ctx), beeorm.NewWhere("`UserID` = ?", userID), nil)
+	for iterator.Next() {
+		credentials = append(credentials, webAuthnCredentialFromEntity(iterator.Entity()))
+	}
+	return credentials, nil
+}
+
+// DeleteCredential removes a credential of the user, WebAuthn MFA is disabled with the last one.
+func (m *WebAuthnManager) DeleteCredential(ctx context.Context, user User, id uint64) error {
+	orm := m.orm.NewORM(ctx)
+	entity, found := beeorm.GetByID[models.WebAuthnCredentialEntity](orm, id)
+	if !found || entity.UserID != user.ID() {
+		return fmt.Errorf("WebAuthn credential %d not found", id)
+	}
+	beeorm.DeleteEntity(orm, entity)
+	if err := orm.Flush(); err != nil {
+		return fmt.Errorf("failed to delete WebAuthn credential: %w", err)
+	}
+
+	if remaining, err := m.Credentials(ctx, user.ID()); err == nil && len(remaining) == 0 {
+		if err := user.DisableMFA(MFAMethodWebAuthn); err == nil {
+			if err := m.users.Update(ctx, user); err != nil {
+				Logger.Error("Failed to disable WebAuthn MFA for user %d: %s", user.ID(), err)
+			}
+		}
+	}
+
+	m.log(ctx, "webauthn_deleted", user.ID(), fmt.Sprintf("credential=%d", id))
+	return nil
+}
+
+func (m *WebAuthnManager) newChallenge(ctx context.Context, session webAuthnSession) (string, error) {
+	raw := make([]byte, webAuthnChallengeSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate WebAuthn challenge: %w", err)
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(raw)
+
+	encoded, _ := json.Marshal(session)
+	m.redisClient.Set(m.orm.NewORM(ctx), webAuthnChallengePrefix+challenge, string(encoded), m.config.Timeout)
+	return challenge, nil
+}
+
+// consumeChallenge returns the session of a challenge, a challenge can only be answered once.
+func (m *WebAuthnManager) consumeChallenge(ctx context.Context, challenge, ceremony string) (*webAuthnSession, error) {
+	orm := m.orm.NewORM(ctx)
+	key := webAuthnChallengePrefix + challenge
+
+	encoded, found := m.redisClient.Get(orm, key)
+	if !found || !m.redisClient.SetNX(orm, key+":used", "1", m.config.Timeout) {
+		return nil, fmt.Errorf("%w: unknown or expired challenge", ErrInvalidWebAuthn)
+	}
+	m.redisClient.Del(orm, key)
+
+	var session webAuthnSession
+	if err := json.Unmarshal([]byte(encoded), &session); err != nil || session.Ceremony != ceremony {
+		return nil, fmt.Errorf("%w: unexpected ceremony", ErrInvalidWebAuthn)
+	}
+	return &session, nil
+}
+
+func (m *WebAuthnManager) descriptors(credentials []*WebAuthnCredential) []WebAuthnCredentialDescriptor {
+	descriptors := make([]WebAuthnCredentialDescriptor, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptors = append(descriptors, WebAuthnCredentialDescriptor{Type: "public-key", ID: credential.CredentialID, Transports: credential.Transports})
+	}
+	return descriptors
+}
+
+func (m *WebAuthnManager) log(ctx context.Context, action string, userID uint64, details string) {
+	if m.audit == nil {
+		return
+	}
+	if err := m.audit.Log(ctx, action, strconv.FormatUint(userID, 10), details); err != nil {
+		Logger.Error("Failed to write audit log: %s", err)
+	}
+}
+
+// webAuthnUserHandle is the user.id of the credentials, an opaque value that does not reveal the username.
+func webAuthnUserHandle(userID uint64) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, userID)
+	return handle
+}
+
+// errWebAuthnSignCount reports a signature counter that did not increase.
+var errWebAuthnSignCount = fmt.Errorf("%w: the signature counter did not increase, the authenticator may be cloned", ErrInvalidWebAuthn)
+
+// verifyCreation verifies a registration response, except the challenge which is checked by the caller.
+func (c WebAuthnConfig) verifyCreation(credential *WebAuthnCredentialCreation) (*webAuthnClientData, *webAuthnAttestation, error) {
+	if credential == nil || credential.Type != "public-key" {
+		return nil, nil, fmt.Errorf("%w: unexpected credential type", ErrInvalidWebAuthn)
+	}
+	rawClientData, err := decodeWebAuthnBase64(credential.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed client data", ErrInvalidWebAuthn)
+	}
+	clientData, err := parseWebAuthnClientData(rawClientData, webAuthnCeremonyCreate, c.Origins)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawAttestation, err := decodeWebAuthnBase64(credential.Response.AttestationObject)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed attestation object", ErrInvalidWebAuthn)
+	}
+	attestation, err := parseWebAuthnAttestationObject(rawAttestation)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkWebAuthnAuthenticatorData(attestation.AuthData, c.RPID, c.UserVerification == "required"); err != nil {
+		return nil, nil, err
+	}
+	if credential.RawID != "" {
+		if rawID, err := decodeWebAuthnBase64(credential.RawID); err != nil || string(rawID) != string(attestation.AuthData.CredentialID) {
+			return nil, nil, fmt.Errorf("%w: credential ID mismatch", ErrInvalidWebAuthn)
+		}
+	}
+
+	key, err := parseCOSEKey(attestation.AuthData.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	if err := attestation.verify(clientDataHash[:], key); err != nil {
+		return nil, nil, err
+	}
+	return clientData, attestation, nil
+}
+
+// verifyAssertion verifies an assertion made with the stored public key, except the challenge
+// which is checked by the caller.
+func (c WebAuthnConfig) verifyAssertion(assertion *WebAuthnCredentialAssertion, publicKey []byte, signCount uint32) (*webAuthnClientData, *webAuthnAuthenticatorData, error) {
+	if assertion == nil || assertion.Type != "public-key" {
+		return nil, nil, fmt.Errorf("%w: unexpected credential type", ErrInvalidWebAuthn)
+	}
+	rawClientData, err := decodeWebAuthnBase64(assertion.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed client data", ErrInvalidWebAuthn)
+	}
+	clientData, err := parseWebAuthnClientData(rawClientData, webAuthnCeremonyGet, c.Origins)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawAuthData, err := decodeWebAuthnBase64(assertion.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed authenticator data", ErrInvalidWebAuthn)
+	}
+	authData, err := parseWebAuthnAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkWebAuthnAuthenticatorData(authData, c.RPID, c.UserVerification == "required"); err != nil {
+		return nil, nil, err
+	}
+
+	signature, err := decodeWebAuthnBase64(assertion.Response.Signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed signature", ErrInvalidWebAuthn)
+	}
+	key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash[:]...)
+	if err := key.verify(signed, signature); err != nil {
+		return nil, nil, err
+	}
+
+	// authenticators without a counter always report 0
+	if (authData.SignCount != 0 || signCount != 0) && authData.SignCount <= signCount {
+		return nil, nil, errWebAuthnSignCount
+	}
+	return clientData, authData, nil
+}
+
+func webAuthnCredentialFromEntity(entity *models.WebAuthnCredentialEntity) *WebAuthnCredential {
+	credential := &WebAuthnCredential{
+		ID:           entity.ID,
+		Name:         entity.Name,
+		UserID:       entity.UserID,
+		AAGUID:       entity.AAGUID,
+		Attestation:  entity.Attestation,
+		SignCount:    entity.SignCount,
+		LastUsedAt:   entity.LastUsedAt,
+		CreatedAt:    entity.CreatedAt,
+		CredentialID: entity.CredentialID,
+	}
+	_ = json.Unmarshal([]byte(entity.Transports), &credential.Transports)
+	return credential
+}
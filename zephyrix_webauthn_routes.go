@@ -0,0 +1,198 @@
+package zephyrix
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webAuthnRouteHandler is one of the JSON endpoints of the WebAuthn ceremonies, mounted under /auth/webauthn:
+//
+//	POST /auth/webauthn/register/begin   (authenticated) -> WebAuthnCreationOptions
+//	POST /auth/webauthn/register/finish  (authenticated) {"name", "credential"} -> WebAuthnCredential
+//	POST /auth/webauthn/login/begin      {"username"} or {"mfa_token"}, both optional -> WebAuthnRequestOptions
+//	POST /auth/webauthn/login/finish     {"credential", "device_id", "mfa_token", "remember_device"} -> AuthResult
+//
+// The endpoints answer 404 while WebAuthn is disabled.
+type webAuthnRouteHandler struct {
+	name    string
+	path    string
+	handler []any
+}
+
+func (h *webAuthnRouteHandler) Name() string     { return h.name }
+func (h *webAuthnRouteHandler) Method() []string { return []string{http.MethodPost} }
+func (h *webAuthnRouteHandler) Path() string     { return h.path }
+func (h *webAuthnRouteHandler) Handlers() []any  { return h.handler }
+
+func newWebAuthnRegisterBeginRoute(ap *AuthProvider) *webAuthnRouteHandler {
+	return &webAuthnRouteHandler{
+		name: "webauthn_register_begin",
+		path: "/auth/webauthn/register/begin",
+		handler: []any{ap.requireWebAuthn, ap.Middleware(), func(c *gin.Context) {
+			options, err := ap.components.webauthn.BeginRegistration(c.Request.Context(), c.Value(userContextKey).(User))
+			if err != nil {
+				writeWebAuthnError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"publicKey": options})
+		}},
+	}
+}
+
+func newWebAuthnRegisterFinishRoute(ap *AuthProvider) *webAuthnRouteHandler {
+	return &webAuthnRouteHandler{
+		name: "webauthn_register_finish",
+		path: "/auth/webauthn/register/finish",
+		handler: []any{ap.requireWebAuthn, ap.Middleware(), func(c *gin.Context) {
+			var body struct {
+				Name       string                      `json:"name"`
+				Credential *WebAuthnCredentialCreation `json:"credential"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Credential == nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			credential, err := ap.components.webauthn.FinishRegistration(c.Request.Context(), c.Value(userContextKey).(User), body.Name, body.Credential)
+			if err != nil {
+				writeWebAuthnError(c, err)
+				return
+			}
+			c.JSON(http.StatusCreated, credential)
+		}},
+	}
+}
+
+func newWebAuthnLoginBeginRoute(ap *AuthProvider) *webAuthnRouteHandler {
+	return &webAuthnRouteHandler{
+		name: "webauthn_login_begin",
+		path: "/auth/webauthn/login/begin",
+		handler: []any{ap.requireWebAuthn, func(c *gin.Context) {
+			var body struct {
+				Username string `json:"username"`
+				MFAToken string `json:"mfa_token"`
+			}
+			if c.Request.ContentLength != 0 {
+				if err := c.ShouldBindJSON(&body); err != nil {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+					return
+				}
+			}
+
+			ctx := c.Request.Context()
+			var user User
+			switch {
+			case body.MFAToken != "":
+				_, state, challengeUser, err := ap.loadMFAChallenge(ctx, body.MFAToken)
+				if err != nil {
+					writeWebAuthnError(c, err)
+					return
+				}
+				if !state.allows(MFAMethodWebAuthn) {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "message": "webauthn is not enabled for this user"})
+					return
+				}
+				user = challengeUser
+			case body.Username != "":
+				if !ap.components.webauthn.PasswordlessEnabled() {
+					c.AbortWithStatus(http.StatusNotFound)
+					return
+				}
+				// unknown users and users without passkeys get discoverable options,
+				// so the answer does not reveal which accounts exist
+				if found, err := ap.getUserByUsername(ctx, body.Username); err == nil {
+					if credentials, err := ap.components.webauthn.Credentials(ctx, found.ID()); err == nil && len(credentials) > 0 {
+						user = found
+					}
+				}
+			case !ap.components.webauthn.PasswordlessEnabled():
+				c.AbortWithStatus(http.StatusNotFound)
+				return
+			}
+
+			options, err := ap.components.webauthn.BeginLogin(ctx, user)
+			if err != nil {
+				writeWebAuthnError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"publicKey": options})
+		}},
+	}
+}
+
+func newWebAuthnLoginFinishRoute(ap *AuthProvider) *webAuthnRouteHandler {
+	return &webAuthnRouteHandler{
+		name: "webauthn_login_finish",
+		path: "/auth/webauthn/login/finish",
+		handler: []any{ap.requireWebAuthn, func(c *gin.Context) {
+			var body struct {
+				Credential     *WebAuthnCredentialAssertion `json:"credential"`
+				DeviceID       string                       `json:"device_id"`
+				MFAToken       string                       `json:"mfa_token"`
+				RememberDevice bool                         `json:"remember_device"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil || body.Credential == nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+				return
+			}
+
+			var result *AuthResult
+			var err error
+			if body.MFAToken != "" {
+				assertion, _ := json.Marshal(body.Credential)
+				result, err = ap.VerifyMFA(c.Request.Context(), MFAVerification{
+					Challenge:      body.MFAToken,
+					Method:         string(MFAMethodWebAuthn),
+					Token:          string(assertion),
+					IP:             c.ClientIP(),
+					RememberDevice: body.RememberDevice,
+				})
+			} else {
+				result, err = ap.AuthenticateUser(c.Request.Context(), Authenticate{
+					GrantType: GrantTypeWebAuthn,
+					WebAuthn:  body.Credential,
+					DeviceID:  body.DeviceID,
+					IP:        c.ClientIP(),
+					UserAgent: c.Request.UserAgent(),
+				})
+			}
+			if err != nil {
+				writeWebAuthnError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, result)
+		}},
+	}
+}
+
+// requireWebAuthn hides the endpoints while WebAuthn is disabled.
+func (ap *AuthProvider) requireWebAuthn(c *gin.Context) {
+	if ap.components.webauthn == nil || !ap.components.webauthn.Enabled() {
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// writeWebAuthnError maps the errors of the ceremonies to JSON responses.
+func writeWebAuthnError(c *gin.Context, err error) {
+	var challenge *MFAChallenge
+	switch {
+	case errors.As(err, &challenge):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "mfa_required", "mfa": challenge})
+	case errors.Is(err, ErrMFAEnrollmentRequired):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "mfa_enrollment_required", "message": err.Error()})
+	case errors.Is(err, ErrInvalidWebAuthn), errors.Is(err, ErrInvalidMFAChallenge), errors.Is(err, ErrInvalidMFAToken):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_credential", "message": err.Error()})
+	case errors.Is(err, ErrRateLimited):
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate_limited"})
+	case errors.Is(err, ErrEmailNotVerified):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "email_not_verified", "message": err.Error()})
+	case errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrAccountLocked):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "message": err.Error()})
+	default:
+		Logger.Error("WebAuthn ceremony failed: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+	}
+}
@@ -0,0 +1,389 @@
+package zephyrix
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// cborEncode encodes the few types the fixtures need: ints, []byte, string, []interface{} and maps.
+func cborEncode(v interface{}) []byte {
+	header := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return header(1, uint64(-1-v))
+		}
+		return header(0, uint64(v))
+	case int64:
+		return cborEncode(int(v))
+	case []byte:
+		return append(header(2, uint64(len(v))), v...)
+	case string:
+		return append(header(3, uint64(len(v))), v...)
+	case []interface{}:
+		out := header(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, cborEncode(item)...)
+		}
+		return out
+	case map[interface{}]interface{}:
+		// canonical order: shorter encoded keys first, then bytewise
+		keys := make([][]byte, 0, len(v))
+		values := make(map[string][]byte, len(v))
+		for key, value := range v {
+			encoded := cborEncode(key)
+			keys = append(keys, encoded)
+			values[string(encoded)] = cborEncode(value)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return string(keys[i]) < string(keys[j])
+		})
+		out := header(5, uint64(len(v)))
+		for _, key := range keys {
+			out = append(append(out, key...), values[string(key)]...)
+		}
+		return out
+	default:
+		panic("cborEncode: unsupported type")
+	}
+}
+
+// softAuthenticator is a software WebAuthn authenticator holding a single credential.
+type softAuthenticator struct {
+	credentialID []byte
+	signer       crypto.Signer
+	alg          int64
+	signCount    uint32
+	noCounter    bool
+	aaguid       []byte
+	flags        byte
+}
+
+func newSoftAuthenticator(t *testing.T, alg int64) *softAuthenticator {
+	a := &softAuthenticator{
+		credentialID: make([]byte, 16),
+		alg:          alg,
+		aaguid:       make([]byte, 16),
+		flags:        webAuthnFlagUserPresent | webAuthnFlagUserVerified,
+	}
+	_, _ = rand.Read(a.credentialID)
+	_, _ = rand.Read(a.aaguid)
+
+	var err error
+	switch alg {
+	case coseAlgES256:
+		a.signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseAlgEdDSA:
+		_, a.signer, err = ed25519.GenerateKey(rand.Reader)
+	}
+	require.NoError(t, err)
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	switch key := a.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		return cborEncode(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: x, -3: y})
+	case ed25519.PublicKey:
+		return cborEncode(map[interface{}]interface{}{1: 1, 3: coseAlgEdDSA, -1: 6, -2: []byte(key)})
+	}
+	return nil
+}
+
+func (a *softAuthenticator) sign(data []byte) []byte {
+	var signature []byte
+	var err error
+	if a.alg == coseAlgEdDSA {
+		signature, err = a.signer.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(data)
+		signature, err = a.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return signature
+}
+
+func (a *softAuthenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= webAuthnFlagAttestedData
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, a.aaguid...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func clientDataJSON(ceremony, challenge, origin string) []byte {
+	raw, _ := json.Marshal(webAuthnClientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	return raw
+}
+
+// create answers navigator.credentials.create, statement builds the attestation statement.
+func (a *softAuthenticator) create(rpID, origin, challenge, format string, statement func(authData, clientDataHash []byte) map[interface{}]interface{}) *WebAuthnCredentialCreation {
+	clientData := clientDataJSON(webAuthnCeremonyCreate, challenge, origin)
+	authData := a.authData(rpID, true)
+	clientDataHash := sha256.Sum256(clientData)
+
+	attStmt := map[interface{}]interface{}{}
+	if statement != nil {
+		attStmt = statement(authData, clientDataHash[:])
+	}
+	attestationObject := cborEncode(map[interface{}]interface{}{"fmt": format, "attStmt": attStmt, "authData": authData})
+
+	encode := base64.RawURLEncoding.EncodeToString
+	return &WebAuthnCredentialCreation{
+		ID:    encode(a.credentialID),
+		RawID: encode(a.credentialID),
+		Type:  "public-key",
+		Response: WebAuthnAttestationResponse{
+			ClientDataJSON:    encode(clientData),
+			AttestationObject: encode(attestationObject),
+			Transports:        []string{"internal"},
+		},
+	}
+}
+
+// get answers navigator.credentials.get, incrementing the signature counter.
+func (a *softAuthenticator) get(rpID, origin, challenge string) *WebAuthnCredentialAssertion {
+	if !a.noCounter {
+		a.signCount++
+	}
+	clientData := clientDataJSON(webAuthnCeremonyGet, challenge, origin)
+	authData := a.authData(rpID, false)
+	clientDataHash := sha256.Sum256(clientData)
+
+	encode := base64.RawURLEncoding.EncodeToString
+	return &WebAuthnCredentialAssertion{
+		ID:    encode(a.credentialID),
+		RawID: encode(a.credentialID),
+		Type:  "public-key",
+		Response: WebAuthnAssertionResponse{
+			ClientDataJSON:    encode(clientData),
+			AuthenticatorData: encode(authData),
+			Signature:         encode(a.sign(append(authData, clientDataHash[:]...))),
+		},
+	}
+}
+
+func testWebAuthnConfig() WebAuthnConfig {
+	return WebAuthnConfig{RPID: "example.com", Origins: []string{"https://example.com"}}.normalize()
+}
+
+func TestCBORDecode(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f93c00", float64(1)},
+		{"c11a514b67b0", int64(1363896240)},
+	}
+	for _, test := range tests {
+		raw, _ := hex.DecodeString(test.hex)
+		got, rest, err := cborDecode(raw)
+		require.NoError(t, err, test.hex)
+		require.Empty(t, rest, test.hex)
+		require.Equal(t, test.want, got, test.hex)
+	}
+
+	for _, invalid := range []string{"", "18", "5f", "9f", "62ff", "a10101a1", "a1010101"} {
+		raw, _ := hex.DecodeString(invalid)
+		_, rest, err := cborDecode(raw)
+		if err == nil {
+			require.NotEmpty(t, rest, invalid)
+		}
+	}
+	_, _, err := cborDecode([]byte{0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x00})
+	require.Error(t, err)
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	config := testWebAuthnConfig()
+
+	t.Run("none attestation", func(t *testing.T) {
+		authenticator := newSoftAuthenticator(t, coseAlgES256)
+		clientData, attestation, err := config.verifyCreation(authenticator.create("example.com", "https://example.com", "challenge", "none", nil))
+		require.NoError(t, err)
+		require.Equal(t, "challenge", clientData.Challenge)
+		require.Equal(t, authenticator.credentialID, attestation.AuthData.CredentialID)
+		require.Equal(t, authenticator.aaguid, attestation.AuthData.AAGUID)
+	})
+
+	t.Run("packed self attestation", func(t *testing.T) {
+		authenticator := newSoftAuthenticator(t, coseAlgEdDSA)
+		credential := authenticator.create("example.com", "https://example.com", "challenge", "packed", func(authData, clientDataHash []byte) map[interface{}]interface{} {
+			return map[interface{}]interface{}{"alg": coseAlgEdDSA, "sig": authenticator.sign(append(append([]byte{}, authData...), clientDataHash...))}
+		})
+		_, attestation, err := config.verifyCreation(credential)
+		require.NoError(t, err)
+		require.Equal(t, "packed", attestation.Format)
+	})
+
+	t.Run("packed attestation certificate", func(t *testing.T) {
+		authenticator := newSoftAuthenticator(t, coseAlgES256)
+		attestationKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		aaguid, _ := asn1.Marshal(authenticator.aaguid)
+		template := &x509.Certificate{
+			SerialNumber:    big.NewInt(1),
+			Subject:         pkix.Name{CommonName: "Soft Authenticator", OrganizationalUnit: []string{"Authenticator Attestation"}},
+			NotBefore:       time.Now().Add(-time.Hour),
+			NotAfter:        time.Now().Add(time.Hour),
+			ExtraExtensions: []pkix.Extension{{Id: oidFIDOGenCeAAGUID, Value: aaguid}},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &attestationKey.PublicKey, attestationKey)
+		require.NoError(t, err)
+
+		credential := authenticator.create("example.com", "https://example.com", "challenge", "packed", func(authData, clientDataHash []byte) map[interface{}]interface{} {
+			digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash...))
+			signature, err := ecdsa.SignASN1(rand.Reader, attestationKey, digest[:])
+			require.NoError(t, err)
+			return map[interface{}]interface{}{"alg": coseAlgES256, "sig": signature, "x5c": []interface{}{der}}
+		})
+		_, _, err = config.verifyCreation(credential)
+		require.NoError(t, err)
+
+		// a statement signed by another key is refused
+		credential = authenticator.create("example.com", "https://example.com", "challenge", "packed", func(authData, clientDataHash []byte) map[interface{}]interface{} {
+			return map[interface{}]interface{}{"alg": coseAlgES256, "sig": authenticator.sign(append(append([]byte{}, authData...), clientDataHash...)), "x5c": []interface{}{der}}
+		})
+		_, _, err = config.verifyCreation(credential)
+		require.ErrorIs(t, err, ErrInvalidWebAuthn)
+	})
+
+	t.Run("rejections", func(t *testing.T) {
+		authenticator := newSoftAuthenticator(t, coseAlgES256)
+		for name, credential := range map[string]*WebAuthnCredentialCreation{
+			"origin": authenticator.create("example.com", "https://evil.example", "challenge", "none", nil),
+			"rp id":  authenticator.create("evil.example", "https://example.com", "challenge", "none", nil),
+			"format": authenticator.create("example.com", "https://example.com", "challenge", "fido-u2f", nil),
+			"none with statement": authenticator.create("example.com", "https://example.com", "challenge", "none", func(_, _ []byte) map[interface{}]interface{} {
+				return map[interface{}]interface{}{"alg": coseAlgES256}
+			}),
+		} {
+			_, _, err := config.verifyCreation(credential)
+			require.ErrorIs(t, err, ErrInvalidWebAuthn, name)
+		}
+
+		credential := authenticator.create("example.com", "https://example.com", "challenge", "none", nil)
+		credential.RawID = base64.RawURLEncoding.EncodeToString([]byte("another credential"))
+		_, _, err := config.verifyCreation(credential)
+		require.ErrorIs(t, err, ErrInvalidWebAuthn)
+
+		authenticator.flags = webAuthnFlagUserPresent
+		required := config
+		required.UserVerification = "required"
+		_, _, err = required.verifyCreation(authenticator.create("example.com", "https://example.com", "challenge", "none", nil))
+		require.ErrorIs(t, err, ErrInvalidWebAuthn)
+	})
+}
+
+func TestWebAuthnAssertion(t *testing.T) {
+	config := testWebAuthnConfig()
+
+	for _, alg := range []int64{coseAlgES256, coseAlgEdDSA} {
+		authenticator := newSoftAuthenticator(t, alg)
+		publicKey := authenticator.coseKey()
+
+		clientData, authData, err := config.verifyAssertion(authenticator.get("example.com", "https://example.com", "challenge"), publicKey, 0)
+		require.NoError(t, err)
+		require.Equal(t, "challenge", clientData.Challenge)
+		require.Equal(t, uint32(1), authData.SignCount)
+		require.True(t, authData.userVerified())
+
+		// the counter must move forward, a replayed or cloned authenticator lags behind
+		_, _, err = config.verifyAssertion(authenticator.get("example.com", "https://example.com", "challenge"), publicKey, 5)
+		require.ErrorIs(t, err, errWebAuthnSignCount)
+
+		assertion := authenticator.get("example.com", "https://example.com", "challenge")
+		assertion.Response.Signature = base64.RawURLEncoding.EncodeToString(authenticator.sign([]byte("something else")))
+		_, _, err = config.verifyAssertion(assertion, publicKey, 0)
+		require.ErrorIs(t, err, ErrInvalidWebAuthn)
+
+		_, _, err = config.verifyAssertion(authenticator.get("example.com", "https://example.com", "challenge"), newSoftAuthenticator(t, alg).coseKey(), 0)
+		require.ErrorIs(t, err, ErrInvalidWebAuthn)
+	}
+
+	// authenticators without a counter always report 0
+	authenticator := newSoftAuthenticator(t, coseAlgES256)
+	authenticator.noCounter = true
+	for i := 0; i < 2; i++ {
+		_, authData, err := config.verifyAssertion(authenticator.get("example.com", "https://example.com", "challenge"), authenticator.coseKey(), 0)
+		require.NoError(t, err)
+		require.Zero(t, authData.SignCount)
+	}
+
+	// a registration response is not an assertion
+	created := authenticator.create("example.com", "https://example.com", "challenge", "none", nil)
+	_, _, err := config.verifyAssertion(&WebAuthnCredentialAssertion{Type: "public-key", Response: WebAuthnAssertionResponse{ClientDataJSON: created.Response.ClientDataJSON}}, authenticator.coseKey(), 0)
+	require.ErrorIs(t, err, ErrInvalidWebAuthn)
+}
+
+func TestWebAuthnConfigDefaults(t *testing.T) {
+	config := WebAuthnConfig{Origins: []string{"https://app.example.com:8443"}}.normalize()
+	require.Equal(t, "app.example.com", config.RPID)
+	require.Equal(t, "preferred", config.UserVerification)
+	require.Equal(t, "none", config.Attestation)
+	require.Equal(t, defaultWebAuthnTimeout, config.Timeout)
+
+	config = WebAuthnConfig{RPID: "example.com"}.normalize()
+	require.Equal(t, []string{"https://example.com"}, config.Origins)
+}
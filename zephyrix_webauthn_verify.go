@@ -0,0 +1,357 @@
+package zephyrix
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// authenticator data flags (WebAuthn section 6.1)
+const (
+	webAuthnFlagUserPresent     = 0x01
+	webAuthnFlagUserVerified    = 0x04
+	webAuthnFlagAttestedData    = 0x40
+	webAuthnFlagExtensionData   = 0x80
+	webAuthnAuthDataMinimumSize = 37
+)
+
+// COSE algorithms supported for credential keys
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgPS256 = -37
+	coseAlgRS256 = -257
+)
+
+// webAuthnSupportedAlgorithms is offered to authenticators at registration, in order of preference.
+var webAuthnSupportedAlgorithms = []int64{coseAlgES256, coseAlgEdDSA, coseAlgRS256, coseAlgPS256}
+
+// oidFIDOGenCeAAGUID is the certificate extension carrying the AAGUID of packed attestation certificates.
+var oidFIDOGenCeAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// webAuthnClientData is the CollectedClientData signed by the authenticator, through its hash.
+type webAuthnClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// webAuthnAuthenticatorData is the parsed authenticator data of a registration or an assertion.
+type webAuthnAuthenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+
+	// attested credential data, only present at registration
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE encoded
+}
+
+func (d *webAuthnAuthenticatorData) userPresent() bool  { return d.Flags&webAuthnFlagUserPresent != 0 }
+func (d *webAuthnAuthenticatorData) userVerified() bool { return d.Flags&webAuthnFlagUserVerified != 0 }
+
+// decodeWebAuthnBase64 decodes the base64url values of the WebAuthn JSON serialization,
+// tolerating padding and the standard alphabet some libraries send.
+func decodeWebAuthnBase64(value string) ([]byte, error) {
+	value = strings.TrimRight(value, "=")
+	value = strings.NewReplacer("+", "-", "/", "_").Replace(value)
+	return base64.RawURLEncoding.DecodeString(value)
+}
+
+// parseWebAuthnClientData checks the client data of a ceremony and returns the challenge it answers.
+func parseWebAuthnClientData(raw []byte, ceremony string, origins []string) (*webAuthnClientData, error) {
+	var clientData webAuthnClientData
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return nil, fmt.Errorf("%w: malformed client data", ErrInvalidWebAuthn)
+	}
+	if clientData.Type != ceremony {
+		return nil, fmt.Errorf("%w: unexpected client data type %q", ErrInvalidWebAuthn, clientData.Type)
+	}
+	if clientData.Challenge == "" {
+		return nil, fmt.Errorf("%w: missing challenge", ErrInvalidWebAuthn)
+	}
+	if clientData.CrossOrigin {
+		return nil, fmt.Errorf("%w: cross-origin ceremonies are not allowed", ErrInvalidWebAuthn)
+	}
+	for _, origin := range origins {
+		if clientData.Origin == origin {
+			return &clientData, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unexpected origin %q", ErrInvalidWebAuthn, clientData.Origin)
+}
+
+// parseWebAuthnAuthenticatorData parses the authenticator data (WebAuthn section 6.1).
+func parseWebAuthnAuthenticatorData(data []byte) (*webAuthnAuthenticatorData, error) {
+	if len(data) < webAuthnAuthDataMinimumSize {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidWebAuthn)
+	}
+
+	authData := &webAuthnAuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if authData.Flags&webAuthnFlagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidWebAuthn)
+		}
+		authData.AAGUID = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+			return nil, fmt.Errorf("%w: invalid credential ID length", ErrInvalidWebAuthn)
+		}
+		authData.CredentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, remaining, err := cborDecode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid credential public key: %v", ErrInvalidWebAuthn, err)
+		}
+		authData.PublicKey = rest[:len(rest)-len(remaining)]
+		rest = remaining
+	}
+
+	if authData.Flags&webAuthnFlagExtensionData != 0 {
+		_, remaining, err := cborDecode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid extension data: %v", ErrInvalidWebAuthn, err)
+		}
+		rest = remaining
+	}
+
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes in authenticator data", ErrInvalidWebAuthn)
+	}
+	return authData, nil
+}
+
+// checkWebAuthnAuthenticatorData applies the checks shared by both ceremonies.
+func checkWebAuthnAuthenticatorData(authData *webAuthnAuthenticatorData, rpID string, requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if subtle.ConstantTimeCompare(authData.RPIDHash, rpIDHash[:]) != 1 {
+		return fmt.Errorf("%w: unexpected relying party ID", ErrInvalidWebAuthn)
+	}
+	if !authData.userPresent() {
+		return fmt.Errorf("%w: user presence was not tested", ErrInvalidWebAuthn)
+	}
+	if requireUserVerification && !authData.userVerified() {
+		return fmt.Errorf("%w: user verification is required", ErrInvalidWebAuthn)
+	}
+	return nil
+}
+
+// webAuthnAttestation is the decoded attestation object of a registration.
+type webAuthnAttestation struct {
+	Format      string
+	Statement   map[interface{}]interface{}
+	RawAuthData []byte
+	AuthData    *webAuthnAuthenticatorData
+}
+
+func parseWebAuthnAttestationObject(raw []byte) (*webAuthnAttestation, error) {
+	decoded, rest, err := cborDecode(raw)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: malformed attestation object", ErrInvalidWebAuthn)
+	}
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed attestation object", ErrInvalidWebAuthn)
+	}
+
+	attestation := &webAuthnAttestation{}
+	attestation.Format, _ = object["fmt"].(string)
+	attestation.Statement, _ = object["attStmt"].(map[interface{}]interface{})
+	attestation.RawAuthData, _ = object["authData"].([]byte)
+	if attestation.Format == "" || attestation.Statement == nil || attestation.RawAuthData == nil {
+		return nil, fmt.Errorf("%w: incomplete attestation object", ErrInvalidWebAuthn)
+	}
+
+	if attestation.AuthData, err = parseWebAuthnAuthenticatorData(attestation.RawAuthData); err != nil {
+		return nil, err
+	}
+	if attestation.AuthData.CredentialID == nil {
+		return nil, fmt.Errorf("%w: attestation without credential data", ErrInvalidWebAuthn)
+	}
+	return attestation, nil
+}
+
+// verify checks the attestation statement, only the "none" and "packed" formats are supported.
+//
+// The trust path of a packed statement is not evaluated against a metadata service, so the
+// attestation proves the authenticator holds the key, not which authenticator model it is.
+func (a *webAuthnAttestation) verify(clientDataHash []byte, credentialKey *coseKey) error {
+	switch a.Format {
+	case "none":
+		if len(a.Statement) != 0 {
+			return fmt.Errorf("%w: none attestation with a statement", ErrInvalidWebAuthn)
+		}
+		return nil
+	case "packed":
+		return a.verifyPacked(clientDataHash, credentialKey)
+	default:
+		return fmt.Errorf("%w: unsupported attestation format %q", ErrInvalidWebAuthn, a.Format)
+	}
+}
+
+// verifyPacked verifies a packed attestation statement (WebAuthn section 8.2).
+func (a *webAuthnAttestation) verifyPacked(clientDataHash []byte, credentialKey *coseKey) error {
+	alg, ok := a.Statement["alg"].(int64)
+	if !ok {
+		return fmt.Errorf("%w: packed attestation without alg", ErrInvalidWebAuthn)
+	}
+	signature, ok := a.Statement["sig"].([]byte)
+	if !ok {
+		return fmt.Errorf("%w: packed attestation without sig", ErrInvalidWebAuthn)
+	}
+	signed := append(append([]byte(nil), a.RawAuthData...), clientDataHash...)
+
+	chain, hasChain := a.Statement["x5c"].([]interface{})
+	if !hasChain {
+		// self attestation, signed by the credential key itself
+		if alg != credentialKey.Algorithm {
+			return fmt.Errorf("%w: self attestation algorithm mismatch", ErrInvalidWebAuthn)
+		}
+		return credentialKey.verify(signed, signature)
+	}
+
+	if len(chain) == 0 {
+		return fmt.Errorf("%w: empty attestation certificate chain", ErrInvalidWebAuthn)
+	}
+	der, ok := chain[0].([]byte)
+	if !ok {
+		return fmt.Errorf("%w: malformed attestation certificate", ErrInvalidWebAuthn)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("%w: malformed attestation certificate: %v", ErrInvalidWebAuthn, err)
+	}
+	if certificate.Version != 3 || certificate.IsCA {
+		return fmt.Errorf("%w: attestation certificate must be a version 3 leaf certificate", ErrInvalidWebAuthn)
+	}
+	for _, extension := range certificate.Extensions {
+		if !extension.Id.Equal(oidFIDOGenCeAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(extension.Value, &aaguid); err != nil || !bytes.Equal(aaguid, a.AuthData.AAGUID) {
+			return fmt.Errorf("%w: attestation certificate AAGUID mismatch", ErrInvalidWebAuthn)
+		}
+	}
+
+	algorithm, ok := map[int64]x509.SignatureAlgorithm{
+		coseAlgES256: x509.ECDSAWithSHA256,
+		coseAlgEdDSA: x509.PureEd25519,
+		coseAlgRS256: x509.SHA256WithRSA,
+		coseAlgPS256: x509.SHA256WithRSAPSS,
+	}[alg]
+	if !ok {
+		return fmt.Errorf("%w: unsupported attestation algorithm %d", ErrInvalidWebAuthn, alg)
+	}
+	if err := certificate.CheckSignature(algorithm, signed, signature); err != nil {
+		return fmt.Errorf("%w: invalid attestation signature", ErrInvalidWebAuthn)
+	}
+	return nil
+}
+
+// coseKey is a credential public key (RFC 9052 section 7).
+type coseKey struct {
+	Algorithm int64
+	PublicKey crypto.PublicKey
+}
+
+func parseCOSEKey(raw []byte) (*coseKey, error) {
+	decoded, rest, err := cborDecode(raw)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: malformed COSE key", ErrInvalidWebAuthn)
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed COSE key", ErrInvalidWebAuthn)
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("%w: invalid P-256 key", ErrInvalidWebAuthn)
+		}
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("%w: P-256 point is not on the curve", ErrInvalidWebAuthn)
+		}
+		return &coseKey{Algorithm: alg, PublicKey: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}}, nil
+
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: invalid Ed25519 key", ErrInvalidWebAuthn)
+		}
+		return &coseKey{Algorithm: alg, PublicKey: ed25519.PublicKey(x)}, nil
+
+	case kty == 3 && (alg == coseAlgRS256 || alg == coseAlgPS256):
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("%w: invalid RSA key, at least 2048 bits are required", ErrInvalidWebAuthn)
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &coseKey{Algorithm: alg, PublicKey: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %d with algorithm %d", ErrInvalidWebAuthn, kty, alg)
+	}
+}
+
+// verify checks a signature made by the credential.
+func (k *coseKey) verify(data, signature []byte) error {
+	digest := sha256.Sum256(data)
+
+	var valid bool
+	switch k.Algorithm {
+	case coseAlgES256:
+		valid = ecdsa.VerifyASN1(k.PublicKey.(*ecdsa.PublicKey), digest[:], signature)
+	case coseAlgEdDSA:
+		valid = ed25519.Verify(k.PublicKey.(ed25519.PublicKey), data, signature)
+	case coseAlgRS256:
+		valid = rsa.VerifyPKCS1v15(k.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	case coseAlgPS256:
+		valid = rsa.VerifyPSS(k.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature, nil) == nil
+	}
+	if !valid {
+		return fmt.Errorf("%w: invalid signature", ErrInvalidWebAuthn)
+	}
+	return nil
+}